@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// blockAudit records which steps of which instances were migrated, so that
+// the blocks written by a migration can be traced back to them.
+type blockAudit struct {
+	mtx sync.Mutex
+	// existing are the ULIDs of the blocks in the v2 storage before the
+	// migration.
+	existing map[string]bool
+	windows  map[model.Time]*auditWindow
+}
+
+// auditWindow is a step and the instances that had samples in it.
+type auditWindow struct {
+	From      model.Time         `json:"from"`
+	Through   model.Time         `json:"through"`
+	Instances []model.LabelValue `json:"instances"`
+}
+
+// auditBlock is an entry of the block audit file.
+type auditBlock struct {
+	ULID    string         `json:"ulid"`
+	MinTime model.Time     `json:"min_time"`
+	MaxTime model.Time     `json:"max_time"`
+	Level   int            `json:"compaction_level"`
+	Windows []*auditWindow `json:"windows"`
+}
+
+// newBlockAudit returns a blockAudit for the v2 storage directory dir, which
+// must not have been opened yet so that the blocks it already contains are
+// known.
+func newBlockAudit(dir string) (*blockAudit, error) {
+	metas, err := readBlockMetas(dir)
+	if err != nil {
+		return nil, err
+	}
+	a := &blockAudit{existing: map[string]bool{}, windows: map[model.Time]*auditWindow{}}
+	for _, m := range metas {
+		a.existing[m.ULID.String()] = true
+	}
+	return a, nil
+}
+
+// record registers the number of samples read for an instance in the step
+// [from, through].
+func (a *blockAudit) record(instance model.LabelValue, from, through model.Time, samples int) {
+	if samples == 0 {
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	w, ok := a.windows[from]
+	if !ok {
+		w = &auditWindow{From: from, Through: through}
+		a.windows[from] = w
+	}
+	w.Instances = append(w.Instances, instance)
+}
+
+// report returns the blocks in the v2 storage directory dir that were
+// written since the audit was created, sorted by time, with the recorded
+// steps that overlap their time range. Samples still in the head of the v2
+// storage are in no block yet.
+func (a *blockAudit) report(dir string) ([]auditBlock, error) {
+	metas, err := readBlockMetas(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	windows := make([]*auditWindow, 0, len(a.windows))
+	for _, w := range a.windows {
+		sort.Slice(w.Instances, func(i, j int) bool { return w.Instances[i] < w.Instances[j] })
+		windows = append(windows, w)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].From < windows[j].From })
+
+	res := []auditBlock{}
+	for _, m := range metas {
+		if a.existing[m.ULID.String()] {
+			continue
+		}
+		b := auditBlock{
+			ULID:    m.ULID.String(),
+			MinTime: model.Time(m.MinTime),
+			MaxTime: model.Time(m.MaxTime),
+			Level:   m.Compaction.Level,
+			Windows: []*auditWindow{},
+		}
+		// The maximum time of a block is exclusive.
+		for _, w := range windows {
+			if w.From < b.MaxTime && w.Through >= b.MinTime {
+				b.Windows = append(b.Windows, w)
+			}
+		}
+		res = append(res, b)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].MinTime != res[j].MinTime {
+			return res[i].MinTime < res[j].MinTime
+		}
+		return res[i].MaxTime < res[j].MaxTime
+	})
+	return res, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestBlockAudit(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	file := filepath.Join(v2Dir, "audit.json")
+
+	var code int
+	captureStderr(t, func() {
+		code = runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+			"-min-block-duration", "30m", "-compact-after", "-block-audit-file", file,
+		)
+	})
+	if code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audited []auditBlock
+	if err := json.Unmarshal(b, &audited); err != nil {
+		t.Fatal(err)
+	}
+
+	var ulids, wantULIDs []string
+	steps := map[model.Time]bool{}
+	for _, block := range audited {
+		ulids = append(ulids, block.ULID)
+		if len(block.Windows) == 0 {
+			t.Errorf("block %s from %s to %s has no windows", block.ULID, block.MinTime, block.MaxTime)
+		}
+		for _, w := range block.Windows {
+			if w.From >= block.MaxTime || w.Through < block.MinTime {
+				t.Errorf("block %s from %s to %s lists window from %s through %s outside of it", block.ULID, block.MinTime, block.MaxTime, w.From, w.Through)
+			}
+			if want := []model.LabelValue{"host0:9090", "host1:9090"}; !reflect.DeepEqual(w.Instances, want) {
+				t.Errorf("window from %s lists instances %v, want %v", w.From, w.Instances, want)
+			}
+			steps[w.From] = true
+		}
+	}
+	for _, dir := range blockDirs(t, v2Dir) {
+		wantULIDs = append(wantULIDs, filepath.Base(dir))
+	}
+	sort.Strings(ulids)
+	sort.Strings(wantULIDs)
+	if len(ulids) == 0 || !reflect.DeepEqual(ulids, wantULIDs) {
+		t.Errorf("audited blocks %v, want the written blocks %v", ulids, wantULIDs)
+	}
+	// The newest samples stay in the head, but the blocks contain some
+	// of the steps of the run.
+	if len(steps) == 0 {
+		t.Error("blocks contain none of the steps")
+	}
+	for from := range steps {
+		if from < testStart || from.Sub(testStart)%(10*time.Minute) != 0 {
+			t.Errorf("blocks contain window from %s, which is not a step of the run", from)
+		}
+	}
+}
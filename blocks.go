@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// blockVerifier checks that blocks written to the v2 storage can be read
+// back completely.
+type blockVerifier struct {
+	db       *tsdb.DB
+	verified map[string]bool
+}
+
+func newBlockVerifier(db *tsdb.DB) *blockVerifier {
+	return &blockVerifier{db: db, verified: map[string]bool{}}
+}
+
+// verifyNew verifies all blocks that have not been verified yet and returns
+// how many it verified.
+func (v *blockVerifier) verifyNew() (int, error) {
+	n := 0
+	for _, b := range v.db.Blocks() {
+		id := b.Meta().ULID.String()
+		if v.verified[id] {
+			continue
+		}
+		if err := verifyBlock(b); err != nil {
+			return n, fmt.Errorf("block %s: %s", id, err)
+		}
+		v.verified[id] = true
+		n++
+	}
+	return n, nil
+}
+
+// verifyBlock reads all series and chunks of the block and checks that the
+// number of series and samples matches the block's meta.json.
+func verifyBlock(b *tsdb.Block) (err error) {
+	// The block readers panic on some kinds of corrupted data.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("read block: %v", r)
+		}
+	}()
+
+	ir, err := b.Index()
+	if err != nil {
+		return fmt.Errorf("open index: %s", err)
+	}
+	defer ir.Close()
+
+	cr, err := b.Chunks()
+	if err != nil {
+		return fmt.Errorf("open chunks: %s", err)
+	}
+	defer cr.Close()
+
+	p, err := ir.Postings("", "")
+	if err != nil {
+		return fmt.Errorf("read postings: %s", err)
+	}
+
+	var (
+		lset            labels.Labels
+		chks            []tsdb.ChunkMeta
+		series, samples uint64
+	)
+	for p.Next() {
+		if err := ir.Series(p.At(), &lset, &chks); err != nil {
+			return fmt.Errorf("read series: %s", err)
+		}
+		for _, c := range chks {
+			chk, err := cr.Chunk(c.Ref)
+			if err != nil {
+				return fmt.Errorf("read chunk of series %s: %s", lset, err)
+			}
+			it := chk.Iterator()
+			for it.Next() {
+				samples++
+			}
+			if err := it.Err(); err != nil {
+				return fmt.Errorf("iterate chunk of series %s: %s", lset, err)
+			}
+		}
+		series++
+	}
+	if err := p.Err(); err != nil {
+		return fmt.Errorf("iterate postings: %s", err)
+	}
+
+	stats := b.Meta().Stats
+	if series != stats.NumSeries {
+		return fmt.Errorf("found %d series, meta.json states %d", series, stats.NumSeries)
+	}
+	if samples != stats.NumSamples {
+		return fmt.Errorf("found %d samples, meta.json states %d", samples, stats.NumSamples)
+	}
+	return nil
+}
+
+// blockMeta is the content of a block's meta.json file.
+type blockMeta struct {
+	tsdb.BlockMeta
+	// Version is the format version of the block.
+	Version int `json:"version"`
+	dir     string
+}
+
+// latestBlockEnd returns the latest end of the blocks in the v2 storage
+// directories, or 0 if there are none. Block ends are exclusive.
+func latestBlockEnd(dirs []string) (model.Time, error) {
+	var end model.Time
+	for _, dir := range dirs {
+		metas, err := readBlockMetas(dir)
+		if err != nil {
+			return 0, err
+		}
+		for _, m := range metas {
+			if t := model.Time(m.MaxTime); t > end {
+				end = t
+			}
+		}
+	}
+	return end, nil
+}
+
+// readBlockMetas reads the metas of all blocks in the v2 storage directory.
+func readBlockMetas(dir string) ([]*blockMeta, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var metas []*blockMeta
+	for _, fi := range fis {
+		if _, err := ulid.Parse(fi.Name()); err != nil || !fi.IsDir() {
+			continue
+		}
+		bdir := filepath.Join(dir, fi.Name())
+		b, err := ioutil.ReadFile(filepath.Join(bdir, "meta.json"))
+		if err != nil {
+			return nil, err
+		}
+		m := &blockMeta{dir: bdir}
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, fmt.Errorf("block %s: %s", fi.Name(), err)
+		}
+		metas = append(metas, m)
+	}
+	return metas, nil
+}
+
+// supersededBlocks returns the blocks whose data is fully contained in
+// another block, which happens if the migrator stopped during a compaction
+// after writing the compacted block but before deleting its sources. A block
+// is only considered superseded by a block of a higher compaction level that
+// covers its whole time range and was compacted from all of its sources.
+func supersededBlocks(metas []*blockMeta) []*blockMeta {
+	var res []*blockMeta
+	for _, b := range metas {
+		for _, c := range metas {
+			if c == b || c.Compaction.Level <= b.Compaction.Level ||
+				c.MinTime > b.MinTime || c.MaxTime < b.MaxTime {
+				continue
+			}
+			if containsSources(c.Compaction.Sources, b.Compaction.Sources) {
+				res = append(res, b)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// overlappingBlocks returns the pairs of blocks whose time ranges overlap,
+// with the earlier block first. Superseded blocks and the blocks superseding
+// them are not reported, as they are expected to overlap until -gc-blocks
+// deletes the former.
+func overlappingBlocks(metas []*blockMeta) [][2]*blockMeta {
+	sorted := make([]*blockMeta, len(metas))
+	copy(sorted, metas)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinTime < sorted[j].MinTime })
+
+	var res [][2]*blockMeta
+	for i, b := range sorted {
+		for _, c := range sorted[i+1:] {
+			// The maximum time of a block is exclusive.
+			if c.MinTime >= b.MaxTime {
+				break
+			}
+			if containsSources(b.Compaction.Sources, c.Compaction.Sources) || containsSources(c.Compaction.Sources, b.Compaction.Sources) {
+				continue
+			}
+			res = append(res, [2]*blockMeta{b, c})
+		}
+	}
+	return res
+}
+
+// containsSources reports whether all of the sources in sub are in sources.
+func containsSources(sources, sub []ulid.ULID) bool {
+	if len(sub) == 0 {
+		return false
+	}
+	set := make(map[ulid.ULID]bool, len(sources))
+	for _, s := range sources {
+		set[s] = true
+	}
+	for _, s := range sub {
+		if !set[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// gcBlocks deletes the superseded blocks in the v2 storage directory and
+// returns their metas. The storage must not be open.
+func gcBlocks(dir string) ([]*blockMeta, error) {
+	metas, err := readBlockMetas(dir)
+	if err != nil {
+		return nil, err
+	}
+	superseded := supersededBlocks(metas)
+	for _, b := range superseded {
+		// Move the block out of sight of the storage first so that an
+		// interrupted deletion does not leave a partial block behind.
+		tmp := b.dir + ".tmp"
+		if err := os.Rename(b.dir, tmp); err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(tmp); err != nil {
+			return nil, err
+		}
+	}
+	return superseded, nil
+}
+
+// thanosMeta is the section Thanos adds to the meta.json of a block.
+type thanosMeta struct {
+	Labels     map[string]string `json:"labels"`
+	Downsample struct {
+		Resolution int64 `json:"resolution"`
+	} `json:"downsample"`
+	Source string `json:"source"`
+}
+
+// labelBlocks adds ls as Thanos external labels to the meta.json of the
+// blocks in the v2 storage directories that are not in existing, as raw
+// data written by the migrator, and returns how many blocks it labeled.
+// The other fields of meta.json are kept as they are.
+func labelBlocks(dirs []string, existing map[string]bool, ls labels.Labels) (int, error) {
+	thanos := thanosMeta{Labels: ls.Map(), Source: "prom-data-migrator"}
+	section, err := json.Marshal(thanos)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, dir := range dirs {
+		metas, err := readBlockMetas(dir)
+		if err != nil {
+			return n, err
+		}
+		for _, m := range metas {
+			if existing[m.ULID.String()] {
+				continue
+			}
+			path := filepath.Join(m.dir, "meta.json")
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return n, err
+			}
+			var raw map[string]json.RawMessage
+			if err := json.Unmarshal(b, &raw); err != nil {
+				return n, fmt.Errorf("block %s: %s", m.ULID, err)
+			}
+			raw["thanos"] = section
+			if b, err = json.MarshalIndent(raw, "", "\t"); err != nil {
+				return n, err
+			}
+			tmp := path + ".tmp"
+			if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+				return n, err
+			}
+			if err := os.Rename(tmp, path); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// newTestCompactor returns a compactor for 2h blocks.
+func newTestCompactor(t *testing.T) *tsdb.LeveledCompactor {
+	c, err := tsdb.NewLeveledCompactor(nil, log.NewNopLogger(), []int64{int64(2 * time.Hour / time.Millisecond)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// writeTestBlock writes a block of the range [0, 2h) with samples of a
+// series to dir, with the timestamps ts and the values ts plus offset.
+func writeTestBlock(t *testing.T, c *tsdb.LeveledCompactor, dir string, ts []int64, offset float64) {
+	h, err := tsdb.NewHead(nil, log.NewNopLogger(), nil, int64(2*time.Hour/time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	app := h.Appender()
+	for _, s := range ts {
+		if _, err := app.Add(labels.FromStrings("__name__", "up"), s, float64(s)+offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write(dir, h, 0, int64(2*time.Hour/time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockDirs returns the block directories in dir.
+func blockDirs(t *testing.T, dir string) []string {
+	metas, err := filepath.Glob(filepath.Join(dir, "*", "meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, m := range metas {
+		res = append(res, filepath.Dir(m))
+	}
+	return res
+}
+
+func TestVerifyBlock(t *testing.T) {
+	var ts []int64
+	for i := int64(0); i < 1000; i++ {
+		ts = append(ts, i*1000)
+	}
+	for _, tc := range []struct {
+		name    string
+		corrupt func(t *testing.T, dir string)
+	}{
+		{name: "intact", corrupt: func(*testing.T, string) {}},
+		{name: "truncated chunks", corrupt: func(t *testing.T, dir string) {
+			f := filepath.Join(dir, "chunks", "000001")
+			fi, err := os.Stat(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(f, fi.Size()/2); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "wrong sample count", corrupt: func(t *testing.T, dir string) {
+			f := filepath.Join(dir, "meta.json")
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(f, []byte(strings.Replace(string(b), `"numSamples": 1000`, `"numSamples": 1001`, 1)), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		dir, remove := tempDir(t)
+		defer remove()
+		writeTestBlock(t, newTestCompactor(t), dir, ts, 0)
+		blocks := blockDirs(t, dir)
+		if len(blocks) != 1 {
+			t.Fatalf("%s: got %d blocks, want 1", tc.name, len(blocks))
+		}
+		tc.corrupt(t, blocks[0])
+
+		b, err := tsdb.OpenBlock(blocks[0], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = verifyBlock(b)
+		b.Close()
+		if tc.name == "intact" && err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		}
+		if tc.name != "intact" && err == nil {
+			t.Errorf("%s: verifying the block succeeded", tc.name)
+		}
+	}
+}
+
+func TestBlockVerifierVerifiesNewBlocksOnce(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	writeTestBlock(t, newTestCompactor(t), dir, []int64{1000, 2000, 3000}, 0)
+	db := openTestV2(t, dir)
+	defer db.Close()
+
+	v := newBlockVerifier(db)
+	for i, want := range []int{1, 0} {
+		n, err := v.verifyNew()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("verification %d: got %d verified blocks, want %d", i, n, want)
+		}
+	}
+}
+
+func TestGCBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestCompactor(t)
+	writeTestBlock(t, c, dir, []int64{0, 1000}, 0)
+	writeTestBlock(t, c, dir, []int64{2000, 3000}, 0)
+	sources := blockDirs(t, dir)
+	// The compaction of the first two blocks was interrupted before they
+	// were deleted.
+	if err := c.Compact(dir, sources...); err != nil {
+		t.Fatal(err)
+	}
+	compacted := map[string]bool{}
+	for _, d := range blockDirs(t, dir) {
+		compacted[d] = true
+	}
+	for _, d := range sources {
+		delete(compacted, d)
+	}
+	// A block of the same time range that was not compacted is kept.
+	writeTestBlock(t, c, dir, []int64{4000}, 0)
+	var want []string
+	for _, d := range blockDirs(t, dir) {
+		if d != sources[0] && d != sources[1] {
+			want = append(want, d)
+		}
+	}
+	if len(compacted) != 1 || len(want) != 2 {
+		t.Fatalf("got %d compacted blocks and %d blocks to keep, want 1 and 2", len(compacted), len(want))
+	}
+
+	deleted, err := gcBlocks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("deleted %d blocks, want the 2 compacted sources", len(deleted))
+	}
+	if got := blockDirs(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("got blocks %v after deleting superseded blocks, want %v", got, want)
+	}
+	// Nothing else is left over.
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 2 {
+		t.Errorf("got %d entries in the storage directory, want 2", len(fis))
+	}
+}
+
+func TestCheckOverlaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestCompactor(t)
+	writeTestBlock(t, c, dir, []int64{0, 1000}, 0)
+	if n, err := checkOverlaps([]string{dir}, log.NewNopLogger()); err != nil || n != 0 {
+		t.Fatalf("got %d overlaps and error %v with a single block, want none", n, err)
+	}
+	// Both blocks have the range [0, 2h).
+	writeTestBlock(t, c, dir, []int64{2000, 3000}, 0)
+	sources := blockDirs(t, dir)
+	if n, err := checkOverlaps([]string{dir}, log.NewNopLogger()); err != nil || n != 1 {
+		t.Fatalf("got %d overlaps and error %v, want 1", n, err)
+	}
+
+	// A block compacted from both does not overlap its sources.
+	if err := c.Compact(dir, sources...); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := checkOverlaps([]string{dir}, log.NewNopLogger()); err != nil || n != 1 {
+		t.Fatalf("got %d overlaps and error %v after compacting, want 1", n, err)
+	}
+	if _, err := gcBlocks(dir); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := checkOverlaps([]string{dir}, log.NewNopLogger()); err != nil || n != 0 {
+		t.Errorf("got %d overlaps and error %v after deleting the sources, want none", n, err)
+	}
+}
+
+// blockChunks returns the number of samples of every chunk of the blocks in
+// the v2 storage directory dir and checks that the chunks are within the time
+// ranges of their blocks.
+func blockChunks(t *testing.T, dir string) []int {
+	var res []int
+	for _, d := range blockDirs(t, dir) {
+		b, err := tsdb.OpenBlock(d, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ir, err := b.Index()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cr, err := b.Chunks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ir.Postings("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			lset labels.Labels
+			chks []tsdb.ChunkMeta
+		)
+		meta := b.Meta()
+		for p.Next() {
+			if err := ir.Series(p.At(), &lset, &chks); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range chks {
+				if c.MinTime < meta.MinTime || c.MaxTime >= meta.MaxTime {
+					t.Errorf("chunk [%d, %d] of series %s is not within its block [%d, %d)", c.MinTime, c.MaxTime, lset, meta.MinTime, meta.MaxTime)
+				}
+				chk, err := cr.Chunk(c.Ref)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res = append(res, chk.NumSamples())
+			}
+		}
+		ir.Close()
+		cr.Close()
+		b.Close()
+	}
+	return res
+}
+
+func TestChunkLayout(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 2, 2*time.Hour))
+	defer removeV1()
+
+	for _, tc := range []struct {
+		step                string
+		wantChunk, wantFull int
+	}{
+		// With a regular scrape interval, the head cuts chunks of 120
+		// samples. The first and last blocks have 20m and 40m of the
+		// samples, as the range is aligned to the hour.
+		{step: "1h", wantChunk: 120, wantFull: 6},
+		// Chunks never span two blocks, here of a step each.
+		{step: "10m", wantChunk: 40, wantFull: 24},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		if code := runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", tc.step, "-lookback", "2h", "-min-block-duration", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(2*time.Hour).Unix()),
+			"-align-blocks", "1h", "-exclusive-end", "-output-blocks-per-window",
+		); code != 0 {
+			t.Fatalf("step %s: got exit code %d, want 0", tc.step, code)
+		}
+		total, full := 0, 0
+		chunks := blockChunks(t, v2Dir)
+		for _, n := range chunks {
+			total += n
+			if n == tc.wantChunk {
+				full++
+			}
+			if n > tc.wantChunk {
+				t.Errorf("step %s: got a chunk of %d samples, want at most %d", tc.step, n, tc.wantChunk)
+			}
+		}
+		if full != tc.wantFull {
+			t.Errorf("step %s: got %d chunks of %d samples, want %d: %v", tc.step, full, tc.wantChunk, tc.wantFull, chunks)
+		}
+		if total != 2*480 {
+			t.Errorf("step %s: got %d samples in chunks, want %d", tc.step, total, 2*480)
+		}
+	}
+}
+
+func TestHeadFlushedByBlockRange(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 2, 4*time.Hour))
+	defer closeV1()
+	dir, err := ioutil.TempDir("", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blockRange := int64(time.Hour / time.Millisecond)
+	db, err := tsdb.Open(dir, log.NewNopLogger(), nil, &tsdb.Options{
+		WALFlushInterval:  time.Hour,
+		RetentionDuration: 999999 * 24 * 60 * 60 * 1000,
+		BlockRanges:       []int64{blockRange},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newTestMigrator(v1, db)
+	for from := testStart; from.Before(testStart.Add(4 * time.Hour)); from = from.Add(10 * time.Minute) {
+		if err := migrateTestInstance(m, "host0:9090", from, from.Add(10*time.Minute)-1); err != nil {
+			t.Fatal(err)
+		}
+		// The head is flushed in the background once it spans one and a
+		// half block ranges.
+		deadline := time.Now().Add(10 * time.Second)
+		for db.Head().MaxTime()-db.Head().MinTime() > blockRange/2*3 {
+			if time.Now().After(deadline) {
+				t.Fatalf("after the step at %s, the head still spans %dms", from, db.Head().MaxTime()-db.Head().MinTime())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	blocks := db.Blocks()
+	if len(blocks) < 2 {
+		t.Errorf("got %d blocks written during the migration, want at least 2", len(blocks))
+	}
+	for _, b := range blocks {
+		if meta := b.Meta(); meta.MaxTime-meta.MinTime != blockRange {
+			t.Errorf("block %s spans [%d, %d), want a single block range", meta.ULID, meta.MinTime, meta.MaxTime)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := storedTimestamps(t, dir)
+	if len(got) != 2 {
+		t.Fatalf("got %d series, want 2", len(got))
+	}
+	for ls, ts := range got {
+		if len(distinct(ts)) != 960 {
+			t.Errorf("series %s has samples at %d timestamps, want 960", ls, len(distinct(ts)))
+		}
+	}
+}
+
+// blockSeries returns the labels of the series of every block in the v2
+// storage directory dir in the order of its index, with the blocks ordered by
+// time.
+func blockSeries(t *testing.T, dir string) [][]string {
+	metas, err := readBlockMetas(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].MinTime < metas[j].MinTime })
+	var res [][]string
+	for _, m := range metas {
+		b, err := tsdb.OpenBlock(m.dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ir, err := b.Index()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ir.Postings("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			series []string
+			lset   labels.Labels
+			chks   []tsdb.ChunkMeta
+		)
+		for p.Next() {
+			if err := ir.Series(p.At(), &lset, &chks); err != nil {
+				t.Fatal(err)
+			}
+			series = append(series, lset.String())
+		}
+		res = append(res, series)
+		ir.Close()
+		b.Close()
+	}
+	return res
+}
+
+func TestBlockSeriesOrder(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(4), 5, 2*time.Hour))
+	defer removeV1()
+
+	// Without -deterministic, the instances are migrated in parallel and
+	// their series are created in the head in varying order.
+	var runs [][][]string
+	for i := 0; i < 2; i++ {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		if code := runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "1h", "-lookback", "2h", "-min-block-duration", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(2*time.Hour).Unix()), "-max-parallelism", "4",
+			"-align-blocks", "1h", "-exclusive-end", "-output-blocks-per-window",
+		); code != 0 {
+			t.Fatalf("run %d: got exit code %d, want 0", i, code)
+		}
+		runs = append(runs, blockSeries(t, v2Dir))
+	}
+	if len(runs[0]) != 3 {
+		t.Fatalf("got %d blocks, want 3", len(runs[0]))
+	}
+	for _, series := range runs[0] {
+		if len(series) != 20 || !sort.StringsAreSorted(series) {
+			t.Errorf("got block series %v, want 20 series in label order", series)
+		}
+	}
+	if !reflect.DeepEqual(runs[0], runs[1]) {
+		t.Errorf("got block series %v and %v, want the same order in both runs", runs[0], runs[1])
+	}
+}
+
+func TestBlockMetaLabels(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 2, 2*time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	if code := runMain(
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "1h", "-lookback", "2h", "-min-block-duration", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(2*time.Hour).Unix()),
+		"-align-blocks", "1h", "-exclusive-end", "-output-blocks-per-window",
+		"-block-meta-label", "cluster=eu", "-block-meta-label", "replica=migrated",
+	); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	dirs := blockDirs(t, v2Dir)
+	if len(dirs) != 3 {
+		t.Fatalf("got %d blocks, want 3", len(dirs))
+	}
+	samples := uint64(0)
+	for _, d := range dirs {
+		b, err := ioutil.ReadFile(filepath.Join(d, "meta.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta struct {
+			tsdb.BlockMeta
+			Thanos thanosMeta `json:"thanos"`
+		}
+		if err := json.Unmarshal(b, &meta); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]string{"cluster": "eu", "replica": "migrated"}; !reflect.DeepEqual(meta.Thanos.Labels, want) || meta.Thanos.Source != "prom-data-migrator" {
+			t.Errorf("block %s has Thanos meta %+v, want labels %v", d, meta.Thanos, want)
+		}
+		// The fields of the v2 storage are kept.
+		if meta.ULID.String() != filepath.Base(d) || meta.Stats.NumSamples == 0 {
+			t.Errorf("block %s has meta %+v, want its ULID and stats", d, meta.BlockMeta)
+		}
+		samples += meta.Stats.NumSamples
+		blk, err := tsdb.OpenBlock(d, nil)
+		if err != nil {
+			t.Errorf("block %s cannot be opened: %s", d, err)
+			continue
+		}
+		blk.Close()
+	}
+	if samples != 960 {
+		t.Errorf("got %d samples in the blocks, want 960", samples)
+	}
+}
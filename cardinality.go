@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// cardinalityBaselineWindows is the number of earlier steps of an instance
+// whose mean number of series is the baseline of the next one.
+const cardinalityBaselineWindows = 5
+
+// cardinalityDetector detects steps of an instance with many more series
+// than the steps before, which usually come from a label bug in the source
+// that should not be migrated as it is.
+type cardinalityDetector struct {
+	// factor is how many times the baseline a step may have.
+	factor float64
+
+	mtx       sync.Mutex
+	instances map[model.LabelValue]*cardinalityBaseline
+}
+
+// cardinalityBaseline is the recent cardinality of an instance.
+type cardinalityBaseline struct {
+	// series are the numbers of series of the last accepted steps, oldest
+	// first.
+	series []int
+	// values are the numbers of values of each label name in the last
+	// accepted step.
+	values map[string]int
+}
+
+func newCardinalityDetector(factor float64) *cardinalityDetector {
+	return &cardinalityDetector{factor: factor, instances: map[model.LabelValue]*cardinalityBaseline{}}
+}
+
+// check returns an error naming the labels with the most new values if the
+// series of a step of instance exceed the factor times its baseline.
+func (d *cardinalityDetector) check(instance model.LabelValue, series []labels.Labels) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	b, ok := d.instances[instance]
+	if !ok || len(b.series) == 0 {
+		return nil
+	}
+	sum := 0
+	for _, n := range b.series {
+		sum += n
+	}
+	baseline := float64(sum) / float64(len(b.series))
+	if float64(len(series)) > d.factor*baseline {
+		return fmt.Errorf("%d series are more than %g times the %.0f series of the steps before, most new values in labels %s", len(series), d.factor, baseline, growingLabels(b.values, labelValueCounts(series)))
+	}
+	return nil
+}
+
+// record adds the series of a migrated step of instance that passed check to
+// its baseline. Only steps that were migrated completely are recorded, so
+// that neither a spike nor a retried step changes it. Steps without series
+// are ignored.
+func (d *cardinalityDetector) record(instance model.LabelValue, series []labels.Labels) {
+	if len(series) == 0 {
+		return
+	}
+	values := labelValueCounts(series)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	b, ok := d.instances[instance]
+	if !ok {
+		b = &cardinalityBaseline{}
+		d.instances[instance] = b
+	}
+	b.series = append(b.series, len(series))
+	if len(b.series) > cardinalityBaselineWindows {
+		b.series = b.series[1:]
+	}
+	b.values = values
+}
+
+// labelValueCounts returns the number of distinct values of each label name
+// in series.
+func labelValueCounts(series []labels.Labels) map[string]int {
+	seen := map[labels.Label]bool{}
+	counts := map[string]int{}
+	for _, ls := range series {
+		for _, l := range ls {
+			if !seen[l] {
+				seen[l] = true
+				counts[l.Name]++
+			}
+		}
+	}
+	return counts
+}
+
+// growingLabels formats the label names with the most new values from
+// before to now, at most three.
+func growingLabels(before, now map[string]int) string {
+	type growth struct {
+		name     string
+		from, to int
+	}
+	var gs []growth
+	for name, n := range now {
+		if n > before[name] {
+			gs = append(gs, growth{name: name, from: before[name], to: n})
+		}
+	}
+	sort.Slice(gs, func(i, j int) bool {
+		if di, dj := gs[i].to-gs[i].from, gs[j].to-gs[j].from; di != dj {
+			return di > dj
+		}
+		return gs[i].name < gs[j].name
+	})
+	if len(gs) > 3 {
+		gs = gs[:3]
+	}
+	parts := make([]string, 0, len(gs))
+	for _, g := range gs {
+		parts = append(parts, fmt.Sprintf("%s (%d to %d values)", g.name, g.from, g.to))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rangeSeries returns the labels of the series of instance in [from,
+// through] as the migration transforms them. Like preflight, it only reads
+// the index of the v1 storage, so that the series of a step can be checked
+// before its samples are read in parts.
+func (m *migrator) rangeSeries(from, through model.Time, instance model.LabelValue) ([]labels.Labels, error) {
+	matchers, err := shardMatchers(m.shardLabel, instance)
+	if err != nil {
+		return nil, windowError(instance, from, through, nil, err)
+	}
+	var its []local.SeriesIterator
+	for _, s := range m.v1Storages() {
+		metrics, err := s.MetricsForLabelMatchers(context.Background(), from-m.roundTimestamps, through+m.roundTimestamps, matchers)
+		if err != nil {
+			return nil, windowError(instance, from, through, ErrSourceUnavailable, err)
+		}
+		for _, met := range metrics {
+			its = append(its, metricIterator{m: met})
+		}
+	}
+	groups, err := m.previewTransform(its)
+	if err != nil {
+		return nil, windowError(instance, from, through, nil, err)
+	}
+	series := make([]labels.Labels, 0, len(groups))
+	for _, g := range groups {
+		series = append(series, g.labels)
+	}
+	return series, nil
+}
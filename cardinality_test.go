@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// spikeSamples returns the samples of 2 series of host0:9090 for 5 steps of
+// 10m from testStart, and of 20 series with new pod labels in the 6th step.
+func spikeSamples() []*model.Sample {
+	samples := testSamples(testInstances(1), 2, 50*time.Minute)
+	for ts := testStart.Add(50 * time.Minute); ts.Before(testStart.Add(time.Hour)); ts = ts.Add(15 * time.Second) {
+		for i := 0; i < 20; i++ {
+			samples = append(samples, &model.Sample{
+				Metric:    model.Metric{model.MetricNameLabel: "test_metric", model.InstanceLabel: "host0:9090", "idx": "0", "pod": model.LabelValue(fmt.Sprint(i))},
+				Timestamp: ts,
+				Value:     1,
+			})
+		}
+	}
+	return samples
+}
+
+func TestCardinalityExplosion(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, spikeSamples())
+	defer closeV1()
+
+	for _, quarantineExplosions := range []bool{false, true} {
+		dir, remove := tempDir(t)
+		defer remove()
+		v2 := &testStorage{}
+		m := newTestMigrator(v1, v2)
+		m.cardinality = newCardinalityDetector(3)
+		m.quarantineExplosions = quarantineExplosions
+		m.quarantine = &quarantine{dir: dir}
+
+		var err error
+		for step := 0; step < 6 && err == nil; step++ {
+			from := testStart.Add(time.Duration(step) * 10 * time.Minute)
+			err = migrateTestInstance(m, "host0:9090", from, from.Add(10*time.Minute)-1)
+			if err != nil && step < 5 {
+				t.Fatalf("quarantine %v: step %d failed before the spike: %v", quarantineExplosions, step, err)
+			}
+		}
+		if err := m.quarantine.close(); err != nil {
+			t.Fatal(err)
+		}
+		if v2.numSamples() != 5*2*40 {
+			t.Errorf("quarantine %v: migrated %d samples, want the %d before the spike", quarantineExplosions, v2.numSamples(), 5*2*40)
+		}
+
+		if !quarantineExplosions {
+			werr, ok := err.(*WindowMigrationError)
+			if !ok || werr.Reason != ErrCardinalityExplosion {
+				t.Fatalf("got error %v, want a cardinality explosion", err)
+			}
+			if !strings.Contains(err.Error(), "pod (0 to 20 values)") {
+				t.Errorf("got error %q, want it to name the pod label", err)
+			}
+			if m.quarantine.files != 0 {
+				t.Errorf("aborting wrote %d quarantine files, want none", m.quarantine.files)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("quarantine: got error %v, want the spike quarantined", err)
+		}
+		if m.explodedSteps != 1 || m.explodedSamples != 20*40 {
+			t.Fatalf("quarantined %d steps with %d samples, want 1 with %d", m.explodedSteps, m.explodedSamples, 20*40)
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*"+quarantineFileSuffix))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("got quarantine files %v and error %v, want one", files, err)
+		}
+		replayed := &testStorage{}
+		r, err := replayQuarantineFile(files[0], replayed, &quarantine{dir: dir})
+		if err != nil || r.samples != 20*40 || len(replayed.samples) != 20 {
+			t.Errorf("replayed %d samples of %d series with error %v, want %d of 20", r.samples, len(replayed.samples), err, 20*40)
+		}
+	}
+}
+
+func TestCardinalityBaselineIgnoresSpikes(t *testing.T) {
+	series := func(n int) []labels.Labels {
+		res := make([]labels.Labels, n)
+		for i := range res {
+			res[i] = labels.FromStrings("idx", fmt.Sprint(i))
+		}
+		return res
+	}
+	d := newCardinalityDetector(2)
+	for step, n := range []int{10, 10, 30, 30, 20} {
+		err := d.check("host0:9090", series(n))
+		// The spikes to 30 series are not part of the baseline, so the
+		// second one fails too.
+		if spike := n > 20; spike != (err != nil) {
+			t.Errorf("step %d with %d series: got error %v, want one %v", step, n, err, spike)
+		}
+		if err == nil {
+			d.record("host0:9090", series(n))
+		}
+	}
+	if err := d.check("host1:9090", series(30)); err != nil {
+		t.Errorf("first step of another instance failed: %v", err)
+	}
+}
+
+func TestCardinalityCheckedPerStep(t *testing.T) {
+	// The pod series only start in the second half of the 6th step, which
+	// has the 2 other series too.
+	var samples []*model.Sample
+	for _, s := range spikeSamples() {
+		if s.Metric["pod"] == "" || !s.Timestamp.Before(testStart.Add(55*time.Minute)) {
+			samples = append(samples, s)
+		}
+	}
+	samples = append(samples, testSamples(testInstances(1), 2, time.Hour)[2*200:]...)
+	v1, closeV1 := newTestV1Storage(t, samples)
+	defer closeV1()
+
+	v2 := &testStorage{}
+	m := newTestMigrator(v1, v2)
+	m.cardinality = newCardinalityDetector(3)
+	// The steps are read in parts of 10 samples per series.
+	m.sampleLimit = 10
+	var err error
+	for step := 0; step < 6 && err == nil; step++ {
+		from := testStart.Add(time.Duration(step) * 10 * time.Minute)
+		err = migrateTestInstance(m, "host0:9090", from, from.Add(10*time.Minute)-1)
+	}
+	if werr, ok := err.(*WindowMigrationError); !ok || werr.Reason != ErrCardinalityExplosion {
+		t.Fatalf("got error %v, want a cardinality explosion", err)
+	}
+	// No part of the 6th step was migrated.
+	if v2.numSamples() != 5*2*40 {
+		t.Errorf("migrated %d samples, want the %d before the spike", v2.numSamples(), 5*2*40)
+	}
+}
+
+func TestCardinalityBaselineAfterCommit(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 2, 10*time.Minute))
+	defer closeV1()
+
+	m := newTestMigrator(v1, &testStorage{err: errors.New("connection refused")})
+	m.cardinality = newCardinalityDetector(3)
+	baseline := func() []int {
+		if b := m.cardinality.instances["host0:9090"]; b != nil {
+			return b.series
+		}
+		return nil
+	}
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(10*time.Minute)-1); err == nil {
+		t.Fatal("migrating to a failing storage succeeded")
+	}
+	if len(baseline()) != 0 {
+		t.Fatalf("failed step is in the baseline %v", baseline())
+	}
+	// The retry adds the step once.
+	m.v2Storage = &testStorage{}
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(10*time.Minute)-1); err != nil {
+		t.Fatal(err)
+	}
+	if got := baseline(); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("got baseline %v, want the retried step once", got)
+	}
+}
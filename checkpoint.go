@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// checkpoint records how far a migration has progressed, so that an
+// interrupted run can be resumed where it left off.
+type checkpoint struct {
+	Start model.Time `json:"start"`
+	End   model.Time `json:"end"`
+	Next  model.Time `json:"next"`
+	// DedupUntil is the end of the previous migration that an incremental
+	// migration overlaps with.
+	DedupUntil model.Time `json:"dedup_until,omitempty"`
+}
+
+// manifest records the time range of a completed migration, so that a later
+// incremental migration can continue after it.
+type manifest struct {
+	Start     model.Time `json:"start"`
+	End       model.Time `json:"end"`
+	Completed time.Time  `json:"completed"`
+}
+
+// failureReport records the instances that were skipped after failing in a
+// migration, so that a later run can migrate exactly them.
+type failureReport struct {
+	Start    model.Time        `json:"start"`
+	End      model.Time        `json:"end"`
+	Failures []reportedFailure `json:"failures"`
+}
+
+// reportedFailure is an instance that failed in the step [From, Through] and
+// was not migrated from then on.
+type reportedFailure struct {
+	Instance model.LabelValue `json:"instance"`
+	From     model.Time       `json:"from"`
+	Through  model.Time       `json:"through"`
+	Error    string           `json:"error"`
+}
+
+// readCheckpoint returns the checkpoint stored at path, or nil if no
+// checkpoint exists.
+func readCheckpoint(path string) (*checkpoint, error) {
+	var cp checkpoint
+	if ok, err := readJSONFile(path, &cp); !ok {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// writeCheckpoint atomically replaces the checkpoint stored at path.
+func writeCheckpoint(path string, cp checkpoint) error {
+	return writeJSONFile(path, cp)
+}
+
+// resumeToken is the state of a stopped migration that is printed with
+// -print-resume-token, for resuming where a checkpoint file does not survive
+// the run.
+type resumeToken struct {
+	checkpoint
+	// Failed are the instances skipped with -skip-failed-instances so far.
+	Failed []reportedFailure `json:"failed,omitempty"`
+}
+
+// encodeResumeToken returns t as gzipped JSON in unpadded URL-safe base64,
+// which fits on a line and into an environment variable.
+func encodeResumeToken(t resumeToken) (string, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(b); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeResumeToken returns the state encoded in s by encodeResumeToken.
+func decodeResumeToken(s string) (*resumeToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if b, err = ioutil.ReadAll(r); err != nil {
+		return nil, err
+	}
+	var t resumeToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// readManifest returns the manifest stored at path, or nil if no manifest
+// exists.
+func readManifest(path string) (*manifest, error) {
+	var m manifest
+	if ok, err := readJSONFile(path, &m); !ok {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// writeManifest atomically replaces the manifest stored at path.
+func writeManifest(path string, m manifest) error {
+	return writeJSONFile(path, m)
+}
+
+// readFailureReport returns the failure report stored at path, or nil if no
+// report exists.
+func readFailureReport(path string) (*failureReport, error) {
+	var r failureReport
+	if ok, err := readJSONFile(path, &r); !ok {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// writeFailureReport atomically replaces the failure report stored at path.
+func writeFailureReport(path string, r failureReport) error {
+	return writeJSONFile(path, r)
+}
+
+// readJSONFile decodes the file at path into v. It returns false if the file
+// does not exist or cannot be decoded.
+func readJSONFile(path string, v interface{}) (bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeJSONFile atomically replaces the file at path with the JSON encoding
+// of v.
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
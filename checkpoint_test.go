@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeTokenRoundTrip(t *testing.T) {
+	for _, tok := range []resumeToken{
+		{},
+		{checkpoint: checkpoint{Start: 1000, End: 5000, Next: 2000}},
+		{
+			checkpoint: checkpoint{Start: 1000, End: 5000, Next: 3000, DedupUntil: 1500},
+			Failed: []reportedFailure{
+				{Instance: "host:9090", From: 1000, Through: 1999, Error: "out of order sample"},
+				{Instance: "other:9090", From: 2000, Through: 2999, Error: "context deadline exceeded"},
+			},
+		},
+	} {
+		s, err := encodeResumeToken(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.ContainsAny(s, "\n=+/") {
+			t.Errorf("token %q is not unpadded URL-safe base64 on one line", s)
+		}
+		got, err := decodeResumeToken(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*got, tok) {
+			t.Errorf("got %+v, want %+v", *got, tok)
+		}
+	}
+}
+
+func TestDecodeResumeTokenInvalid(t *testing.T) {
+	for _, s := range []string{"not base64!", "bm90IGd6aXA", ""} {
+		if _, err := decodeResumeToken(s); err == nil {
+			t.Errorf("decoding %q succeeded", s)
+		}
+	}
+}
+
+func TestResumeTokenCycle(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, 2*time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	args := []string{
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "2h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(2 * time.Hour).Unix()),
+		"-max-windows", "5", "-print-resume-token",
+	}
+
+	var token string
+	for run := 0; ; run++ {
+		if run == 5 {
+			t.Fatal("migration did not finish after 5 runs")
+		}
+		runArgs := args
+		if token != "" {
+			runArgs = append(runArgs, "-resume-token", token)
+		}
+		var code int
+		out := captureStdout(t, func() { code = runMain(runArgs...) })
+		if code != 0 {
+			t.Fatalf("run %d exited with %d", run, code)
+		}
+		// Like in a new container, the checkpoint file is gone.
+		if err := os.Remove(filepath.Join(v2Dir, "migrator.checkpoint")); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		last := lines[len(lines)-1]
+		if _, err := decodeResumeToken(last); err != nil {
+			// Only stopped runs print a token.
+			if run < 2 {
+				t.Fatalf("run %d printed no resume token, got %q", run, out)
+			}
+			break
+		}
+		token = last
+	}
+
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 4 {
+		t.Fatalf("got %d series, want 4", len(got))
+	}
+	for ls, ts := range got {
+		if len(ts) != 480 || len(distinct(ts)) != 480 {
+			t.Errorf("series %s has %d samples at %d timestamps, want 480", ls, len(ts), len(distinct(ts)))
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/tsdb"
+)
+
+// persistHead waits until the v2 storage has written all of its head that
+// is old enough to blocks. The storage only checks this on commits and once
+// a minute, so it is nudged with empty commits. Waiting stops early if ctx is
+// canceled.
+func persistHead(ctx context.Context, db *tsdb.DB, blockRange int64, p *progress, logger log.Logger) {
+	compactable := func() bool {
+		h := db.Head()
+		return h.MaxTime()-h.MinTime() > blockRange/2*3
+	}
+	if !compactable() {
+		return
+	}
+	level.Info(logger).Log("msg", "Waiting for v2 storage to persist its head", "head_mint", db.Head().MinTime(), "head_maxt", db.Head().MaxTime())
+
+	blocks := len(db.Blocks())
+	for compactable() {
+		db.Appender().Commit()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if n := len(db.Blocks()); n != blocks {
+			blocks = n
+			p.update()
+			level.Info(logger).Log("msg", "Persisted v2 head", "blocks", blocks, "head_mint", db.Head().MinTime())
+		}
+	}
+}
+
+// compactBlocks compacts the blocks in the v2 storage directory until the
+// compactor finds nothing left to compact, logging progress on the way. The
+// storage must not be open. The vendored compactor plans one compaction at a
+// time, each of which depends on the result of the previous one, so the
+// compactions run one after another.
+func compactBlocks(dir string, ranges []int64, p *progress, logger log.Logger) error {
+	c, err := tsdb.NewLeveledCompactor(nil, logger, ranges, nil)
+	if err != nil {
+		return err
+	}
+	metas, err := readBlockMetas(dir)
+	if err != nil {
+		return err
+	}
+	level.Info(logger).Log("msg", "Compacting v2 storage", "blocks", len(metas))
+
+	start := time.Now()
+	n := 0
+	for {
+		plan, err := c.Plan(dir)
+		if err != nil {
+			return err
+		}
+		if len(plan) == 0 {
+			break
+		}
+		began := time.Now()
+		if err := c.Compact(dir, plan...); err != nil {
+			return err
+		}
+		// The compacted block has been written, so the blocks it was
+		// compacted from can go. If this is interrupted, -gc-blocks
+		// deletes the leftovers.
+		for _, d := range plan {
+			if err := os.RemoveAll(d); err != nil {
+				return err
+			}
+		}
+		n++
+		p.update()
+
+		metas, err := readBlockMetas(dir)
+		if err != nil {
+			return err
+		}
+		level.Info(logger).Log("msg", "Compacted v2 blocks", "compaction", n, "sources", len(plan), "blocks_left", len(metas), "duration", time.Since(began))
+	}
+	level.Info(logger).Log("msg", "Compaction complete", "compactions", n, "duration", time.Since(start))
+	return nil
+}
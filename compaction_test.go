@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestCompactBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ranges := tsdb.ExponentialBlockRanges(int64(2*time.Hour/time.Millisecond), 10, 3)
+	c, err := tsdb.NewLeveledCompactor(nil, log.NewNopLogger(), ranges, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Four 2h blocks, of which the first three fill a 6h block.
+	for i := int64(0); i < 4; i++ {
+		h, err := tsdb.NewHead(nil, log.NewNopLogger(), nil, ranges[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := h.Appender()
+		for ts := i * ranges[0]; ts < (i+1)*ranges[0]; ts += 60000 {
+			if _, err := app.Add(labels.FromStrings("__name__", "up"), ts, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := app.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Write(dir, h, i*ranges[0], (i+1)*ranges[0]); err != nil {
+			t.Fatal(err)
+		}
+		h.Close()
+	}
+
+	var (
+		buf bytes.Buffer
+		p   progress
+	)
+	if err := compactBlocks(dir, ranges, &p, log.NewLogfmtLogger(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	logs := buf.String()
+	if l := logLine(logs, "Compacted v2 blocks"); logValue(l, "sources") != "3" || logValue(l, "blocks_left") != "2" {
+		t.Errorf("got progress %q, want a compaction of 3 blocks leaving 2", l)
+	}
+	if n := logValue(logLine(logs, "Compaction complete"), "compactions"); n != "1" {
+		t.Errorf("got %q compactions, want 1", n)
+	}
+	if time.Since(p.lastProgress()) > time.Minute {
+		t.Error("compacting did not update the progress")
+	}
+
+	metas, err := readBlockMetas(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 2 {
+		t.Fatalf("got %d blocks after compacting, want 2", len(metas))
+	}
+	for _, m := range metas {
+		if m.MinTime == 0 && (m.MaxTime != 3*ranges[0] || m.Stats.NumSamples != 360) {
+			t.Errorf("got compacted block [%d, %d) with %d samples, want [0, %d) with 360", m.MinTime, m.MaxTime, m.Stats.NumSamples, 3*ranges[0])
+		}
+	}
+	if strings.Contains(logs, "level=error") {
+		t.Errorf("errors while compacting:\n%s", logs)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// maxComparePoints is the maximum number of points requested from the live
+// Prometheus in one range query, below its limit of 11000.
+const maxComparePoints = 10000
+
+// liveMismatch rewrites the descriptions of the mismatches found by
+// compareSamples, which is passed the live results in place of the v1
+// samples.
+var liveMismatch = strings.NewReplacer("v1", "live")
+
+// liveComparer compares the v2 storage with a running Prometheus server via
+// its HTTP API.
+type liveComparer struct {
+	url string
+	// bearerToken is sent with every request if it is not empty. Basic
+	// auth credentials in url are sent by the HTTP client.
+	bearerToken string
+	client      *http.Client
+	// step is the resolution of the compared range queries and lookback
+	// how far back an instant vector selector looks for a sample.
+	step     time.Duration
+	lookback time.Duration
+}
+
+// queryRangeResponse is the response of the query_range API.
+type queryRangeResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string       `json:"resultType"`
+		Result     model.Matrix `json:"result"`
+	} `json:"data"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// compare evaluates a stable sample of the given fraction of the series in
+// the v2 storage of m at every step in [from, through] and compares the
+// results with the same range query against the live Prometheus. Labels added
+// with -external-label are left out of the queries, as are those with the
+// value of a -default-label. Mismatches are logged. It returns the number of
+// series checked and the number of series with mismatches.
+func (c *liveComparer) compare(m *migrator, from, through model.Time, fraction float64, logger log.Logger) (checked, failed int, err error) {
+	// The live Prometheus evaluates range queries at multiples of the
+	// step, counted from the start.
+	step := model.Time(c.step / time.Millisecond)
+	if r := from % step; r != 0 {
+		from += step - r
+	}
+	if from > through {
+		return 0, 0, nil
+	}
+
+	external := make([]string, 0, len(m.externalLabels))
+	for _, l := range m.externalLabels {
+		external = append(external, l.Name)
+	}
+
+	lookback := model.Time(c.lookback / time.Millisecond)
+	q, err := m.v2DB.Querier(int64(from-lookback), int64(through))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer q.Close()
+
+	matcher, err := labels.NewRegexpMatcher(model.MetricNameLabel, ".+")
+	if err != nil {
+		return 0, 0, err
+	}
+	set := q.Select(matcher)
+	for set.Next() {
+		ls := set.At().Labels()
+		if !inSample(ls, fraction) {
+			continue
+		}
+		var samples []model.SamplePair
+		it := set.At().Iterator()
+		for it.Next() {
+			t, v := it.At()
+			samples = append(samples, model.SamplePair{Timestamp: model.Time(t), Value: model.SampleValue(v)})
+		}
+		if err := it.Err(); err != nil {
+			return checked, failed, err
+		}
+
+		live := withoutDefaults(withoutNames(ls, external), m.defaultLabels)
+		got, err := c.queryRange(live, from, through)
+		if err != nil {
+			return checked, failed, fmt.Errorf("querying %s: %s", live, err)
+		}
+		checked++
+		// The live results are rounded like the migrated samples were.
+		mismatches := compareSamples(got, evalSteps(samples, from, through, step, lookback), m.valuePrecision)
+		if len(mismatches) > 0 {
+			failed++
+			for i, mm := range mismatches {
+				if i == maxReportedMismatches {
+					level.Error(logger).Log("msg", "more sample mismatches not shown", "series", ls, "mismatches", len(mismatches))
+					break
+				}
+				level.Error(logger).Log("msg", "sample mismatch between live Prometheus and v2", "series", ls, "timestamp", mm.t, "err", liveMismatch.Replace(mm.desc))
+			}
+		}
+	}
+	return checked, failed, set.Err()
+}
+
+// withoutDefaults returns ls without the labels that have the value of the
+// default label of the same name, which the live series most likely lacks.
+func withoutDefaults(ls, defaults labels.Labels) labels.Labels {
+	if len(defaults) == 0 {
+		return ls
+	}
+	res := make(labels.Labels, 0, len(ls))
+	for _, l := range ls {
+		if defaults.Get(l.Name) != l.Value {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// evalSteps returns the value of an instant vector selector over samples at
+// every step in [from, through], which is the latest sample at most lookback
+// before it. Steps without such a sample are left out.
+func evalSteps(samples []model.SamplePair, from, through, step, lookback model.Time) []model.SamplePair {
+	var res []model.SamplePair
+	i := 0
+	for t := from; t <= through; t += step {
+		for i < len(samples) && samples[i].Timestamp <= t {
+			i++
+		}
+		if i > 0 && samples[i-1].Timestamp > t-lookback {
+			res = append(res, model.SamplePair{Timestamp: t, Value: samples[i-1].Value})
+		}
+	}
+	return res
+}
+
+// queryRange returns the result of a range query for the series with exactly
+// the labels ls in [from, through] from the live Prometheus, in parts of at
+// most maxComparePoints steps.
+func (c *liveComparer) queryRange(ls labels.Labels, from, through model.Time) ([]model.SamplePair, error) {
+	step := model.Time(c.step / time.Millisecond)
+	var res []model.SamplePair
+	for start := from; start <= through; start += maxComparePoints * step {
+		end := start + (maxComparePoints-1)*step
+		if end > through {
+			end = through
+		}
+		matrix, err := c.get(selector(ls), start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, ss := range matrix {
+			if labelsFromMetric(ss.Metric).Equals(ls) {
+				res = append(res, ss.Values...)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (c *liveComparer) get(query string, start, end model.Time) (model.Matrix, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/query_range"
+	u.RawQuery = url.Values{
+		"query": {query},
+		"start": {start.String()},
+		"end":   {end.String()},
+		"step":  {strconv.FormatFloat(c.step.Seconds(), 'f', -1, 64)},
+	}.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var r queryRangeResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("unexpected response with status %s: %s", resp.Status, err)
+	}
+	if r.Status != "success" {
+		return nil, fmt.Errorf("query failed with status %s: %s: %s", resp.Status, r.ErrorType, r.Error)
+	}
+	if r.Data.ResultType != model.ValMatrix.String() {
+		return nil, fmt.Errorf("unexpected result type %q", r.Data.ResultType)
+	}
+	return r.Data.Result, nil
+}
+
+// selector returns a PromQL selector for the series with the labels ls.
+func selector(ls labels.Labels) string {
+	ms := make([]string, 0, len(ls))
+	for _, l := range ls {
+		ms = append(ms, l.Name+"="+strconv.Quote(l.Value))
+	}
+	return "{" + strings.Join(ms, ",") + "}"
+}
+
+// labelsFromMetric converts m to sorted labels.
+func labelsFromMetric(m model.Metric) labels.Labels {
+	ls := make(map[string]string, len(m))
+	for k, v := range m {
+		ls[string(k)] = string(v)
+	}
+	return labels.FromMap(ls)
+}
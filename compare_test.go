@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+)
+
+func TestEvalSteps(t *testing.T) {
+	samples := []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2500, Value: 2}, {Timestamp: 9000, Value: 3}}
+	for _, tc := range []struct {
+		name                          string
+		from, through, step, lookback model.Time
+		want                          []model.SamplePair
+	}{
+		{
+			name: "every step", from: 1000, through: 4000, step: 1000, lookback: 5000,
+			want: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 1}, {Timestamp: 3000, Value: 2}, {Timestamp: 4000, Value: 2}},
+		},
+		{
+			name: "lookback gaps", from: 0, through: 10000, step: 2000, lookback: 2000,
+			want: []model.SamplePair{{Timestamp: 2000, Value: 1}, {Timestamp: 4000, Value: 2}, {Timestamp: 10000, Value: 3}},
+		},
+		{
+			name: "sample exactly lookback before", from: 4500, through: 4500, step: 1000, lookback: 2000,
+			want: nil,
+		},
+		{
+			name: "before first sample", from: 0, through: 500, step: 100, lookback: 5000,
+			want: nil,
+		},
+	} {
+		if got := evalSteps(samples, tc.from, tc.through, tc.step, tc.lookback); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLiveComparer(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 2, 10*time.Minute))
+	defer closeV1()
+	v2, closeV2 := newTestV2Storage(t)
+	defer closeV2()
+	m := newTestMigrator(v1, v2)
+	m.v2DB = v2
+	through := testStart.Add(10*time.Minute) - 1
+	if err := migrateTestInstance(m, "host0:9090", testStart, through); err != nil {
+		t.Fatal(err)
+	}
+
+	// The live Prometheus returns the value of idx at every step, except
+	// for a wrong value of the series with idx 1 at 5m.
+	wrong := testStart.Add(5 * time.Minute)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prefix/api/v1/query_range" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		start, _ := strconv.ParseFloat(q.Get("start"), 64)
+		end, _ := strconv.ParseFloat(q.Get("end"), 64)
+		step, _ := strconv.ParseFloat(q.Get("step"), 64)
+		var ss model.SampleStream
+		ss.Metric = model.Metric{model.MetricNameLabel: "test_metric", model.InstanceLabel: "host0:9090"}
+		for idx := 0; idx < 2; idx++ {
+			if strings.Contains(q.Get("query"), `idx="`+strconv.Itoa(idx)+`"`) {
+				ss.Metric["idx"] = model.LabelValue(strconv.Itoa(idx))
+			}
+		}
+		for ts := start; ts <= end; ts += step {
+			v, _ := strconv.ParseFloat(string(ss.Metric["idx"]), 64)
+			t := model.TimeFromUnixNano(int64(ts * 1e9))
+			if t == wrong && v == 1 {
+				v = 2
+			}
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: t, Value: model.SampleValue(v)})
+		}
+		b, _ := json.Marshal(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "matrix", "result": model.Matrix{&ss}},
+		})
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	c := &liveComparer{
+		url:         srv.URL + "/prefix/",
+		bearerToken: "secret",
+		client:      srv.Client(),
+		step:        time.Minute,
+		lookback:    5 * time.Minute,
+	}
+	var buf bytes.Buffer
+	checked, failed, err := c.compare(m, testStart, through, 1, log.NewLogfmtLogger(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 2 || failed != 1 {
+		t.Errorf("checked %d series with %d failures, want 2 with 1", checked, failed)
+	}
+	l := logLine(buf.String(), "sample mismatch between live Prometheus and v2")
+	if logValue(l, "timestamp") != wrong.String() || !strings.Contains(l, `idx=\"1\"`) || !strings.Contains(l, "live value 2, v2 value 1") {
+		t.Errorf("got mismatch %q, want the wrong live value of idx 1 at %s", l, wrong)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/common/model"
+)
+
+// nominalSampleSize is the uncompressed size of a sample in bytes, an int64
+// timestamp and a float64 value, against which the size of the blocks is
+// compared.
+const nominalSampleSize = 16
+
+// blockCompression is the size of a block written by the migration.
+type blockCompression struct {
+	ULID    string
+	MinTime model.Time
+	MaxTime model.Time
+	Samples uint64
+	Bytes   int64
+}
+
+// bytesPerSample returns the bytes the block takes on disk per sample.
+func (b blockCompression) bytesPerSample() float64 {
+	if b.Samples == 0 {
+		return 0
+	}
+	return float64(b.Bytes) / float64(b.Samples)
+}
+
+// ratio returns the nominal size of the block's samples divided by the size
+// of the block on disk.
+func (b blockCompression) ratio() float64 {
+	if b.Bytes == 0 {
+		return 0
+	}
+	return float64(b.Samples*nominalSampleSize) / float64(b.Bytes)
+}
+
+// existingBlocks returns the ULIDs of the blocks in the v2 storage
+// directories, which must not have been opened yet.
+func existingBlocks(dirs []string) (map[string]bool, error) {
+	existing := map[string]bool{}
+	for _, dir := range dirs {
+		metas, err := readBlockMetas(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range metas {
+			existing[m.ULID.String()] = true
+		}
+	}
+	return existing, nil
+}
+
+// measureCompression returns the sizes of the blocks in the v2 storage
+// directories that are not in existing, and their total. Index, chunks and
+// meta.json all count towards the size of a block. Samples still in the head
+// of the v2 storage are in no block yet and are not counted.
+func measureCompression(dirs []string, existing map[string]bool) ([]blockCompression, blockCompression, error) {
+	var (
+		blocks []blockCompression
+		total  blockCompression
+	)
+	for _, dir := range dirs {
+		metas, err := readBlockMetas(dir)
+		if err != nil {
+			return nil, total, err
+		}
+		for _, m := range metas {
+			if existing[m.ULID.String()] {
+				continue
+			}
+			size, err := dirSize(m.dir)
+			if err != nil {
+				return nil, total, err
+			}
+			b := blockCompression{
+				ULID:    m.ULID.String(),
+				MinTime: model.Time(m.MinTime),
+				MaxTime: model.Time(m.MaxTime),
+				Samples: m.Stats.NumSamples,
+				Bytes:   size,
+			}
+			blocks = append(blocks, b)
+			total.Samples += b.Samples
+			total.Bytes += b.Bytes
+		}
+	}
+	return blocks, total, nil
+}
+
+// dirSize returns the total size of the regular files below dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
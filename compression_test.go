@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeasureCompressionRatio(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 5, 2*time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	logs := captureStderr(t, func() {
+		if code := runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "1h", "-lookback", "2h", "-min-block-duration", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(2*time.Hour).Unix()),
+			"-align-blocks", "1h", "-exclusive-end", "-output-blocks-per-window",
+			"-measure-compression-ratio", "-compression-ratio-per-block",
+		); code != 0 {
+			t.Fatalf("got exit code %d, want 0", code)
+		}
+	})
+	l := logLine(logs, "Compression ratio of written v2 blocks")
+	if logValue(l, "blocks") != "3" || logValue(l, "samples") != "4800" {
+		t.Fatalf("got log line %q, want the 4800 samples of 3 blocks, logs:\n%s", l, logs)
+	}
+	// Regular samples compress to a few bytes, including the index.
+	bps, err := strconv.ParseFloat(logValue(l, "bytes_per_sample"), 64)
+	if err != nil || bps <= 0 || bps >= nominalSampleSize {
+		t.Errorf("got %q bytes per sample, want more than 0 and less than %d", logValue(l, "bytes_per_sample"), nominalSampleSize)
+	}
+	ratio, err := strconv.ParseFloat(logValue(l, "ratio"), 64)
+	if err != nil || ratio <= 1 {
+		t.Errorf("got ratio %q, want more than 1", logValue(l, "ratio"))
+	}
+	if n := strings.Count(logs, `msg="Block compression"`); n != 3 {
+		t.Errorf("got %d lines per block, want 3", n)
+	}
+
+	// Blocks that existed before the migration are not counted.
+	existing, err := existingBlocks([]string{v2Dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, total, err := measureCompression([]string{v2Dir}, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 0 || total.Samples != 0 {
+		t.Errorf("got %d blocks with %d samples, want none", len(blocks), total.Samples)
+	}
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// redactedPassword replaces passwords in the dumped configuration.
+const redactedPassword = "REDACTED"
+
+// config holds the values of the command line flags and the values that
+// validate derives from them.
+type config struct {
+	v1Dir                       string
+	v1ReplicaDirs               stringSlice
+	replicaTieBreak             string
+	v2Dir                       string
+	v2Shards                    int
+	v2ShardDirTemplate          string
+	lookback                    time.Duration
+	endTimestamp                int64
+	allowEmpty                  bool
+	step                        time.Duration
+	v1HeapSize                  byteSize
+	maxParallelism              int
+	warmup                      bool
+	maxRuntime                  time.Duration
+	maxWindows                  int
+	checkpointFile              string
+	printResumeToken            bool
+	resumeTokenFlag             string
+	resumeVerify                bool
+	resumeMargin                time.Duration
+	remoteWriteURLs             stringSlice
+	remoteWriteTimeout          time.Duration
+	destErrorPolicy             string
+	assertLabels                bool
+	exclusiveEnd                bool
+	listenAddress               string
+	stallTimeout                time.Duration
+	valuePrecision              int
+	v1ReadOnly                  bool
+	v1CopyDir                   string
+	sourceOpenTimeout           time.Duration
+	includeInstances            stringSlice
+	skipInstances               stringSlice
+	shardOf                     int
+	totalShards                 int
+	deterministic               bool
+	timingReport                bool
+	normalizeBucketLabels       bool
+	heapProfileFile             string
+	maxIdleTimeout              time.Duration
+	verifyBlocks                bool
+	manifestFile                string
+	incremental                 bool
+	incrementalMargin           time.Duration
+	resumeFromExisting          bool
+	shardLabel                  string
+	reportGaps                  bool
+	alignBlocks                 time.Duration
+	maxConcurrentCommits        int
+	sourceQueryConcurrency      int
+	commitSamples               int
+	commitSeries                int
+	readBufferWindows           int
+	windowWorkers               int
+	sourceSampleLimit           int
+	estimate                    bool
+	listInstances               bool
+	countOnly                   bool
+	sampleFraction              float64
+	gcBlocksFlag                bool
+	seriesListFile              string
+	dropLabels                  stringSlice
+	externalLabels              labelsFlag
+	overwriteLabels             bool
+	defaultLabels               labelsFlag
+	defaultJob                  string
+	compactAfter                bool
+	walFlushInterval            time.Duration
+	minBlockDuration            time.Duration
+	dumpIndexFlag               bool
+	dumpIndexLabel              string
+	noShardKeyBucket            bool
+	verifyIndexFlag             bool
+	verifyValuesFlag            bool
+	verifyCounterResets         bool
+	verifySampleOrderFlag       bool
+	verifyValuesFraction        float64
+	compareURL                  string
+	compareStep                 time.Duration
+	compareLookback             time.Duration
+	compareBearerTokenFile      string
+	compareTimeout              time.Duration
+	instanceRetries             int
+	skipFailedInstances         bool
+	failureReportFile           string
+	retryReportFile             string
+	detectOverlap               bool
+	nanPolicy                   string
+	checkOrder                  bool
+	sortSamples                 bool
+	dropRepeated                bool
+	repeatedTolerance           float64
+	targetVersion               string
+	progressFile                string
+	etaModel                    string
+	progressMode                string
+	progressFileInterval        time.Duration
+	progressRemoteWriteURL      string
+	progressRemoteWriteInterval time.Duration
+	blockMetaLabels             labelsFlag
+	progressLabels              labelsFlag
+	reverse                     bool
+	recentFirst                 time.Duration
+	blocksPerWindow             bool
+	minValidTime                int64
+	maxValidTime                int64
+	sourceLoadURL               string
+	sourceLoadMetric            string
+	sourceLoadHigh              float64
+	sourceLoadLow               float64
+	sourceLoadInterval          time.Duration
+	dumpConfigFlag              bool
+	minSamplesPerSeries         int
+	maxMetricNames              int
+	maxTotalSeries              int
+	roundTimestampsFlag         time.Duration
+	expectSeries                int
+	expectSamples               int64
+	expectTolerance             float64
+	probeFlag                   bool
+	strictNames                 string
+	maxLabelValueLength         int
+	longLabelValues             string
+	duplicateLabels             string
+	verifyNoOverlap             string
+	blockAuditFile              string
+	measureCompressionRatio     bool
+	compressionRatioPerBlock    bool
+	reportFile                  string
+	reportFormat                string
+	preflightFlag               bool
+	force                       bool
+	quarantineDir               string
+	maxAppendErrors             uint64
+	maxAppendErrorRatio         float64
+	quarantineMaxFileSize       int64
+	cardinalityExplosionFactor  float64
+	cardinalityExplosionAction  string
+	replayQuarantineFlag        bool
+	verifyOnly                  bool
+	ciMode                      bool
+	ciWindows                   int
+	printVersion                bool
+
+	// Derived from the flags by validate.
+	memory          uint64
+	skipInstanceREs []*regexp.Regexp
+	compareToken    string
+	v2Dirs          []string
+}
+
+// newConfig returns a config with its flags defined in fs.
+func newConfig(fs *flag.FlagSet) *config {
+	c := &config{}
+	fs.StringVar(&c.v1Dir, "v1-dir", "./data-v1", "Path to the v1 storage directory.")
+	fs.Var(&c.v1ReplicaDirs, "v1-replica-dir", "Path to the v1 storage directory of an HA replica of the Prometheus server of -v1-dir. May be repeated. Series with the same labels in several directories are migrated as one, with one sample per timestamp chosen by -replica-tie-break. The -v1-target-heap-size is split between the storages.")
+	fs.StringVar(&c.replicaTieBreak, "replica-tie-break", "first", "Which sample to keep of samples with the same timestamp in several -v1-replica-dir: 'first' prefers -v1-dir and then the replicas in the order given, 'last' the reverse order.")
+	fs.StringVar(&c.v2Dir, "v2-dir", "./data-v2", "Path to the v2 storage directory.")
+	fs.IntVar(&c.v2Shards, "v2-shards", 1, "Number of v2 storages to distribute the migrated series over by the hash of their labels, like a hashring assigns series to ingesters. With more than 1, the storages are in the directories given by -v2-shard-dir-template, and -v2-dir only holds the checkpoint and manifest.")
+	fs.StringVar(&c.v2ShardDirTemplate, "v2-shard-dir-template", "", "Directories of the -v2-shards v2 storages, with %d replaced by the shard number from 0. Defaults to shard-%d in -v2-dir.")
+	fs.DurationVar(&c.lookback, "lookback", 15*24*time.Hour, "How far back to start when exporting old data.")
+	fs.Int64Var(&c.endTimestamp, "end-timestamp", 0, "Unix timestamp in seconds of the end of the time range to migrate. If 0, the current time is chosen.")
+	fs.BoolVar(&c.allowEmpty, "allow-empty", false, "Exit successfully if the time range to migrate is empty, e.g. because -lookback is 0 or -incremental or -resume-from-existing start at or after the end, instead of failing.")
+	fs.DurationVar(&c.step, "step", 15*time.Minute, "How much data to load at once.")
+	c.v1HeapSize = byteSize(2e9)
+	fs.Var(&c.v1HeapSize, "v1-target-heap-size", "How much memory to use for the v1 storage, in bytes or with a unit like 2GiB or 500MB.")
+	fs.IntVar(&c.maxParallelism, "max-parallelism", 1, "How many instances to migrate at the same time.")
+	fs.BoolVar(&c.warmup, "warmup", false, "Look up all series of the migration range in the v1 index before starting, so that throughput is steady from the first step.")
+	fs.DurationVar(&c.maxRuntime, "max-runtime", 0, "Stop the migration cleanly after this duration, recording a checkpoint to resume from. If 0, there is no limit.")
+	fs.IntVar(&c.maxWindows, "max-windows", 0, "Stop the migration cleanly after migrating this many steps in this run, recording a checkpoint to resume from. Unlike -max-runtime, this always stops at the same step. If 0, there is no limit.")
+	fs.StringVar(&c.checkpointFile, "checkpoint-file", "", "Path to the file recording migration progress for resuming interrupted runs. Defaults to a file in the v2 storage directory.")
+	fs.BoolVar(&c.printResumeToken, "print-resume-token", false, "On a graceful stop, e.g. on SIGTERM, -max-runtime or -max-windows, print a token with the progress of the migration and the instances skipped with -skip-failed-instances as the last line to stdout, for orchestrators whose containers do not keep the checkpoint file. Cannot be used with -reverse.")
+	fs.StringVar(&c.resumeTokenFlag, "resume-token", "", "Resume from a token printed with -print-resume-token instead of the checkpoint file, or from the token read from stdin if -. The token takes precedence over the checkpoint file.")
+	fs.BoolVar(&c.resumeVerify, "resume-verify", false, "When resuming from a checkpoint, check that the v2 storage has samples in the last step before it, and if not, migrate again from the step of the latest sample it has. Samples already present in the v2 storage are skipped.")
+	fs.DurationVar(&c.resumeMargin, "resume-safety-margin", -1, "How far before the checkpoint to start when resuming, so that samples of steps the v2 storage lost in a crash are migrated again. Samples already present in the v2 storage are skipped. If negative, one -step is used, or none with -output-blocks-per-window.")
+	fs.Var(&c.remoteWriteURLs, "remote-write-url", "URL of a remote write endpoint to send migrated samples to in addition to the v2 storage. May be repeated.")
+	fs.DurationVar(&c.remoteWriteTimeout, "remote-write-timeout", 30*time.Second, "Timeout for remote write requests.")
+	fs.StringVar(&c.destErrorPolicy, "destination-error-policy", "fail-fast", "What to do when writing to a destination fails: 'fail-fast' aborts the migration, 'continue' skips the failing destination for the current step and keeps writing to the others.")
+	fs.BoolVar(&c.assertLabels, "debug-assert-labels", false, "Verify that the labels of every series are sorted and free of duplicate names before appending it. Violating series are logged, counted and skipped.")
+	fs.BoolVar(&c.exclusiveEnd, "exclusive-end", false, "Do not migrate samples at exactly the end of the time range, i.e. migrate [start, end) instead of [start, end].")
+	fs.StringVar(&c.listenAddress, "listen-address", "", "Address to serve metrics on /metrics and a liveness check on /healthz. Disabled if empty.")
+	fs.DurationVar(&c.stallTimeout, "stall-timeout", 30*time.Minute, "Report the migration as unhealthy on /healthz if no step has completed within this duration.")
+	fs.IntVar(&c.valuePrecision, "value-precision", 0, "Round sample values to this many significant decimal digits to improve compression. This is lossy. If 0, values are migrated exactly.")
+	fs.BoolVar(&c.v1ReadOnly, "v1-readonly", false, "Copy the v1 storage directory to a temporary directory and migrate from the copy, so that the v1 storage directory is never modified. Requires enough free disk space for the copy.")
+	fs.StringVar(&c.v1CopyDir, "v1-readonly-tmp-dir", "", "Directory to create the temporary copy of the v1 storage in when -v1-readonly is set. Defaults to the system temporary directory.")
+	fs.DurationVar(&c.sourceOpenTimeout, "source-open-timeout", 0, "Give up if the v1 storage has not loaded its series within this duration, e.g. because a running Prometheus server holds it. If 0, there is no limit.")
+	fs.Var(&c.includeInstances, "instance", "Only migrate series of this instance, i.e. with this value of the -shard-label label. May be repeated. If not set, all instances are migrated.")
+	fs.Var(&c.skipInstances, "skip-instance", "Do not migrate series of instances (values of the -shard-label label) fully matching this regular expression, unless they are explicitly selected with -instance. May be repeated.")
+	fs.IntVar(&c.shardOf, "shard-of", 0, "Only migrate the instances whose hash modulo -total-shards equals this number, counted from 0, so that several migrators on different machines split the instances between them without overlap.")
+	fs.IntVar(&c.totalShards, "total-shards", 1, "Number of migrators the instances are split between with -shard-of. The hash of an instance only depends on its name, so every migrator computes the same split.")
+	fs.BoolVar(&c.deterministic, "deterministic", false, "Migrate instances one at a time and append series in sorted order, so that repeated migrations of the same data produce identical blocks. Overrides -max-parallelism.")
+	fs.BoolVar(&c.timingReport, "timing-report", false, "Log a summary of the step durations and the steps that took considerably longer than the median after the migration.")
+	fs.BoolVar(&c.normalizeBucketLabels, "normalize-bucket-labels", false, "Rewrite the values of 'le' and 'quantile' labels to the standard Prometheus float formatting (e.g. '0.50' to '0.5'), so that differently formatted buckets end up in the same series.")
+	fs.StringVar(&c.heapProfileFile, "heap-profile-file", "", "Path to write a heap profile to when the migrator exits, whether it succeeded or failed. Besides the memory in use at the end, it records all allocations of the run. Disabled if empty.")
+	fs.DurationVar(&c.maxIdleTimeout, "max-idle-timeout", 0, "Abort with a dump of all goroutines if no samples have been appended for this duration, e.g. because reading from the v1 storage hangs. If 0, there is no limit.")
+	fs.BoolVar(&c.verifyBlocks, "verify-blocks", false, "Read back every block written to the v2 storage and abort the migration if it is unreadable or its series and sample counts do not match its meta.json.")
+	fs.StringVar(&c.manifestFile, "manifest-file", "", "Path to the file recording the time range of the last completed migration. Defaults to a file in the v2 storage directory.")
+	fs.BoolVar(&c.incremental, "incremental", false, "Start the migration at the end of the last completed migration recorded in the manifest file instead of -lookback before the end timestamp.")
+	fs.DurationVar(&c.incrementalMargin, "incremental-safety-margin", 5*time.Minute, "How far before the end of the last completed migration, or of the latest v2 block with -resume-from-existing, to start an incremental migration. Samples already present in the v2 storage are skipped.")
+	fs.BoolVar(&c.resumeFromExisting, "resume-from-existing", false, "Start the migration at the end of the latest block in the v2 storage instead of -lookback before the end timestamp, without needing a manifest file.")
+	fs.StringVar(&c.shardLabel, "shard-label", string(model.InstanceLabel), "Label whose values partition the series into units that are migrated in parallel. Only series with this label are migrated.")
+	fs.BoolVar(&c.reportGaps, "report-gaps", false, "Log the time ranges in which an instance had no samples although it had samples before and after.")
+	fs.DurationVar(&c.alignBlocks, "align-blocks", 0, "Extend the migrated time range to multiples of this duration (e.g. 2h or 24h), so that the first and last blocks are not partial. Must be a multiple of -step. If 0, the range is not aligned.")
+	fs.IntVar(&c.maxConcurrentCommits, "max-concurrent-commits", 0, "How many instances may commit their samples to the v2 storage at the same time. If 0, commits are only limited by -max-parallelism.")
+	fs.IntVar(&c.sourceQueryConcurrency, "source-query-concurrency", 0, "How many reads from the v1 storage, i.e. looking up the series of an instance's step or reading the samples of a series, may run at the same time across all instances. If 0, reads are only limited by -max-parallelism and -copy-window-workers.")
+	fs.IntVar(&c.commitSamples, "commit-samples", 0, "Commit the samples of an instance's step to the v2 storage whenever at least this many have been appended, checked after each series, instead of once per step. Together with -commit-series, this bounds the memory of uncommitted samples for both deep and wide steps. If 0, there is no sample limit.")
+	fs.IntVar(&c.commitSeries, "commit-series", 0, "Commit the samples of an instance's step to the v2 storage whenever samples of this many series have been appended, before -commit-samples is reached. If 0, there is no series limit.")
+	fs.IntVar(&c.readBufferWindows, "read-buffer-windows", 0, "How many of the next steps to read from the v1 storage while the current step is written to the destinations. The samples read ahead are held in memory until their step is migrated. If 0, every step is read when it is migrated.")
+	fs.IntVar(&c.windowWorkers, "copy-window-workers", 1, "How many series of an instance to read from the v1 storage at the same time within a step. Samples are still appended in the same order.")
+	fs.IntVar(&c.sourceSampleLimit, "source-sample-limit", 0, "Read the steps of an instance from the v1 storage in parts in which every series has at most about this many samples, to bound the memory for wide steps. Each part is appended and committed before the next is read. The parts are sized after the densest series of the instance in the part before, so the first step of an instance is read whole. Cannot be used with -read-buffer-windows. If 0, steps are read whole.")
+	fs.BoolVar(&c.estimate, "estimate", false, "Read a small sample of the v1 storage, print the extrapolated size and duration of the migration and exit without migrating.")
+	fs.BoolVar(&c.listInstances, "list-instances", false, "Print the number of series and the estimated number of samples of every instance selected for migration in the time range, largest first, and exit without migrating, e.g. to balance instances between several migrators. The samples are extrapolated from a few steps of every instance.")
+	fs.BoolVar(&c.countOnly, "count-only", false, "Count the samples in the time range of the migration from the chunks in the v1 storage files, decoding only some of them, print the estimated total and exit without migrating. Series selection flags are not applied.")
+	fs.Float64Var(&c.sampleFraction, "sample-fraction", 1, "Only migrate this fraction of all series, e.g. 0.1 for 10%. The series are selected by a hash of their labels, so the same series are selected in every step and run.")
+	fs.BoolVar(&c.gcBlocksFlag, "gc-blocks", false, "Before and after the migration, delete v2 blocks whose data is completely contained in a compacted block, e.g. because an earlier run stopped during a compaction.")
+	fs.StringVar(&c.seriesListFile, "series-list", "", "Path to a file with one JSON object of label names to values per line. Only series with exactly one of these label sets are migrated.")
+	fs.Var(&c.dropLabels, "drop-label", "Name of a label to remove from every migrated series, e.g. an internal bookkeeping label. May be repeated. Series that end up with the same labels are merged.")
+	fs.Var(&c.externalLabels, "external-label", "Label of the form name=value to add to every migrated series. May be repeated. Series that already have the label are an error unless -overwrite-labels is set.")
+	fs.BoolVar(&c.overwriteLabels, "overwrite-labels", false, "Replace the value of a label given with -external-label if a series already has it.")
+	fs.Var(&c.defaultLabels, "default-label", "Label of the form name=value to add to the migrated series that do not have a label of that name, e.g. for targets that require every series to have it. Existing labels are kept. May be repeated.")
+	fs.StringVar(&c.defaultJob, "default-job", "", "Value of the job label to add to the migrated series that have none, the same as -default-label job=value.")
+	fs.BoolVar(&c.compactAfter, "compact-after", false, "After the migration, close the v2 storage and compact its blocks until there is nothing left to compact, instead of leaving outstanding compactions to the next Prometheus start.")
+	fs.DurationVar(&c.walFlushInterval, "wal-flush-interval", 5*time.Second, "How often the v2 storage syncs its write-ahead log to disk. If 0, it is only synced when a segment is full and on shutdown, which is fastest but loses more of the last steps on a crash.")
+	fs.DurationVar(&c.minBlockDuration, "min-block-duration", 2*time.Hour, "Time range of the blocks the v2 storage writes from its in-memory head. Larger blocks are compacted from 10 and 100 of these. This should match the --storage.tsdb.min-block-duration of the Prometheus server that uses the v2 storage.")
+	fs.BoolVar(&c.dumpIndexFlag, "dump-index", false, "Print the label names of all series in the v1 storage and the values of -dump-index-label with their numbers of series, then exit without migrating.")
+	fs.StringVar(&c.dumpIndexLabel, "dump-index-label", "", "Label whose values -dump-index prints. Defaults to -shard-label.")
+	fs.BoolVar(&c.noShardKeyBucket, "no-shard-key-bucket", false, "Also migrate the series without the -shard-label label, as one additional instance with the empty value.")
+	fs.BoolVar(&c.verifyIndexFlag, "verify-index", false, "After the migration, check that the label index of the v2 storage has every label name and value pair of the series migrated by this run and fail if any are missing. Other values of their label names are reported, too. This needs memory for every migrated series.")
+	fs.BoolVar(&c.verifyValuesFlag, "verify-values", false, "After the migration, compare the samples of a stable sample of the series in the v1 and v2 storage and fail if any of them differ.")
+	fs.BoolVar(&c.verifyCounterResets, "verify-counter-resets", false, "After the migration, check that the counters among a stable sample of the series have their counter resets at the same timestamps in the v1 and v2 storage and fail if not. Counters are recognized by the suffixes _total, _count and _bucket.")
+	fs.BoolVar(&c.verifySampleOrderFlag, "verify-sample-order", false, "After the migration, check that the timestamps of a stable sample of the series in the v2 storage are strictly increasing and fail if not, reporting the series and the offending timestamps. Exact duplicates of earlier samples, which the v2 storage writes at block boundaries, are counted but allowed. Unlike -verify-values, this also catches samples out of order with counts that match.")
+	fs.Float64Var(&c.verifyValuesFraction, "verify-values-fraction", 0.01, "Fraction of the series that -verify-values, -verify-counter-resets, -verify-sample-order and -compare-url compare.")
+	fs.StringVar(&c.compareURL, "compare-url", "", "URL of a running Prometheus server, e.g. the one owning the v1 storage, to compare the v2 storage with after the migration. A stable sample of -verify-values-fraction of the series is evaluated at every -compare-step in both and the migrator fails if any result differs. Basic auth credentials can be part of the URL. Disabled if empty.")
+	fs.DurationVar(&c.compareStep, "compare-step", time.Minute, "Resolution of the range queries that -compare-url compares.")
+	fs.DurationVar(&c.compareLookback, "compare-lookback", 5*time.Minute, "How far back -compare-url looks for a sample at every step in the v2 storage. This must match the lookback of the Prometheus server at -compare-url, i.e. its -query.staleness-delta for Prometheus 1.x.")
+	fs.StringVar(&c.compareBearerTokenFile, "compare-bearer-token-file", "", "File with a bearer token to send to -compare-url instead of basic auth credentials.")
+	fs.DurationVar(&c.compareTimeout, "compare-timeout", time.Minute, "Timeout for the queries of -compare-url.")
+	fs.IntVar(&c.instanceRetries, "instance-retries", 0, "How many times to retry migrating a step of an instance that failed for a reason other than writing to a destination.")
+	fs.BoolVar(&c.skipFailedInstances, "skip-failed-instances", false, "If migrating a step of an instance still fails after -instance-retries, skip that instance for the rest of the migration and report it at the end instead of aborting. Failures to write to a destination still abort.")
+	fs.StringVar(&c.failureReportFile, "failure-report-file", "", "Path to a JSON file to write the instances skipped with -skip-failed-instances and the steps they failed at to once the migration has run through. Disabled if empty.")
+	fs.StringVar(&c.retryReportFile, "retry-report", "", "Path to a failure report written with -failure-report-file. Only the reported instances are migrated, each from the step it failed at to the end of the reported migration.")
+	fs.BoolVar(&c.detectOverlap, "detect-window-overlap", false, "Track the latest sample committed for every series and skip samples that a later step appends at or before it, reporting their number at the end. This needs memory for every migrated series.")
+	fs.StringVar(&c.nanPolicy, "nan-policy", "keep", "What to do with NaN values: 'keep' migrates them as they are, 'drop' drops their samples and 'stale' replaces them with Prometheus 2 staleness markers, which end the series at that time in queries.")
+	fs.BoolVar(&c.checkOrder, "validate-monotonic-timestamps", false, "Report series whose samples read from the v1 storage are not in increasing order of their timestamps, e.g. because the v1 storage is corrupt. The v2 storage silently drops the samples that are not newer than the one before.")
+	fs.BoolVar(&c.sortSamples, "sort-non-monotonic-timestamps", false, "Sort the samples of series reported by -validate-monotonic-timestamps by their timestamps before appending them, keeping the first of samples with the same timestamp. Implies -validate-monotonic-timestamps.")
+	fs.BoolVar(&c.dropRepeated, "drop-repeated-values", false, "Drop samples whose value equals that of the samples before and after them, keeping the first and last sample of every run of equal values and of every step. This is lossy.")
+	fs.Float64Var(&c.repeatedTolerance, "drop-repeated-values-tolerance", 0, "Relative difference up to which -drop-repeated-values considers values equal. If 0, only exactly equal values are.")
+	fs.StringVar(&c.targetVersion, "target-prometheus-version", "", "Version of the Prometheus server that will use the v2 storage, e.g. 2.0.0. Fails if the v2 storage cannot write blocks it can read, and checks the format version of all blocks after the migration. Not checked if empty.")
+	fs.StringVar(&c.progressFile, "progress-file", "", "Path to a JSON file with the progress of the migration, i.e. the percentage and number of steps done, the samples read, the estimated remaining time, the current step, the instances being migrated and the number of errors. It is atomically replaced every -progress-file-interval. Disabled if empty.")
+	fs.StringVar(&c.etaModel, "progress-eta-model", "linear", "How to estimate the remaining time of the migration: 'linear' from the time per step so far, 'throughput' from the samples read per second in the last 5 minutes and the samples per step so far, 'density-weighted' from the time so far weighted by how much data the steps hold, which is estimated from the chunk headers of the v1 storage before migrating. The progress bar only shows the remaining time with 'linear'.")
+	fs.StringVar(&c.progressMode, "progress", "bar", "How to show the progress on standard output: 'bar' for a progress bar, 'tui' for a view of the overall progress, throughput, remaining time and the instances being migrated that is redrawn every second. Falls back to the bar if standard output is not a terminal.")
+	fs.DurationVar(&c.progressFileInterval, "progress-file-interval", 10*time.Second, "How often to rewrite the -progress-file.")
+	fs.StringVar(&c.progressRemoteWriteURL, "progress-remote-write-url", "", "URL of a remote write endpoint to send the progress of the migration to as prom_data_migrator_* metrics every -progress-remote-write-interval, with the -remote-write-timeout. Disabled if empty.")
+	fs.DurationVar(&c.progressRemoteWriteInterval, "progress-remote-write-interval", 15*time.Second, "How often to send the progress to the -progress-remote-write-url.")
+	fs.Var(&c.blockMetaLabels, "block-meta-label", "Label of the form name=value to add as a Thanos external label to the meta.json of every block written by the migration, together with the raw resolution and the migrator as the source, so that Thanos can upload and query the blocks. May be repeated. Samples still in the head of the v2 storage at the end are in no block yet and not labeled.")
+	fs.Var(&c.progressLabels, "progress-label", "Label of the form name=value to add to the metrics sent to the -progress-remote-write-url, e.g. to tell migrations apart. May be repeated.")
+	fs.BoolVar(&c.reverse, "reverse", false, "Migrate the newest data first, one -min-block-duration block range at a time, writing each as a block once it is complete. Aligns the time range to -min-block-duration and implies -exclusive-end. Does not record checkpoints.")
+	fs.DurationVar(&c.recentFirst, "recent-first", 0, "Make this much of the newest data available in the v2 storage before migrating the rest, e.g. for a live cutover. Implies -reverse, which writes the newest block ranges first, and logs once the block ranges covering this duration are written. Rounded up to a multiple of -min-block-duration. Disabled if 0.")
+	fs.BoolVar(&c.blocksPerWindow, "output-blocks-per-window", false, "Write the samples of every step as a block of its own to the v2 storage once the step is complete, instead of appending them to its head, so that blocks map 1:1 to steps. The blocks are not compacted during the migration.")
+	fs.Int64Var(&c.minValidTime, "min-valid-time", 0, "Unix timestamp in seconds before which samples are considered corrupt and dropped. Only samples in the migrated time range are read in any case. If 0, there is no additional limit.")
+	fs.Int64Var(&c.maxValidTime, "max-valid-time", 0, "Unix timestamp in seconds after which samples are considered corrupt and dropped. Only samples in the migrated time range are read in any case. If 0, there is no additional limit.")
+	fs.StringVar(&c.sourceLoadURL, "source-load-url", "", "URL of the metrics of the Prometheus server owning the v1 storage. If set, only one instance is migrated at a time while -source-load-metric exceeds -source-load-high, until it falls below -source-load-low.")
+	fs.StringVar(&c.sourceLoadMetric, "source-load-metric", "prometheus_local_storage_persistence_urgency_score", "Metric at -source-load-url that indicates the load of the v1 storage. The values of all its series are summed up.")
+	fs.Float64Var(&c.sourceLoadHigh, "source-load-high", 0.7, "Value of -source-load-metric above which the migration is throttled.")
+	fs.Float64Var(&c.sourceLoadLow, "source-load-low", 0.5, "Value of -source-load-metric below which a throttled migration continues at full parallelism.")
+	fs.DurationVar(&c.sourceLoadInterval, "source-load-interval", 15*time.Second, "How often to check -source-load-url.")
+	fs.BoolVar(&c.dumpConfigFlag, "dump-config", false, "Print the values of all flags, including defaults and values derived from other flags, as JSON and exit. Passwords in URLs are redacted.")
+	fs.IntVar(&c.minSamplesPerSeries, "min-samples-per-series", 0, "Drop series with fewer samples than this in the whole migrated time range of the run. Their samples are counted in an additional pass over the v1 storage before the migration. If 0, no series are dropped.")
+	fs.IntVar(&c.maxMetricNames, "max-metric-names", 0, "Only migrate the series of the first this many metric names in sort order that have series in the time range of the migration, across all instances, e.g. for scoped migrations. The included and excluded names are logged. If 0, there is no limit.")
+	fs.IntVar(&c.maxTotalSeries, "max-total-series", 0, "Only migrate the first this many distinct series across all instances, e.g. for bounded test migrations. Implies -deterministic, so that the same series are selected in every run. The limit applies to each run separately. If 0, there is no limit.")
+	fs.DurationVar(&c.roundTimestampsFlag, "round-timestamps", 0, "Round sample timestamps to the nearest multiple of this duration, e.g. 1s to remove sub-second jitter. Of samples rounded to the same timestamp, the latest is kept. If 0, timestamps are migrated exactly.")
+	fs.IntVar(&c.expectSeries, "expect-series", -1, "Exit with status 1 if the number of distinct series migrated by this run differs from this by more than -expect-tolerance. Not checked if negative.")
+	fs.Int64Var(&c.expectSamples, "expect-samples", -1, "Exit with status 1 if the number of samples migrated by this run differs from this by more than -expect-tolerance. Not checked if negative.")
+	fs.Float64Var(&c.expectTolerance, "expect-tolerance", 0, "Relative difference from -expect-series and -expect-samples that is still accepted, e.g. 0.01 for 1%.")
+	fs.BoolVar(&c.probeFlag, "probe", false, "Open both storages, print the number of instances and a sample series of the v1 storage and the number of blocks of the v2 storage, then exit without migrating. Exits non-zero if either storage cannot be read.")
+	fs.StringVar(&c.strictNames, "strict-names", "", "Check the metric and label names of every series against the Prometheus naming rules and label values for valid UTF-8. With 'fail', an invalid series aborts the migration, with 'skip', it is logged, counted and skipped. Disabled if empty.")
+	fs.IntVar(&c.maxLabelValueLength, "max-label-value-length", 0, "Truncate label values longer than this many bytes or skip their series, as selected with -long-label-values. If 0, label values are migrated unchanged.")
+	fs.StringVar(&c.longLabelValues, "long-label-values", "truncate", "What to do with series that have label values longer than -max-label-value-length: 'truncate' shortens the values to a prefix without split UTF-8 characters and a hash of the full value, so that distinct values stay distinct, 'skip' skips the series. Affected series are counted.")
+	fs.StringVar(&c.duplicateLabels, "duplicate-labels", "fail", "What to do with series that end up with a label name more than once after their conversion to v2 labels, which would corrupt the v2 index: 'fail' aborts the migration, 'last-wins' keeps the last of the labels in sort order and counts the series.")
+	fs.StringVar(&c.verifyNoOverlap, "verify-no-overlap", "", "After the migration, check that the time ranges of the v2 blocks do not overlap, which Prometheus 2.x does not support. With 'warn', overlapping blocks are logged, with 'fail', the migrator also exits with status 1. Disabled if empty.")
+	fs.StringVar(&c.blockAuditFile, "block-audit-file", "", "Path to a JSON file to write at the end of the migration that lists the blocks written by it with the steps and instances whose samples they contain. Disabled if empty.")
+	fs.BoolVar(&c.measureCompressionRatio, "measure-compression-ratio", false, "After the migration, log the size on disk of the v2 blocks it wrote, in bytes per sample and as the ratio of the uncompressed size of their samples, 16 bytes each, to the size of the blocks. Samples still in the head of the v2 storage are not counted.")
+	fs.BoolVar(&c.compressionRatioPerBlock, "compression-ratio-per-block", false, "With -measure-compression-ratio, also log the size of every block.")
+	fs.StringVar(&c.reportFile, "report-file", "", "Path to write a summary of the migration to once it has run through, with the time range, the samples read per instance, the step timings and the skipped series and samples and errors, in the -report-format. Disabled if empty.")
+	fs.StringVar(&c.reportFormat, "report-format", "html", "Format of the -report-file: 'html' for a self-contained page to attach to a ticket or runbook, or 'json'.")
+	fs.BoolVar(&c.preflightFlag, "preflight", false, "Before migrating, count the series selected by -instance, -skip-instance, -series-list, -sample-fraction and -long-label-values in the migration range, and refuse to start if there are none.")
+	fs.BoolVar(&c.force, "force", false, "Start the migration even if -preflight finds no series to migrate.")
+	fs.StringVar(&c.quarantineDir, "quarantine-dir", "", "Directory to write samples to that the v2 storage rejects, e.g. because they are out of order, in the text exposition format, instead of failing the step. Samples dropped by -min-valid-time, -max-valid-time or -nan-policy drop are written there too. Disabled if empty.")
+	fs.Uint64Var(&c.maxAppendErrors, "max-append-errors", 0, "Stop the migration with status 1 once more than this many samples have been rejected by the v2 storage and quarantined, which points to a problem with the v2 storage rather than isolated bad samples. The checkpoint of the last completed step is kept for resuming. Requires -quarantine-dir. If 0, there is no limit.")
+	fs.Float64Var(&c.maxAppendErrorRatio, "max-append-error-ratio", 0, "Stop the migration like -max-append-errors once more than this fraction of the samples of a step has been rejected by the v2 storage. Requires -quarantine-dir. If 0, there is no limit.")
+	fs.Int64Var(&c.quarantineMaxFileSize, "quarantine-max-file-size", 0, "Size in bytes after which a new file is started in -quarantine-dir. The samples of a series are always written to one file. If 0, one file is written per run.")
+	fs.Float64Var(&c.cardinalityExplosionFactor, "cardinality-explosion-factor", 0, "Treat a step of an instance as a cardinality explosion if it has more than this many times the mean number of series of its last 5 steps, which usually comes from a label bug in the source. The error names the labels with the most new values. If 0, steps are not checked.")
+	fs.StringVar(&c.cardinalityExplosionAction, "cardinality-explosion-action", "abort", "What to do with a step of an instance with a cardinality explosion: abort fails the step like a read error, quarantine writes its samples to -quarantine-dir instead of the v2 storage and goes on.")
+	fs.BoolVar(&c.replayQuarantineFlag, "replay-quarantine", false, "Do not migrate, append the samples of the files in -quarantine-dir to the destinations that rejected them instead and remove the replayed files. Samples that are rejected again are written to a new file in -quarantine-dir. The series replayed and those still failing are logged.")
+	fs.BoolVar(&c.verifyOnly, "verify-only", false, "Do not migrate, only run the verifications selected with -verify-blocks, -verify-values, -verify-counter-resets, -verify-sample-order and -compare-url against the existing v2 storage.")
+	fs.BoolVar(&c.ciMode, "ci-mode", false, "Migrate a small slice of the v1 storage and verify it, for pre-merge checks: only the last -ci-windows steps and at most -max-total-series series (100 if not set) are migrated, with -verify-blocks, -verify-index and -verify-values of all migrated series. Prints whether the check passed and exits with status 0 or 1.")
+	fs.IntVar(&c.ciWindows, "ci-windows", 3, "Number of steps that -ci-mode migrates.")
+	fs.BoolVar(&c.printVersion, "version", false, "Print version information and exit.")
+	return c
+}
+
+// applyCIMode sets the flags that -ci-mode implies.
+func (c *config) applyCIMode() error {
+	if c.ciWindows < 1 {
+		return fmt.Errorf("-ci-windows %d must be at least 1", c.ciWindows)
+	}
+	if c.verifyOnly || c.reverse || c.recentFirst > 0 || c.blocksPerWindow || c.incremental || c.resumeFromExisting || c.maxRuntime > 0 || c.maxWindows > 0 {
+		return errors.New("-ci-mode cannot be used with -verify-only, -reverse, -recent-first, -output-blocks-per-window, -incremental, -resume-from-existing, -max-runtime or -max-windows")
+	}
+	if ci := time.Duration(c.ciWindows) * c.step; c.lookback > ci {
+		c.lookback = ci
+	}
+	if c.maxTotalSeries == 0 {
+		c.maxTotalSeries = 100
+	}
+	c.verifyBlocks, c.verifyIndexFlag, c.verifyValuesFlag, c.verifyValuesFraction = true, true, true, 1
+	return nil
+}
+
+// validate checks the flags for invalid values and combinations and sets the
+// values derived from them, e.g. the defaults that depend on other flags.
+func (c *config) validate() error {
+	if c.verifyOnly && !c.verifyBlocks && !c.verifyValuesFlag && !c.verifyCounterResets && !c.verifySampleOrderFlag && c.compareURL == "" {
+		return errors.New("-verify-only requires -verify-blocks, -verify-values, -verify-counter-resets, -verify-sample-order or -compare-url")
+	}
+	if c.verifyOnly && c.verifyIndexFlag {
+		return errors.New("-verify-index cannot be used with -verify-only, which migrates no series to check the index against")
+	}
+
+	c.memory = systemMemory()
+	if c.v1HeapSize == 0 || c.memory > 0 && uint64(c.v1HeapSize) >= c.memory {
+		return fmt.Errorf("-v1-target-heap-size %s must be positive and less than the system memory of %d bytes", &c.v1HeapSize, c.memory)
+	}
+
+	if c.replicaTieBreak != "first" && c.replicaTieBreak != "last" {
+		return fmt.Errorf("invalid -replica-tie-break %q", c.replicaTieBreak)
+	}
+	if c.verifyNoOverlap != "" && c.verifyNoOverlap != "warn" && c.verifyNoOverlap != "fail" {
+		return fmt.Errorf("invalid -verify-no-overlap %q", c.verifyNoOverlap)
+	}
+	for _, l := range c.dropLabels {
+		if !model.LabelName(l).IsValid() || l == string(model.MetricNameLabel) {
+			return fmt.Errorf("invalid -drop-label %q", l)
+		}
+	}
+	if len(c.dropLabels) > 0 && c.compareURL != "" {
+		return errors.New("-drop-label cannot be used with -compare-url")
+	}
+	if c.duplicateLabels != "fail" && c.duplicateLabels != "last-wins" {
+		return fmt.Errorf("invalid -duplicate-labels %q", c.duplicateLabels)
+	}
+	if c.strictNames != "" && c.strictNames != "fail" && c.strictNames != "skip" {
+		return fmt.Errorf("invalid -strict-names %q", c.strictNames)
+	}
+	if c.maxLabelValueLength < 0 {
+		return fmt.Errorf("-max-label-value-length %d must not be negative", c.maxLabelValueLength)
+	}
+	if c.longLabelValues != "truncate" && c.longLabelValues != "skip" {
+		return fmt.Errorf("invalid -long-label-values %q", c.longLabelValues)
+	}
+	if c.maxLabelValueLength > 0 && c.maxLabelValueLength < 2*truncationSuffixLen && c.longLabelValues == "truncate" {
+		return fmt.Errorf("-max-label-value-length %d must be at least %d to truncate values to a prefix and a hash", c.maxLabelValueLength, 2*truncationSuffixLen)
+	}
+	if c.destErrorPolicy != "fail-fast" && c.destErrorPolicy != "continue" {
+		return fmt.Errorf("invalid -destination-error-policy %q", c.destErrorPolicy)
+	}
+
+	for _, s := range c.skipInstances {
+		re, err := regexp.Compile("^(?:" + s + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid -skip-instance %q: %s", s, err)
+		}
+		c.skipInstanceREs = append(c.skipInstanceREs, re)
+	}
+
+	if c.totalShards < 1 || c.shardOf < 0 || c.shardOf >= c.totalShards {
+		return fmt.Errorf("-shard-of %d must be in [0, -total-shards %d)", c.shardOf, c.totalShards)
+	}
+
+	if c.minSamplesPerSeries < 0 {
+		return fmt.Errorf("-min-samples-per-series %d must not be negative", c.minSamplesPerSeries)
+	}
+	if c.maxTotalSeries < 0 {
+		return fmt.Errorf("-max-total-series %d must not be negative", c.maxTotalSeries)
+	}
+	if c.maxMetricNames < 0 {
+		return fmt.Errorf("-max-metric-names %d must not be negative", c.maxMetricNames)
+	}
+	if c.maxTotalSeries > 0 {
+		c.deterministic = true
+	}
+	if c.deterministic {
+		c.maxParallelism = 1
+	}
+	if c.alignBlocks > 0 && c.alignBlocks%c.step != 0 {
+		return fmt.Errorf("-align-blocks %s must be a multiple of -step %s", c.alignBlocks, c.step)
+	}
+	if c.recentFirst < 0 {
+		return fmt.Errorf("-recent-first %s must not be negative", c.recentFirst)
+	}
+	if c.recentFirst > 0 {
+		c.reverse = true
+	}
+	if c.retryReportFile != "" && (c.incremental || c.resumeFromExisting || c.reverse) {
+		return errors.New("-retry-report cannot be used with -incremental, -resume-from-existing or -reverse")
+	}
+	if c.resumeFromExisting && (c.incremental || c.reverse || c.blocksPerWindow) {
+		return errors.New("-resume-from-existing cannot be used with -incremental, -reverse or -output-blocks-per-window")
+	}
+	if c.blocksPerWindow && (c.reverse || c.incremental || c.verifyBlocks || c.verifyValuesFlag || c.verifyCounterResets || c.verifyIndexFlag || c.reportGaps) {
+		return errors.New("-output-blocks-per-window cannot be used with -reverse, -incremental, -verify-blocks, -verify-values, -verify-counter-resets, -verify-index or -report-gaps")
+	}
+	if c.reverse {
+		// The blocks are written directly, so the range needs to consist of
+		// whole block ranges, and their end is exclusive.
+		if c.incremental || c.verifyBlocks || c.verifyValuesFlag || c.verifyCounterResets || c.verifyIndexFlag || c.reportGaps {
+			return errors.New("-reverse cannot be used with -incremental, -verify-blocks, -verify-values, -verify-counter-resets, -verify-index or -report-gaps")
+		}
+		if c.minBlockDuration%c.step != 0 || c.alignBlocks > 0 && c.alignBlocks%c.minBlockDuration != 0 {
+			return fmt.Errorf("-reverse requires -min-block-duration %s to be a multiple of -step %s and -align-blocks to be a multiple of it", c.minBlockDuration, c.step)
+		}
+		if c.alignBlocks == 0 {
+			c.alignBlocks = c.minBlockDuration
+		}
+		c.exclusiveEnd = true
+	}
+	if c.verifyValuesFraction <= 0 || c.verifyValuesFraction > 1 {
+		return fmt.Errorf("-verify-values-fraction %v must be in (0, 1]", c.verifyValuesFraction)
+	}
+	if c.sampleFraction <= 0 || c.sampleFraction > 1 {
+		return fmt.Errorf("-sample-fraction %v must be in (0, 1]", c.sampleFraction)
+	}
+	if c.compareURL != "" && (c.compareStep <= 0 || c.compareLookback <= 0) {
+		return errors.New("-compare-step and -compare-lookback must be positive")
+	}
+	if c.compareBearerTokenFile != "" {
+		b, err := ioutil.ReadFile(c.compareBearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("error reading -compare-bearer-token-file: %s", err)
+		}
+		c.compareToken = strings.TrimSpace(string(b))
+	}
+	if c.instanceRetries < 0 {
+		return fmt.Errorf("-instance-retries %d must not be negative", c.instanceRetries)
+	}
+	if (c.maxAppendErrors > 0 || c.maxAppendErrorRatio > 0) && (c.quarantineDir == "" || c.reverse) {
+		// Without a quarantine, the first rejected sample fails the
+		// step anyway.
+		return errors.New("-max-append-errors and -max-append-error-ratio require -quarantine-dir and cannot be used with -reverse")
+	}
+	if c.maxAppendErrorRatio < 0 || c.maxAppendErrorRatio > 1 {
+		return fmt.Errorf("-max-append-error-ratio %v must be in [0, 1]", c.maxAppendErrorRatio)
+	}
+	if c.cardinalityExplosionFactor < 0 || c.cardinalityExplosionFactor > 0 && c.cardinalityExplosionFactor <= 1 {
+		return fmt.Errorf("-cardinality-explosion-factor %v must be 0 or greater than 1", c.cardinalityExplosionFactor)
+	}
+	switch c.cardinalityExplosionAction {
+	case "abort":
+	case "quarantine":
+		if c.quarantineDir == "" {
+			return errors.New("-cardinality-explosion-action quarantine requires -quarantine-dir")
+		}
+	default:
+		return fmt.Errorf("-cardinality-explosion-action must be abort or quarantine, not %q", c.cardinalityExplosionAction)
+	}
+	if c.replayQuarantineFlag && (c.quarantineDir == "" || c.reverse) {
+		return errors.New("-replay-quarantine requires -quarantine-dir and cannot be used with -reverse")
+	}
+	if c.readBufferWindows < 0 {
+		return fmt.Errorf("-read-buffer-windows %d must not be negative", c.readBufferWindows)
+	}
+	if c.sourceSampleLimit < 0 {
+		return fmt.Errorf("-source-sample-limit %d must not be negative", c.sourceSampleLimit)
+	}
+	if c.sourceSampleLimit > 0 && c.readBufferWindows > 0 {
+		return errors.New("-source-sample-limit cannot be used with -read-buffer-windows")
+	}
+	if c.printResumeToken && c.reverse {
+		return errors.New("-print-resume-token cannot be used with -reverse")
+	}
+	if c.maxWindows < 0 {
+		return fmt.Errorf("-max-windows %d must not be negative", c.maxWindows)
+	}
+	if c.commitSamples < 0 || c.commitSeries < 0 {
+		return fmt.Errorf("-commit-samples %d and -commit-series %d must not be negative", c.commitSamples, c.commitSeries)
+	}
+	if c.detectOverlap && c.reverse {
+		return errors.New("-detect-window-overlap cannot be used with -reverse, which migrates older steps after newer ones")
+	}
+	if c.progressMode != "bar" && c.progressMode != "tui" {
+		return fmt.Errorf("invalid -progress %q", c.progressMode)
+	}
+	if c.etaModel != "linear" && c.etaModel != "throughput" && c.etaModel != "density-weighted" {
+		return fmt.Errorf("invalid -progress-eta-model %q", c.etaModel)
+	}
+	if c.reportFormat != "html" && c.reportFormat != "json" {
+		return fmt.Errorf("invalid -report-format %q", c.reportFormat)
+	}
+	if c.nanPolicy != "keep" && c.nanPolicy != "drop" && c.nanPolicy != "stale" {
+		return fmt.Errorf("invalid -nan-policy %q", c.nanPolicy)
+	}
+	if c.repeatedTolerance < 0 {
+		return fmt.Errorf("-drop-repeated-values-tolerance %v must not be negative", c.repeatedTolerance)
+	}
+	if c.dropRepeated && c.verifyValuesFlag {
+		return errors.New("-verify-values cannot be used with -drop-repeated-values, which changes the migrated samples")
+	}
+	if c.targetVersion != "" {
+		if err := checkTargetVersion(c.targetVersion); err != nil {
+			return fmt.Errorf("-target-prometheus-version: %s", err)
+		}
+	}
+	if c.progressFile != "" && c.progressFileInterval <= 0 {
+		return fmt.Errorf("-progress-file-interval %s must be positive", c.progressFileInterval)
+	}
+	if c.progressRemoteWriteURL != "" && c.progressRemoteWriteInterval <= 0 {
+		return fmt.Errorf("-progress-remote-write-interval %s must be positive", c.progressRemoteWriteInterval)
+	}
+	if labels.Labels(c.progressLabels).Get(model.MetricNameLabel) != "" {
+		return fmt.Errorf("-progress-label cannot set %s", model.MetricNameLabel)
+	}
+	if c.defaultJob != "" {
+		if err := c.defaultLabels.Set("job=" + c.defaultJob); err != nil {
+			return fmt.Errorf("invalid -default-job: %s", err)
+		}
+	}
+	for _, l := range c.defaultLabels {
+		if l.Name == model.MetricNameLabel || labels.Labels(c.externalLabels).Get(l.Name) != "" {
+			return fmt.Errorf("-default-label cannot set %s or a label given with -external-label", l.Name)
+		}
+	}
+	if c.minValidTime != 0 && c.maxValidTime != 0 && c.minValidTime > c.maxValidTime {
+		return fmt.Errorf("-min-valid-time %d must not be after -max-valid-time %d", c.minValidTime, c.maxValidTime)
+	}
+	if c.sourceLoadURL != "" && (c.sourceLoadLow > c.sourceLoadHigh || c.sourceLoadInterval <= 0) {
+		return fmt.Errorf("-source-load-low %v must not exceed -source-load-high %v and -source-load-interval %s must be positive", c.sourceLoadLow, c.sourceLoadHigh, c.sourceLoadInterval)
+	}
+	if c.roundTimestampsFlag < 0 || c.roundTimestampsFlag%time.Millisecond != 0 {
+		return fmt.Errorf("-round-timestamps %s must be a non-negative number of milliseconds", c.roundTimestampsFlag)
+	}
+	if c.expectTolerance < 0 {
+		return fmt.Errorf("-expect-tolerance %v must not be negative", c.expectTolerance)
+	}
+	if c.walFlushInterval < 0 {
+		return fmt.Errorf("-wal-flush-interval %s must not be negative", c.walFlushInterval)
+	}
+	if c.minBlockDuration < time.Millisecond || c.minBlockDuration%time.Millisecond != 0 {
+		return fmt.Errorf("-min-block-duration %s must be a positive number of milliseconds", c.minBlockDuration)
+	}
+	if !model.LabelName(c.shardLabel).IsValid() {
+		return fmt.Errorf("invalid -shard-label %q", c.shardLabel)
+	}
+
+	c.v2Dirs = []string{c.v2Dir}
+	if c.v2Shards < 1 {
+		return fmt.Errorf("-v2-shards %d must be positive", c.v2Shards)
+	}
+	if c.v2Shards > 1 {
+		// These write or read the blocks of a single v2 storage.
+		if c.reverse || c.blocksPerWindow || c.verifyBlocks || c.compactAfter || c.blockAuditFile != "" {
+			return errors.New("-v2-shards cannot be used with -reverse, -output-blocks-per-window, -verify-blocks, -compact-after or -block-audit-file")
+		}
+		if c.v2ShardDirTemplate == "" {
+			c.v2ShardDirTemplate = filepath.Join(c.v2Dir, "shard-%d")
+		}
+		dirs, err := shardDirs(c.v2ShardDirTemplate, c.v2Shards)
+		if err != nil {
+			return fmt.Errorf("invalid -v2-shard-dir-template: %s", err)
+		}
+		c.v2Dirs = dirs
+	}
+
+	if c.checkpointFile == "" {
+		c.checkpointFile = filepath.Join(c.v2Dir, "migrator.checkpoint")
+	}
+	if c.manifestFile == "" {
+		c.manifestFile = filepath.Join(c.v2Dir, "migrator.manifest")
+	}
+	if c.dumpIndexLabel == "" {
+		c.dumpIndexLabel = c.shardLabel
+	}
+
+	return nil
+}
+
+// dumpConfig writes the values of all flags of fs, including defaults and
+// values derived from other flags, as JSON to w. Passwords in URLs are
+// redacted.
+func dumpConfig(fs *flag.FlagSet, w io.Writer) error {
+	cfg := map[string]interface{}{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if s, ok := f.Value.(*stringSlice); ok {
+			vs := make([]string, 0, len(*s))
+			for _, v := range *s {
+				vs = append(vs, redactURL(v))
+			}
+			cfg[f.Name] = vs
+			return
+		}
+		cfg[f.Name] = redactURL(f.Value.String())
+	})
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// redactURL returns s with the password replaced if it is a URL with a
+// password, and s unchanged otherwise.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), redactedPassword)
+	return u.String()
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// Layout of the heads file of the v1 storage, see storage/local/heads.go.
+const (
+	v1HeadsMagic               = "PrometheusHeads"
+	v1HeadsFormatVersion       = 2
+	v1HeadsFormatLegacyVersion = 1
+	v1FlagHeadChunkPersisted   = 1
+)
+
+// countSampleEvery is how many of the chunks of a series file that lie
+// completely in the counted range share one whose samples are counted. The
+// samples of the others are extrapolated.
+const countSampleEvery = 100
+
+// sampleCount is the number of samples in a time range of the v1 storage,
+// counted from its chunks.
+type sampleCount struct {
+	series int
+	chunks int
+	// decoded is the number of chunks whose samples were counted, and
+	// decodedLen the number of samples in them.
+	decoded    int
+	decodedLen int
+	// exact is the number of samples in the range of the decoded chunks,
+	// and extrapolated the number of the other chunks in the range.
+	exact        int
+	extrapolated int
+}
+
+// samples returns the estimated number of samples in the range.
+func (c *sampleCount) samples() float64 {
+	if c.decoded == 0 {
+		return float64(c.exact)
+	}
+	return float64(c.exact) + float64(c.extrapolated)*float64(c.decodedLen)/float64(c.decoded)
+}
+
+// print writes the count in human readable form to w.
+func (c *sampleCount) print(w io.Writer) {
+	fmt.Fprintf(w, "Series:             %d\n", c.series)
+	fmt.Fprintf(w, "Chunks:             %d\n", c.chunks)
+	fmt.Fprintf(w, "Estimated samples:  %.0f\n", c.samples())
+	fmt.Fprintf(w, "\nThe samples of %d of %d chunks were counted, the others are extrapolated from them.\n", c.decoded, c.chunks)
+	fmt.Fprintln(w, "Series selection flags are not applied.")
+}
+
+// countSamples counts the series, chunks and samples in [from, through] in
+// the v1 storage directory dir from the chunk headers of the series files and
+// the chunks in the heads file, without loading the series into a v1
+// storage. Chunks that are only partly in the range and one in
+// countSampleEvery of the others are decoded.
+func countSamples(dir string, from, through model.Time) (*sampleCount, error) {
+	c := &sampleCount{}
+	series := map[model.Fingerprint]bool{}
+
+	// The chunks of the heads file that are persisted are in the series
+	// files, too, so only the others are counted here.
+	err := scanHeadChunks(filepath.Join(dir, v1HeadsFile), func(fp model.Fingerprint, ch chunk.Chunk) error {
+		last, err := ch.NewIterator().LastTimestamp()
+		if err != nil {
+			return err
+		}
+		if last.Before(from) || ch.FirstTime().After(through) {
+			return nil
+		}
+		series[fp] = true
+		return c.decode(ch, from, through)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading heads file: %s", err)
+	}
+
+	err = walkSeriesFiles(dir, func(fp model.Fingerprint, name string) error {
+		found, err := c.countSeriesFile(name, from, through)
+		if found {
+			series[fp] = true
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.series = len(series)
+	return c, nil
+}
+
+// walkSeriesFiles calls f with the fingerprint and path of every series file
+// in the v1 storage directory dir.
+func walkSeriesFiles(dir string, f func(model.Fingerprint, string) error) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || len(fi.Name()) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), v1SeriesFileSuffix) {
+				continue
+			}
+			fp, err := model.FingerprintFromString(fi.Name() + strings.TrimSuffix(file.Name(), v1SeriesFileSuffix))
+			if err != nil {
+				continue
+			}
+			if err := f(fp, filepath.Join(dir, fi.Name(), file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// countSeriesFile counts the chunks and samples in [from, through] of a
+// series file and returns whether it has any. A chunk the v1 storage is
+// still writing at the end of the file is left out.
+func (c *sampleCount) countSeriesFile(name string, from, through model.Time) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		found, sampled bool
+		full           int
+		header         = make([]byte, v1ChunkHeaderLen)
+		buf            = make([]byte, v1ChunkLenWithHeader)
+	)
+	for off := int64(0); off+v1ChunkLenWithHeader <= fi.Size(); off += v1ChunkLenWithHeader {
+		if _, err := f.ReadAt(header, off); err != nil {
+			return false, err
+		}
+		first := model.Time(binary.LittleEndian.Uint64(header[v1ChunkHeaderFirstTimeOffset:]))
+		last := model.Time(binary.LittleEndian.Uint64(header[v1ChunkHeaderLastTimeOffset:]))
+		if last.Before(from) || first.After(through) {
+			continue
+		}
+		found = true
+
+		// Chunks completely in the range only need to be decoded to
+		// know how many samples chunks of the series hold.
+		inside := !first.Before(from) && !last.After(through)
+		if inside {
+			full++
+			if sampled && full%countSampleEvery != 0 {
+				c.chunks++
+				c.extrapolated++
+				continue
+			}
+			sampled = true
+		}
+		if _, err := f.ReadAt(buf, off); err != nil {
+			return false, err
+		}
+		ch, err := chunk.NewForEncoding(chunk.Encoding(buf[0]))
+		if err != nil {
+			return false, fmt.Errorf("series file %s: %s", name, err)
+		}
+		if err := ch.UnmarshalFromBuf(buf[v1ChunkHeaderLen:]); err != nil {
+			return false, fmt.Errorf("series file %s: %s", name, err)
+		}
+		if err := c.decode(ch, from, through); err != nil {
+			return false, fmt.Errorf("series file %s: %s", name, err)
+		}
+	}
+	return found, nil
+}
+
+// stepDensity estimates how much data each of the steps of length step
+// holds in the v1 storage directory dir by the number of chunks in it. A
+// chunk is split between the steps it overlaps by the share of its time range
+// in each. Only the chunk headers of the series files are read, whose chunks
+// are counted as full, and the chunks of the heads file, which are counted by
+// how full they are, without decoding any samples. Series selection flags are
+// not applied.
+func stepDensity(dir string, steps []model.Time, step time.Duration) (map[model.Time]float64, error) {
+	sorted := make([]model.Time, len(steps))
+	copy(sorted, steps)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	density := make(map[model.Time]float64, len(steps))
+	add := func(first, last model.Time, weight float64) {
+		// The first step that ends after the start of the chunk.
+		i := sort.Search(len(sorted), func(i int) bool { return sorted[i].Add(step) > first })
+		span := float64(last-first) + 1
+		for ; i < len(sorted) && !sorted[i].After(last); i++ {
+			from, through := sorted[i], sorted[i].Add(step)-1
+			if from.Before(first) {
+				from = first
+			}
+			if through.After(last) {
+				through = last
+			}
+			density[sorted[i]] += weight * (float64(through-from) + 1) / span
+		}
+	}
+
+	err := scanHeadChunks(filepath.Join(dir, v1HeadsFile), func(_ model.Fingerprint, ch chunk.Chunk) error {
+		last, err := ch.NewIterator().LastTimestamp()
+		if err != nil {
+			return err
+		}
+		add(ch.FirstTime(), last, ch.Utilization())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading heads file: %s", err)
+	}
+
+	header := make([]byte, v1ChunkHeaderLen)
+	err = walkSeriesFiles(dir, func(_ model.Fingerprint, name string) error {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		for off := int64(0); off+v1ChunkLenWithHeader <= fi.Size(); off += v1ChunkLenWithHeader {
+			if _, err := f.ReadAt(header, off); err != nil {
+				return err
+			}
+			add(
+				model.Time(binary.LittleEndian.Uint64(header[v1ChunkHeaderFirstTimeOffset:])),
+				model.Time(binary.LittleEndian.Uint64(header[v1ChunkHeaderLastTimeOffset:])),
+				1,
+			)
+		}
+		return nil
+	})
+	return density, err
+}
+
+// decode counts the samples of ch in [from, through].
+func (c *sampleCount) decode(ch chunk.Chunk, from, through model.Time) error {
+	samples, err := chunk.RangeValues(ch.NewIterator(), metric.Interval{OldestInclusive: from, NewestInclusive: through})
+	if err != nil {
+		return err
+	}
+	c.chunks++
+	c.decoded++
+	c.decodedLen += ch.Len()
+	c.exact += len(samples)
+	return nil
+}
+
+// scanHeadChunks calls f for every chunk in the heads file name that has not
+// been persisted to a series file yet. A missing heads file has no chunks.
+func scanHeadChunks(name string, f func(model.Fingerprint, chunk.Chunk) error) error {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	magic := make([]byte, len(v1HeadsMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != v1HeadsMagic {
+		return fmt.Errorf("unexpected magic string %q", magic)
+	}
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return err
+	}
+	if version != v1HeadsFormatVersion && version != v1HeadsFormatLegacyVersion {
+		return fmt.Errorf("unknown format version %d", version)
+	}
+	total, err := codable.DecodeUint64(r)
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < total; i++ {
+		flags, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		fp, err := codable.DecodeUint64(r)
+		if err != nil {
+			return err
+		}
+		var m codable.Metric
+		if err := m.UnmarshalFromReader(r); err != nil {
+			return err
+		}
+		var persistWatermark int64
+		if version != v1HeadsFormatLegacyVersion {
+			// persistWatermark and modTime.
+			if persistWatermark, err = binary.ReadVarint(r); err != nil {
+				return err
+			}
+			if _, err := binary.ReadVarint(r); err != nil {
+				return err
+			}
+		}
+		// chunkDescsOffset and savedFirstTime.
+		for j := 0; j < 2; j++ {
+			if _, err := binary.ReadVarint(r); err != nil {
+				return err
+			}
+		}
+		numChunkDescs, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		if version == v1HeadsFormatLegacyVersion {
+			persistWatermark = numChunkDescs - 1
+			if flags&v1FlagHeadChunkPersisted != 0 {
+				persistWatermark = numChunkDescs
+			}
+		}
+
+		for j := int64(0); j < numChunkDescs; j++ {
+			if j < persistWatermark {
+				// The first and last time of a persisted chunk.
+				for k := 0; k < 2; k++ {
+					if _, err := binary.ReadVarint(r); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			encoding, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			ch, err := chunk.NewForEncoding(chunk.Encoding(encoding))
+			if err != nil {
+				return err
+			}
+			if err := ch.Unmarshal(r); err != nil {
+				return err
+			}
+			if err := f(model.Fingerprint(fp), ch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestCountSamplesHeadChunks(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, time.Hour))
+	defer removeV1()
+
+	for _, tc := range []struct {
+		from, through model.Time
+		want          float64
+	}{
+		{from: testStart.Add(-time.Hour), through: testStart.Add(2 * time.Hour), want: 4 * 240},
+		{from: testStart.Add(10 * time.Minute), through: testStart.Add(20*time.Minute) - 1, want: 4 * 40},
+	} {
+		c, err := countSamples(v1Dir, tc.from, tc.through)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The chunks of the heads file are all decoded.
+		if c.series != 4 || c.samples() != tc.want || c.decoded != c.chunks {
+			t.Errorf("[%v, %v]: got %d series and %v samples with %d of %d chunks decoded, want 4 series and %v samples with all decoded", tc.from, tc.through, c.series, c.samples(), c.decoded, c.chunks, tc.want)
+		}
+	}
+}
+
+func TestCountSamplesSeriesFiles(t *testing.T) {
+	v1Dir, removeV1 := tempDir(t)
+	defer removeV1()
+	// A week of samples every 15s, with some jitter in the values so that
+	// the chunks are not all the same size.
+	var samples []model.SamplePair
+	for i := 0; i < 7*24*240; i++ {
+		samples = append(samples, model.SamplePair{
+			Timestamp: testStart.Add(time.Duration(i) * 15 * time.Second),
+			Value:     model.SampleValue(i % 97),
+		})
+	}
+	for _, instance := range testInstances(2) {
+		writeTestSeriesFile(t, v1Dir, model.Metric{model.MetricNameLabel: "test_metric", model.InstanceLabel: model.LabelValue(instance)}, samples)
+	}
+
+	for _, tc := range []struct {
+		from, through model.Time
+		want          float64
+	}{
+		{from: testStart, through: testStart.Add(7 * 24 * time.Hour), want: 2 * 7 * 24 * 240},
+		{from: testStart.Add(24*time.Hour + 7*time.Minute), through: testStart.Add(3*24*time.Hour) - 1, want: 2 * (2*24*240 - 28)},
+	} {
+		c, err := countSamples(v1Dir, tc.from, tc.through)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.series != 2 {
+			t.Errorf("[%v, %v]: got %d series, want 2", tc.from, tc.through, c.series)
+		}
+		if c.decoded >= c.chunks {
+			t.Errorf("[%v, %v]: all %d chunks decoded, want some extrapolated", tc.from, tc.through, c.chunks)
+		}
+		if got := c.samples(); math.Abs(got-tc.want)/tc.want > 0.01 {
+			t.Errorf("[%v, %v]: got %.0f samples, want %.0f within 1%%", tc.from, tc.through, got, tc.want)
+		}
+	}
+}
+
+func TestCountOnly(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	var code int
+	out := captureStdout(t, func() {
+		code = runMain("count", "-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()))
+	})
+	if code != 0 {
+		t.Fatalf("count exited with %d", code)
+	}
+	for _, want := range []string{"Series:             4\n", "Estimated samples:  960\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("got output %q, want it to contain %q", out, want)
+		}
+	}
+}
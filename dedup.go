@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// skipExisting drops the samples of s that are not newer than the latest
+// sample the v2 storage already holds for it in the range of q, which spans
+// from the start of the step to m.dedupUntil.
+func (m *migrator) skipExisting(q tsdb.Querier, s *series) error {
+	maxt, err := latestSample(q, s.labels)
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(s.samples), func(i int) bool {
+		return int64(s.samples[i].Timestamp) > maxt
+	})
+	atomic.AddUint64(&m.skippedExisting, uint64(i))
+	s.samples = s.samples[i:]
+	return nil
+}
+
+// latestSample returns the timestamp of the latest sample of the series with
+// exactly the labels ls, or math.MinInt64 if there is none.
+func latestSample(q tsdb.Querier, ls labels.Labels) (int64, error) {
+	ms := make([]labels.Matcher, 0, len(ls))
+	for _, l := range ls {
+		ms = append(ms, labels.NewEqualMatcher(l.Name, l.Value))
+	}
+
+	maxt := int64(math.MinInt64)
+	set := q.Select(ms...)
+	for set.Next() {
+		if !set.At().Labels().Equals(ls) {
+			continue
+		}
+		it := set.At().Iterator()
+		for it.Next() {
+			if t, _ := it.At(); t > maxt {
+				maxt = t
+			}
+		}
+		if err := it.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return maxt, set.Err()
+}
+
+// latestStoredSample returns the timestamp of the latest sample of any series
+// in db in [mint, maxt], and false if there is none.
+func latestStoredSample(db queryable, mint, maxt model.Time) (model.Time, bool, error) {
+	q, err := db.Querier(int64(mint), int64(maxt))
+	if err != nil {
+		return 0, false, err
+	}
+	defer q.Close()
+
+	named, err := labels.NewRegexpMatcher(model.MetricNameLabel, ".+")
+	if err != nil {
+		return 0, false, err
+	}
+	latest := int64(math.MinInt64)
+	set := q.Select(named)
+	for set.Next() {
+		it := set.At().Iterator()
+		for it.Next() {
+			if t, _ := it.At(); t > latest && t >= int64(mint) && t <= int64(maxt) {
+				latest = t
+			}
+		}
+		if err := it.Err(); err != nil {
+			return 0, false, err
+		}
+	}
+	if err := set.Err(); err != nil {
+		return 0, false, err
+	}
+	return model.Time(latest), latest != math.MinInt64, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIncremental(t *testing.T) {
+	base, removeBase := newTestV1Dir(t, testSamples(testInstances(1), 2, time.Hour))
+	defer removeBase()
+	// The source of the incremental migration has an hour of new samples.
+	full, removeFull := newTestV1Dir(t, testSamples(testInstances(1), 2, 2*time.Hour))
+	defer removeFull()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	runMain(
+		"-v1-dir", base, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+	)
+	logs := captureStderr(t, func() {
+		runMain(
+			"-v1-dir", full, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "2h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(2*time.Hour).Unix()),
+			"-incremental", "-incremental-safety-margin", "5m",
+		)
+	})
+
+	l := logLine(logs, "Migrating incrementally")
+	if l == "" {
+		t.Fatalf("incremental migration did not use the manifest, logs:\n%s", logs)
+	}
+	// Only the 5m safety margin of samples already present is read again.
+	if got, want := logValue(logLine(logs, "Skipped samples already present in v2 storage"), "samples"), "40"; got != want {
+		t.Errorf("skipped %q samples already present, want %s", got, want)
+	}
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 2 {
+		t.Fatalf("got %d series, want 2", len(got))
+	}
+	for ls, ts := range got {
+		if len(ts) != 480 || len(distinct(ts)) != 480 {
+			t.Errorf("series %s has %d samples at %d timestamps, want 480", ls, len(ts), len(distinct(ts)))
+		}
+	}
+}
+
+func TestResumeFromExisting(t *testing.T) {
+	base, removeBase := newTestV1Dir(t, testSamples(testInstances(1), 2, 3*time.Hour))
+	defer removeBase()
+	full, removeFull := newTestV1Dir(t, testSamples(testInstances(1), 2, 4*time.Hour))
+	defer removeFull()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	if code := runMain(
+		"-v1-dir", base, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "3h", "-min-block-duration", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(3*time.Hour).Unix()),
+	); code != 0 {
+		t.Fatalf("first migration exited with %d", code)
+	}
+	// The manifest is not needed.
+	if err := os.Remove(filepath.Join(v2Dir, "migrator.manifest")); err != nil {
+		t.Fatal(err)
+	}
+	end, err := latestBlockEnd([]string{v2Dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end == 0 {
+		t.Fatal("the first migration wrote no blocks")
+	}
+
+	logs := captureStderr(t, func() {
+		if code := runMain(
+			"-v1-dir", full, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "4h", "-min-block-duration", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(4*time.Hour).Unix()),
+			"-resume-from-existing", "-incremental-safety-margin", "5m",
+		); code != 0 {
+			t.Fatalf("resumed migration exited with %d", code)
+		}
+	})
+	l := logLine(logs, "Resuming after latest v2 block")
+	if got, want := logValue(l, "start"), end.Add(-5*time.Minute).String(); got != want {
+		t.Errorf("resumed at %q, want %s, logs:\n%s", got, want, logs)
+	}
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 2 {
+		t.Fatalf("got %d series, want 2", len(got))
+	}
+	for ls, ts := range got {
+		if len(distinct(ts)) != 960 {
+			t.Errorf("series %s has samples at %d timestamps, want 960", ls, len(distinct(ts)))
+		}
+	}
+}
+
+func TestResumeVerify(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 2, 2*time.Hour))
+	defer removeV1()
+	end := testStart.Add(2 * time.Hour)
+
+	for _, verify := range []bool{false, true} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		args := []string{
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "2h",
+			"-end-timestamp", fmt.Sprint(end.Unix()), "-resume-safety-margin", "0",
+		}
+		if code := runMain(append(args, "-max-windows", "3")...); code != 0 {
+			t.Fatalf("first run exited with %d", code)
+		}
+		// The checkpoint claims three more steps than the v2 storage has.
+		path := filepath.Join(v2Dir, "migrator.checkpoint")
+		cp, err := readCheckpoint(path)
+		if err != nil || cp == nil || cp.Next != testStart.Add(30*time.Minute) {
+			t.Fatalf("got checkpoint %+v and error %v, want one after 3 steps", cp, err)
+		}
+		cp.Next = testStart.Add(time.Hour)
+		if err := writeCheckpoint(path, *cp); err != nil {
+			t.Fatal(err)
+		}
+
+		if verify {
+			args = append(args, "-resume-verify")
+		}
+		logs := captureStderr(t, func() {
+			if code := runMain(args...); code != 0 {
+				t.Fatalf("verify %v: resumed run exited with %d", verify, code)
+			}
+		})
+		l := logLine(logs, "v2 storage has no samples of the last step before the checkpoint, migrating again from the step of its latest sample")
+		if verify && logValue(l, "from") != testStart.Add(20*time.Minute).String() {
+			t.Errorf("got log line %q, want the resume point rewound to the step of the latest sample", l)
+		}
+		want := 480
+		if !verify {
+			// The three steps are lost.
+			want = 480 - 3*40
+		}
+		got := storedTimestamps(t, v2Dir)
+		if len(got) != 2 {
+			t.Fatalf("verify %v: got %d series, want 2", verify, len(got))
+		}
+		for ls, ts := range got {
+			if len(ts) != want || len(distinct(ts)) != want {
+				t.Errorf("verify %v: series %s has %d samples at %d timestamps, want %d", verify, ls, len(ts), len(distinct(ts)), want)
+			}
+		}
+	}
+}
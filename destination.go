@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// appendable is a storage that migrated samples can be appended to.
+type appendable interface {
+	Appender() tsdb.Appender
+}
+
+// destination is a named storage that migrated samples are written to.
+type destination struct {
+	// errors counts failed steps. Accessed atomically, keep it first for
+	// alignment on 32-bit platforms.
+	errors uint64
+
+	name    string
+	storage appendable
+}
+
+// fanout is an appendable that writes every sample to all destinations.
+type fanout struct {
+	dests    []*destination
+	failFast bool
+	logger   log.Logger
+}
+
+func (f *fanout) Appender() tsdb.Appender {
+	a := &fanoutAppender{
+		fanout: f,
+		apps:   make([]tsdb.Appender, len(f.dests)),
+		failed: make([]bool, len(f.dests)),
+	}
+	for i, d := range f.dests {
+		a.apps[i] = d.storage.Appender()
+	}
+	return a
+}
+
+// fanoutAppender appends to one appender per destination. If failFast is
+// not set, a destination that fails is skipped for the remainder of the
+// transaction while the others continue to receive all data. A sample a
+// destination rejects, e.g. because it is out of order, does not fail the
+// destination but is returned to the caller as a *rejectedError naming the
+// destinations that rejected it, so that it can be quarantined for them.
+type fanoutAppender struct {
+	*fanout
+	apps   []tsdb.Appender
+	failed []bool
+}
+
+func (a *fanoutAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	return a.add(nil, l, t, v)
+}
+
+// addTo appends a sample to the destinations with the given names only, e.g.
+// to replay a quarantined sample that only they rejected.
+func (a *fanoutAppender) addTo(names []string, l labels.Labels, t int64, v float64) (uint64, error) {
+	configured := make(map[string]bool, len(a.dests))
+	for _, d := range a.dests {
+		configured[d.name] = true
+	}
+	only := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !configured[name] {
+			return 0, fmt.Errorf("destination %s is not configured", name)
+		}
+		only[name] = true
+	}
+	return a.add(only, l, t, v)
+}
+
+// add appends a sample to the destinations in only, or to all if it is nil.
+func (a *fanoutAppender) add(only map[string]bool, l labels.Labels, t int64, v float64) (uint64, error) {
+	var (
+		rejected *rejectedError
+		accepted bool
+	)
+	for i, app := range a.apps {
+		if a.failed[i] || only != nil && !only[a.dests[i].name] {
+			continue
+		}
+		_, err := app.Add(l, t, v)
+		if err == nil {
+			accepted = true
+			continue
+		}
+		if rejectedSample(err) {
+			if rejected == nil {
+				rejected = &rejectedError{}
+			}
+			rejected.errs = append(rejected.errs, &destinationError{name: a.dests[i].name, err: err})
+			continue
+		}
+		if err := a.fail(i, err); err != nil {
+			return 0, err
+		}
+	}
+	if rejected != nil {
+		rejected.partial = accepted
+		return 0, rejected
+	}
+	return 0, nil
+}
+
+func (a *fanoutAppender) AddFast(ref uint64, t int64, v float64) error {
+	return tsdb.ErrNotFound
+}
+
+func (a *fanoutAppender) Commit() error {
+	var errs tsdb.MultiError
+	for i, app := range a.apps {
+		if a.failed[i] {
+			continue
+		}
+		if err := app.Commit(); err != nil {
+			errs.Add(a.fail(i, err))
+		}
+	}
+	return errs.Err()
+}
+
+func (a *fanoutAppender) Rollback() error {
+	var errs tsdb.MultiError
+	for i, app := range a.apps {
+		if !a.failed[i] {
+			errs.Add(app.Rollback())
+		}
+	}
+	return errs.Err()
+}
+
+// anyFailed reports whether a destination failed in the transaction, which
+// is then missing its samples.
+func (a *fanoutAppender) anyFailed() bool {
+	for _, f := range a.failed {
+		if f {
+			return true
+		}
+	}
+	return false
+}
+
+// fail handles an error of the i-th destination. It returns the error if the
+// transaction should be aborted.
+func (a *fanoutAppender) fail(i int, err error) error {
+	d := a.dests[i]
+	err = &destinationError{name: d.name, err: err}
+	if a.failFast {
+		return err
+	}
+	a.failed[i] = true
+	atomic.AddUint64(&d.errors, 1)
+	level.Error(a.logger).Log("msg", "error writing to destination, skipping it for this step", "err", err)
+	a.apps[i].Rollback()
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// testStorage is an appendable that records the committed samples by the
+// string form of their labels. If err is set, its appenders fail every Add
+// with it.
+type testStorage struct {
+	err error
+
+	mtx        sync.Mutex
+	samples    map[string][]model.SamplePair
+	rolledBack bool
+}
+
+func (s *testStorage) Appender() tsdb.Appender { return &testAppender{s: s} }
+
+type testAppender struct {
+	s     *testStorage
+	added map[string][]model.SamplePair
+}
+
+func (a *testAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	if a.s.err != nil {
+		return 0, a.s.err
+	}
+	if a.added == nil {
+		a.added = map[string][]model.SamplePair{}
+	}
+	a.added[l.String()] = append(a.added[l.String()], model.SamplePair{Timestamp: model.Time(t), Value: model.SampleValue(v)})
+	return 0, nil
+}
+
+func (a *testAppender) AddFast(ref uint64, t int64, v float64) error { return tsdb.ErrNotFound }
+
+func (a *testAppender) Commit() error {
+	a.s.mtx.Lock()
+	defer a.s.mtx.Unlock()
+	if a.s.samples == nil {
+		a.s.samples = map[string][]model.SamplePair{}
+	}
+	for ls, samples := range a.added {
+		a.s.samples[ls] = append(a.s.samples[ls], samples...)
+	}
+	a.added = nil
+	return nil
+}
+
+func (a *testAppender) Rollback() error {
+	a.s.mtx.Lock()
+	a.s.rolledBack = true
+	a.s.mtx.Unlock()
+	a.added = nil
+	return nil
+}
+
+// numSamples returns the number of committed samples of s.
+func (s *testStorage) numSamples() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	n := 0
+	for _, samples := range s.samples {
+		n += len(samples)
+	}
+	return n
+}
+
+func TestFanoutWritesAllDestinations(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 3, time.Hour))
+	defer closeV1()
+
+	a, b := &testStorage{}, &testStorage{}
+	f := &fanout{
+		dests:    []*destination{{name: "a", storage: a}, {name: "b", storage: b}},
+		failFast: true,
+		logger:   log.NewNopLogger(),
+	}
+	if err := migrateTestInstance(newTestMigrator(v1, f), "host0:9090", testStart, testStart.Add(time.Hour)-1); err != nil {
+		t.Fatal(err)
+	}
+	if n := a.numSamples(); n != 3*240 {
+		t.Fatalf("got %d samples, want %d", n, 3*240)
+	}
+	if !reflect.DeepEqual(a.samples, b.samples) {
+		t.Error("destinations received different data")
+	}
+}
+
+func TestFanoutDestinationErrorPolicy(t *testing.T) {
+	for _, failFast := range []bool{true, false} {
+		failing, ok := &testStorage{err: errors.New("connection refused")}, &testStorage{}
+		f := &fanout{
+			dests:    []*destination{{name: "failing", storage: failing}, {name: "ok", storage: ok}},
+			failFast: failFast,
+			logger:   log.NewNopLogger(),
+		}
+		app := f.Appender()
+		for ts := int64(1000); ts <= 3000; ts += 1000 {
+			_, err := app.Add(labels.FromStrings("__name__", "up"), ts, 1)
+			if failFast && err == nil {
+				t.Fatal("fail-fast: adding to a failing destination succeeded")
+			}
+			if !failFast && err != nil {
+				t.Fatalf("continue: got error %v, want the failing destination to be skipped", err)
+			}
+		}
+		if failFast {
+			continue
+		}
+		if err := app.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if n := ok.numSamples(); n != 3 {
+			t.Errorf("continue: other destination got %d samples, want 3", n)
+		}
+		if f.dests[0].errors != 1 || !failing.rolledBack {
+			t.Errorf("continue: failing destination has %d errors and rolled back %v, want 1 and true", f.dests[0].errors, failing.rolledBack)
+		}
+	}
+}
+
+func TestFanoutAppenderRejectedSample(t *testing.T) {
+	for _, failFast := range []bool{false, true} {
+		rejecting, ok := &testStorage{err: tsdb.ErrOutOfOrderSample}, &testStorage{}
+		f := &fanout{
+			dests:    []*destination{{name: "v2", storage: rejecting}, {name: "remote", storage: ok}},
+			failFast: failFast,
+			logger:   log.NewNopLogger(),
+		}
+		app := f.Appender()
+		_, err := app.Add(labels.FromStrings("__name__", "up"), 1000, 1)
+		if !rejectedSample(err) {
+			t.Fatalf("failFast %v: got error %v, want a rejected sample", failFast, err)
+		}
+		if _, err := app.Add(labels.FromStrings("__name__", "up"), 2000, 1); !rejectedSample(err) {
+			t.Fatalf("failFast %v: got error %v for second sample, want a rejected sample", failFast, err)
+		}
+		fa := app.(*fanoutAppender)
+		if fa.anyFailed() || f.dests[0].errors > 0 || rejecting.rolledBack {
+			t.Fatalf("failFast %v: destination failed for a rejected sample", failFast)
+		}
+		if err := app.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if ok.numSamples() != 2 {
+			t.Fatalf("failFast %v: other destination committed %d samples, want 2", failFast, ok.numSamples())
+		}
+	}
+}
+
+func TestFanoutAppenderDestinationFailure(t *testing.T) {
+	failing, ok := &testStorage{err: errors.New("connection refused")}, &testStorage{}
+	f := &fanout{
+		dests:  []*destination{{name: "v2", storage: failing}, {name: "remote", storage: ok}},
+		logger: log.NewNopLogger(),
+	}
+	app := f.Appender()
+	if _, err := app.Add(labels.FromStrings("__name__", "up"), 1000, 1); err != nil {
+		t.Fatalf("got error %v, want the failing destination to be skipped", err)
+	}
+	if !app.(*fanoutAppender).anyFailed() || f.dests[0].errors != 1 || !failing.rolledBack {
+		t.Fatal("failing destination was not failed")
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if ok.numSamples() != 1 {
+		t.Fatalf("other destination committed %d samples, want 1", ok.numSamples())
+	}
+}
+
+func TestCommitSkipsFailedDestination(t *testing.T) {
+	f := &fanout{
+		dests:  []*destination{{name: "v2", storage: &testStorage{err: errors.New("connection refused")}}},
+		logger: log.NewNopLogger(),
+	}
+	m := &migrator{}
+	app := f.Appender()
+	app.Add(labels.FromStrings("__name__", "up"), 1000, 1)
+	if err := m.commit(app, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if m.appended != 0 {
+		t.Fatalf("got %d appended samples, want 0 for a failed destination", m.appended)
+	}
+
+	f.dests[0].storage = &testStorage{}
+	app = f.Appender()
+	app.Add(labels.FromStrings("__name__", "up"), 1000, 1)
+	if err := m.commit(app, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if m.appended != 1 {
+		t.Fatalf("got %d appended samples, want 1", m.appended)
+	}
+}
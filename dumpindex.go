@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// dumpIndex writes all label names of the series in the v1 storage with
+// their numbers of values and series to w, followed by the values of label
+// with their numbers of series.
+func dumpIndex(v1Storage *local.MemorySeriesStorage, label model.LabelName, w io.Writer) error {
+	// The v1 storage has no index of label names, so collect them from the
+	// metrics of all series.
+	matcher, err := metric.NewLabelMatcher(metric.RegexMatch, model.MetricNameLabel, ".+")
+	if err != nil {
+		return err
+	}
+	metrics, err := v1Storage.MetricsForLabelMatchers(context.Background(), model.Earliest, model.Latest, metric.LabelMatchers{matcher})
+	if err != nil {
+		return err
+	}
+
+	var (
+		names       = map[model.LabelName]map[model.LabelValue]int{}
+		nameSeries  = map[model.LabelName]int{}
+		labelValues = map[model.LabelValue]int{}
+	)
+	for _, m := range metrics {
+		for n, v := range m.Metric {
+			if names[n] == nil {
+				names[n] = map[model.LabelValue]int{}
+			}
+			names[n][v]++
+			nameSeries[n]++
+			if n == label {
+				labelValues[v]++
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "Series: %d\n\nLabel names:\n", len(metrics))
+	sortedNames := make(model.LabelNames, 0, len(names))
+	for n := range names {
+		sortedNames = append(sortedNames, n)
+	}
+	sort.Sort(sortedNames)
+	for _, n := range sortedNames {
+		fmt.Fprintf(w, "  %s\tvalues=%d\tseries=%d\n", n, len(names[n]), nameSeries[n])
+	}
+
+	fmt.Fprintf(w, "\nValues of %s:\n", label)
+	values := make(model.LabelValues, 0, len(labelValues))
+	for v := range labelValues {
+		values = append(values, v)
+	}
+	sort.Sort(values)
+	for _, v := range values {
+		fmt.Fprintf(w, "  %q\tseries=%d\n", v, labelValues[v])
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDumpIndex(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(2), 3, 10*time.Minute))
+	defer closeV1()
+
+	var buf bytes.Buffer
+	if err := dumpIndex(v1, "idx", &buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `Series: 6
+
+Label names:
+  __name__	values=1	series=6
+  idx	values=3	series=6
+  instance	values=2	series=6
+
+Values of idx:
+  "0"	series=2
+  "1"	series=2
+  "2"	series=2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got index dump\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+)
+
+var (
+	// ErrSourceUnavailable is the reason of a failure to read from the v1
+	// storage.
+	ErrSourceUnavailable = errors.New("v1 storage unavailable")
+	// ErrDestinationFull is the reason of a failure to write to a
+	// destination that has run out of disk space.
+	ErrDestinationFull = errors.New("destination full")
+	// ErrCardinalityExplosion is the reason of a failure because a step of
+	// an instance has many more series than the steps before.
+	ErrCardinalityExplosion = errors.New("cardinality explosion")
+)
+
+// WindowMigrationError is returned if the series of an instance could not be
+// migrated in the time window [From, Through].
+type WindowMigrationError struct {
+	Instance      model.LabelValue
+	From, Through model.Time
+	// Reason is ErrSourceUnavailable, ErrDestinationFull or
+	// ErrCardinalityExplosion if the failure is known to be one of them,
+	// and nil otherwise.
+	Reason error
+	Err    error
+}
+
+func (e *WindowMigrationError) Error() string {
+	msg := fmt.Sprintf("migrating %s from %s through %s", e.Instance, e.From, e.Through)
+	if e.Reason != nil {
+		msg += ": " + e.Reason.Error()
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Cause returns the reason of the failure if it is known, and the underlying
+// error otherwise. This is compatible with github.com/pkg/errors.Cause.
+func (e *WindowMigrationError) Cause() error {
+	if e.Reason != nil {
+		return e.Reason
+	}
+	return e.Err
+}
+
+// Retriable reports whether migrating the window again may succeed without
+// intervention. This is the case if reading from the v1 storage failed, while
+// a full destination or an unknown failure need to be looked at first.
+func (e *WindowMigrationError) Retriable() bool {
+	return e.Reason == ErrSourceUnavailable
+}
+
+// windowError returns a *WindowMigrationError for instance. Running out of
+// disk space is detected if reason is nil.
+func windowError(instance model.LabelValue, from, through model.Time, reason, err error) error {
+	if reason == nil && isNoSpace(err) {
+		reason = ErrDestinationFull
+	}
+	return &WindowMigrationError{
+		Instance: instance,
+		From:     from,
+		Through:  through,
+		Reason:   reason,
+		Err:      err,
+	}
+}
+
+// destinationFailed reports whether err is a failure to write to a
+// destination, which affects all instances alike.
+func destinationFailed(err error) bool {
+	e, ok := err.(*WindowMigrationError)
+	if !ok {
+		return false
+	}
+	if e.Reason == ErrDestinationFull {
+		return true
+	}
+	switch err := e.Err.(type) {
+	case *destinationError:
+		return true
+	case tsdb.MultiError:
+		for _, err := range err {
+			if _, ok := err.(*destinationError); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// destinationError is an error of writing to a destination.
+type destinationError struct {
+	name string
+	err  error
+}
+
+func (e *destinationError) Error() string {
+	return fmt.Sprintf("destination %s: %s", e.name, e.err)
+}
+
+func (e *destinationError) Cause() error {
+	return e.err
+}
+
+// rejectedError is the error of a sample that destinations rejected, e.g.
+// because it is out of order. If partial is set, the other destinations
+// appended it.
+type rejectedError struct {
+	errs    []*destinationError
+	partial bool
+}
+
+func (e *rejectedError) Error() string {
+	msgs := make([]string, 0, len(e.errs))
+	for _, err := range e.errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *rejectedError) Cause() error {
+	return e.errs[0]
+}
+
+// destinations returns the names of the destinations that rejected the
+// sample.
+func (e *rejectedError) destinations() []string {
+	names := make([]string, 0, len(e.errs))
+	for _, err := range e.errs {
+		names = append(names, err.name)
+	}
+	return names
+}
+
+// isNoSpace reports whether err, or any error it wraps, is caused by running
+// out of disk space.
+func isNoSpace(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case syscall.Errno:
+			return e == syscall.ENOSPC
+		case *os.PathError:
+			err = e.Err
+		case *os.LinkError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case tsdb.MultiError:
+			for _, err := range e {
+				if isNoSpace(err) {
+					return true
+				}
+			}
+			return false
+		case interface {
+			Cause() error
+		}:
+			c := e.Cause()
+			if c == err {
+				return false
+			}
+			err = c
+		default:
+			return false
+		}
+	}
+	return false
+}
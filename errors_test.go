@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/tsdb"
+)
+
+func TestWindowMigrationErrors(t *testing.T) {
+	noSpace := &os.PathError{Op: "write", Path: "wal/000001", Err: syscall.ENOSPC}
+	for _, tc := range []struct {
+		name       string
+		err        error
+		wantReason error
+	}{
+		{name: "destination full", err: noSpace, wantReason: ErrDestinationFull},
+		{name: "destination full in multi error", err: tsdb.MultiError{errors.New("closing"), noSpace}, wantReason: ErrDestinationFull},
+		{name: "unknown", err: errors.New("connection refused")},
+	} {
+		v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 1, 10*time.Minute))
+		m := newTestMigrator(v1, &fanout{
+			dests:    []*destination{{name: "remote", storage: &testStorage{err: tc.err}}},
+			failFast: true,
+			logger:   log.NewNopLogger(),
+		})
+		err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(10*time.Minute))
+		closeV1()
+
+		e, ok := err.(*WindowMigrationError)
+		if !ok {
+			t.Fatalf("%s: got error %#v, want a *WindowMigrationError", tc.name, err)
+		}
+		if e.Instance != "host0:9090" || e.From != testStart || e.Through != testStart.Add(10*time.Minute) {
+			t.Errorf("%s: got window %s from %s through %s, want host0:9090 from %s through %s", tc.name, e.Instance, e.From, e.Through, testStart, testStart.Add(10*time.Minute))
+		}
+		if e.Reason != tc.wantReason {
+			t.Errorf("%s: got reason %v, want %v", tc.name, e.Reason, tc.wantReason)
+		}
+		if e.Retriable() {
+			t.Errorf("%s: write failure is retriable", tc.name)
+		}
+	}
+}
+
+func TestWindowMigrationErrorSourceUnavailable(t *testing.T) {
+	dir, remove := newTestV1Dir(t, testSamples(testInstances(1), 1, 10*time.Minute))
+	defer remove()
+	v1 := local.NewMemorySeriesStorage(newTestV1Options(dir))
+	if err := v1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The series without an instance are selected with a regular
+	// expression matcher, which looks up label values in the v1 index.
+	// That fails once the storage is stopped.
+	if err := v1.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	err := migrateTestInstance(newTestMigrator(v1, &testStorage{}), "", testStart, testStart.Add(10*time.Minute))
+	e, ok := err.(*WindowMigrationError)
+	if !ok {
+		t.Fatalf("got error %#v, want a *WindowMigrationError", err)
+	}
+	if e.Reason != ErrSourceUnavailable || !e.Retriable() {
+		t.Errorf("got reason %v and retriable %v, want %v and true", e.Reason, e.Retriable(), ErrSourceUnavailable)
+	}
+}
+
+func TestFailStepDestinationFull(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 1, 20*time.Minute))
+	defer closeV1()
+	dir, remove := tempDir(t)
+	defer remove()
+
+	for _, tc := range []struct {
+		name     string
+		err      error
+		wantCode int
+	}{
+		{name: "destination full", err: &os.PathError{Op: "write", Path: "wal/000001", Err: syscall.ENOSPC}, wantCode: exitDestinationFull},
+		{name: "other error", err: errors.New("connection refused"), wantCode: 1},
+	} {
+		m := newTestMigrator(v1, &fanout{
+			dests:    []*destination{{name: "full", storage: &testStorage{err: tc.err}}},
+			failFast: true,
+			logger:   log.NewNopLogger(),
+		})
+		from := testStart.Add(10 * time.Minute)
+		err := migrateTestInstance(m, "host0:9090", from, testStart.Add(20*time.Minute)-1)
+		if err == nil {
+			t.Fatalf("%s: migrating to a failing destination succeeded", tc.name)
+		}
+
+		file := filepath.Join(dir, tc.name)
+		cp := checkpoint{Start: testStart, End: testStart.Add(20 * time.Minute), Next: from}
+		if code := failStep([]error{err}, file, &cp, log.NewNopLogger()); code != tc.wantCode {
+			t.Errorf("%s: got exit code %d, want %d", tc.name, code, tc.wantCode)
+		}
+		got, err := readCheckpoint(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.wantCode != exitDestinationFull {
+			if got != nil {
+				t.Errorf("%s: wrote checkpoint %+v, want none", tc.name, *got)
+			}
+			continue
+		}
+		if got == nil || *got != cp {
+			t.Errorf("%s: got checkpoint %+v, want %+v resuming at the failed step", tc.name, got, cp)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+const (
+	// estimateInstances and estimateWindows bound the number of instances
+	// and steps that are read to estimate a migration.
+	estimateInstances = 10
+	estimateWindows   = 4
+	// bytesPerSample is the typical size of a sample in a compacted v2
+	// block.
+	bytesPerSample = 1.4
+)
+
+// migrationEstimate is the extrapolated size and duration of a migration.
+type migrationEstimate struct {
+	instances, steps int
+	// sampled is the number of (instance, step) pairs that were read.
+	sampled int
+
+	series   float64
+	samples  float64
+	bytes    float64
+	duration time.Duration
+}
+
+// estimateMigration reads a few evenly spread steps of a few evenly spread
+// instances and extrapolates the totals for migrating all instances from
+// start to end, assuming that the data is distributed uniformly.
+func estimateMigration(m *migrator, instances model.LabelValues, start, end model.Time, step time.Duration, parallelism int) (*migrationEstimate, error) {
+	steps := int((end.Sub(start) + step - 1) / step)
+	e := &migrationEstimate{instances: len(instances), steps: steps}
+	if len(instances) == 0 || steps == 0 {
+		return e, nil
+	}
+
+	var (
+		series, samples, labelBytes int
+		elapsed                     time.Duration
+	)
+	for _, i := range spread(len(instances), estimateInstances) {
+		matchers, err := shardMatchers(m.shardLabel, instances[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range spread(steps, estimateWindows) {
+			from := start.Add(time.Duration(w) * step)
+			through := stepEnd(from, end, step, false)
+
+			begin := time.Now()
+			its, err := m.queryV1(from, through, matchers...)
+			if err != nil {
+				return nil, err
+			}
+			groups, err := m.previewTransform(its)
+			if err != nil {
+				return nil, err
+			}
+			for _, g := range groups {
+				s := readGroup(g, from, through)
+				if len(s.samples) == 0 {
+					continue
+				}
+				series++
+				samples += len(s.samples)
+				for _, l := range s.labels {
+					labelBytes += len(l.Name) + len(l.Value)
+				}
+			}
+			closeIterators(its)
+			elapsed += time.Since(begin)
+			e.sampled++
+		}
+	}
+
+	var (
+		n = float64(len(instances))
+		// Series are assumed to exist in all steps, while samples and
+		// reading time scale with the number of steps.
+		perPair = n * float64(steps) / float64(e.sampled)
+		perInst = n / float64(e.sampled)
+	)
+	e.series = float64(series) * perInst
+	e.samples = float64(samples) * perPair
+	e.bytes = e.samples*bytesPerSample + float64(labelBytes)*perInst
+	e.duration = time.Duration(float64(elapsed) * perPair / float64(parallelism))
+	return e, nil
+}
+
+// print writes the estimate in human readable form to w.
+func (e *migrationEstimate) print(w io.Writer) {
+	fmt.Fprintf(w, "Instances:          %d\n", e.instances)
+	fmt.Fprintf(w, "Steps:              %d\n", e.steps)
+	fmt.Fprintf(w, "Estimated series:   %.0f\n", e.series)
+	fmt.Fprintf(w, "Estimated samples:  %.0f\n", e.samples)
+	fmt.Fprintf(w, "Estimated size:     %.1f MiB\n", e.bytes/(1<<20))
+	fmt.Fprintf(w, "Estimated duration: %s\n", e.duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "\nThis is extrapolated from %d of %d instance steps assuming evenly distributed data.\n", e.sampled, e.instances*e.steps)
+	fmt.Fprintln(w, "Series churn, uneven instances and the time for writing to the v2 storage are not accounted for.")
+}
+
+// instanceVolume is the number of series and the extrapolated number of
+// samples of an instance in the migrated time range.
+type instanceVolume struct {
+	instance model.LabelValue
+	series   int
+	samples  float64
+}
+
+// instanceVolumes counts the series of every instance selected by m that
+// have samples from start to end and extrapolates their samples from a few
+// evenly spread steps like estimateMigration. The result is sorted by the
+// number of samples, largest first.
+func instanceVolumes(m *migrator, instances model.LabelValues, start, end model.Time, step time.Duration) ([]instanceVolume, error) {
+	steps := int((end.Sub(start) + step - 1) / step)
+	res := make([]instanceVolume, 0, len(instances))
+	for _, instance := range instances {
+		n, err := preflight(m, model.LabelValues{instance}, start, end)
+		if err != nil {
+			return nil, err
+		}
+		v := instanceVolume{instance: instance, series: n}
+
+		matchers, err := shardMatchers(m.shardLabel, instance)
+		if err != nil {
+			return nil, err
+		}
+		sampled := spread(steps, estimateWindows)
+		for _, w := range sampled {
+			from := start.Add(time.Duration(w) * step)
+			through := stepEnd(from, end, step, false)
+			its, err := m.queryV1(from, through, matchers...)
+			if err != nil {
+				return nil, err
+			}
+			groups, err := m.previewTransform(its)
+			if err != nil {
+				closeIterators(its)
+				return nil, err
+			}
+			for _, g := range groups {
+				v.samples += float64(len(readGroup(g, from, through).samples))
+			}
+			closeIterators(its)
+		}
+		if len(sampled) > 0 {
+			v.samples *= float64(steps) / float64(len(sampled))
+		}
+		res = append(res, v)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].samples > res[j].samples
+	})
+	return res, nil
+}
+
+// printInstanceVolumes writes the volumes in human readable form to w.
+func printInstanceVolumes(w io.Writer, volumes []instanceVolume) {
+	var series int
+	var samples float64
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tSERIES\tEST. SAMPLES")
+	for _, v := range volumes {
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\n", v.instance, v.series, v.samples)
+		series += v.series
+		samples += v.samples
+	}
+	fmt.Fprintf(tw, "total\t%d\t%.0f\n", series, samples)
+	tw.Flush()
+	fmt.Fprintf(w, "\nSamples are extrapolated from up to %d steps per instance assuming evenly distributed data.\n", estimateWindows)
+}
+
+// spread returns up to k indexes spread evenly over [0, n).
+func spread(n, k int) []int {
+	if n <= k {
+		k = n
+	}
+	idx := make([]int, 0, k)
+	for i := 0; i < k; i++ {
+		idx = append(idx, i*n/k)
+	}
+	return idx
+}
+
+// closeIterators releases the resources of the series iterators.
+func closeIterators(its []local.SeriesIterator) {
+	for _, it := range its {
+		it.Close()
+	}
+}
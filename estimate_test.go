@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestEstimateMigration(t *testing.T) {
+	instances := testInstances(20)
+	v1, closeV1 := newTestV1Storage(t, testSamples(instances, 2, 4*time.Hour))
+	defer closeV1()
+
+	values := make(model.LabelValues, len(instances))
+	for i, instance := range instances {
+		values[i] = model.LabelValue(instance)
+	}
+	e, err := estimateMigration(newTestMigrator(v1, nil), values, testStart, testStart.Add(4*time.Hour), 10*time.Minute, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.sampled != estimateInstances*estimateWindows {
+		t.Errorf("sampled %d instance steps, want %d", e.sampled, estimateInstances*estimateWindows)
+	}
+	for _, c := range []struct {
+		name      string
+		got, want float64
+	}{
+		{name: "series", got: e.series, want: 20 * 2},
+		{name: "samples", got: e.samples, want: 20 * 2 * 4 * 240},
+	} {
+		if math.Abs(c.got-c.want) > 0.1*c.want {
+			t.Errorf("estimated %.0f %s, want %.0f within 10%%", c.got, c.name, c.want)
+		}
+	}
+	if e.bytes < e.samples || e.duration <= 0 {
+		t.Errorf("estimated %.0f bytes and %s, want at least a byte per sample and a positive duration", e.bytes, e.duration)
+	}
+}
+
+func TestInstanceVolumes(t *testing.T) {
+	var samples []*model.Sample
+	for instance, n := range map[string]int{"host0:9090": 3, "host1:9090": 1, "host2:9090": 5} {
+		samples = append(samples, testSamples([]string{instance}, n, 4*time.Hour)...)
+	}
+	v1, closeV1 := newTestV1Storage(t, samples)
+	defer closeV1()
+
+	volumes, err := instanceVolumes(newTestMigrator(v1, nil), model.LabelValues{"host0:9090", "host1:9090", "host2:9090"}, testStart, testStart.Add(4*time.Hour), 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []instanceVolume{
+		{instance: "host2:9090", series: 5, samples: 5 * 4 * 240},
+		{instance: "host0:9090", series: 3, samples: 3 * 4 * 240},
+		{instance: "host1:9090", series: 1, samples: 4 * 240},
+	}
+	if len(volumes) != len(want) {
+		t.Fatalf("got volumes %v, want %v", volumes, want)
+	}
+	for i, v := range volumes {
+		if v.instance != want[i].instance || v.series != want[i].series || math.Abs(v.samples-want[i].samples) > 0.1*want[i].samples {
+			t.Errorf("got volume %+v at index %d, want %+v with samples within 10%%", v, i, want[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	printInstanceVolumes(&buf, volumes)
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) < 5 || !strings.HasPrefix(lines[1], "host2:9090") || !strings.HasPrefix(lines[4], "total") || !strings.Contains(lines[4], " 9 ") {
+		t.Errorf("got output %q, want the instances largest first and a total of 9 series", buf.String())
+	}
+}
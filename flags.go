@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// stringSlice is a flag.Value collecting the values of a repeatable flag.
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// labelsFlag is a flag.Value collecting sorted labels from a repeatable flag
+// of the form name=value.
+type labelsFlag labels.Labels
+
+func (f *labelsFlag) String() string {
+	return labels.Labels(*f).String()
+}
+
+func (f *labelsFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("%q is not of the form name=value", v)
+	}
+	name, value := v[:i], v[i+1:]
+	if !model.LabelName(name).IsValid() {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	if value == "" || !utf8.ValidString(value) {
+		return fmt.Errorf("invalid value %q of label %s", value, name)
+	}
+	ls := labels.Labels(*f)
+	if ls.Get(name) != "" {
+		return fmt.Errorf("label %s given more than once", name)
+	}
+	ls = append(ls, labels.Label{Name: name, Value: value})
+	sort.Sort(ls)
+	*f = labelsFlag(ls)
+	return nil
+}
+
+// byteSize is a flag.Value for a number of bytes that accepts a unit, e.g.
+// 2GiB or 500MB. A plain number is a number of bytes.
+type byteSize uint64
+
+// byteUnits are ordered from largest to smallest factor, binary before
+// decimal units.
+var byteUnits = []struct {
+	suffix string
+	factor uint64
+}{
+	{"TiB", 1 << 40}, {"TB", 1e12},
+	{"GiB", 1 << 30}, {"GB", 1e9},
+	{"MiB", 1 << 20}, {"MB", 1e6},
+	{"KiB", 1 << 10}, {"KB", 1e3},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	for _, u := range byteUnits {
+		if uint64(*b) >= u.factor && uint64(*b)%u.factor == 0 {
+			return strconv.FormatUint(uint64(*b)/u.factor, 10) + u.suffix
+		}
+	}
+	return "0B"
+}
+
+func (b *byteSize) Set(v string) error {
+	num, factor := strings.TrimSpace(v), uint64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, factor = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	if n > math.MaxUint64/factor {
+		return fmt.Errorf("size %q is too large", v)
+	}
+	*b = byteSize(n * factor)
+	return nil
+}
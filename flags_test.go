@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want byteSize
+		str  string
+	}{
+		{in: "0", want: 0, str: "0B"},
+		{in: "1024", want: 1024, str: "1KiB"},
+		{in: "1000", want: 1000, str: "1KB"},
+		{in: "2GiB", want: 2 << 30, str: "2GiB"},
+		{in: "500MB", want: 500e6, str: "500MB"},
+		{in: " 3 TiB ", want: 3 << 40, str: "3TiB"},
+		{in: "1500B", want: 1500, str: "1500B"},
+	} {
+		var b byteSize
+		if err := b.Set(tc.in); err != nil {
+			t.Errorf("%q: %s", tc.in, err)
+			continue
+		}
+		if b != tc.want {
+			t.Errorf("%q: got %d bytes, want %d", tc.in, b, tc.want)
+		}
+		if s := b.String(); s != tc.str {
+			t.Errorf("%q: got string %q, want %q", tc.in, s, tc.str)
+		}
+	}
+}
+
+func TestByteSizeInvalid(t *testing.T) {
+	for _, in := range []string{"", "GiB", "-1", "1.5GB", "2XB", "20000000TiB"} {
+		var b byteSize
+		if err := b.Set(in); err == nil {
+			t.Errorf("%q: got %d bytes, want an error", in, b)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// blockFormatVersion is the format version of the blocks the vendored v2
+// storage writes. All Prometheus 2 releases read it.
+const blockFormatVersion = 1
+
+var prometheusVersionRE = regexp.MustCompile(`^v?(\d+)\.(\d+)(?:\.(\d+))?$`)
+
+// checkTargetVersion returns an error if the blocks written by the v2
+// storage cannot be read by the given Prometheus version.
+func checkTargetVersion(version string) error {
+	m := prometheusVersionRE.FindStringSubmatch(version)
+	if m == nil {
+		return fmt.Errorf("invalid Prometheus version %q", version)
+	}
+	if major, _ := strconv.Atoi(m[1]); major != 2 {
+		return fmt.Errorf("blocks of format version %d can only be produced for Prometheus 2, not %s", blockFormatVersion, version)
+	}
+	return nil
+}
+
+// checkBlockVersions returns an error if any block in the v2 storage
+// directory has a format version other than blockFormatVersion.
+func checkBlockVersions(dir, target string) error {
+	metas, err := readBlockMetas(dir)
+	if err != nil {
+		return err
+	}
+	for _, m := range metas {
+		if m.Version != blockFormatVersion {
+			return fmt.Errorf("block %s has format version %d, which Prometheus %s cannot read", m.ULID, m.Version, target)
+		}
+	}
+	return nil
+}
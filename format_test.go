@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTargetPrometheusVersion(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 1, time.Hour))
+	defer removeV1()
+	for _, tc := range []struct {
+		version  string
+		wantCode int
+	}{
+		{version: "2.0.0"},
+		{version: "v2.3"},
+		{version: "1.8.2", wantCode: 2},
+		{version: "latest", wantCode: 2},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		var code int
+		captureStderr(t, func() {
+			code = runMain(
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+				"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+				"-min-block-duration", "30m", "-compact-after", "-target-prometheus-version", tc.version,
+			)
+		})
+		if code != tc.wantCode {
+			t.Fatalf("%s: got exit code %d, want %d", tc.version, code, tc.wantCode)
+		}
+		if code != 0 {
+			continue
+		}
+		dirs := blockDirs(t, v2Dir)
+		if len(dirs) == 0 {
+			t.Fatalf("%s: no blocks written", tc.version)
+		}
+		for _, dir := range dirs {
+			b, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var meta struct {
+				Version int `json:"version"`
+			}
+			if err := json.Unmarshal(b, &meta); err != nil {
+				t.Fatal(err)
+			}
+			if meta.Version != blockFormatVersion {
+				t.Errorf("%s: block %s declares format version %d, want %d", tc.version, dir, meta.Version, blockFormatVersion)
+			}
+		}
+	}
+}
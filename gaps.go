@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// gap is a time range in which an instance had no samples, although it had
+// samples before and after.
+type gap struct {
+	instance      model.LabelValue
+	from, through model.Time
+}
+
+type instanceGaps struct {
+	seenData            bool
+	inGap               bool
+	gapFrom, gapThrough model.Time
+}
+
+// gapTracker detects interior gaps in the data of each instance. Steps of an
+// instance have to be recorded in time order.
+type gapTracker struct {
+	mtx       sync.Mutex
+	instances map[model.LabelValue]*instanceGaps
+	gaps      []gap
+}
+
+func newGapTracker() *gapTracker {
+	return &gapTracker{instances: map[model.LabelValue]*instanceGaps{}}
+}
+
+// record registers the number of samples found for an instance in the step
+// [from, through].
+func (g *gapTracker) record(instance model.LabelValue, from, through model.Time, samples int) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	s, ok := g.instances[instance]
+	if !ok {
+		s = &instanceGaps{}
+		g.instances[instance] = s
+	}
+	if samples == 0 {
+		if !s.seenData {
+			return
+		}
+		if !s.inGap {
+			s.inGap, s.gapFrom = true, from
+		}
+		s.gapThrough = through
+		return
+	}
+	if s.inGap {
+		g.gaps = append(g.gaps, gap{instance: instance, from: s.gapFrom, through: s.gapThrough})
+		s.inGap = false
+	}
+	s.seenData = true
+}
+
+// report returns all gaps found so far, sorted by instance and time.
+func (g *gapTracker) report() []gap {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	res := append([]gap(nil), g.gaps...)
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].instance != res[j].instance {
+			return res[i].instance < res[j].instance
+		}
+		return res[i].from < res[j].from
+	})
+	return res
+}
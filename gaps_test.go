@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestReportGaps(t *testing.T) {
+	var samples []*model.Sample
+	for _, s := range testSamples(testInstances(2), 1, time.Hour) {
+		// host0:9090 is not scraped between 20m and 40m, host1:9090 only
+		// starts reporting at 30m, which is not a gap.
+		ts := s.Timestamp.Sub(testStart)
+		switch s.Metric[model.InstanceLabel] {
+		case "host0:9090":
+			if ts >= 20*time.Minute && ts < 40*time.Minute {
+				continue
+			}
+		case "host1:9090":
+			if ts < 30*time.Minute {
+				continue
+			}
+		}
+		samples = append(samples, s)
+	}
+	v1Dir, removeV1 := newTestV1Dir(t, samples)
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	logs := captureStderr(t, func() {
+		runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()), "-report-gaps",
+		)
+	})
+	if n := logValue(logLine(logs, "Gap report complete"), "gaps"); n != "1" {
+		t.Fatalf("got %q gaps, want 1, logs:\n%s", n, logs)
+	}
+	l := logLine(logs, "Gap in data")
+	if got := logValue(l, "instance"); got != "host0:9090" {
+		t.Errorf("got gap of instance %q, want host0:9090", got)
+	}
+	if got, want := logValue(l, "from"), testStart.Add(20*time.Minute).String(); got != want {
+		t.Errorf("got gap from %s, want %s", got, want)
+	}
+	if got, want := logValue(l, "through"), (testStart.Add(40*time.Minute) - 1).String(); got != want {
+		t.Errorf("got gap through %s, want %s", got, want)
+	}
+}
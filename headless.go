@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+)
+
+// Layout of the series files of the v1 storage, see
+// storage/local/persistence.go.
+const (
+	v1HeadsFile                  = "heads.db"
+	v1SeriesFileSuffix           = ".db"
+	v1ChunkHeaderLen             = 17
+	v1ChunkHeaderFirstTimeOffset = 1
+	v1ChunkHeaderLastTimeOffset  = 9
+	v1ChunkLenWithHeader         = chunk.ChunkLen + v1ChunkHeaderLen
+)
+
+// v1HeadsMissing returns whether the v1 storage directory dir has an index
+// but no heads file, as in archives made of the persisted chunks only.
+func v1HeadsMissing(dir string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(dir, index.LabelPairToFingerprintsDir)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, v1HeadsFile)); err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// archiveHeadlessSeries adds the series of the v1 storage directory dir
+// that have a series file but are neither in the heads file nor archived to
+// the archive indexes, so that the v1 storage finds them. Without the heads
+// file, it only knows about archived series. It returns the number of
+// series added.
+//
+// Samples that were only in head chunks are lost with the heads file.
+// Fingerprint mappings of colliding series are not restored.
+func archiveHeadlessSeries(dir string) (int, error) {
+	lpIndex, err := index.NewLabelPairFingerprintIndex(dir)
+	if err != nil {
+		return 0, err
+	}
+	metrics := map[model.Fingerprint]model.Metric{}
+	err = lpIndex.ForEach(func(kv index.KeyValueAccessor) error {
+		var (
+			lp  codable.LabelPair
+			fps codable.FingerprintSet
+		)
+		if err := kv.Key(&lp); err != nil {
+			return err
+		}
+		if err := kv.Value(&fps); err != nil {
+			return err
+		}
+		for fp := range fps {
+			m, ok := metrics[fp]
+			if !ok {
+				m = model.Metric{}
+				metrics[fp] = m
+			}
+			m[lp.Name] = lp.Value
+		}
+		return nil
+	})
+	if cerr := lpIndex.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading label pair index: %s", err)
+	}
+
+	fpIndex, err := index.NewFingerprintMetricIndex(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer fpIndex.Close()
+	trIndex, err := index.NewFingerprintTimeRangeIndex(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer trIndex.Close()
+
+	mapping := index.FingerprintMetricMapping{}
+	for fp, m := range metrics {
+		if _, ok, err := fpIndex.Lookup(fp); err != nil {
+			return 0, err
+		} else if ok {
+			continue
+		}
+		first, last, ok, err := seriesFileTimeRange(dir, fp)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		if err := trIndex.Put(codable.Fingerprint(fp), codable.TimeRange{First: first, Last: last}); err != nil {
+			return 0, err
+		}
+		mapping[fp] = m
+	}
+	if err := fpIndex.IndexBatch(mapping); err != nil {
+		return 0, err
+	}
+	return len(mapping), nil
+}
+
+// seriesFileTimeRange returns the time of the first and the last sample in
+// the series file of fp, read from the chunk headers. It returns false if
+// there is no series file or it is empty.
+func seriesFileTimeRange(dir string, fp model.Fingerprint) (first, last model.Time, ok bool, err error) {
+	s := fp.String()
+	f, err := os.Open(filepath.Join(dir, s[:2], s[2:]+v1SeriesFileSuffix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, false, nil
+		}
+		return 0, 0, false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if fi.Size() == 0 {
+		return 0, 0, false, nil
+	}
+	if fi.Size()%v1ChunkLenWithHeader != 0 {
+		return 0, 0, false, fmt.Errorf("size of series file %s is not a multiple of %d", f.Name(), v1ChunkLenWithHeader)
+	}
+
+	buf := make([]byte, v1ChunkHeaderLen)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return 0, 0, false, err
+	}
+	first = model.Time(binary.LittleEndian.Uint64(buf[v1ChunkHeaderFirstTimeOffset:]))
+	if _, err := f.ReadAt(buf, fi.Size()-v1ChunkLenWithHeader); err != nil {
+		return 0, 0, false, err
+	}
+	last = model.Time(binary.LittleEndian.Uint64(buf[v1ChunkHeaderLastTimeOffset:]))
+	return first, last, true, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+)
+
+// writeTestSeriesFile writes the samples of the series with the metric m as
+// persisted chunks to its series file in the v1 storage directory dir.
+func writeTestSeriesFile(t *testing.T, dir string, m model.Metric, samples []model.SamplePair) {
+	c, err := chunk.NewForEncoding(chunk.DoubleDelta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []chunk.Chunk{c}
+	for _, s := range samples {
+		cs, err := chunks[len(chunks)-1].Add(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks[:len(chunks)-1], cs...)
+	}
+
+	var b []byte
+	for _, c := range chunks {
+		buf := make([]byte, v1ChunkLenWithHeader)
+		buf[0] = byte(c.Encoding())
+		last, err := c.NewIterator().LastTimestamp()
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.LittleEndian.PutUint64(buf[v1ChunkHeaderFirstTimeOffset:], uint64(c.FirstTime()))
+		binary.LittleEndian.PutUint64(buf[v1ChunkHeaderLastTimeOffset:], uint64(last))
+		if err := c.MarshalToBuf(buf[v1ChunkHeaderLen:]); err != nil {
+			t.Fatal(err)
+		}
+		b = append(b, buf...)
+	}
+	fp := m.FastFingerprint().String()
+	if err := os.MkdirAll(filepath.Join(dir, fp[:2]), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, fp[:2], fp[2:]+v1SeriesFileSuffix), b, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeadlessV1Storage(t *testing.T) {
+	samples := testSamples(testInstances(2), 2, time.Hour)
+	v1Dir, removeV1 := newTestV1Dir(t, samples)
+	defer removeV1()
+	// Replace the heads file with series files holding the same samples,
+	// as if all chunks had been persisted.
+	series := map[model.Fingerprint][]model.SamplePair{}
+	metrics := map[model.Fingerprint]model.Metric{}
+	for _, s := range samples {
+		fp := s.Metric.FastFingerprint()
+		metrics[fp] = s.Metric
+		series[fp] = append(series[fp], model.SamplePair{Timestamp: s.Timestamp, Value: s.Value})
+	}
+	for fp, ss := range series {
+		writeTestSeriesFile(t, v1Dir, metrics[fp], ss)
+	}
+	if err := os.Remove(filepath.Join(v1Dir, v1HeadsFile)); err != nil {
+		t.Fatal(err)
+	}
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	var code int
+	logs := captureStderr(t, func() {
+		code = runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+		)
+	})
+	if code != 0 {
+		t.Fatalf("got exit code %d, want 0, logs:\n%s", code, logs)
+	}
+	if n := logValue(logLine(logs, "Archived persisted series of v1 storage without heads file, samples only in head chunks are lost"), "series"); n != "4" {
+		t.Errorf("archived %q series, want 4", n)
+	}
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 4 {
+		t.Fatalf("got %d series, want 4", len(got))
+	}
+	for ls, ts := range got {
+		if len(ts) != 240 {
+			t.Errorf("series %s has %d samples, want 240", ls, len(ts))
+		}
+	}
+}
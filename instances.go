@@ -0,0 +1,90 @@
+package main
+
+import (
+	"hash/fnv"
+	"regexp"
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// shardMatchers returns the matchers selecting the series of an instance,
+// i.e. the series whose shard label has the given value. The empty value
+// selects all series without the shard label, which the v1 storage only
+// looks up together with a matcher that does not match the empty string.
+func shardMatchers(shardLabel model.LabelName, instance model.LabelValue) (metric.LabelMatchers, error) {
+	m, err := metric.NewLabelMatcher(metric.Equal, shardLabel, instance)
+	if err != nil {
+		return nil, err
+	}
+	if instance != "" {
+		return metric.LabelMatchers{m}, nil
+	}
+	named, err := metric.NewLabelMatcher(metric.RegexMatch, model.MetricNameLabel, ".+")
+	if err != nil {
+		return nil, err
+	}
+	return metric.LabelMatchers{named, m}, nil
+}
+
+// filterInstances returns the instances to migrate. If include is not empty,
+// only the listed instances are kept. Instances matching any of the skip
+// expressions are dropped unless they are explicitly included.
+func filterInstances(instances model.LabelValues, include []string, skip []*regexp.Regexp) model.LabelValues {
+	included := make(map[model.LabelValue]bool, len(include))
+	for _, i := range include {
+		included[model.LabelValue(i)] = true
+	}
+
+	var res model.LabelValues
+	for _, i := range instances {
+		if len(included) > 0 && !included[i] {
+			continue
+		}
+		if !included[i] && matchesAny(string(i), skip) {
+			continue
+		}
+		res = append(res, i)
+	}
+	return res
+}
+
+// instancesOfShard returns the instances whose FNV-1a hash modulo total is
+// shard.
+func instancesOfShard(instances model.LabelValues, shard, total int) model.LabelValues {
+	var res model.LabelValues
+	for _, i := range instances {
+		h := fnv.New64a()
+		h.Write([]byte(i))
+		if h.Sum64()%uint64(total) == uint64(shard) {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// mergeLabelValues returns the sorted union of the instances a and b.
+func mergeLabelValues(a, b model.LabelValues) model.LabelValues {
+	seen := make(map[model.LabelValue]bool, len(a)+len(b))
+	var res model.LabelValues
+	for _, vs := range []model.LabelValues{a, b} {
+		for _, v := range vs {
+			if !seen[v] {
+				seen[v] = true
+				res = append(res, v)
+			}
+		}
+	}
+	sort.Sort(res)
+	return res
+}
+
+func matchesAny(s string, res []*regexp.Regexp) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestFilterInstances(t *testing.T) {
+	instances := model.LabelValues{"ci-1:9090", "ci-2:9090", "db:9090", "web:9090"}
+	skipCI := []*regexp.Regexp{regexp.MustCompile("^(?:ci-.*)$")}
+	for _, tc := range []struct {
+		name    string
+		include []string
+		skip    []*regexp.Regexp
+		want    model.LabelValues
+	}{
+		{name: "all", want: instances},
+		{name: "include", include: []string{"db:9090", "unknown:9090"}, want: model.LabelValues{"db:9090"}},
+		{name: "skip", skip: skipCI, want: model.LabelValues{"db:9090", "web:9090"}},
+		{name: "include wins", include: []string{"ci-2:9090", "web:9090"}, skip: skipCI, want: model.LabelValues{"ci-2:9090", "web:9090"}},
+	} {
+		if got := filterInstances(instances, tc.include, tc.skip); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// storedInstances returns the sorted instances of the series in the v2
+// storage in dir.
+func storedInstances(t *testing.T, dir string) []string {
+	seen := map[string]bool{}
+	for ls := range storedTimestamps(t, dir) {
+		i := strings.Index(ls, `instance="`)
+		if i < 0 {
+			continue
+		}
+		v := ls[i+len(`instance="`):]
+		seen[v[:strings.Index(v, `"`)]] = true
+	}
+	var res []string
+	for i := range seen {
+		res = append(res, i)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestSkipInstance(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples([]string{"ci-1:9090", "ci-2:9090", "db:9090", "web:9090"}, 1, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	runMain(
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+		"-skip-instance", "ci-.*", "-skip-instance", "web:.*",
+	)
+	if got, want := storedInstances(t, v2Dir), []string{"db:9090"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got instances %v, want %v", got, want)
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	instances := testInstances(12)
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(instances, 1, time.Hour))
+	defer removeV1()
+
+	var values model.LabelValues
+	for _, i := range instances {
+		values = append(values, model.LabelValue(i))
+	}
+	const total = 3
+	seen := map[string]int{}
+	for shard := 0; shard < total; shard++ {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		if code := runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+			"-shard-of", fmt.Sprint(shard), "-total-shards", fmt.Sprint(total),
+		); code != 0 {
+			t.Fatalf("shard %d: got exit code %d, want 0", shard, code)
+		}
+		got := storedInstances(t, v2Dir)
+		if len(got) == 0 {
+			t.Errorf("shard %d migrated no instances", shard)
+		}
+		// Every migrator computes the same split.
+		var want []string
+		for _, i := range instancesOfShard(values, shard, total) {
+			want = append(want, string(i))
+		}
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("shard %d: got instances %v, want %v", shard, got, want)
+		}
+		for _, i := range got {
+			seen[i]++
+		}
+	}
+	for _, i := range instances {
+		if seen[i] != 1 {
+			t.Errorf("instance %s was migrated by %d shards, want 1", i, seen[i])
+		}
+	}
+}
+
+func TestShardsMatchSingleMigration(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(50), 2, time.Hour))
+	defer removeV1()
+	args := []string{"-v1-dir", v1Dir, "-step", "10m", "-lookback", "1h", "-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix())}
+
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	if code := runMain(append(args, "-v2-dir", v2Dir)...); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	want := storedTimestamps(t, v2Dir)
+
+	// Instances split between migrators are migrated the same way as all
+	// of them at once.
+	got := map[string][]int64{}
+	for shard := 0; shard < 4; shard++ {
+		dir, remove := tempDir(t)
+		defer remove()
+		if code := runMain(append(args, "-v2-dir", dir, "-shard-of", fmt.Sprint(shard), "-total-shards", "4")...); code != 0 {
+			t.Fatalf("shard %d: got exit code %d, want 0", shard, code)
+		}
+		for ls, ts := range storedTimestamps(t, dir) {
+			if _, ok := got[ls]; ok {
+				t.Errorf("series %s was migrated by more than one shard", ls)
+			}
+			got[ls] = ts
+		}
+	}
+	if len(want) != 100 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d series from the shards and %d from one migration, want the same 100", len(got), len(want))
+	}
+}
+
+func TestShardLabel(t *testing.T) {
+	samples := testSamples(testInstances(1), 1, time.Hour)
+	for _, s := range testSamples([]string{"a", "b"}, 1, time.Hour) {
+		s.Metric["pod"] = s.Metric[model.InstanceLabel]
+		delete(s.Metric, model.InstanceLabel)
+		samples = append(samples, s)
+	}
+	v1Dir, removeV1 := newTestV1Dir(t, samples)
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	runMain(
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+		"-shard-label", "pod",
+	)
+	got := storedTimestamps(t, v2Dir)
+	var series []string
+	for ls, ts := range got {
+		series = append(series, ls)
+		if len(ts) != 240 {
+			t.Errorf("series %s has %d samples, want 240", ls, len(ts))
+		}
+	}
+	sort.Strings(series)
+	// The series without the shard label are not migrated.
+	want := []string{
+		`{__name__="test_metric",idx="0",pod="a"}`,
+		`{__name__="test_metric",idx="0",pod="b"}`,
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("got series %v, want %v", series, want)
+	}
+}
+
+func TestNoShardKeyBucket(t *testing.T) {
+	samples := testSamples(testInstances(1), 1, time.Hour)
+	for _, s := range testSamples([]string{"none"}, 2, time.Hour) {
+		// Aggregated by a recording rule, without the instance label.
+		s.Metric[model.MetricNameLabel] = "job:test_metric:sum"
+		delete(s.Metric, model.InstanceLabel)
+		samples = append(samples, s)
+	}
+	v1Dir, removeV1 := newTestV1Dir(t, samples)
+	defer removeV1()
+
+	for _, tc := range []struct {
+		bucket bool
+		want   []string
+	}{
+		{want: []string{
+			`{__name__="test_metric",idx="0",instance="host0:9090"}`,
+		}},
+		{bucket: true, want: []string{
+			`{__name__="job:test_metric:sum",idx="0"}`,
+			`{__name__="job:test_metric:sum",idx="1"}`,
+			`{__name__="test_metric",idx="0",instance="host0:9090"}`,
+		}},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+			fmt.Sprintf("-no-shard-key-bucket=%v", tc.bucket),
+		)
+		var got []string
+		for ls, ts := range storedTimestamps(t, v2Dir) {
+			got = append(got, ls)
+			if len(ts) != 240 {
+				t.Errorf("bucket %v: series %s has %d samples, want 240", tc.bucket, ls, len(ts))
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("bucket %v: got series %v, want %v", tc.bucket, got, tc.want)
+		}
+	}
+}
+
+func TestSkipFailedInstances(t *testing.T) {
+	samples := testSamples(testInstances(3), 1, time.Hour)
+	// The series with an invalid name lets every step of host1:9090 fail
+	// with -strict-names=fail.
+	for _, s := range testSamples([]string{"host1:9090"}, 1, time.Hour) {
+		s.Metric[model.MetricNameLabel] = "test-metric"
+		samples = append(samples, s)
+	}
+	v1Dir, removeV1 := newTestV1Dir(t, samples)
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	var code int
+	logs := captureStderr(t, func() {
+		code = runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+			"-strict-names", "fail", "-instance-retries", "2", "-skip-failed-instances",
+		)
+	})
+	if code != 1 {
+		t.Errorf("got exit code %d, want 1", code)
+	}
+	if n := strings.Count(logs, `msg="Retrying failed step" instance=host1:9090`); n != 2 {
+		t.Errorf("retried %d times, want 2", n)
+	}
+	if l := logLine(logs, "instance failed and was not migrated from the failed step on"); logValue(l, "instance") != "host1:9090" || logValue(l, "from") != testStart.String() {
+		t.Errorf("got failure report %q, want host1:9090 from the first step", l)
+	}
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 2 {
+		t.Fatalf("got %d series, want the 2 of the other instances", len(got))
+	}
+	for ls, ts := range got {
+		if strings.Contains(ls, "host1:9090") || len(ts) != 240 {
+			t.Errorf("series %s has %d samples, want only host0:9090 and host2:9090 with 240 samples", ls, len(ts))
+		}
+	}
+}
+
+func TestRetryReport(t *testing.T) {
+	samples := testSamples(testInstances(3), 1, time.Hour)
+	// The series with an invalid name lets host1:9090 fail from the third
+	// step on with -strict-names=fail.
+	broken := testSamples([]string{"host1:9090"}, 1, time.Hour)[80:]
+	for _, s := range broken {
+		s.Metric[model.MetricNameLabel] = "test-metric"
+	}
+	v1Dir, removeV1 := newTestV1Dir(t, append(samples, broken...))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	reportFile := filepath.Join(v2Dir, "failures.json")
+
+	code := runMain(
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+		"-strict-names", "fail", "-skip-failed-instances", "-failure-report-file", reportFile,
+	)
+	if code != 1 {
+		t.Fatalf("got exit code %d, want 1", code)
+	}
+	report, err := readFailureReport(reportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report == nil || len(report.Failures) != 1 || report.Failures[0].Instance != "host1:9090" || report.Failures[0].From != testStart.Add(20*time.Minute) {
+		t.Fatalf("got failure report %+v, want host1:9090 from the third step", report)
+	}
+
+	// In the fixed source, the series is renamed. The other instances have
+	// a new series, which is not migrated as they did not fail.
+	for _, s := range broken {
+		s.Metric[model.MetricNameLabel] = "test_metric_fixed"
+	}
+	for _, s := range testSamples([]string{"host0:9090", "host2:9090"}, 1, time.Hour) {
+		s.Metric[model.MetricNameLabel] = "test_metric_new"
+		broken = append(broken, s)
+	}
+	fixedDir, removeFixed := newTestV1Dir(t, append(samples, broken...))
+	defer removeFixed()
+	logs := captureStderr(t, func() {
+		code = runMain(
+			"-v1-dir", fixedDir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+			"-strict-names", "fail", "-retry-report", reportFile,
+		)
+	})
+	if code != 0 {
+		t.Fatalf("retry exited with %d, logs:\n%s", code, logs)
+	}
+	if got := logValue(logLine(logs, "Migrating failed instances of failure report"), "selected"); got != "1" {
+		t.Errorf("selected %q instances, want 1", got)
+	}
+
+	got := storedTimestamps(t, v2Dir)
+	want := map[string]int{
+		labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host0:9090", "idx", "0").String():       240,
+		labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host1:9090", "idx", "0").String():       240,
+		labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host2:9090", "idx", "0").String():       240,
+		labels.FromStrings(model.MetricNameLabel, "test_metric_fixed", model.InstanceLabel, "host1:9090", "idx", "0").String(): 160,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+	for ls, n := range want {
+		if len(distinct(got[ls])) != n {
+			t.Errorf("series %s has samples at %d timestamps, want %d", ls, len(distinct(got[ls])), n)
+		}
+	}
+
+	man, err := readManifest(filepath.Join(v2Dir, "migrator.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if man == nil || man.Start != report.Start || man.End != report.End {
+		t.Errorf("got manifest %+v, want the reported range [%v, %v]", man, report.Start, report.End)
+	}
+}
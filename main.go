@@ -2,130 +2,1860 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
 	"github.com/prometheus/prometheus/storage/local"
-	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/prometheus/tsdb"
 	"github.com/prometheus/tsdb/labels"
-	"gopkg.in/cheggaaa/pb.v1"
 )
 
+// exitDestinationFull is the exit code if the migration stopped because a
+// destination ran out of disk space. It can be resumed once space is freed.
+const exitDestinationFull = 3
+
+// subcommands maps the subcommands to the flag that selects their mode. All
+// subcommands share the same flags, and an invocation without a subcommand
+// migrates.
+var subcommands = map[string]string{
+	"migrate":   "",
+	"probe":     "probe",
+	"list":      "dump-index",
+	"estimate":  "estimate",
+	"count":     "count-only",
+	"instances": "list-instances",
+	"verify":    "verify-only",
+	"ci":        "ci-mode",
+	"version":   "version",
+}
+
 func main() {
-	v1Dir := flag.String("v1-dir", "./data-v1", "Path to the v1 storage directory.")
-	v2Dir := flag.String("v2-dir", "./data-v2", "Path to the v2 storage directory.")
-	lookback := flag.Duration("lookback", 15*24*time.Hour, "How far back to start when exporting old data.")
-	endTimestamp := flag.Int64("end-timestamp", 0, "Unix timestamp in seconds of the end of the time range to migrate. If 0, the current time is chosen.")
-	step := flag.Duration("step", 15*time.Minute, "How much data to load at once.")
-	v1HeapSize := flag.Uint64("v1-target-heap-size", 2000000000, "How much memory to use for v1 storage in bytes")
-	maxParallelism := flag.Int("max-parallelism", 1, "How many instances to migrate at the same time.")
-	flag.Parse()
+	os.Exit(run())
+}
+
+// parseArgs parses the command line arguments, which may start with one of
+// the subcommands.
+func parseArgs(args []string) error {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		mode, ok := subcommands[args[0]]
+		if !ok {
+			return fmt.Errorf("unknown subcommand %q", args[0])
+		}
+		args = args[1:]
+		if mode != "" {
+			args = append([]string{"-" + mode}, args...)
+		}
+	}
+	return flag.CommandLine.Parse(args)
+}
+
+// run migrates the v1 storage according to the command line flags and
+// returns the exit code.
+func run() (code int) {
+	c := newConfig(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [migrate|probe|list|estimate|count|instances|verify|version] [flags]\n\nWithout a subcommand, the migrator migrates. The subcommands are equivalent to -probe, -dump-index, -estimate, -count-only, -list-instances, -verify-only and -version.\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	if err := parseArgs(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		flag.Usage()
+		return 2
+	}
+
+	if c.printVersion {
+		fmt.Println(version.Print("prom-data-migrator"))
+		return 0
+	}
+
+	if c.ciMode {
+		if err := c.applyCIMode(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 2
+		}
+		defer func() {
+			if code == 0 {
+				fmt.Println("CI check passed")
+			} else {
+				fmt.Printf("CI check failed with exit status %d\n", code)
+			}
+		}()
+	}
+	if err := c.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	if c.dumpConfigFlag {
+		if err := dumpConfig(flag.CommandLine, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "error dumping configuration: %s\n", err)
+			return 1
+		}
+		return 0
+	}
 
 	logger := log.NewSyncLogger(log.NewLogfmtLogger(os.Stderr))
+	if c.heapProfileFile != "" {
+		// Deferred first, this runs after the storages have been closed.
+		defer func() {
+			if err := writeHeapProfile(c.heapProfileFile); err != nil {
+				level.Error(logger).Log("msg", "error writing heap profile", "file", c.heapProfileFile, "err", err)
+			}
+		}()
+	}
 
-	v1Storage := local.NewMemorySeriesStorage(&local.MemorySeriesStorageOptions{
-		TargetHeapSize:             *v1HeapSize,
-		PersistenceRetentionPeriod: 999999 * time.Hour,
-		PersistenceStoragePath:     *v1Dir,
-		HeadChunkTimeout:           0,
-		CheckpointInterval:         999999 * time.Hour,
-		CheckpointDirtySeriesLimit: 1e9,
-		MinShrinkRatio:             0.1,
-		SyncStrategy:               local.Never,
-	})
-	if err := v1Storage.Start(); err != nil {
-		level.Error(logger).Log("msg", "error starting v1 storage", "err", err)
-		os.Exit(1)
+	// The v2 storage keeps the series of the most recent blocks in memory
+	// as well, which easily needs as much memory as the v1 storage.
+	if c.memory > 0 && uint64(c.v1HeapSize) > c.memory/2 {
+		level.Warn(logger).Log("msg", "v1 target heap size exceeds half of the system memory, which leaves little for the v2 storage", "v1_target_heap_size", &c.v1HeapSize, "system_memory", c.memory)
 	}
-	defer v1Storage.Stop()
 
-	v2Storage, err := tsdb.Open(*v2Dir, logger, nil, &tsdb.Options{
-		WALFlushInterval:  5 * time.Second,
+	mg := &migration{config: c, logger: logger, stopIdle: func() {}}
+	defer mg.close()
+	return mg.run()
+}
+
+// migration is the state of a run of the migrator from opening the storages
+// to the checks after the last step.
+type migration struct {
+	*config
+	logger log.Logger
+	// closers are called in reverse order by close, like deferred calls.
+	closers []func()
+
+	prog         progress
+	activity     progress
+	timings      stepTimings
+	registry     prometheus.Registerer
+	stepDuration prometheus.Histogram
+
+	v1Path     string
+	v1Storages []*local.MemorySeriesStorage
+	v1Storage  *local.MemorySeriesStorage
+	v1Replicas []*local.MemorySeriesStorage
+
+	instances model.LabelValues
+	retry     *failureReport
+	retryFrom map[model.LabelValue]model.Time
+
+	blockRanges []int64
+	v2Options   *tsdb.Options
+
+	// The time range of the migration and the step to continue at.
+	startTime, endTime, next model.Time
+	// dedupUntil is recorded in the checkpoint, skipUntil is how far the
+	// samples already in the v2 storage are skipped in this run.
+	dedupUntil, skipUntil model.Time
+	prevManifest          *manifest
+	cp                    *checkpoint
+	// The instances skipped in the runs before, if resuming from a token.
+	tokenFailures []reportedFailure
+
+	series      *seriesList
+	metricNames map[string]bool
+
+	existingV2Blocks map[string]bool
+	audit            *blockAudit
+	v2DBs            []*tsdb.DB
+	v2Open           bool
+	v2Query          queryable
+	blocks           *blockWriter
+	dests            *fanout
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	throttle *loadThrottle
+	m        *migrator
+	stopIdle func()
+	gaps     *gapTracker
+	verifier *blockVerifier
+
+	steps       []model.Time
+	status      *migrationStatus
+	bar         progressView
+	windowsDone int
+	// With -recent-first, recentFrom is the start of the newest block
+	// ranges, which are reported once they are written.
+	recentFrom model.Time
+	recentDone bool
+
+	failedInstances []*WindowMigrationError
+	failedInstance  map[model.LabelValue]bool
+}
+
+// onClose registers f to be called by close.
+func (mg *migration) onClose(f func()) {
+	mg.closers = append(mg.closers, f)
+}
+
+// close calls the functions registered with onClose, the last one first.
+func (mg *migration) close() {
+	for i := len(mg.closers) - 1; i >= 0; i-- {
+		mg.closers[i]()
+	}
+}
+
+// run runs the migration or the mode selected by the flags and returns the
+// exit code.
+func (mg *migration) run() int {
+	mg.serveMetrics()
+	if !mg.openV1() {
+		return 1
+	}
+
+	if mg.dumpIndexFlag {
+		if err := dumpIndex(mg.v1Storage, model.LabelName(mg.dumpIndexLabel), os.Stdout); err != nil {
+			level.Error(mg.logger).Log("msg", "error dumping v1 index", "err", err)
+			return 1
+		}
+		return 0
+	}
+
+	if !mg.selectInstances() {
+		return 1
+	}
+
+	mg.blockRanges = tsdb.ExponentialBlockRanges(int64(mg.minBlockDuration/time.Millisecond), 10, 3)
+	mg.v2Options = &tsdb.Options{
+		WALFlushInterval:  mg.walFlushInterval,
 		RetentionDuration: 999999 * 24 * 60 * 60 * 1000,
-		BlockRanges:       tsdb.ExponentialBlockRanges(int64(2*60*60*1000), 10, 3),
+		BlockRanges:       mg.blockRanges,
+	}
+
+	if mg.probeFlag {
+		return mg.runProbe()
+	}
+
+	if !mg.selectTimeRange() || !mg.resume() || !mg.selectSeries() {
+		return 1
+	}
+
+	switch {
+	case mg.estimate:
+		return mg.runEstimate()
+	case mg.listInstances:
+		return mg.runListInstances()
+	case mg.countOnly:
+		return mg.runCount()
+	}
+
+	if !mg.openV2() {
+		return 1
+	}
+
+	if mg.replayQuarantineFlag {
+		return mg.runReplay()
+	}
+
+	mg.startStopping()
+	if !mg.newMigrator() || !mg.planSteps() {
+		return 1
+	}
+	if code, ok := mg.migrateSteps(); !ok {
+		return code
+	}
+
+	errs, ok := mg.verify()
+	if !ok {
+		return 1
+	}
+	if mg.verifyOnly {
+		if len(errs) > 0 {
+			mg.bar.FinishPrint("Verification complete with errors")
+			return 1
+		}
+		mg.bar.FinishPrint("Verification complete")
+		return 0
+	}
+	return mg.finish(errs)
+}
+
+// serveMetrics serves the metrics and liveness check on -listen-address, if
+// set.
+func (mg *migration) serveMetrics() {
+	mg.stepDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "migrator_step_duration_seconds",
+		Help:    "Time it took to migrate a step.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
 	})
-	if err != nil {
-		level.Error(logger).Log("msg", "error starting v2 storage", "err", err)
-		os.Exit(1)
+	mg.prog.update()
+	if mg.listenAddress != "" {
+		mg.registry = prometheus.DefaultRegisterer
+		mg.registry.MustRegister(mg.stepDuration)
+		serveWeb(mg.listenAddress, &mg.prog, mg.stallTimeout, mg.logger)
+	}
+}
+
+// openV1 starts the v1 storage and its replicas, from copies with
+// -v1-readonly.
+func (mg *migration) openV1() bool {
+	v1Dirs := append([]string{mg.v1Dir}, mg.v1ReplicaDirs...)
+	v1Paths := make([]string, 0, len(v1Dirs))
+	for _, dir := range v1Dirs {
+		path := dir
+		if mg.v1ReadOnly {
+			tmpDir, err := ioutil.TempDir(mg.v1CopyDir, "prom-data-migrator-v1-")
+			if err != nil {
+				level.Error(mg.logger).Log("msg", "error creating temporary directory for v1 storage copy", "err", err)
+				return false
+			}
+			mg.onClose(func() { os.RemoveAll(tmpDir) })
+
+			path = filepath.Join(tmpDir, "data")
+			level.Info(mg.logger).Log("msg", "Copying v1 storage", "from", dir, "to", path)
+			if err := copyDir(dir, path); err != nil {
+				level.Error(mg.logger).Log("msg", "error copying v1 storage", "err", err)
+				return false
+			}
+		}
+
+		// The v1 storage creates a missing directory on start, which
+		// hides a mistyped -v1-dir.
+		if mg.probeFlag {
+			if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+				level.Error(mg.logger).Log("msg", "v1 storage directory not found", "dir", dir, "err", err)
+				return false
+			}
+		}
+
+		// Without its heads file, the v1 storage only finds archived
+		// series.
+		if missing, err := v1HeadsMissing(path); err != nil {
+			level.Error(mg.logger).Log("msg", "error checking v1 storage", "dir", dir, "err", err)
+			return false
+		} else if missing {
+			n, err := archiveHeadlessSeries(path)
+			if err != nil {
+				level.Error(mg.logger).Log("msg", "error archiving series of v1 storage without heads file", "dir", dir, "err", err)
+				return false
+			}
+			level.Warn(mg.logger).Log("msg", "Archived persisted series of v1 storage without heads file, samples only in head chunks are lost", "dir", dir, "series", n)
+		}
+		v1Paths = append(v1Paths, path)
+	}
+	mg.v1Path = v1Paths[0]
+
+	mg.v1Storages = make([]*local.MemorySeriesStorage, 0, len(v1Paths))
+	for i, path := range v1Paths {
+		s := local.NewMemorySeriesStorage(&local.MemorySeriesStorageOptions{
+			TargetHeapSize:             uint64(mg.v1HeapSize) / uint64(len(v1Paths)),
+			PersistenceRetentionPeriod: 999999 * time.Hour,
+			PersistenceStoragePath:     path,
+			HeadChunkTimeout:           0,
+			CheckpointInterval:         999999 * time.Hour,
+			CheckpointDirtySeriesLimit: 1e9,
+			MinShrinkRatio:             0.1,
+			SyncStrategy:               local.Never,
+		})
+		if err := startV1Storage(s.Start, mg.sourceOpenTimeout); err != nil {
+			level.Error(mg.logger).Log("msg", "error starting v1 storage", "dir", v1Dirs[i], "err", err)
+			return false
+		}
+		mg.onClose(func() { s.Stop() })
+		mg.v1Storages = append(mg.v1Storages, s)
+	}
+	mg.v1Storage, mg.v1Replicas = mg.v1Storages[0], mg.v1Storages[1:]
+	// The metrics of the replicas would collide with those of the v1
+	// storage.
+	if mg.registry != nil {
+		mg.registry.MustRegister(mg.v1Storage)
 	}
-	defer v2Storage.Close()
+	return true
+}
 
-	instances, err := v1Storage.LabelValuesForLabelName(context.Background(), model.InstanceLabel)
+// selectInstances looks up the instances in the v1 storages and selects the
+// ones to migrate.
+func (mg *migration) selectInstances() bool {
+	instances, err := mg.v1Storage.LabelValuesForLabelName(context.Background(), model.LabelName(mg.shardLabel))
 	if err != nil {
-		level.Error(logger).Log("msg", "error querying instance labels from v1 storage", "err", err)
-		os.Exit(1)
+		level.Error(mg.logger).Log("msg", "error querying instance labels from v1 storage", "err", err)
+		return false
+	}
+	for i, r := range mg.v1Replicas {
+		vals, err := r.LabelValuesForLabelName(context.Background(), model.LabelName(mg.shardLabel))
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error querying instance labels from v1 replica", "dir", mg.v1ReplicaDirs[i], "err", err)
+			return false
+		}
+		instances = mergeLabelValues(instances, vals)
+	}
+	if mg.noShardKeyBucket {
+		instances = append(instances, "")
+	} else if len(instances) == 0 {
+		level.Warn(mg.logger).Log("msg", "No series with the shard label found in v1 storage, nothing will be migrated", "shard_label", mg.shardLabel)
+	}
+	if len(mg.includeInstances) > 0 || len(mg.skipInstanceREs) > 0 {
+		discovered := len(instances)
+		instances = filterInstances(instances, mg.includeInstances, mg.skipInstanceREs)
+		level.Info(mg.logger).Log("msg", "Filtered instances", "discovered", discovered, "selected", len(instances))
+	}
+	if mg.totalShards > 1 {
+		discovered := len(instances)
+		instances = instancesOfShard(instances, mg.shardOf, mg.totalShards)
+		level.Info(mg.logger).Log("msg", "Selected instances of shard", "shard", mg.shardOf, "total_shards", mg.totalShards, "discovered", discovered, "selected", len(instances))
+	}
+	if mg.retryReportFile != "" {
+		if mg.retry, err = readFailureReport(mg.retryReportFile); err != nil {
+			level.Error(mg.logger).Log("msg", "error reading failure report", "file", mg.retryReportFile, "err", err)
+			return false
+		}
+		if mg.retry == nil {
+			level.Error(mg.logger).Log("msg", "failure report not found", "file", mg.retryReportFile)
+			return false
+		}
+		mg.retryFrom = map[model.LabelValue]model.Time{}
+		var failed []string
+		for _, f := range mg.retry.Failures {
+			mg.retryFrom[f.Instance] = f.From
+			failed = append(failed, string(f.Instance))
+		}
+		// An empty include list would select all instances.
+		if len(failed) == 0 {
+			instances = nil
+		} else {
+			instances = filterInstances(instances, failed, nil)
+		}
+		level.Info(mg.logger).Log("msg", "Migrating failed instances of failure report", "file", mg.retryReportFile, "reported", len(mg.retry.Failures), "selected", len(instances))
+	}
+	if mg.deterministic {
+		sort.Sort(instances)
+	}
+	mg.instances = instances
+	return true
+}
+
+// runProbe runs -probe.
+func (mg *migration) runProbe() int {
+	if err := probe(mg.v1Storage, model.LabelName(mg.shardLabel), mg.instances, mg.v2Dirs, mg.v2Options, mg.logger, os.Stdout); err != nil {
+		level.Error(mg.logger).Log("msg", "error probing storages", "err", err)
+		return 1
 	}
+	return 0
+}
 
-	endTime := model.Now()
-	if *endTimestamp != 0 {
-		endTime = model.TimeFromUnix(*endTimestamp)
+// selectTimeRange sets the time range to migrate from the flags, the manifest
+// of the last migration, the v2 blocks or the failure report, and trims it to
+// the data in the v1 storages.
+func (mg *migration) selectTimeRange() bool {
+	mg.endTime = model.Now()
+	if mg.endTimestamp != 0 {
+		mg.endTime = model.TimeFromUnix(mg.endTimestamp)
 	}
+	mg.startTime = mg.endTime.Add(-mg.lookback)
 
-	totalSteps := (*lookback / *step).Nanoseconds()
-	bar := pb.StartNew(int(totalSteps))
-	level.Info(logger).Log("msg", "Total steps", "steps", totalSteps)
-	for t := endTime.Add(-*lookback); !t.After(endTime); t = t.Add(*step) {
-		bar.Increment()
+	var err error
+	mg.prevManifest, err = readManifest(mg.manifestFile)
+	if err != nil {
+		level.Error(mg.logger).Log("msg", "error reading manifest", "file", mg.manifestFile, "err", err)
+		return false
+	}
+	if mg.incremental {
+		if mg.prevManifest != nil {
+			mg.startTime = mg.prevManifest.End.Add(-mg.incrementalMargin)
+			mg.dedupUntil = mg.prevManifest.End
+			level.Info(mg.logger).Log("msg", "Migrating incrementally", "previous_end", mg.prevManifest.End, "start", mg.startTime)
+		} else {
+			level.Info(mg.logger).Log("msg", "No previous migration found, migrating full lookback", "manifest", mg.manifestFile)
+		}
+	}
+	if mg.resumeFromExisting {
+		end, err := latestBlockEnd(mg.v2Dirs)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error reading v2 blocks", "err", err)
+			return false
+		}
+		if end != 0 {
+			// The v2 head may hold samples after the latest block, which
+			// are only in its WAL, so samples the v2 storage already
+			// holds are skipped up to the end.
+			mg.startTime = end.Add(-mg.incrementalMargin)
+			mg.dedupUntil = mg.endTime
+			level.Info(mg.logger).Log("msg", "Resuming after latest v2 block", "block_end", end, "start", mg.startTime)
+		} else {
+			level.Info(mg.logger).Log("msg", "No v2 blocks found, migrating full lookback")
+		}
+	}
+	if mg.retry != nil {
+		// A failed step may have been committed partially, so the
+		// samples the v2 storage already holds are skipped in it.
+		mg.startTime, mg.endTime = mg.retry.End, mg.retry.End
+		for _, f := range mg.retry.Failures {
+			if f.From.Before(mg.startTime) {
+				mg.startTime = f.From
+			}
+			if f.Through > mg.dedupUntil {
+				mg.dedupUntil = f.Through
+			}
+		}
+	}
+	if mg.alignBlocks > 0 {
+		mg.startTime, mg.endTime = alignRange(mg.startTime, mg.endTime, mg.alignBlocks)
+		level.Info(mg.logger).Log("msg", "Aligned time range", "start", mg.startTime, "end", mg.endTime)
+	}
+	// Skip the steps before the earliest data, e.g. if the v1 storage had a
+	// shorter retention than -lookback. Trimming by aligned ranges keeps the
+	// range aligned.
+	trimUnit := mg.step
+	if mg.alignBlocks > 0 {
+		trimUnit = mg.alignBlocks
+	}
+	// Replicas may hold older data than the v1 storage.
+	trimmed := mg.endTime
+	for _, st := range mg.v1Storages {
+		t, err := trimToData(st, mg.startTime, mg.endTime, trimUnit)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error looking up earliest data in v1 storage", "err", err)
+			return false
+		}
+		if t.Before(trimmed) {
+			trimmed = t
+		}
+	}
+	if trimmed != mg.startTime {
+		level.Info(mg.logger).Log("msg", "Trimmed time range to the earliest data in the v1 storage", "requested_start", mg.startTime, "start", trimmed)
+		mg.startTime = trimmed
+	}
+	// A misconfigured range would otherwise migrate nothing and still
+	// report the migration as complete. The range of a failure report
+	// without failures is empty on purpose.
+	if !mg.startTime.Before(mg.endTime) && !mg.verifyOnly && mg.retry == nil {
+		if !mg.allowEmpty {
+			level.Error(mg.logger).Log("msg", "time range to migrate is empty, check -lookback and -end-timestamp or pass -allow-empty", "start", mg.startTime, "end", mg.endTime)
+			return false
+		}
+		level.Warn(mg.logger).Log("msg", "Time range to migrate is empty", "start", mg.startTime, "end", mg.endTime)
+	}
+	mg.next = mg.startTime
+	return true
+}
 
-		var wg sync.WaitGroup
-		sema := make(chan struct{}, *maxParallelism)
-		for _, instance := range instances {
-			matcher, err := metric.NewLabelMatcher(metric.Equal, model.InstanceLabel, instance)
+// resume continues the migration of the checkpoint or resume token, if any,
+// and sets how far the samples already in the v2 storage are skipped.
+func (mg *migration) resume() bool {
+	var err error
+	mg.cp, err = readCheckpoint(mg.checkpointFile)
+	if err != nil {
+		level.Error(mg.logger).Log("msg", "error reading checkpoint", "file", mg.checkpointFile, "err", err)
+		return false
+	}
+	if mg.resumeTokenFlag != "" {
+		s := mg.resumeTokenFlag
+		if s == "-" {
+			b, err := ioutil.ReadAll(os.Stdin)
 			if err != nil {
-				panic(err)
+				level.Error(mg.logger).Log("msg", "error reading resume token from stdin", "err", err)
+				return false
 			}
+			s = strings.TrimSpace(string(b))
+		}
+		t, err := decodeResumeToken(s)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error decoding resume token", "err", err)
+			return false
+		}
+		mg.cp, mg.tokenFailures = &t.checkpoint, t.Failed
+	}
+	if mg.cp != nil && mg.reverse {
+		level.Error(mg.logger).Log("msg", "reverse migrations cannot be resumed from a checkpoint, remove it or migrate forward", "file", mg.checkpointFile)
+		return false
+	}
+	mg.skipUntil = mg.dedupUntil
+	if mg.cp == nil {
+		return true
+	}
 
-			wg.Add(1)
-			go func() {
-				sema <- struct{}{}
-				if err := migrate(v1Storage, v2Storage, t, t.Add(*step), matcher); err != nil {
-					level.Error(logger).Log("msg", "error migrating", "err", err)
-					os.Exit(1)
-				}
-				<-sema
-				wg.Done()
-			}()
+	mg.startTime, mg.endTime, mg.next, mg.dedupUntil = mg.cp.Start, mg.cp.End, mg.cp.Next, mg.cp.DedupUntil
+	if mg.resumeTokenFlag != "" {
+		level.Info(mg.logger).Log("msg", "Resuming from resume token", "start", mg.startTime, "end", mg.endTime, "next", mg.next)
+	} else {
+		level.Info(mg.logger).Log("msg", "Resuming from checkpoint", "file", mg.checkpointFile, "start", mg.startTime, "end", mg.endTime, "next", mg.next)
+	}
+
+	// The step that was in progress may have been committed for some
+	// instances or series already. Skip the samples the v2 storage
+	// holds for it instead of appending them again.
+	mg.skipUntil = mg.dedupUntil
+	if mg.next.Before(mg.endTime) {
+		if through := stepEnd(mg.next, mg.endTime, mg.step, mg.exclusiveEnd); through > mg.skipUntil {
+			mg.skipUntil = through
 		}
-		wg.Wait()
 	}
-	bar.FinishPrint("Migration Complete")
+
+	// A crash also loses the steps committed since the v2 storage last
+	// synced its WAL, although they are in the checkpoint. Migrate
+	// them again, too.
+	// The blocks written with -output-blocks-per-window are
+	// complete once the checkpoint is written.
+	if mg.resumeMargin < 0 {
+		mg.resumeMargin = mg.step
+		if mg.blocksPerWindow {
+			mg.resumeMargin = 0
+		}
+	}
+	if resumeFrom := mg.next.Add(-mg.resumeMargin); resumeFrom.Before(mg.next) {
+		if resumeFrom.Before(mg.startTime) {
+			resumeFrom = mg.startTime
+		}
+		level.Info(mg.logger).Log("msg", "Migrating again before checkpoint", "from", resumeFrom, "safety_margin", mg.resumeMargin)
+		mg.next = resumeFrom
+	}
+	return true
+}
+
+// selectSeries reads the -series-list, selects the -max-metric-names and runs
+// -preflight.
+func (mg *migration) selectSeries() bool {
+	var err error
+	if mg.seriesListFile != "" {
+		mg.series, err = readSeriesList(mg.seriesListFile)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error reading series list", "file", mg.seriesListFile, "err", err)
+			return false
+		}
+		level.Info(mg.logger).Log("msg", "Migrating listed series only", "file", mg.seriesListFile, "series", mg.series.size())
+	}
+	// The names are selected from the whole range, so that a resumed run
+	// selects the same ones.
+	if mg.maxMetricNames > 0 {
+		included, excluded, err := firstMetricNames(mg.v1Storages, mg.startTime, mg.endTime, mg.maxMetricNames)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error looking up metric names in v1 storage", "err", err)
+			return false
+		}
+		mg.metricNames = make(map[string]bool, len(included))
+		for _, n := range included {
+			mg.metricNames[n] = true
+		}
+		level.Info(mg.logger).Log("msg", "Migrating the first metric names only", "max_metric_names", mg.maxMetricNames, "included", strings.Join(included, ","), "excluded", len(excluded))
+		if len(excluded) > 0 {
+			level.Info(mg.logger).Log("msg", "Excluded metric names", "names", strings.Join(excluded, ","))
+		}
+	}
+
+	if mg.preflightFlag && !mg.verifyOnly {
+		pm := &migrator{
+			v1Storage:           mg.v1Storage,
+			v1Replicas:          mg.v1Replicas,
+			lastReplicaWins:     mg.replicaTieBreak == "last",
+			shardLabel:          model.LabelName(mg.shardLabel),
+			sampleFraction:      mg.sampleFraction,
+			seriesList:          mg.series,
+			metricNames:         mg.metricNames,
+			maxLabelValueLength: mg.maxLabelValueLength,
+			skipLongLabelValues: mg.longLabelValues == "skip",
+			dropLabels:          mg.dropLabels,
+		}
+		n, err := preflight(pm, mg.instances, mg.next, mg.endTime)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error counting series to migrate", "err", err)
+			return false
+		}
+		level.Info(mg.logger).Log("msg", "Preflight complete", "instances", len(mg.instances), "series", n)
+		if n == 0 && !mg.force {
+			level.Error(mg.logger).Log("msg", "no series selected for migration, check the selection flags or pass -force to start anyway")
+			return false
+		}
+	}
+	return true
 }
 
-func migrate(v1Storage *local.MemorySeriesStorage, v2Storage *tsdb.DB, from, through model.Time, matcher *metric.LabelMatcher) error {
-	its, err := v1Storage.QueryRange(context.Background(), from, through, matcher)
+// runEstimate runs -estimate.
+func (mg *migration) runEstimate() int {
+	e, err := estimateMigration(&migrator{v1Storage: mg.v1Storage, v1Replicas: mg.v1Replicas, lastReplicaWins: mg.replicaTieBreak == "last", shardLabel: model.LabelName(mg.shardLabel), windowWorkers: mg.windowWorkers, sampleFraction: mg.sampleFraction, seriesList: mg.series, metricNames: mg.metricNames}, mg.instances, mg.next, mg.endTime, mg.step, mg.maxParallelism)
 	if err != nil {
-		return err
+		level.Error(mg.logger).Log("msg", "error estimating migration", "err", err)
+		return 1
+	}
+	e.print(os.Stdout)
+	return 0
+}
+
+// runListInstances runs -list-instances.
+func (mg *migration) runListInstances() int {
+	volumes, err := instanceVolumes(&migrator{v1Storage: mg.v1Storage, v1Replicas: mg.v1Replicas, lastReplicaWins: mg.replicaTieBreak == "last", shardLabel: model.LabelName(mg.shardLabel), sampleFraction: mg.sampleFraction, seriesList: mg.series, metricNames: mg.metricNames}, mg.instances, mg.next, mg.endTime, mg.step)
+	if err != nil {
+		level.Error(mg.logger).Log("msg", "error counting instance volumes", "err", err)
+		return 1
+	}
+	printInstanceVolumes(os.Stdout, volumes)
+	return 0
+}
+
+// runCount runs -count-only.
+func (mg *migration) runCount() int {
+	c, err := countSamples(mg.v1Path, mg.next, mg.endTime)
+	if err != nil {
+		level.Error(mg.logger).Log("msg", "error counting v1 samples", "err", err)
+		return 1
+	}
+	c.print(os.Stdout)
+	return 0
+}
+
+// openV2 opens the v2 storages and sets up the destinations of the migrated
+// samples.
+func (mg *migration) openV2() bool {
+	if mg.gcBlocksFlag && !collectBlocks(mg.v2Dirs, mg.logger) {
+		return false
+	}
+
+	// The blocks written by the migration are the ones not there before.
+	var err error
+	if mg.measureCompressionRatio || len(mg.blockMetaLabels) > 0 {
+		if mg.existingV2Blocks, err = existingBlocks(mg.v2Dirs); err != nil {
+			level.Error(mg.logger).Log("msg", "error reading v2 blocks", "err", err)
+			return false
+		}
+	}
+
+	if mg.blockAuditFile != "" {
+		if mg.audit, err = newBlockAudit(mg.v2Dir); err != nil {
+			level.Error(mg.logger).Log("msg", "error reading v2 blocks for block audit", "err", err)
+			return false
+		}
+	}
+
+	// The metrics of several v2 storages would collide, so they are only
+	// registered for a single one.
+	v2Registry := mg.registry
+	if len(mg.v2Dirs) > 1 {
+		v2Registry = nil
+	}
+	// The blocks written with -reverse and -output-blocks-per-window must
+	// not be compacted during the migration.
+	mg.v2DBs, err = openV2Storages(mg.v2Dirs, mg.v2Options, v2Registry, !mg.reverse && !mg.blocksPerWindow, mg.logger)
+	if err != nil {
+		level.Error(mg.logger).Log("msg", "error starting v2 storage", "err", err)
+		return false
+	}
+	mg.v2Open = true
+	mg.onClose(func() {
+		if mg.v2Open {
+			for _, db := range mg.v2DBs {
+				db.Close()
+			}
+		}
+	})
+
+	var v2Dest appendable = mg.v2DBs[0]
+	mg.v2Query = mg.v2DBs[0]
+	if len(mg.v2DBs) > 1 {
+		// -v2-dir still holds the checkpoint and manifest.
+		if err := os.MkdirAll(mg.v2Dir, 0777); err != nil {
+			level.Error(mg.logger).Log("msg", "error creating v2 directory", "err", err)
+			return false
+		}
+		sharded := &shardedStorage{dbs: mg.v2DBs}
+		v2Dest, mg.v2Query = sharded, sharded
+	}
+
+	if mg.resumeVerify && !mg.verifyCheckpoint() {
+		return false
+	}
+	if mg.reverse || mg.blocksPerWindow {
+		mg.blocks, err = newBlockWriter(mg.v2Dir, mg.blockRanges[0], mg.logger)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error creating v2 block writer", "err", err)
+			return false
+		}
+		v2Dest = mg.blocks
+	}
+	// The quarantine records the destinations that rejected samples by
+	// name, so the v2 storage keeps its name if it moves to a new
+	// directory before the quarantine is replayed.
+	mg.dests = &fanout{
+		dests:    []*destination{{name: "v2", storage: v2Dest}},
+		failFast: mg.destErrorPolicy == "fail-fast",
+		logger:   mg.logger,
+	}
+	for _, u := range mg.remoteWriteURLs {
+		mg.dests.dests = append(mg.dests.dests, &destination{name: u, storage: newRemoteWriteStorage(u, mg.remoteWriteTimeout)})
+	}
+	return true
+}
+
+// verifyCheckpoint checks for -resume-verify that the v2 storage has samples
+// of the last step before the checkpoint, and if not, continues at the step
+// of its latest sample.
+//
+// The checkpoint is written after the steps are committed, but a crash can
+// still lose more of them than the -resume-safety-margin, e.g. with a long
+// -wal-flush-interval or a v2 storage restored from an older backup.
+func (mg *migration) verifyCheckpoint() bool {
+	if mg.cp == nil || !mg.startTime.Before(mg.cp.Next) {
+		return true
+	}
+	last := mg.cp.Next.Add(-mg.step)
+	if last.Before(mg.startTime) {
+		last = mg.startTime
+	}
+	if _, ok, err := latestStoredSample(mg.v2Query, last, mg.cp.Next-1); err != nil {
+		level.Error(mg.logger).Log("msg", "error verifying checkpoint against v2 storage", "err", err)
+		return false
+	} else if ok {
+		level.Info(mg.logger).Log("msg", "Verified that v2 storage has samples of the last step before the checkpoint", "from", last)
+		return true
+	}
+	latest, ok, err := latestStoredSample(mg.v2Query, mg.startTime, mg.cp.Next-1)
+	if err != nil {
+		level.Error(mg.logger).Log("msg", "error verifying checkpoint against v2 storage", "err", err)
+		return false
+	}
+	from := mg.startTime
+	if ok {
+		from = mg.startTime.Add((latest.Sub(mg.startTime) / mg.step) * mg.step)
+	}
+	if from.Before(mg.next) {
+		level.Warn(mg.logger).Log("msg", "v2 storage has no samples of the last step before the checkpoint, migrating again from the step of its latest sample", "checkpoint", mg.cp.Next, "latest_sample", latest, "from", from)
+		mg.next = from
+	}
+	return true
+}
+
+// runReplay runs -replay-quarantine.
+func (mg *migration) runReplay() int {
+	q := &quarantine{dir: mg.quarantineDir, maxSize: mg.quarantineMaxFileSize}
+	r, err := replayQuarantine(mg.quarantineDir, mg.dests, q, mg.logger)
+	if cerr := q.close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		level.Error(mg.logger).Log("msg", "error replaying quarantine", "dir", mg.quarantineDir, "series", r.series, "samples", r.samples, "err", err)
+		return 1
+	}
+	level.Info(mg.logger).Log("msg", "Replayed quarantine", "dir", mg.quarantineDir, "series", r.series, "samples", r.samples)
+	if r.failedSeries > 0 {
+		level.Warn(mg.logger).Log("msg", "Quarantined series were rejected again and remain quarantined", "series", r.failedSeries, "samples", r.failedSamples, "file", q.path)
+	}
+	return 0
+}
+
+// startStopping sets up the context that stops the migration after the
+// current step on SIGTERM or after -max-runtime, and the throttling by
+// -source-load-url.
+func (mg *migration) startStopping() {
+	mg.ctx, mg.cancel = context.WithCancel(context.Background())
+	mg.onClose(mg.cancel)
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-term:
+			level.Warn(mg.logger).Log("msg", "Received signal, stopping after the current step", "signal", sig)
+			mg.cancel()
+		case <-mg.ctx.Done():
+		}
+	}()
+	if mg.maxRuntime > 0 {
+		time.AfterFunc(mg.maxRuntime, func() {
+			level.Warn(mg.logger).Log("msg", "Maximum runtime reached, stopping after the current step", "max_runtime", mg.maxRuntime)
+			mg.cancel()
+		})
+	}
+
+	if mg.sourceLoadURL != "" {
+		mg.throttle = &loadThrottle{
+			url:    mg.sourceLoadURL,
+			metric: mg.sourceLoadMetric,
+			high:   mg.sourceLoadHigh,
+			low:    mg.sourceLoadLow,
+			max:    mg.maxParallelism,
+			client: &http.Client{Timeout: mg.sourceLoadInterval},
+			logger: mg.logger,
+		}
+		go mg.throttle.run(mg.ctx, mg.sourceLoadInterval)
+	}
+}
+
+// newMigrator warms up the v1 storages and sets up the migrator of the steps.
+func (mg *migration) newMigrator() bool {
+	if mg.warmup {
+		level.Info(mg.logger).Log("msg", "Warming up v1 storage", "instances", len(mg.instances))
+		start := time.Now()
+		for _, st := range mg.v1Storages {
+			if err := warmupV1(st, model.LabelName(mg.shardLabel), mg.instances, mg.next, mg.endTime, mg.maxParallelism); err != nil {
+				level.Error(mg.logger).Log("msg", "error warming up v1 storage", "err", err)
+				return false
+			}
+		}
+		level.Info(mg.logger).Log("msg", "Warmup complete", "duration", time.Since(start))
+	}
+
+	m := &migrator{
+		v1Storage:      mg.v1Storage,
+		v1Replicas:     mg.v1Replicas,
+		shardLabel:     model.LabelName(mg.shardLabel),
+		v2Storage:      mg.dests,
+		v2DB:           mg.v2Query,
+		logger:         mg.logger,
+		activity:       &mg.activity,
+		assertLabels:   mg.assertLabels,
+		valuePrecision: mg.valuePrecision,
+		deterministic:  mg.deterministic,
+
+		normalizeBucketLabels: mg.normalizeBucketLabels,
+		lastReplicaWins:       mg.replicaTieBreak == "last",
+		dedupUntil:            mg.skipUntil,
+		windowWorkers:         mg.windowWorkers,
+		sampleLimit:           mg.sourceSampleLimit,
+		seriesList:            mg.series,
+		metricNames:           mg.metricNames,
+		dropLabels:            mg.dropLabels,
+		defaultLabels:         labels.Labels(mg.defaultLabels),
+		externalLabels:        labels.Labels(mg.externalLabels),
+		overwriteLabels:       mg.overwriteLabels,
+		strictNames:           mg.strictNames,
+		failDuplicateLabels:   mg.duplicateLabels == "fail",
+		maxLabelValueLength:   mg.maxLabelValueLength,
+		skipLongLabelValues:   mg.longLabelValues == "skip",
+		dropRepeated:          mg.dropRepeated,
+		commitSamples:         mg.commitSamples,
+		commitSeries:          mg.commitSeries,
+		repeatedTolerance:     mg.repeatedTolerance,
+	}
+	mg.m = m
+	m.roundTimestamps = model.Time(mg.roundTimestampsFlag / time.Millisecond)
+	if mg.expectSeries >= 0 || mg.verifyIndexFlag {
+		m.migrated = newSeriesList()
+	}
+	if mg.maxTotalSeries > 0 {
+		m.seriesLimit = mg.maxTotalSeries
+		m.admitted = newSeriesList()
+	}
+	if mg.minValidTime != 0 || mg.maxValidTime != 0 {
+		m.checkTimes = true
+		m.minValidTime, m.maxValidTime = model.Earliest, model.Latest
+		if mg.minValidTime != 0 {
+			m.minValidTime = model.TimeFromUnix(mg.minValidTime)
+		}
+		if mg.maxValidTime != 0 {
+			m.maxValidTime = model.TimeFromUnix(mg.maxValidTime)
+		}
+	}
+	if mg.sampleFraction < 1 {
+		m.sampleFraction = mg.sampleFraction
+	}
+	if mg.minSamplesPerSeries > 0 {
+		level.Info(mg.logger).Log("msg", "Counting samples per series", "min_samples_per_series", mg.minSamplesPerSeries)
+		// The counting migrator selects and labels series like m,
+		// without logging or counting what it skips.
+		cm := &migrator{
+			v1Storage:             mg.v1Storage,
+			v1Replicas:            m.v1Replicas,
+			lastReplicaWins:       m.lastReplicaWins,
+			shardLabel:            m.shardLabel,
+			logger:                log.NewNopLogger(),
+			sampleFraction:        m.sampleFraction,
+			seriesList:            mg.series,
+			metricNames:           mg.metricNames,
+			dropLabels:            mg.dropLabels,
+			defaultLabels:         m.defaultLabels,
+			externalLabels:        m.externalLabels,
+			overwriteLabels:       m.overwriteLabels,
+			maxLabelValueLength:   m.maxLabelValueLength,
+			skipLongLabelValues:   m.skipLongLabelValues,
+			normalizeBucketLabels: m.normalizeBucketLabels,
+		}
+		sparse, n, err := sparseSeries(cm, mg.instances, mg.next, mg.endTime, mg.step, mg.exclusiveEnd, mg.minSamplesPerSeries)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error counting samples per series", "err", err)
+			return false
+		}
+		level.Info(mg.logger).Log("msg", "Dropping sparse series", "series", sparse.size(), "counted", n)
+		m.sparse = sparse
 	}
 
-	app := v2Storage.Appender()
+	if mg.maxIdleTimeout > 0 {
+		mg.activity.update()
+		mg.stopIdle = watchIdle(&mg.activity, mg.maxIdleTimeout, mg.logger)
+	}
+	mg.onClose(func() { mg.stopIdle() })
 
-	for _, it := range its {
-		samples := it.RangeValues(metric.Interval{
-			OldestInclusive: from,
-			NewestInclusive: through,
+	if mg.maxConcurrentCommits > 0 {
+		m.commitSema = make(chan struct{}, mg.maxConcurrentCommits)
+	}
+	if mg.sourceQueryConcurrency > 0 {
+		m.querySema = make(chan struct{}, mg.sourceQueryConcurrency)
+	}
+	if mg.nanPolicy != "keep" {
+		m.nanPolicy = mg.nanPolicy
+	}
+	if mg.checkOrder || mg.sortSamples {
+		m.checkOrder, m.sortSamples = true, mg.sortSamples
+	}
+	if mg.detectOverlap {
+		m.overlaps = newOverlapDetector()
+	}
+	if mg.quarantineDir != "" {
+		m.quarantine = &quarantine{dir: mg.quarantineDir, maxSize: mg.quarantineMaxFileSize}
+		mg.onClose(func() { m.quarantine.close() })
+	}
+	if mg.cardinalityExplosionFactor > 0 {
+		m.cardinality = newCardinalityDetector(mg.cardinalityExplosionFactor)
+		m.quarantineExplosions = mg.cardinalityExplosionAction == "quarantine"
+	}
+	if mg.readBufferWindows > 0 {
+		m.prefetch = newPrefetcher(mg.ctx, m)
+		// The reads in the background must be done before the v1
+		// storage is stopped.
+		mg.onClose(func() {
+			mg.cancel()
+			m.prefetch.wait()
 		})
+	}
+	return true
+}
 
-		ls := make(labels.Labels, 0, len(it.Metric().Metric))
-		for k, v := range it.Metric().Metric {
-			ls = append(ls, labels.Label{Name: string(k), Value: string(v)})
+// planSteps lists the steps to migrate and sets up the progress reporting.
+func (mg *migration) planSteps() bool {
+	if mg.reportGaps {
+		mg.gaps = newGapTracker()
+	}
+	if mg.verifyBlocks {
+		mg.verifier = newBlockVerifier(mg.v2DBs[0])
+	}
+
+	// In -verify-only mode, there are no steps and only the verifications
+	// after the migration run.
+	switch {
+	case mg.verifyOnly:
+	case mg.reverse:
+		mg.steps = reverseSteps(mg.startTime, mg.endTime, mg.step, mg.blockRanges[0])
+	default:
+		for t := mg.next; t.Before(mg.endTime); t = t.Add(mg.step) {
+			mg.steps = append(mg.steps, t)
+		}
+	}
+	var density map[model.Time]float64
+	if mg.etaModel == "density-weighted" && len(mg.steps) > 0 {
+		level.Info(mg.logger).Log("msg", "Estimating the data of every step from the v1 chunks for the remaining time")
+		scanStart := time.Now()
+		var err error
+		if density, err = stepDensity(mg.v1Path, mg.steps, mg.step); err != nil {
+			level.Error(mg.logger).Log("msg", "error estimating data per step", "err", err)
+			return false
 		}
-		sort.Sort(ls)
+		level.Info(mg.logger).Log("msg", "Estimated data per step", "duration", time.Since(scanStart))
+	}
+
+	totalSteps := ((mg.endTime.Sub(mg.startTime) + mg.step - 1) / mg.step).Nanoseconds()
+	doneSteps := (mg.next.Sub(mg.startTime) / mg.step).Nanoseconds()
+	mg.status = newMigrationStatus(totalSteps, doneSteps, mg.etaModel)
+	mg.status.setDensity(density)
+	mg.bar = newProgressView(mg.progressMode, mg.status, mg.logger)
+	level.Info(mg.logger).Log("msg", "Total steps", "steps", totalSteps, "done", doneSteps, "eta_model", mg.etaModel)
+	if mg.progressFile != "" {
+		mg.onClose(mg.status.writeEvery(mg.progressFile, mg.progressFileInterval, mg.logger))
+	}
+	if mg.progressRemoteWriteURL != "" {
+		rw := newRemoteWriteStorage(mg.progressRemoteWriteURL, mg.remoteWriteTimeout)
+		mg.onClose(mg.status.remoteWriteEvery(rw, labels.Labels(mg.progressLabels), mg.progressRemoteWriteInterval, mg.logger))
+	}
+	mg.failedInstance = map[model.LabelValue]bool{}
+	for _, f := range mg.tokenFailures {
+		level.Warn(mg.logger).Log("msg", "Skipping instance that failed before the resume token", "instance", f.Instance, "from", f.From, "err", f.Error)
+		mg.failedInstances = append(mg.failedInstances, &WindowMigrationError{Instance: f.Instance, From: f.From, Through: f.Through, Err: errors.New(f.Error)})
+		mg.failedInstance[f.Instance] = true
+	}
 
-		for _, s := range samples {
-			_, err := app.Add(ls, int64(s.Timestamp), float64(s.Value))
+	mg.recentDone = mg.recentFirst == 0
+	if !mg.recentDone {
+		r := model.Time(mg.blockRanges[0])
+		mg.recentFrom = mg.endTime - (model.Time(mg.recentFirst/time.Millisecond)+r-1)/r*r
+		if mg.recentFrom.Before(mg.startTime) {
+			mg.recentFrom = mg.startTime
+		}
+	}
+	return true
+}
 
+// migrateSteps migrates the steps one after another. If the migration stops
+// or fails before the last step, it returns the exit code and false.
+func (mg *migration) migrateSteps() (int, bool) {
+	for i, t := range mg.steps {
+		select {
+		case <-mg.ctx.Done():
+			return mg.stop(t), false
+		default:
+		}
+		if code, ok := mg.migrateStep(i, t); !ok {
+			return code, false
+		}
+	}
+	// No samples are appended after the migration, so the verifications
+	// and other checks that follow must not count as idle.
+	mg.stopIdle()
+	mg.stopIdle = func() {}
+	if mg.blocks != nil {
+		if err := mg.blocks.flush(); err != nil {
+			level.Error(mg.logger).Log("msg", "error writing v2 block", "err", err)
+			return 1, false
+		}
+	}
+
+	if mg.verifier != nil && !verifyNewBlocks(mg.verifier, mg.logger) {
+		return 1, false
+	}
+	return 0, true
+}
+
+// stop stops the migration before the step at t on SIGTERM, -max-runtime or
+// -max-windows and returns the exit code.
+func (mg *migration) stop(t model.Time) int {
+	if mg.reverse {
+		// Only whole block ranges are written. The one before t
+		// is still in memory if t starts a new one.
+		if err := mg.blocks.flushComplete(t); err != nil {
+			level.Error(mg.logger).Log("msg", "error writing v2 block", "err", err)
+			return 1
+		}
+		migratedFrom := t - t%model.Time(mg.blockRanges[0]) + model.Time(mg.blockRanges[0])
+		level.Info(mg.logger).Log("msg", "Migration stopped, re-run with -end-timestamp set to the start of the migrated data to migrate the rest", "migrated_from", migratedFrom)
+		mg.bar.FinishPrint("Migration stopped")
+		return 0
+	}
+	level.Info(mg.logger).Log("msg", "Migration stopped", "next", t, "checkpoint", mg.checkpointFile)
+	if mg.timingReport {
+		mg.timings.report(mg.logger)
+	}
+	if mg.gaps != nil {
+		logGaps(mg.gaps, mg.logger)
+	}
+	mg.bar.FinishPrint("Migration stopped, re-run with the same checkpoint file to resume")
+	if mg.printResumeToken {
+		rt := resumeToken{checkpoint: checkpoint{Start: mg.startTime, End: mg.endTime, Next: t, DedupUntil: mg.dedupUntil}}
+		for _, e := range mg.failedInstances {
+			rt.Failed = append(rt.Failed, reportedFailure{Instance: e.Instance, From: e.From, Through: e.Through, Error: e.Err.Error()})
+		}
+		token, err := encodeResumeToken(rt)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error encoding resume token", "err", err)
+			return 1
+		}
+		fmt.Println(token)
+	}
+	return 0
+}
+
+// migrateStep migrates the i-th step, which starts at t, and records it in
+// the checkpoint. If the migration cannot go on, it returns the exit code and
+// false.
+func (mg *migration) migrateStep(i int, t model.Time) (int, bool) {
+	m := mg.m
+	through := stepEnd(t, mg.endTime, mg.step, mg.exclusiveEnd)
+	if mg.blocks != nil {
+		var err error
+		if mg.blocksPerWindow {
+			err = mg.blocks.startRange(int64(t), int64(through)+1)
+		} else {
+			err = mg.blocks.startBlock(t)
+		}
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error writing v2 block", "err", err)
+			return 1, false
+		}
+	}
+	mg.status.startStep(t)
+	mg.bar.Increment()
+	stepStart := time.Now()
+	appendedBefore, rejectedBefore := atomic.LoadUint64(&m.appended), atomic.LoadUint64(&m.quarantined)
+
+	// Instances of a failure report are migrated from the step they
+	// failed at.
+	var active model.LabelValues
+	for _, instance := range mg.instances {
+		if mg.failedInstance[instance] {
+			continue
+		}
+		if from, ok := mg.retryFrom[instance]; ok && through.Before(from) {
+			continue
+		}
+		active = append(active, instance)
+	}
+	if m.prefetch != nil {
+		ahead := mg.steps[i+1:]
+		if len(ahead) > mg.readBufferWindows {
+			ahead = ahead[:mg.readBufferWindows]
+		}
+		for _, n := range ahead {
+			m.prefetch.start(n, stepEnd(n, mg.endTime, mg.step, mg.exclusiveEnd), active)
+		}
+	}
+	stepErrs := mg.migrateInstances(t, through, active)
+	if m.prefetch != nil {
+		m.prefetch.drop(t)
+	}
+	if len(stepErrs) > 0 {
+		return mg.stepFailed(t, stepErrs), false
+	}
+	if mg.blocksPerWindow {
+		if err := mg.blocks.flush(); err != nil {
+			level.Error(mg.logger).Log("msg", "error writing v2 block", "err", err)
+			return 1, false
+		}
+	}
+	mg.prog.update()
+	mg.status.stepDone()
+	mg.stepDuration.Observe(time.Since(stepStart).Seconds())
+	mg.timings.add(t, time.Since(stepStart))
+
+	// Stop like on reaching -max-runtime, unless this was the last step
+	// anyway.
+	if mg.windowsDone++; mg.windowsDone == mg.maxWindows && mg.windowsDone < len(mg.steps) {
+		level.Warn(mg.logger).Log("msg", "Maximum number of steps reached, stopping", "max_windows", mg.maxWindows)
+		mg.cancel()
+	}
+
+	if mg.verifier != nil {
+		if !verifyNewBlocks(mg.verifier, mg.logger) {
+			return 1, false
+		}
+	}
+
+	if !mg.recentDone && (i+1 == len(mg.steps) || mg.steps[i+1].Before(mg.recentFrom)) {
+		mg.recentDone = true
+		if err := mg.blocks.flush(); err != nil {
+			level.Error(mg.logger).Log("msg", "error writing v2 block", "err", err)
+			return 1, false
+		}
+		level.Info(mg.logger).Log("msg", "Recent data migrated", "from", mg.recentFrom, "end", mg.endTime, "remaining_steps", len(mg.steps)-i-1)
+	}
+
+	if mg.reverse {
+		return 0, true
+	}
+	if err := writeCheckpoint(mg.checkpointFile, checkpoint{Start: mg.startTime, End: mg.endTime, Next: t.Add(mg.step), DedupUntil: mg.dedupUntil}); err != nil {
+		level.Error(mg.logger).Log("msg", "error writing checkpoint", "file", mg.checkpointFile, "err", err)
+		return 1, false
+	}
+
+	rejected := atomic.LoadUint64(&m.quarantined)
+	stepRejected := rejected - rejectedBefore
+	stepTotal := atomic.LoadUint64(&m.appended) - appendedBefore + stepRejected
+	if mg.maxAppendErrors > 0 && rejected > mg.maxAppendErrors || mg.maxAppendErrorRatio > 0 && stepTotal > 0 && float64(stepRejected) > mg.maxAppendErrorRatio*float64(stepTotal) {
+		level.Error(mg.logger).Log("msg", "too many samples rejected by the v2 storage, stopping", "rejected", rejected, "step_rejected", stepRejected, "step_samples", stepTotal, "next", t.Add(mg.step), "checkpoint", mg.checkpointFile)
+		mg.bar.FinishPrint("Migration stopped, check the v2 storage and re-run with the same checkpoint file to resume")
+		return 1, false
+	}
+	return 0, true
+}
+
+// migrateInstances migrates the step from t through through of the active
+// instances, up to -max-parallelism of them at the same time, and returns the
+// errors of the instances that failed it. Instances that are skipped with
+// -skip-failed-instances are recorded as failed instead.
+func (mg *migration) migrateInstances(t, through model.Time, active model.LabelValues) []error {
+	var (
+		wg       sync.WaitGroup
+		errMtx   sync.Mutex
+		stepErrs []error
+	)
+	parallelism := mg.maxParallelism
+	if mg.throttle != nil {
+		parallelism = mg.throttle.parallelism()
+	}
+	sema := make(chan struct{}, parallelism)
+	for _, instance := range active {
+		instance := instance
+		// The instances start in order, so that with -deterministic
+		// they are migrated one after another in sorted order.
+		sema <- struct{}{}
+		wg.Add(1)
+		go func() {
+			mg.status.startInstance(instance)
+			n, err := mg.m.migrate(t, through, instance)
+			for retry := 1; err != nil && retry <= mg.instanceRetries && !destinationFailed(err); retry++ {
+				level.Warn(mg.logger).Log("msg", "Retrying failed step", "instance", instance, "from", t, "retry", retry, "err", err)
+				n, err = mg.m.migrate(t, through, instance)
+			}
+			mg.status.instanceDone(instance, n, err)
 			if err != nil {
-				return err
+				errMtx.Lock()
+				if e, ok := err.(*WindowMigrationError); ok && mg.skipFailedInstances && !destinationFailed(err) {
+					logWindowError(err, mg.logger)
+					level.Warn(mg.logger).Log("msg", "Skipping failed instance for the rest of the migration", "instance", instance)
+					mg.failedInstances = append(mg.failedInstances, e)
+					mg.failedInstance[instance] = true
+				} else {
+					stepErrs = append(stepErrs, err)
+				}
+				errMtx.Unlock()
+			} else {
+				if mg.gaps != nil {
+					mg.gaps.record(instance, t, through, n)
+				}
+				if mg.audit != nil {
+					mg.audit.record(instance, t, through, n)
+				}
+			}
+			<-sema
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	return stepErrs
+}
+
+// stepFailed records the failed step starting at t in the checkpoint where
+// needed and returns the exit code.
+func (mg *migration) stepFailed(t model.Time, errs []error) int {
+	var cp *checkpoint
+	if !mg.reverse {
+		cp = &checkpoint{Start: mg.startTime, End: mg.endTime, Next: t, DedupUntil: mg.dedupUntil}
+	}
+	if failStep(errs, mg.checkpointFile, cp, mg.logger) == exitDestinationFull {
+		if mg.reverse {
+			migratedFrom := t - t%model.Time(mg.blockRanges[0]) + model.Time(mg.blockRanges[0])
+			level.Error(mg.logger).Log("msg", "destination out of disk space, free up space and re-run with -end-timestamp set to the start of the migrated data", "migrated_from", migratedFrom)
+			mg.bar.FinishPrint("Destination out of disk space")
+			return exitDestinationFull
+		}
+		mg.bar.FinishPrint("Destination out of disk space, free up space and re-run with the same checkpoint file to resume")
+		return exitDestinationFull
+	}
+	if !mg.reverse && (mg.commitSamples > 0 || mg.commitSeries > 0 || mg.sourceSampleLimit > 0) {
+		// The step may have been committed in part. Record it
+		// as the next step like above, so that retrying skips
+		// the committed samples.
+		if err := writeCheckpoint(mg.checkpointFile, checkpoint{Start: mg.startTime, End: mg.endTime, Next: t, DedupUntil: mg.dedupUntil}); err != nil {
+			level.Error(mg.logger).Log("msg", "error writing checkpoint", "file", mg.checkpointFile, "err", err)
+		}
+	}
+	mg.bar.FinishPrint("Migration failed, re-run with the same checkpoint file to retry the failed step")
+	return 1
+}
+
+// verify runs the verifications of the migrated data against the v1 storage,
+// the v2 index and -compare-url. It returns the mismatches it found, and false
+// if a verification could not run.
+func (mg *migration) verify() ([]string, bool) {
+	var errs []string
+	migrated := mg.instances
+	if len(mg.failedInstances) > 0 {
+		migrated = nil
+		for _, i := range mg.instances {
+			if !mg.failedInstance[i] {
+				migrated = append(migrated, i)
+			}
+		}
+	}
+	through := mg.endTime
+	if mg.exclusiveEnd {
+		through--
+	}
+
+	if mg.verifyValuesFlag || mg.verifyCounterResets {
+		checked, failed, err := verifyValues(mg.m, migrated, mg.startTime, through, mg.verifyValuesFraction, mg.verifyValuesFlag, mg.verifyCounterResets, mg.logger)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error verifying samples", "err", err)
+			return nil, false
+		}
+		if failed > 0 {
+			level.Error(mg.logger).Log("msg", "samples differ between v1 and v2 storage", "series_checked", checked, "series_failed", failed)
+			errs = append(errs, fmt.Sprintf("samples of %d of %d checked series differ between v1 and v2 storage", failed, checked))
+		} else {
+			level.Info(mg.logger).Log("msg", "Verified samples", "series", checked)
+		}
+	}
+	if mg.verifySampleOrderFlag {
+		checked, failed, duplicates, err := verifySampleOrder(mg.v2Dirs, mg.v2DBs, mg.startTime, through, mg.verifyValuesFraction, mg.logger)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error verifying sample order", "err", err)
+			return nil, false
+		}
+		if failed > 0 {
+			level.Error(mg.logger).Log("msg", "samples out of order in v2 storage", "series_checked", checked, "series_failed", failed, "duplicate_samples", duplicates)
+			errs = append(errs, fmt.Sprintf("samples of %d of %d checked series are out of order in v2 storage", failed, checked))
+		} else {
+			level.Info(mg.logger).Log("msg", "Verified sample order", "series", checked, "duplicate_samples", duplicates)
+		}
+	}
+	if mg.verifyIndexFlag {
+		checked, missing, extra, err := verifyIndex(mg.v2Query, mg.m.migrated, mg.startTime, through, mg.logger)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error verifying v2 index", "err", err)
+			return nil, false
+		}
+		if missing > 0 {
+			level.Error(mg.logger).Log("msg", "label pairs of migrated series missing in v2 index", "pairs_checked", checked, "missing", missing, "extra", extra)
+			errs = append(errs, fmt.Sprintf("%d of %d label pairs of migrated series are missing in v2 index", missing, checked))
+		} else {
+			level.Info(mg.logger).Log("msg", "Verified v2 index", "pairs", checked, "extra", extra)
+		}
+	}
+	if mg.compareURL != "" {
+		c := &liveComparer{
+			url:         mg.compareURL,
+			bearerToken: mg.compareToken,
+			client:      &http.Client{Timeout: mg.compareTimeout},
+			step:        mg.compareStep,
+			lookback:    mg.compareLookback,
+		}
+		checked, failed, err := c.compare(mg.m, mg.startTime, through, mg.verifyValuesFraction, mg.logger)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error comparing with live Prometheus", "url", redactURL(mg.compareURL), "err", err)
+			return nil, false
+		}
+		if failed > 0 {
+			level.Error(mg.logger).Log("msg", "query results differ between live Prometheus and v2 storage", "series_checked", checked, "series_failed", failed)
+			errs = append(errs, fmt.Sprintf("query results of %d of %d checked series differ between live Prometheus and v2 storage", failed, checked))
+		} else {
+			level.Info(mg.logger).Log("msg", "Compared with live Prometheus", "series", checked)
+		}
+	}
+	return errs, true
+}
+
+// finish records the completed migration, post-processes the v2 blocks and
+// runs the checks after the migration. errs are the verification mismatches,
+// which are reported together with the failed checks. It returns the exit
+// code.
+func (mg *migration) finish(errs []string) int {
+	verified := len(errs) == 0
+	if !mg.recordCompletion(verified) {
+		return 1
+	}
+	if mg.m.quarantine != nil {
+		if err := mg.m.quarantine.close(); err != nil {
+			level.Error(mg.logger).Log("msg", "error closing quarantine file", "file", mg.m.quarantine.path, "err", err)
+			return 1
+		}
+	}
+	mg.logSummary()
+	if !mg.processBlocks() {
+		return 1
+	}
+	errs, ok := mg.postChecks(errs)
+	if !ok {
+		return 1
+	}
+	if mg.reportFile != "" {
+		r := newMigrationReport(mg.startTime, mg.endTime, mg.status, mg.timings, mg.instances, mg.failedInstances)
+		r.Failed, r.SamplesAppended = len(errs) > 0, mg.m.appended
+		r.Errors = append(r.Errors, errs...)
+		mg.m.reportSkipped(&r)
+		if err := writeReport(mg.reportFile, mg.reportFormat, r); err != nil {
+			level.Error(mg.logger).Log("msg", "error writing report", "file", mg.reportFile, "err", err)
+			return 1
+		}
+	}
+	if len(errs) > 0 {
+		mg.bar.FinishPrint("Migration Complete with errors")
+		return 1
+	}
+	mg.bar.FinishPrint("Migration Complete")
+	return 0
+}
+
+// recordCompletion writes the failure report and, if the migration is
+// complete, the manifest, and removes the checkpoint unless the migrated data
+// failed verification.
+func (mg *migration) recordCompletion(verified bool) bool {
+	// The manifest records a complete migration, which it is not if
+	// instances were skipped or the migrated data failed verification.
+	if mg.failureReportFile != "" {
+		report := failureReport{Start: mg.startTime, End: mg.endTime, Failures: []reportedFailure{}}
+		for _, e := range mg.failedInstances {
+			report.Failures = append(report.Failures, reportedFailure{Instance: e.Instance, From: e.From, Through: e.Through, Error: e.Err.Error()})
+		}
+		if err := writeFailureReport(mg.failureReportFile, report); err != nil {
+			level.Error(mg.logger).Log("msg", "error writing failure report", "file", mg.failureReportFile, "err", err)
+			return false
+		}
+	}
+	if len(mg.failedInstances) == 0 && verified {
+		man := manifest{Start: mg.startTime, End: mg.endTime, Completed: time.Now()}
+		if mg.prevManifest != nil && mg.dedupUntil != 0 && mg.prevManifest.Start.Before(mg.startTime) {
+			man.Start = mg.prevManifest.Start
+		}
+		// Together with the run that wrote the failure report, the
+		// reported migration is complete.
+		if mg.retry != nil {
+			man.Start = mg.retry.Start
+		}
+		if err := writeManifest(mg.manifestFile, man); err != nil {
+			level.Error(mg.logger).Log("msg", "error writing manifest", "file", mg.manifestFile, "err", err)
+			return false
+		}
+	}
+	// A run that failed verification keeps its checkpoint, so that running
+	// it again only verifies.
+	if verified {
+		if err := os.Remove(mg.checkpointFile); err != nil && !os.IsNotExist(err) {
+			level.Warn(mg.logger).Log("msg", "error removing checkpoint", "file", mg.checkpointFile, "err", err)
+		}
+	}
+	return true
+}
+
+// logSummary logs the step timings, the gaps and what the migration skipped,
+// dropped, changed or quarantined.
+func (mg *migration) logSummary() {
+	m, logger := mg.m, mg.logger
+	if mg.timingReport {
+		mg.timings.report(logger)
+	}
+	if mg.gaps != nil {
+		logGaps(mg.gaps, logger)
+	}
+	if n := m.skippedExisting; n > 0 {
+		level.Info(logger).Log("msg", "Skipped samples already present in v2 storage", "samples", n)
+	}
+	if m.sparse != nil && m.sparse.size() > 0 {
+		level.Info(logger).Log("msg", "Dropped series with too few samples", "series", m.sparse.size(), "min_samples_per_series", mg.minSamplesPerSeries)
+	}
+	if n := m.mergedSeries.count(); n > 0 {
+		level.Info(logger).Log("msg", "Merged series with identical labels", "series", n)
+	}
+	if n := m.invalidTimes; n > 0 {
+		level.Warn(logger).Log("msg", "Dropped samples with invalid timestamps", "samples", n, "quarantined", m.quarantine != nil)
+	}
+	if m.checkOrder {
+		if n := m.unordered; n == 0 {
+			level.Info(logger).Log("msg", "All samples were in increasing order of their timestamps")
+		} else if m.sortSamples {
+			level.Warn(logger).Log("msg", "Sorted samples of series with non-monotonic timestamps", "unordered_samples", n)
+		} else {
+			level.Warn(logger).Log("msg", "Found series with non-monotonic timestamps, the v2 storage dropped their unordered samples", "unordered_samples", n)
+		}
+	}
+	if n := m.defaultedSeries.count(); n > 0 {
+		level.Info(logger).Log("msg", "Added default labels to series without them", "series", n)
+	}
+	if n := m.droppedRepeated; n > 0 {
+		level.Info(logger).Log("msg", "Dropped samples with repeated values", "samples", n)
+	}
+	if m.overlaps != nil {
+		if n := m.overlaps.skipped; n > 0 {
+			level.Warn(logger).Log("msg", "Skipped samples at or before the latest sample committed in an earlier step", "samples", n)
+		} else {
+			level.Info(logger).Log("msg", "No samples were appended in more than one step")
+		}
+	}
+	if n := m.nanValues; n > 0 {
+		if m.nanPolicy == "drop" {
+			level.Info(logger).Log("msg", "Dropped samples with NaN values", "samples", n, "quarantined", m.quarantine != nil)
+		} else {
+			level.Info(logger).Log("msg", "Replaced NaN values with staleness markers", "samples", n)
+		}
+	}
+	if n := m.longLabelValues.count(); n > 0 {
+		if m.skipLongLabelValues {
+			level.Warn(logger).Log("msg", "Skipped series with too long label values", "series", n)
+		} else {
+			level.Warn(logger).Log("msg", "Truncated too long label values of series", "series", n)
+		}
+	}
+	if n := m.quarantined; n > 0 {
+		level.Warn(logger).Log("msg", "Quarantined samples rejected by the v2 storage", "samples", n, "dir", m.quarantine.dir, "files", m.quarantine.files, "last_file", m.quarantine.path)
+	}
+	if n := m.explodedSteps; n > 0 {
+		level.Warn(logger).Log("msg", "Quarantined steps of instances with a cardinality explosion", "steps", n, "samples", m.explodedSamples, "dir", m.quarantine.dir, "last_file", m.quarantine.path)
+	}
+	if n := m.nameViolations.count(); n > 0 {
+		level.Warn(logger).Log("msg", "Skipped series with invalid names", "series", n)
+	}
+	if n := m.labelViolations.count(); n > 0 {
+		level.Warn(logger).Log("msg", "Skipped series with invalid labels", "series", n)
+	}
+	if n := m.duplicateLabels.count(); n > 0 {
+		level.Warn(logger).Log("msg", "Dropped duplicate label names", "series", n)
+	}
+}
+
+// processBlocks compacts, collects, checks, labels, audits and measures the
+// v2 blocks as selected by the flags.
+func (mg *migration) processBlocks() bool {
+	if mg.compactAfter {
+		persistHead(mg.ctx, mg.v2DBs[0], mg.blockRanges[0], &mg.prog, mg.logger)
+	}
+	if mg.gcBlocksFlag || mg.compactAfter {
+		mg.v2Open = false
+		for _, db := range mg.v2DBs {
+			if err := db.Close(); err != nil {
+				level.Error(mg.logger).Log("msg", "error closing v2 storage", "err", err)
+				return false
+			}
+		}
+	}
+	if mg.compactAfter {
+		if err := compactBlocks(mg.v2Dir, mg.blockRanges, &mg.prog, mg.logger); err != nil {
+			level.Error(mg.logger).Log("msg", "error compacting v2 storage", "err", err)
+			return false
+		}
+	}
+	if mg.gcBlocksFlag && !collectBlocks(mg.v2Dirs, mg.logger) {
+		return false
+	}
+	if mg.targetVersion != "" {
+		for _, dir := range mg.v2Dirs {
+			if err := checkBlockVersions(dir, mg.targetVersion); err != nil {
+				level.Error(mg.logger).Log("msg", "v2 storage is incompatible with target Prometheus version", "dir", dir, "err", err)
+				return false
 			}
 		}
 	}
+	if len(mg.blockMetaLabels) > 0 {
+		n, err := labelBlocks(mg.v2Dirs, mg.existingV2Blocks, labels.Labels(mg.blockMetaLabels))
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error labeling v2 blocks", "err", err)
+			return false
+		}
+		level.Info(mg.logger).Log("msg", "Added Thanos labels to written v2 blocks", "blocks", n, "labels", labels.Labels(mg.blockMetaLabels))
+	}
+	if mg.audit != nil {
+		audited, err := mg.audit.report(mg.v2Dir)
+		if err == nil {
+			err = writeJSONFile(mg.blockAuditFile, audited)
+		}
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error writing block audit", "file", mg.blockAuditFile, "err", err)
+			return false
+		}
+	}
 
-	return app.Commit()
+	if mg.measureCompressionRatio {
+		blocks, total, err := measureCompression(mg.v2Dirs, mg.existingV2Blocks)
+		if err != nil {
+			level.Error(mg.logger).Log("msg", "error measuring v2 block sizes", "err", err)
+			return false
+		}
+		if mg.compressionRatioPerBlock {
+			for _, b := range blocks {
+				level.Info(mg.logger).Log("msg", "Block compression", "block", b.ULID, "mint", b.MinTime, "maxt", b.MaxTime, "samples", b.Samples, "bytes", b.Bytes, "bytes_per_sample", fmt.Sprintf("%.3f", b.bytesPerSample()), "ratio", fmt.Sprintf("%.2f", b.ratio()))
+			}
+		}
+		if total.Samples == 0 {
+			level.Info(mg.logger).Log("msg", "No v2 blocks were written to measure the compression ratio of, samples may still be in the head", "samples_appended", mg.m.appended)
+		} else {
+			level.Info(mg.logger).Log("msg", "Compression ratio of written v2 blocks", "blocks", len(blocks), "samples", total.Samples, "bytes", total.Bytes, "bytes_per_sample", fmt.Sprintf("%.3f", total.bytesPerSample()), "ratio", fmt.Sprintf("%.2f", total.ratio()), "samples_appended", mg.m.appended)
+		}
+	}
+	return true
+}
+
+// postChecks checks the v2 blocks for overlaps, the migrated series and
+// samples against -expect-series and -expect-samples, and the failed instances
+// and destinations. It returns errs with the failed checks appended, and false
+// if a check could not run.
+func (mg *migration) postChecks(errs []string) ([]string, bool) {
+	m := mg.m
+	if mg.verifyNoOverlap != "" {
+		switch n, err := checkOverlaps(mg.v2Dirs, mg.logger); {
+		case err != nil:
+			level.Error(mg.logger).Log("msg", "error reading v2 blocks", "err", err)
+			return nil, false
+		case n > 0 && mg.verifyNoOverlap == "fail":
+			level.Error(mg.logger).Log("msg", "found overlapping v2 blocks", "overlaps", n)
+			errs = append(errs, fmt.Sprintf("found %d overlapping v2 blocks", n))
+		case n > 0:
+			level.Warn(mg.logger).Log("msg", "Found overlapping v2 blocks", "overlaps", n)
+		default:
+			level.Info(mg.logger).Log("msg", "Verified that v2 blocks do not overlap")
+		}
+	}
+	if mg.expectSeries >= 0 && !withinTolerance(float64(m.migrated.size()), float64(mg.expectSeries), mg.expectTolerance) {
+		level.Error(mg.logger).Log("msg", "number of migrated series differs from expected", "series", m.migrated.size(), "expected", mg.expectSeries, "tolerance", mg.expectTolerance)
+		errs = append(errs, fmt.Sprintf("migrated %d series instead of the expected %d", m.migrated.size(), mg.expectSeries))
+	}
+	if mg.expectSamples >= 0 && !withinTolerance(float64(m.appended), float64(mg.expectSamples), mg.expectTolerance) {
+		level.Error(mg.logger).Log("msg", "number of migrated samples differs from expected", "samples", m.appended, "expected", mg.expectSamples, "tolerance", mg.expectTolerance)
+		errs = append(errs, fmt.Sprintf("migrated %d samples instead of the expected %d", m.appended, mg.expectSamples))
+	}
+	for _, e := range mg.failedInstances {
+		level.Error(mg.logger).Log("msg", "instance failed and was not migrated from the failed step on", "instance", e.Instance, "from", e.From, "err", e.Err)
+		errs = append(errs, fmt.Sprintf("instance %s failed and was not migrated from %s on: %s", e.Instance, e.From, e.Err))
+	}
+	for _, d := range mg.dests.dests {
+		if d.errors > 0 {
+			level.Error(mg.logger).Log("msg", "destination is missing data of failed steps", "destination", d.name, "failed_steps", d.errors)
+			errs = append(errs, fmt.Sprintf("destination %s is missing data of %d failed steps", d.name, d.errors))
+		}
+	}
+	return errs, true
+}
+
+// withinTolerance reports whether got differs from want by at most tolerance
+// relative to want.
+func withinTolerance(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance*want
+}
+
+// stepEnd returns the inclusive end of the step starting at t. Steps do not
+// overlap, so a sample at the boundary between two steps is only migrated by
+// the later one. The last step ends at end, which is only included in the
+// migration if exclusiveEnd is false.
+func stepEnd(t, end model.Time, step time.Duration, exclusiveEnd bool) model.Time {
+	if next := t.Add(step); next.Before(end) {
+		return next - 1
+	}
+	if exclusiveEnd {
+		return end - 1
+	}
+	return end
+}
+
+// verifyNewBlocks verifies all v2 blocks that have been written since the
+// last verification. It returns false if any of them is broken.
+func verifyNewBlocks(v *blockVerifier, logger log.Logger) bool {
+	n, err := v.verifyNew()
+	if err != nil {
+		level.Error(logger).Log("msg", "error verifying v2 block", "err", err)
+		return false
+	}
+	if n > 0 {
+		level.Info(logger).Log("msg", "Verified new v2 blocks", "blocks", n)
+	}
+	return true
+}
+
+// collectBlocks deletes superseded blocks from the v2 storage directories. It
+// returns false if that failed.
+func collectBlocks(dirs []string, logger log.Logger) bool {
+	for _, dir := range dirs {
+		deleted, err := gcBlocks(dir)
+		if err != nil {
+			level.Error(logger).Log("msg", "error deleting superseded v2 blocks", "dir", dir, "err", err)
+			return false
+		}
+		for _, b := range deleted {
+			level.Info(logger).Log("msg", "Deleted superseded v2 block", "block", b.ULID, "mint", b.MinTime, "maxt", b.MaxTime)
+		}
+	}
+	return true
+}
+
+// checkOverlaps logs every pair of overlapping blocks in the v2 storage
+// directories and returns their number.
+func checkOverlaps(dirs []string, logger log.Logger) (int, error) {
+	n := 0
+	for _, dir := range dirs {
+		metas, err := readBlockMetas(dir)
+		if err != nil {
+			return n, err
+		}
+		overlaps := overlappingBlocks(metas)
+		for _, o := range overlaps {
+			level.Warn(logger).Log("msg", "Overlapping v2 blocks", "dir", dir, "block", o[0].ULID, "mint", model.Time(o[0].MinTime), "maxt", model.Time(o[0].MaxTime), "overlapping_block", o[1].ULID, "overlapping_mint", model.Time(o[1].MinTime), "overlapping_maxt", model.Time(o[1].MaxTime))
+		}
+		n += len(overlaps)
+	}
+	return n, nil
+}
+
+// logWindowError logs an error returned by the migrator, including whether
+// retrying may help.
+func logWindowError(err error, logger log.Logger) {
+	e, ok := err.(*WindowMigrationError)
+	if !ok {
+		level.Error(logger).Log("msg", "error migrating", "err", err)
+		return
+	}
+	kvs := []interface{}{"msg", "error migrating", "instance", e.Instance, "from", e.From, "through", e.Through, "retriable", e.Retriable()}
+	if e.Reason != nil {
+		kvs = append(kvs, "reason", e.Reason)
+	}
+	level.Error(logger).Log(append(kvs, "err", e.Err)...)
+}
+
+// failStep logs the errors of a failed step and returns the exit code of the
+// migration. If a destination ran out of disk space, it first writes the
+// checkpoint cp, whose Next is the failed step, unless cp is nil.
+func failStep(errs []error, checkpointFile string, cp *checkpoint, logger log.Logger) int {
+	full := false
+	for _, err := range errs {
+		logWindowError(err, logger)
+		if e, ok := err.(*WindowMigrationError); ok && e.Reason == ErrDestinationFull {
+			full = true
+		}
+	}
+	if !full {
+		return 1
+	}
+	if cp == nil {
+		return exitDestinationFull
+	}
+	// The failed appends and commits were rolled back, but other instances
+	// committed the step. Record it as the next step so that resuming skips
+	// the samples that made it to the v2 storage, even if this run has not
+	// written a checkpoint yet.
+	if err := writeCheckpoint(checkpointFile, *cp); err != nil {
+		level.Error(logger).Log("msg", "error writing checkpoint", "file", checkpointFile, "err", err)
+	}
+	return exitDestinationFull
+}
+
+// logGaps logs all gaps found by the gap tracker.
+func logGaps(g *gapTracker, logger log.Logger) {
+	gaps := g.report()
+	for _, gap := range gaps {
+		level.Info(logger).Log("msg", "Gap in data", "instance", gap.instance, "from", gap.from, "through", gap.through)
+	}
+	level.Info(logger).Log("msg", "Gap report complete", "gaps", len(gaps))
+}
+
+// alignRange extends [start, end] to the enclosing multiples of align.
+func alignRange(start, end model.Time, align time.Duration) (model.Time, model.Time) {
+	a := model.Time(align / time.Millisecond)
+	start -= start % a
+	if end%a != 0 {
+		end += a - end%a
+	}
+	return start, end
+}
+
+// warmupV1 looks up the metrics of every instance, i.e. value of the shard
+// label, for the whole migration range, pulling the relevant parts of the v1
+// index and series archive into the caches before the first step is
+// migrated.
+func warmupV1(v1Storage *local.MemorySeriesStorage, shardLabel model.LabelName, instances model.LabelValues, from, through model.Time, maxParallelism int) error {
+	var (
+		wg   sync.WaitGroup
+		mtx  sync.Mutex
+		errs []error
+	)
+	sema := make(chan struct{}, maxParallelism)
+	for _, instance := range instances {
+		matchers, err := shardMatchers(shardLabel, instance)
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			sema <- struct{}{}
+			if _, err := v1Storage.MetricsForLabelMatchers(context.Background(), from, through, matchers); err != nil {
+				mtx.Lock()
+				errs = append(errs, err)
+				mtx.Unlock()
+			}
+			<-sema
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
 }
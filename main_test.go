@@ -0,0 +1,848 @@
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// testStart is the start of the samples of the test storages.
+const testStart = model.Time(1500000000000)
+
+// newTestV1Options returns the options of a v1 storage in dir.
+func newTestV1Options(dir string) *local.MemorySeriesStorageOptions {
+	return &local.MemorySeriesStorageOptions{
+		TargetHeapSize:             1e9,
+		PersistenceRetentionPeriod: 999999 * time.Hour,
+		PersistenceStoragePath:     dir,
+		CheckpointInterval:         999999 * time.Hour,
+		CheckpointDirtySeriesLimit: 1e9,
+		MinShrinkRatio:             0.1,
+		SyncStrategy:               local.Never,
+	}
+}
+
+// newTestV1Dir returns a temporary directory with a v1 storage holding the
+// given samples, and a function that removes it.
+func newTestV1Dir(t testing.TB, samples []*model.Sample) (string, func()) {
+	dir, err := ioutil.TempDir("", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := local.NewMemorySeriesStorage(newTestV1Options(dir))
+	if err := s.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	for _, smpl := range samples {
+		if err := s.Append(smpl); err != nil {
+			s.Stop()
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	s.WaitForIndexing()
+	if err := s.Stop(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// newTestV1Storage returns a started v1 storage in a temporary directory
+// with the given samples, loaded from disk like a stopped Prometheus 1, and
+// a function that stops and removes it.
+func newTestV1Storage(t testing.TB, samples []*model.Sample) (*local.MemorySeriesStorage, func()) {
+	dir, remove := newTestV1Dir(t, samples)
+	s := local.NewMemorySeriesStorage(newTestV1Options(dir))
+	if err := s.Start(); err != nil {
+		remove()
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Stop()
+		remove()
+	}
+}
+
+// newTestV2Storage returns an open v2 storage in a temporary directory with
+// 2h blocks, and a function that closes and removes it.
+func newTestV2Storage(t testing.TB) (*tsdb.DB, func()) {
+	dir, err := ioutil.TempDir("", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := tsdb.Open(dir, log.NewNopLogger(), nil, &tsdb.Options{
+		WALFlushInterval:  time.Hour,
+		RetentionDuration: 999999 * 24 * 60 * 60 * 1000,
+		BlockRanges:       tsdb.ExponentialBlockRanges(int64(2*time.Hour/time.Millisecond), 10, 3),
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testSamples returns a sample every 15s in [testStart, testStart+d) of n
+// series named test_metric, with an idx label, of each of the instances.
+func testSamples(instances []string, n int, d time.Duration) []*model.Sample {
+	var samples []*model.Sample
+	for t := testStart; t.Before(testStart.Add(d)); t = t.Add(15 * time.Second) {
+		for _, instance := range instances {
+			for i := 0; i < n; i++ {
+				samples = append(samples, &model.Sample{
+					Metric:    model.Metric{model.MetricNameLabel: "test_metric", model.InstanceLabel: model.LabelValue(instance), "idx": model.LabelValue(fmt.Sprint(i))},
+					Timestamp: t,
+					Value:     model.SampleValue(i),
+				})
+			}
+		}
+	}
+	return samples
+}
+
+// testInstances returns the instances host0:9090 to host<n-1>:9090.
+func testInstances(n int) []string {
+	res := make([]string, n)
+	for i := range res {
+		res[i] = fmt.Sprintf("host%d:9090", i)
+	}
+	return res
+}
+
+// newTestMigrator returns a migrator from v1 to v2.
+func newTestMigrator(v1 *local.MemorySeriesStorage, v2 appendable) *migrator {
+	return &migrator{
+		v1Storage:  v1,
+		shardLabel: model.InstanceLabel,
+		v2Storage:  v2,
+		logger:     log.NewNopLogger(),
+		activity:   &progress{},
+	}
+}
+
+// migrateTestInstance migrates the series of instance in [from, through]
+// with m.
+func migrateTestInstance(m *migrator, instance string, from, through model.Time) error {
+	_, err := m.migrate(from, through, model.LabelValue(instance))
+	return err
+}
+
+func TestWarmupSteadiesThroughput(t *testing.T) {
+	instances := testInstances(20)
+	v1, closeV1 := newTestV1Storage(t, testSamples(instances, 10, 4*time.Hour))
+	defer closeV1()
+	db, closeV2 := newTestV2Storage(t)
+	defer closeV2()
+
+	values := make(model.LabelValues, len(instances))
+	for i, instance := range instances {
+		values[i] = model.LabelValue(instance)
+	}
+	through := testStart.Add(4*time.Hour) - 1
+	if err := warmupV1(v1, model.InstanceLabel, values, testStart, through, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newTestMigrator(v1, db)
+	var durations []time.Duration
+	for from := testStart; from.Before(through); from = from.Add(time.Hour) {
+		start := time.Now()
+		for _, instance := range instances {
+			if err := migrateTestInstance(m, instance, from, from.Add(time.Hour)-1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		durations = append(durations, time.Since(start))
+	}
+
+	later := append([]time.Duration(nil), durations[1:]...)
+	sort.Slice(later, func(i, j int) bool { return later[i] < later[j] })
+	if median := later[len(later)/2]; durations[0] > 4*median+50*time.Millisecond {
+		t.Errorf("first step took %s after warming up, later steps %s", durations[0], median)
+	}
+}
+
+// runMain runs the migrator with the command line arguments args and returns
+// its exit code.
+func runMain(args ...string) int {
+	defer func(args []string) { os.Args = args }(os.Args)
+	flag.CommandLine = flag.NewFlagSet("migrator", flag.ExitOnError)
+	os.Args = append([]string{"migrator"}, args...)
+	return run()
+}
+
+// storedTimestamps returns the timestamps of the samples of every series in
+// the v2 storage in dir, by the string form of their labels.
+func storedTimestamps(t *testing.T, dir string) map[string][]int64 {
+	db := openTestV2(t, dir)
+	defer db.Close()
+	q, err := db.Querier(math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	res := map[string][]int64{}
+	set := q.Select(labels.NewPrefixMatcher(model.MetricNameLabel, ""))
+	for set.Next() {
+		ls := set.At().Labels().String()
+		it := set.At().Iterator()
+		for it.Next() {
+			ts, _ := it.At()
+			res[ls] = append(res[ls], ts)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// tempDir returns a new temporary directory and a function that removes it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "migrator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// distinct returns the distinct timestamps of ts.
+func distinct(ts []int64) map[int64]struct{} {
+	res := make(map[int64]struct{}, len(ts))
+	for _, t := range ts {
+		res[t] = struct{}{}
+	}
+	return res
+}
+
+func TestMaxRuntime(t *testing.T) {
+	// The range is short enough for the v2 storage not to compact its head
+	// during the test, which takes at least 3h of samples, so that the first
+	// run stops early even with many steps.
+	const d = 150 * time.Minute
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(4), 1, d))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	end := testStart.Add(d)
+	args := []string{
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "5s",
+		"-end-timestamp", fmt.Sprint(end.Unix()), "-lookback", d.String(),
+	}
+
+	runMain(append(args, "-max-runtime", "100ms")...)
+	cp, err := readCheckpoint(filepath.Join(v2Dir, "migrator.checkpoint"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp == nil {
+		t.Fatal("no checkpoint after reaching the maximum runtime")
+	}
+	if !cp.Next.After(cp.Start) || !cp.Next.Before(cp.End) {
+		t.Fatalf("checkpoint %+v does not continue within the range", cp)
+	}
+	partial := storedTimestamps(t, v2Dir)
+	if len(partial) == 0 {
+		t.Fatal("no samples committed before stopping")
+	}
+	for ls, ts := range partial {
+		if last := ts[len(ts)-1]; last > int64(cp.Next) {
+			t.Errorf("series %s has sample %d after the checkpoint %d", ls, last, cp.Next)
+		}
+	}
+
+	runMain(args...)
+	if cp, err := readCheckpoint(filepath.Join(v2Dir, "migrator.checkpoint")); err != nil || cp != nil {
+		t.Errorf("got checkpoint %+v and error %v after resuming, want none", cp, err)
+	}
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 4 {
+		t.Fatalf("got %d series, want 4", len(got))
+	}
+	want := int(d / (15 * time.Second))
+	for ls, ts := range got {
+		if n := len(distinct(ts)); n != want {
+			t.Errorf("series %s has samples at %d timestamps after resuming, want %d", ls, n, want)
+		}
+	}
+}
+
+func TestResumeKeepsWALSamples(t *testing.T) {
+	const d = 6 * time.Hour
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 1, d))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	args := []string{
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", d.String(),
+		"-end-timestamp", fmt.Sprint(testStart.Add(d).Unix()),
+	}
+
+	// The first run stops before the v2 storage writes a block, so its
+	// samples are only in the WAL when the second run opens it, and in the
+	// block range before the one the second run starts in.
+	if code := runMain(append(args, "-max-windows", "9")...); code != 0 {
+		t.Fatalf("first run exited with %d", code)
+	}
+	if code := runMain(args...); code != 0 {
+		t.Fatalf("resumed run exited with %d", code)
+	}
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 1 {
+		t.Fatalf("got %d series, want 1", len(got))
+	}
+	want := int(d / (15 * time.Second))
+	for ls, ts := range got {
+		if n := len(distinct(ts)); n != want || ts[0] != int64(testStart) {
+			t.Errorf("series %s has samples at %d timestamps from %d after resuming, want %d from %d", ls, n, ts[0], want, testStart)
+		}
+	}
+}
+
+func TestExclusiveEnd(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 2, time.Hour))
+	defer removeV1()
+	// The range of 25m has a sample at its start and end, and does not end
+	// at a step boundary.
+	end := testStart.Add(30 * time.Minute)
+	for _, tc := range []struct {
+		exclusive bool
+		want      int
+	}{
+		{exclusive: false, want: 101},
+		{exclusive: true, want: 100},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "25m",
+			"-end-timestamp", fmt.Sprint(end.Unix()), fmt.Sprintf("-exclusive-end=%v", tc.exclusive),
+		)
+		got := storedTimestamps(t, v2Dir)
+		if len(got) != 2 {
+			t.Fatalf("exclusive %v: got %d series, want 2", tc.exclusive, len(got))
+		}
+		for ls, ts := range got {
+			if len(ts) != tc.want {
+				t.Errorf("exclusive %v: series %s has %d samples, want %d", tc.exclusive, ls, len(ts), tc.want)
+			}
+		}
+	}
+}
+
+func TestEmptyRange(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 1, time.Hour))
+	defer removeV1()
+	for _, allow := range []bool{false, true} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		args := []string{"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-lookback", "0", "-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix())}
+		if allow {
+			args = append(args, "-allow-empty")
+		}
+		var (
+			code int
+			out  string
+		)
+		logs := captureStderr(t, func() {
+			out = captureStdout(t, func() { code = runMain(args...) })
+		})
+		if allow {
+			if code != 0 || logLine(logs, "Time range to migrate is empty") == "" {
+				t.Errorf("allowed: got exit code %d, want 0 and a warning, logs:\n%s", code, logs)
+			}
+			continue
+		}
+		if code != 1 || logLine(logs, "time range to migrate is empty, check -lookback and -end-timestamp or pass -allow-empty") == "" {
+			t.Errorf("got exit code %d, want 1 and an error, logs:\n%s", code, logs)
+		}
+		if strings.Contains(out, "Migration Complete") {
+			t.Errorf("got output %q, want the migration not to be reported as complete", out)
+		}
+	}
+}
+
+func TestStepEnd(t *testing.T) {
+	const end = model.Time(3600000)
+	for _, tc := range []struct {
+		t            model.Time
+		exclusiveEnd bool
+		want         model.Time
+	}{
+		{t: 0, want: 599999},
+		{t: 0, exclusiveEnd: true, want: 599999},
+		// The last step ends exactly at the end of the range.
+		{t: 3000000, want: end},
+		{t: 3000000, exclusiveEnd: true, want: end - 1},
+		// The last step is shorter than a step.
+		{t: 3300000, want: end},
+		{t: 3300000, exclusiveEnd: true, want: end - 1},
+	} {
+		if got := stepEnd(tc.t, end, 10*time.Minute, tc.exclusiveEnd); got != tc.want {
+			t.Errorf("stepEnd(%d, exclusiveEnd %v) = %d, want %d", tc.t, tc.exclusiveEnd, got, tc.want)
+		}
+	}
+}
+
+// openTestV2 opens the v2 storage in dir with 2h blocks.
+func openTestV2(t *testing.T, dir string) *tsdb.DB {
+	db, err := tsdb.Open(dir, log.NewNopLogger(), nil, &tsdb.Options{
+		WALFlushInterval:  time.Hour,
+		RetentionDuration: 999999 * 24 * 60 * 60 * 1000,
+		BlockRanges:       tsdb.ExponentialBlockRanges(int64(2*time.Hour/time.Millisecond), 10, 3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// headChecksum writes the head of the v2 storage in dir to a block and
+// returns the SHA-256 checksum of its chunk files.
+func headChecksum(t *testing.T, dir string) string {
+	db := openTestV2(t, dir)
+	defer db.Close()
+	tmp, removeTmp := tempDir(t)
+	defer removeTmp()
+
+	c, err := tsdb.NewLeveledCompactor(nil, log.NewNopLogger(), []int64{int64(2 * time.Hour / time.Millisecond)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write(tmp, db.Head(), math.MinInt64, math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(tmp, "*", "chunks", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no chunk files written")
+	}
+	h := sha256.New()
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Write(b)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func TestDeterministic(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(3), 3, 2*time.Hour))
+	defer removeV1()
+
+	var sums []string
+	for i := 0; i < 2; i++ {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-deterministic", "-max-parallelism", "4",
+			"-step", "10m", "-lookback", "2h", "-end-timestamp", fmt.Sprint(testStart.Add(2*time.Hour).Unix()),
+		)
+		sums = append(sums, headChecksum(t, v2Dir))
+	}
+	if sums[0] != sums[1] {
+		t.Errorf("got chunk checksums %v and %v, want them to be identical", sums[0], sums[1])
+	}
+}
+
+// captureStderr returns what f writes to stderr.
+func captureStderr(t *testing.T, f func()) string {
+	return captureFile(t, &os.Stderr, f)
+}
+
+// captureStdout returns what f writes to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	return captureFile(t, &os.Stdout, f)
+}
+
+// captureFile returns what f writes to *file, which is replaced by a
+// temporary file while f runs.
+func captureFile(t *testing.T, file **os.File, f func()) string {
+	tmp, err := ioutil.TempFile("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	orig := *file
+	*file = tmp
+	defer func() { *file = orig }()
+	f()
+
+	b, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// logLine returns the first logfmt line in logs with the message msg.
+func logLine(logs, msg string) string {
+	for _, l := range strings.Split(logs, "\n") {
+		if strings.Contains(l, fmt.Sprintf("msg=%q", msg)) || strings.Contains(l, "msg="+msg+" ") {
+			return l
+		}
+	}
+	return ""
+}
+
+// logValue returns the value of key in the logfmt line l.
+func logValue(l, key string) string {
+	for _, f := range strings.Fields(l) {
+		if strings.HasPrefix(f, key+"=") {
+			return strings.Trim(strings.TrimPrefix(f, key+"="), `"`)
+		}
+	}
+	return ""
+}
+
+func TestAlignBlocks(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 1, 4*time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	// Neither the start nor the end of the range is aligned to 2h.
+	const align = 2 * time.Hour
+	end := testStart.Add(3 * time.Hour)
+	if end%model.Time(align/time.Millisecond) == 0 {
+		t.Fatal("test range is already aligned")
+	}
+	runMain(
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(end.Unix()), "-align-blocks", align.String(),
+	)
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 1 {
+		t.Fatalf("got %d series, want 1", len(got))
+	}
+	for ls, ts := range got {
+		first, last := model.Time(ts[0]), model.Time(ts[len(ts)-1])
+		if first%model.Time(align/time.Millisecond) != 0 || last%model.Time(align/time.Millisecond) != 0 {
+			t.Errorf("series %s has samples from %s to %s, want both to be aligned to %s", ls, first, last, align)
+		}
+		// The aligned range covers the range given by -lookback.
+		if first > end.Add(-time.Hour) || last < end || last.Sub(first) != align {
+			t.Errorf("series %s has samples from %s to %s, want the block enclosing [%s, %s]", ls, first, last, end.Add(-time.Hour), end)
+		}
+	}
+}
+
+func TestResumeInterruptedStep(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 1, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	// Simulate a crash within the only step, after the first half of the
+	// samples of host0:9090 has been committed.
+	v1 := local.NewMemorySeriesStorage(newTestV1Options(v1Dir))
+	if err := v1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	v2 := openTestV2(t, v2Dir)
+	err := migrateTestInstance(newTestMigrator(v1, v2), "host0:9090", testStart, testStart.Add(30*time.Minute)-1)
+	v2.Close()
+	v1.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := testStart.Add(time.Hour)
+	if err := writeCheckpoint(filepath.Join(v2Dir, "migrator.checkpoint"), checkpoint{Start: testStart, End: end, Next: testStart}); err != nil {
+		t.Fatal(err)
+	}
+
+	var code int
+	logs := captureStderr(t, func() {
+		code = runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "1h", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(end.Unix()),
+		)
+	})
+	if code != 0 {
+		t.Fatalf("resuming exited with %d, logs:\n%s", code, logs)
+	}
+	if got := logValue(logLine(logs, "Skipped samples already present in v2 storage"), "samples"); got != "120" {
+		t.Errorf("skipped %q samples already present, want 120", got)
+	}
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 2 {
+		t.Fatalf("got %d series, want 2", len(got))
+	}
+	for ls, ts := range got {
+		if len(ts) != 240 || len(distinct(ts)) != 240 {
+			t.Errorf("series %s has %d samples at %d timestamps, want 240", ls, len(ts), len(distinct(ts)))
+		}
+	}
+}
+
+func TestV2StorageOptions(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 1, 2*time.Hour))
+	defer removeV1()
+	end := testStart.Add(2 * time.Hour)
+	for _, tc := range []struct {
+		args     []string
+		wantCode int
+	}{
+		{args: []string{"-wal-flush-interval", "0", "-min-block-duration", "30m"}},
+		{args: []string{"-wal-flush-interval", "-1s"}, wantCode: 2},
+		{args: []string{"-min-block-duration", "0s"}, wantCode: 2},
+		{args: []string{"-min-block-duration", "1500us"}, wantCode: 2},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		var code int
+		captureStderr(t, func() {
+			code = runMain(append([]string{
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "2h",
+				"-end-timestamp", fmt.Sprint(end.Unix()), "-compact-after",
+			}, tc.args...)...)
+		})
+		if code != tc.wantCode {
+			t.Fatalf("%v: got exit code %d, want %d", tc.args, code, tc.wantCode)
+		}
+		if code != 0 {
+			continue
+		}
+		// The head has been written to blocks of the configured size.
+		if n := len(blockDirs(t, v2Dir)); n < 2 {
+			t.Errorf("%v: got %d blocks, want 30m blocks", tc.args, n)
+		}
+		got := storedTimestamps(t, v2Dir)
+		if len(got) != 2 {
+			t.Fatalf("%v: got %d series, want 2", tc.args, len(got))
+		}
+		for ls, ts := range got {
+			if n := len(distinct(ts)); n != 480 {
+				t.Errorf("%v: series %s has samples at %d timestamps, want 480", tc.args, ls, n)
+			}
+		}
+	}
+}
+
+func TestResumeProgress(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 1, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	end := testStart.Add(time.Hour)
+	if err := writeCheckpoint(filepath.Join(v2Dir, "migrator.checkpoint"), checkpoint{Start: testStart, End: end, Next: testStart.Add(30 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	var out string
+	captureStderr(t, func() {
+		out = captureStdout(t, func() {
+			runMain(
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+				"-end-timestamp", fmt.Sprint(end.Unix()),
+			)
+		})
+	})
+	// The bar rewrites its line with carriage returns.
+	first := strings.TrimSpace(strings.Split(strings.TrimPrefix(out, "\r"), "\r")[0])
+	// The step before the checkpoint is migrated again.
+	if !strings.HasPrefix(first, "2 / 6") || !strings.Contains(first, "33.33%") {
+		t.Errorf("progress bar starts with %q, want 2 of 6 steps at 33%%", first)
+	}
+}
+
+func TestSubcommands(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 3, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	common := []string{
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+	}
+
+	for _, tc := range []struct {
+		args       []string
+		wantCode   int
+		wantStdout string
+	}{
+		{args: []string{"version"}, wantStdout: "prom-data-migrator, version"},
+		{args: append([]string{"migrate"}, common...), wantStdout: "Migration Complete"},
+		{args: append([]string{"probe"}, common...), wantStdout: "v1 instances: 2"},
+		{args: append([]string{"list", "-dump-index-label", "idx"}, common...), wantStdout: "Values of idx:"},
+		{args: append([]string{"estimate"}, common...), wantStdout: "Instances:          2"},
+		{args: append([]string{"verify", "-verify-blocks"}, common...), wantStdout: "Verification complete"},
+		{args: append([]string{"verify"}, common...), wantCode: 2},
+		{args: append([]string{"unknown"}, common...), wantCode: 2},
+	} {
+		var (
+			code   int
+			stdout string
+		)
+		captureStderr(t, func() {
+			stdout = captureStdout(t, func() {
+				code = runMain(tc.args...)
+			})
+		})
+		if code != tc.wantCode {
+			t.Errorf("%s: got exit code %d, want %d", tc.args[0], code, tc.wantCode)
+		}
+		if !strings.Contains(stdout, tc.wantStdout) {
+			t.Errorf("%s: got output %q, want it to contain %q", tc.args[0], stdout, tc.wantStdout)
+		}
+	}
+	// The migrate subcommand ran with the shared flags.
+	if n := len(storedTimestamps(t, v2Dir)); n != 6 {
+		t.Errorf("got %d migrated series, want 6", n)
+	}
+}
+
+func TestExpectCounts(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, time.Hour))
+	defer removeV1()
+	for _, tc := range []struct {
+		args     []string
+		wantCode int
+	}{
+		{args: []string{"-expect-series", "4", "-expect-samples", "960"}},
+		{args: []string{"-expect-series", "5"}, wantCode: 1},
+		{args: []string{"-expect-samples", "900"}, wantCode: 1},
+		{args: []string{"-expect-samples", "955", "-expect-tolerance", "0.01"}},
+		{args: []string{"-expect-tolerance", "-0.1"}, wantCode: 2},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		var code int
+		captureStderr(t, func() {
+			code = runMain(append([]string{
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+				"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+			}, tc.args...)...)
+		})
+		if code != tc.wantCode {
+			t.Errorf("%v: got exit code %d, want %d", tc.args, code, tc.wantCode)
+		}
+	}
+}
+
+func TestResumeSafetyMargin(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 1, time.Hour))
+	defer removeV1()
+	end := testStart.Add(time.Hour)
+
+	for _, tc := range []struct {
+		margin      string
+		wantSamples int
+	}{
+		// The step before the checkpoint is lost without a margin.
+		{margin: "0s", wantSamples: 200},
+		{margin: "-1s", wantSamples: 240},
+		// Samples of the margin that the v2 storage holds are skipped.
+		{margin: "20m", wantSamples: 240},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+
+		// Simulate a crash that lost the last step recorded in the
+		// checkpoint, which starts at 30m.
+		v1 := local.NewMemorySeriesStorage(newTestV1Options(v1Dir))
+		if err := v1.Start(); err != nil {
+			t.Fatal(err)
+		}
+		v2 := openTestV2(t, v2Dir)
+		var err error
+		for _, instance := range testInstances(2) {
+			if err == nil {
+				err = migrateTestInstance(newTestMigrator(v1, v2), instance, testStart, testStart.Add(20*time.Minute)-1)
+			}
+		}
+		v2.Close()
+		v1.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeCheckpoint(filepath.Join(v2Dir, "migrator.checkpoint"), checkpoint{Start: testStart, End: end, Next: testStart.Add(30 * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+
+		var code int
+		captureStderr(t, func() {
+			code = runMain(
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+				"-end-timestamp", fmt.Sprint(end.Unix()), "-resume-safety-margin", tc.margin,
+			)
+		})
+		if code != 0 {
+			t.Fatalf("margin %s: resuming exited with %d", tc.margin, code)
+		}
+		got := storedTimestamps(t, v2Dir)
+		if len(got) != 2 {
+			t.Fatalf("margin %s: got %d series, want 2", tc.margin, len(got))
+		}
+		for ls, ts := range got {
+			if len(ts) != tc.wantSamples || len(distinct(ts)) != tc.wantSamples {
+				t.Errorf("margin %s: series %s has %d samples at %d timestamps, want %d", tc.margin, ls, len(ts), len(distinct(ts)), tc.wantSamples)
+			}
+		}
+	}
+}
+
+func TestMaxWindows(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 1, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	end := testStart.Add(time.Hour)
+
+	for run, wantNext := range []model.Time{testStart.Add(20 * time.Minute), testStart.Add(40 * time.Minute)} {
+		var code int
+		logs := captureStderr(t, func() {
+			code = runMain(
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+				"-end-timestamp", fmt.Sprint(end.Unix()), "-max-windows", "2", "-resume-safety-margin", "0",
+			)
+		})
+		if code != 0 {
+			t.Fatalf("run %d: got exit code %d, want 0", run, code)
+		}
+		if next := logValue(logLine(logs, "Migration stopped"), "next"); next != wantNext.String() {
+			t.Errorf("run %d: stopped at %q, want %s", run, next, wantNext)
+		}
+		cp, err := readCheckpoint(filepath.Join(v2Dir, "migrator.checkpoint"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp == nil || cp.Next != wantNext {
+			t.Fatalf("run %d: got checkpoint %+v, want the next step at %s", run, cp, wantNext)
+		}
+	}
+	for ls, ts := range storedTimestamps(t, v2Dir) {
+		if n := len(distinct(ts)); n != 160 {
+			t.Errorf("series %s has %d samples after 4 steps, want 160", ls, n)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestV1HeapSizeExceedsMemory(t *testing.T) {
+	memory := systemMemory()
+	if memory == 0 {
+		t.Skip("system memory is unknown")
+	}
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 1, 10*time.Minute))
+	defer removeV1()
+
+	for _, tc := range []struct {
+		size     uint64
+		wantCode int
+		wantWarn bool
+	}{
+		{size: 64 << 20},
+		{size: memory/2 + 1<<20, wantWarn: true},
+		{size: memory, wantCode: 2},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		var code int
+		logs := captureStderr(t, func() {
+			code = runMain(
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "10m",
+				"-end-timestamp", fmt.Sprint(testStart.Add(10*time.Minute).Unix()),
+				"-v1-target-heap-size", fmt.Sprintf("%dKiB", tc.size/1024),
+			)
+		})
+		if code != tc.wantCode {
+			t.Errorf("%d bytes: got exit code %d, want %d", tc.size, code, tc.wantCode)
+		}
+		warned := logLine(logs, "v1 target heap size exceeds half of the system memory, which leaves little for the v2 storage") != ""
+		if warned != tc.wantWarn {
+			t.Errorf("%d bytes of %d: got warning %v, want %v", tc.size, memory, warned, tc.wantWarn)
+		}
+	}
+}
+
+func TestHeapProfileFile(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 1, 10*time.Minute))
+	defer removeV1()
+
+	for _, tc := range []struct {
+		args     []string
+		wantCode int
+	}{
+		{},
+		// The migration succeeds, but the check at the end fails.
+		{args: []string{"-expect-series", "5"}, wantCode: 1},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		profile := filepath.Join(v2Dir, "heap.pprof")
+		args := append([]string{
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "10m",
+			"-end-timestamp", fmt.Sprint(testStart.Add(10 * time.Minute).Unix()),
+			"-heap-profile-file", profile,
+		}, tc.args...)
+		if code := runMain(args...); code != tc.wantCode {
+			t.Errorf("%v: got exit code %d, want %d", tc.args, code, tc.wantCode)
+		}
+		// Heap profiles are gzipped protocol buffers.
+		b, err := ioutil.ReadFile(profile)
+		if err != nil {
+			t.Errorf("%v: %s", tc.args, err)
+			continue
+		}
+		if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+			t.Errorf("%v: heap profile is not gzipped", tc.args)
+		}
+	}
+}
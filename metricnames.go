@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// firstMetricNames returns the first n metric names in sort order that have
+// series in [from, through] in any of the v1 storages, and the names with
+// series in the range after them. Names whose series all lie outside the
+// range are skipped.
+func firstMetricNames(storages []*local.MemorySeriesStorage, from, through model.Time, n int) (included, excluded []string, err error) {
+	var names model.LabelValues
+	for _, s := range storages {
+		vals, err := s.LabelValuesForLabelName(context.Background(), model.MetricNameLabel)
+		if err != nil {
+			return nil, nil, err
+		}
+		names = mergeLabelValues(names, vals)
+	}
+	for _, name := range names {
+		matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := false
+		for _, s := range storages {
+			metrics, err := s.MetricsForLabelMatchers(context.Background(), from, through, metric.LabelMatchers{matcher})
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(metrics) > 0 {
+				found = true
+				break
+			}
+		}
+		switch {
+		case !found:
+		case len(included) < n:
+			included = append(included, string(name))
+		default:
+			excluded = append(excluded, string(name))
+		}
+	}
+	return included, excluded, nil
+}
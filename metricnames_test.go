@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestMaxMetricNames(t *testing.T) {
+	var samples []*model.Sample
+	for _, name := range []string{"c_metric", "a_metric", "d_metric", "b_metric"} {
+		for _, s := range testSamples(testInstances(2), 1, time.Hour) {
+			s.Metric[model.MetricNameLabel] = model.LabelValue(name)
+			samples = append(samples, s)
+		}
+	}
+	// The series of this name end before the range of the migration.
+	for _, s := range testSamples(testInstances(1), 1, 10*time.Minute) {
+		s.Metric[model.MetricNameLabel] = "1_old_metric"
+		samples = append(samples, s)
+	}
+	v1Dir, removeV1 := newTestV1Dir(t, samples)
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	logs := captureStderr(t, func() {
+		if code := runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "30m",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()), "-max-metric-names", "2",
+		); code != 0 {
+			t.Fatalf("got exit code %d, want 0", code)
+		}
+	})
+	names := map[string]int{}
+	for ls := range storedTimestamps(t, v2Dir) {
+		names[ls[len(`{__name__="`):strings.Index(ls, `",`)]]++
+	}
+	if want := map[string]int{"a_metric": 2, "b_metric": 2}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got series per metric name %v, want %v", names, want)
+	}
+	if l := logLine(logs, "Migrating the first metric names only"); logValue(l, "included") != "a_metric,b_metric" || logValue(l, "excluded") != "2" {
+		t.Errorf("got log line %q, want the included names and 2 excluded ones", l)
+	}
+	excluded := strings.Split(logValue(logLine(logs, "Excluded metric names"), "names"), ",")
+	sort.Strings(excluded)
+	if want := []string{"c_metric", "d_metric"}; !reflect.DeepEqual(excluded, want) {
+		t.Errorf("got excluded names %v, want %v", excluded, want)
+	}
+}
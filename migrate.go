@@ -0,0 +1,1187 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// migrator copies series from the v1 storage to the v2 storage.
+type migrator struct {
+	// The sample counters are accessed atomically, keep them first for
+	// alignment on 32-bit platforms.
+	skippedExisting uint64
+	droppedRepeated uint64
+	invalidTimes    uint64
+	nanValues       uint64
+	unordered       uint64
+	quarantined     uint64
+	// explodedSteps counts the steps of instances quarantined for a
+	// cardinality explosion, explodedSamples their samples.
+	explodedSteps   uint64
+	explodedSamples uint64
+	appended        uint64
+
+	// labelViolations counts the series skipped by the label assertion,
+	// the other series counters those skipped or changed for the reasons
+	// they are named after. Every series counts once, however many steps
+	// it has.
+	labelViolations seriesCounter
+	mergedSeries    seriesCounter
+	nameViolations  seriesCounter
+	longLabelValues seriesCounter
+	duplicateLabels seriesCounter
+	defaultedSeries seriesCounter
+
+	v1Storage *local.MemorySeriesStorage
+	// v1Replicas are v1 storages of HA replicas of v1Storage. If
+	// lastReplicaWins is set, their samples take precedence over those of
+	// earlier ones with the same timestamp, otherwise those of v1Storage
+	// and earlier replicas do.
+	v1Replicas      []*local.MemorySeriesStorage
+	lastReplicaWins bool
+	// shardLabel is the label whose values select the series that are
+	// migrated together.
+	shardLabel model.LabelName
+	v2Storage  appendable
+	// v2DB is the local v2 storage, or all of its shards, which is consulted
+	// for samples that already exist.
+	v2DB   queryable
+	logger log.Logger
+	// activity is updated whenever the migrator appends a series or
+	// finishes migrating a step of an instance.
+	activity *progress
+
+	assertLabels   bool
+	valuePrecision int
+	deterministic  bool
+
+	normalizeBucketLabels bool
+	// dedupUntil is the end of a previous migration into the v2 storage.
+	// Up to that time, samples the v2 storage already contains are skipped.
+	dedupUntil model.Time
+	// commitSema limits the number of concurrent commits if it is not nil.
+	commitSema chan struct{}
+	// querySema limits the number of concurrent reads from the v1 storage
+	// if it is not nil.
+	querySema chan struct{}
+	// If commitSamples or commitSeries is greater than 0, the samples of
+	// a step are committed whenever that many samples or series with
+	// samples have been appended, instead of once at the end.
+	commitSamples int
+	commitSeries  int
+	// quarantine receives the samples the v2 storage rejects if it is not
+	// nil. Otherwise, a rejected sample fails the step.
+	quarantine *quarantine
+	// overlaps skips samples that are not newer than those committed for
+	// the same series in earlier steps if it is not nil.
+	overlaps *overlapDetector
+	// prefetch has read the series of upcoming steps already if it is not
+	// nil.
+	prefetch *prefetcher
+	// windowWorkers is the number of series read concurrently within one
+	// call of migrate.
+	windowWorkers int
+	// sampleFraction is the fraction of series to migrate if it is
+	// greater than 0.
+	sampleFraction float64
+	// seriesList restricts the migration to the listed series if it is
+	// not nil.
+	seriesList *seriesList
+	// metricNames restricts the migration to the series with these metric
+	// names if it is not nil.
+	metricNames map[string]bool
+	// sparse are the series dropped for having too few samples in the
+	// migrated time range if it is not nil.
+	sparse *seriesList
+	// dropLabels are the names of the labels removed from every series.
+	dropLabels []string
+	// defaultLabels are added to the series that do not have a label of
+	// the same name.
+	defaultLabels labels.Labels
+	// externalLabels are added to every series. Unless overwriteLabels is
+	// set, a series that already has one of them is an error.
+	externalLabels  labels.Labels
+	overwriteLabels bool
+	// strictNames is "fail" or "skip" if series with invalid metric or
+	// label names fail the migration or are skipped, and empty if they are
+	// migrated.
+	strictNames string
+	// If maxLabelValueLength is greater than 0, longer label values are
+	// truncated, or their series skipped if skipLongLabelValues is set.
+	maxLabelValueLength int
+	skipLongLabelValues bool
+	truncations         labelTruncations
+	// If failDuplicateLabels is set, a series with a label name that
+	// occurs more than once fails the migration. Otherwise, only the last
+	// of the labels with that name is kept.
+	failDuplicateLabels bool
+	// nanPolicy is "drop" to drop samples with NaN values or "stale" to
+	// replace them with staleness markers. If empty, they are kept.
+	nanPolicy string
+	// dropRepeated drops samples whose value equals, within the relative
+	// repeatedTolerance, that of the samples before and after them.
+	dropRepeated      bool
+	repeatedTolerance float64
+	// If checkOrder is set, series whose samples are not in strictly
+	// increasing order of their timestamps are reported, as the v2 storage
+	// silently drops the samples that are not newer than the one before.
+	// If sortSamples is set as well, their samples are sorted instead.
+	checkOrder  bool
+	sortSamples bool
+	// If checkTimes is set, samples with timestamps outside of
+	// [minValidTime, maxValidTime] are dropped.
+	checkTimes                 bool
+	minValidTime, maxValidTime model.Time
+	// If roundTimestamps is greater than 0, timestamps are rounded to the
+	// nearest multiple of it.
+	roundTimestamps model.Time
+	// If seriesLimit is greater than 0, only the first seriesLimit
+	// distinct series are migrated. They are recorded in admitted.
+	seriesLimit  int
+	admittedMtx  sync.Mutex
+	admitted     *seriesList
+	limitReached sync.Once
+	// migrated records the distinct series that have been committed if
+	// it is not nil.
+	migratedMtx sync.Mutex
+	migrated    *seriesList
+	// If sampleLimit is greater than 0, the steps of an instance are read
+	// in parts short enough for every series to have at most about that
+	// many samples in each, based on the densest series of the instance
+	// read so far. readSpans are the current lengths of the parts.
+	sampleLimit  int
+	readSpansMtx sync.Mutex
+	readSpans    map[model.LabelValue]model.Time
+	// cardinality detects steps of an instance with too many series if it
+	// is not nil. Their samples are written to the quarantine if
+	// quarantineExplosions is set, otherwise the step fails.
+	cardinality          *cardinalityDetector
+	quarantineExplosions bool
+	// committed are, for every instance whose current step has been
+	// committed in part, the latest committed sample of each series, which
+	// retrying the step after a failure skips. Only used with partial
+	// commits.
+	committedMtx sync.Mutex
+	committed    map[model.LabelValue]*overlapDetector
+}
+
+// migrate copies all samples in [from, through] of the series of instance,
+// i.e. with that value of m.shardLabel. It returns the number of samples read
+// from the v1 storage and a *WindowMigrationError if migrating failed.
+//
+// With m.sampleLimit, the range is migrated in consecutive parts, each of
+// which is read, appended and committed before the next one. The first
+// range of an instance is read whole, after which the parts are shortened
+// or lengthened according to the most samples a series had in the last one.
+//
+// If migrating the range fails after part of it has been committed, a retry
+// skips the samples that were.
+//
+// With m.cardinality, the series of the whole range are checked for a
+// cardinality explosion before any part is migrated, and added to the
+// baseline once all parts are.
+func (m *migrator) migrate(from, through model.Time, instance model.LabelValue) (int, error) {
+	var (
+		series    []labels.Labels
+		explosion error
+	)
+	if m.cardinality != nil {
+		var err error
+		if series, err = m.rangeSeries(from, through, instance); err != nil {
+			return 0, err
+		}
+		if explosion = m.cardinality.check(instance, series); explosion != nil {
+			if !m.quarantineExplosions {
+				return 0, windowError(instance, from, through, ErrCardinalityExplosion, explosion)
+			}
+			level.Warn(m.logger).Log("msg", "Quarantining step of instance with cardinality explosion", "instance", instance, "from", from, "through", through, "err", explosion)
+		}
+	}
+
+	read := 0
+	for t := from; t <= through; {
+		end := through
+		if span := m.readSpan(instance); m.sampleLimit > 0 && span > 0 && t+span-1 < through {
+			end = t + span - 1
+		}
+		n, most, err := m.migrateRange(t, end, instance, explosion)
+		read += n
+		if err != nil {
+			return read, err
+		}
+		if m.sampleLimit > 0 {
+			m.adaptReadSpan(instance, end-t+1, most)
+		}
+		t = end + 1
+	}
+	m.forgetCommitted(instance)
+	if m.cardinality != nil {
+		if explosion != nil {
+			atomic.AddUint64(&m.explodedSteps, 1)
+		} else {
+			m.cardinality.record(instance, series)
+		}
+	}
+	return read, nil
+}
+
+// partialCommits reports whether a step of an instance may be committed in
+// several parts.
+func (m *migrator) partialCommits() bool {
+	return m.commitSamples > 0 || m.commitSeries > 0 || m.sampleLimit > 0
+}
+
+// committedSeries returns the latest committed samples of the series of the
+// current step of instance, or nil without partial commits.
+func (m *migrator) committedSeries(instance model.LabelValue) *overlapDetector {
+	if !m.partialCommits() {
+		return nil
+	}
+	m.committedMtx.Lock()
+	defer m.committedMtx.Unlock()
+	if m.committed == nil {
+		m.committed = map[model.LabelValue]*overlapDetector{}
+	}
+	d, ok := m.committed[instance]
+	if !ok {
+		d = newOverlapDetector()
+		m.committed[instance] = d
+	}
+	return d
+}
+
+// forgetCommitted drops the committed samples of the current step of
+// instance once the step has been migrated completely.
+func (m *migrator) forgetCommitted(instance model.LabelValue) {
+	m.committedMtx.Lock()
+	defer m.committedMtx.Unlock()
+	delete(m.committed, instance)
+}
+
+// readSpan returns the length of the parts to read the steps of instance in,
+// or 0 if they are read whole.
+func (m *migrator) readSpan(instance model.LabelValue) model.Time {
+	m.readSpansMtx.Lock()
+	defer m.readSpansMtx.Unlock()
+	return m.readSpans[instance]
+}
+
+// adaptReadSpan sets the length of the parts to read the steps of instance
+// in from the most samples a series had in the last part of length span,
+// so that a series has at most about m.sampleLimit samples in the next ones.
+func (m *migrator) adaptReadSpan(instance model.LabelValue, span model.Time, most int) {
+	if most == 0 {
+		return
+	}
+	next := model.Time(float64(span) * float64(m.sampleLimit) / float64(most))
+	if next < 1 {
+		next = 1
+	}
+	m.readSpansMtx.Lock()
+	defer m.readSpansMtx.Unlock()
+	if m.readSpans == nil {
+		m.readSpans = map[model.LabelValue]model.Time{}
+	}
+	m.readSpans[instance] = next
+}
+
+// migrateRange migrates the samples in [from, through] of the series of
+// instance like migrate without m.sampleLimit, and also returns the most
+// samples read for one series. If explosion is not nil, the samples are
+// quarantined with it instead.
+//
+// The series are migrated in three stages: transform converts the metrics of
+// the v1 series to v2 labels, which needs no samples yet, readGroups reads
+// the samples of the resulting series concurrently, and migrateRange appends
+// them to the v2 storage in order as they become available.
+func (m *migrator) migrateRange(from, through model.Time, instance model.LabelValue, explosion error) (int, int, error) {
+	matchers, err := shardMatchers(m.shardLabel, instance)
+	if err != nil {
+		return 0, 0, windowError(instance, from, through, nil, err)
+	}
+	// Samples just outside of the window may be rounded into it.
+	readFrom, readThrough := from-m.roundTimestamps, through+m.roundTimestamps
+	its, ok := []local.SeriesIterator(nil), false
+	if m.prefetch != nil {
+		its, ok = m.prefetch.take(instance, from)
+	}
+	if !ok {
+		release := m.acquireQuery()
+		its, err = m.queryV1(readFrom, readThrough, matchers...)
+		release()
+		if err != nil {
+			return 0, 0, windowError(instance, from, through, ErrSourceUnavailable, err)
+		}
+	}
+	// The iterators pin the chunks of their series in the v1 storage.
+	defer closeIterators(its)
+
+	if m.deterministic {
+		sort.SliceStable(its, func(i, j int) bool {
+			return its[i].Metric().Metric.Before(its[j].Metric().Metric)
+		})
+	}
+
+	groups, err := m.transform(its)
+	if err != nil {
+		return 0, 0, windowError(instance, from, through, nil, err)
+	}
+
+	done := make(chan struct{})
+	sers := m.readGroups(done, groups, readFrom, readThrough)
+	defer func() {
+		// Wait for the reads to stop before the iterators are closed.
+		close(done)
+		for range sers {
+		}
+	}()
+
+	var q tsdb.Querier
+	if from <= m.dedupUntil {
+		if q, err = m.v2DB.Querier(int64(from), int64(m.dedupUntil)); err != nil {
+			return 0, 0, windowError(instance, from, through, nil, err)
+		}
+		defer q.Close()
+	}
+
+	committed := m.committedSeries(instance)
+	var (
+		app      = m.v2Storage.Appender()
+		read     int
+		most     int
+		appended int
+		// touched is the number of series with samples in app.
+		touched int
+		seen    []appendedSeries
+	)
+	for ser := range sers {
+		read += len(ser.samples)
+		if len(ser.samples) > most {
+			most = len(ser.samples)
+		}
+		if m.checkOrder {
+			if n := unorderedSamples(ser.samples); n > 0 {
+				atomic.AddUint64(&m.unordered, uint64(n))
+				if m.sortSamples {
+					ser.samples = sortSamples(ser.samples)
+					level.Warn(m.logger).Log("msg", "Sorted samples of series with non-monotonic timestamps", "series", ser.labels, "from", from, "through", through, "unordered_samples", n)
+				} else {
+					level.Warn(m.logger).Log("msg", "Series has non-monotonic timestamps, the v2 storage drops the unordered samples", "series", ser.labels, "from", from, "through", through, "unordered_samples", n)
+				}
+			}
+		}
+		if m.roundTimestamps > 0 {
+			ser.samples = roundTimestamps(ser.samples, m.roundTimestamps, from, through)
+		}
+		if q != nil {
+			if err := m.skipExisting(q, ser); err != nil {
+				app.Rollback()
+				return read, most, windowError(instance, from, through, nil, err)
+			}
+		}
+		// quarantined are the samples of the series to write to the
+		// quarantine, if there is one, with the reason of each.
+		var quarantined []quarantinedSample
+		if m.checkTimes {
+			var dropped []model.SamplePair
+			ser.samples, dropped = m.dropInvalidTimes(ser.samples)
+			atomic.AddUint64(&m.invalidTimes, uint64(len(dropped)))
+			if m.quarantine != nil {
+				quarantined = appendQuarantined(quarantined, dropped, errInvalidTime)
+			}
+		}
+		if m.nanPolicy != "" {
+			var nans []model.SamplePair
+			ser.samples, nans = applyNaNPolicy(ser.samples, m.nanPolicy)
+			atomic.AddUint64(&m.nanValues, uint64(len(nans)))
+			if m.quarantine != nil && m.nanPolicy == "drop" {
+				quarantined = appendQuarantined(quarantined, nans, errNaNValue)
+			}
+		}
+		if m.overlaps != nil {
+			ser.samples = m.overlaps.skip(ser.labels, ser.samples)
+		}
+		if committed != nil {
+			ser.samples = committed.skip(ser.labels, ser.samples)
+		}
+		if m.dropRepeated {
+			n := len(ser.samples)
+			ser.samples = dropRepeatedValues(ser.samples, m.repeatedTolerance)
+			atomic.AddUint64(&m.droppedRepeated, uint64(n-len(ser.samples)))
+		}
+
+		if explosion != nil {
+			quarantined = appendQuarantined(quarantined, ser.samples, explosion)
+			if len(quarantined) == 0 {
+				continue
+			}
+			if err := m.quarantine.add(ser.labels, rejections(quarantined)); err != nil {
+				app.Rollback()
+				return read, most, windowError(instance, from, through, nil, fmt.Errorf("quarantining samples: %s", err))
+			}
+			atomic.AddUint64(&m.explodedSamples, uint64(len(ser.samples)))
+			continue
+		}
+
+		var (
+			// rejected counts the rejected samples, lost those that no
+			// destination appended.
+			rejected, lost int
+		)
+		for _, s := range ser.samples {
+			v := float64(s.Value)
+			if m.valuePrecision > 0 {
+				v = roundSignificant(v, m.valuePrecision)
+			}
+			_, err := app.Add(ser.labels, int64(s.Timestamp), v)
+
+			if err != nil && m.quarantine != nil && rejectedSample(err) {
+				quarantined = append(quarantined, quarantinedSample{SamplePair: model.SamplePair{Timestamp: s.Timestamp, Value: model.SampleValue(v)}, err: err})
+				rejected++
+				if e, ok := err.(*rejectedError); !ok || !e.partial {
+					lost++
+				}
+				continue
+			}
+			if err != nil {
+				app.Rollback()
+				return read, most, windowError(instance, from, through, nil, err)
+			}
+		}
+		if len(quarantined) > 0 {
+			if err := m.quarantine.add(ser.labels, rejections(quarantined)); err != nil {
+				app.Rollback()
+				return read, most, windowError(instance, from, through, nil, fmt.Errorf("quarantining rejected samples: %s", err))
+			}
+			atomic.AddUint64(&m.quarantined, uint64(rejected))
+		}
+		appended += len(ser.samples) - lost
+		if len(ser.samples) > lost {
+			touched++
+			if m.migrated != nil || m.overlaps != nil || committed != nil {
+				seen = append(seen, appendedSeries{labels: ser.labels, last: int64(ser.samples[len(ser.samples)-1].Timestamp)})
+			}
+		}
+		m.activity.update()
+
+		if m.commitSamples > 0 && appended >= m.commitSamples || m.commitSeries > 0 && touched >= m.commitSeries {
+			if err := m.commit(app, appended, seen); err != nil {
+				return read, most, windowError(instance, from, through, nil, err)
+			}
+			if committed != nil {
+				committed.record(seen)
+			}
+			app, appended, touched, seen = m.v2Storage.Appender(), 0, 0, nil
+		}
+	}
+
+	if err := m.commit(app, appended, seen); err != nil {
+		return read, most, windowError(instance, from, through, nil, err)
+	}
+	if committed != nil {
+		committed.record(seen)
+	}
+	m.activity.update()
+	return read, most, nil
+}
+
+// commit commits app, which holds the given number of appended samples of
+// the series in seen, and records them as migrated.
+func (m *migrator) commit(app tsdb.Appender, appended int, seen []appendedSeries) error {
+	if m.commitSema != nil {
+		m.commitSema <- struct{}{}
+	}
+	err := app.Commit()
+	if m.commitSema != nil {
+		<-m.commitSema
+	}
+	if err != nil {
+		return err
+	}
+	// The samples of a destination that failed were rolled back.
+	if fa, ok := app.(*fanoutAppender); !ok || !fa.anyFailed() {
+		atomic.AddUint64(&m.appended, uint64(appended))
+	}
+	if m.migrated != nil {
+		m.migratedMtx.Lock()
+		for _, s := range seen {
+			m.migrated.add(s.labels)
+		}
+		m.migratedMtx.Unlock()
+	}
+	if m.overlaps != nil {
+		m.overlaps.record(seen)
+	}
+	return nil
+}
+
+// appendedSeries is a series with samples in an appender and the timestamp
+// of its last sample.
+type appendedSeries struct {
+	labels labels.Labels
+	last   int64
+}
+
+// seriesGroup is a v2 series and the v1 series it is migrated from.
+type seriesGroup struct {
+	labels labels.Labels
+	its    []local.SeriesIterator
+}
+
+// transform converts the metrics of the v1 series to v2 labels and drops the
+// series that are not selected for migration. The v1 storage may return
+// several series with the same labels, e.g. once differently formatted
+// bucket labels are normalized or labels dropped, which are grouped into one
+// series, as is the same series read from several v1 replicas. The groups
+// are in the order of their first series in its. The series of a group are
+// sorted by their v1 metric, so that merging them has the same result in
+// every run, and those with the same metric keep their order in its. The
+// series skipped or changed on the way are counted and logged.
+func (m *migrator) transform(its []local.SeriesIterator) ([]*seriesGroup, error) {
+	return m.transformSeries(its, true)
+}
+
+// previewTransform is transform for the passes that only read the series,
+// e.g. verifications and estimates, which neither count nor log the series
+// skipped or changed, so that the migration does not count them twice.
+func (m *migrator) previewTransform(its []local.SeriesIterator) ([]*seriesGroup, error) {
+	return m.transformSeries(its, false)
+}
+
+// transformSeries is transform, which counts and logs the skipped and changed
+// series if record is set.
+func (m *migrator) transformSeries(its []local.SeriesIterator, record bool) ([]*seriesGroup, error) {
+	var (
+		groups []*seriesGroup
+		byKey  = make(map[string]*seriesGroup, len(its))
+	)
+	for _, it := range its {
+		ls := metricLabels(it.Metric().Metric)
+
+		if m.sampleFraction > 0 && !inSample(ls, m.sampleFraction) {
+			continue
+		}
+		if m.seriesList != nil && !m.seriesList.contains(ls) {
+			continue
+		}
+		if m.metricNames != nil && !m.metricNames[ls.Get(model.MetricNameLabel)] {
+			continue
+		}
+
+		if m.assertLabels {
+			if err := checkLabels(ls); err != nil {
+				if record && m.labelViolations.add(ls) {
+					level.Error(m.logger).Log("msg", "skipping series with invalid labels", "series", ls, "err", err)
+				}
+				continue
+			}
+		}
+
+		if m.strictNames != "" {
+			if err := checkNames(ls); err != nil {
+				if m.strictNames == "fail" {
+					return nil, fmt.Errorf("series %s: %s", ls, err)
+				}
+				if record && m.nameViolations.add(ls) {
+					level.Warn(m.logger).Log("msg", "Skipping series with invalid name", "series", ls, "err", err)
+				}
+				continue
+			}
+		}
+
+		if m.maxLabelValueLength > 0 && hasLongValues(ls, m.maxLabelValueLength) {
+			if record {
+				m.longLabelValues.add(ls)
+			}
+			if m.skipLongLabelValues {
+				continue
+			}
+			orig := ls.String()
+			if err := m.truncations.truncate(ls, m.maxLabelValueLength); err != nil {
+				return nil, fmt.Errorf("series %s: %s", orig, err)
+			}
+		}
+
+		if len(m.dropLabels) > 0 {
+			ls = withoutNames(ls, m.dropLabels)
+		}
+
+		if len(m.defaultLabels) > 0 {
+			if res := addDefaultLabels(ls, m.defaultLabels); len(res) != len(ls) {
+				if record {
+					m.defaultedSeries.add(ls)
+				}
+				ls = res
+			}
+		}
+
+		if len(m.externalLabels) > 0 {
+			var err error
+			if ls, err = addExternalLabels(ls, m.externalLabels, m.overwriteLabels); err != nil {
+				return nil, err
+			}
+		}
+
+		if m.normalizeBucketLabels {
+			normalizeBucketLabels(ls)
+		}
+
+		// The v2 index requires unique label names. The v1 storage
+		// decodes metrics into maps, which already keep only the last
+		// of duplicate names, so this only guards against the label
+		// changes above producing them.
+		if dedup := dedupLabels(ls); len(dedup) != len(ls) {
+			if m.failDuplicateLabels {
+				return nil, fmt.Errorf("series %s: duplicate label names", ls)
+			}
+			if record && m.duplicateLabels.add(ls) {
+				level.Warn(m.logger).Log("msg", "Dropping duplicate label names of series", "series", ls, "labels", dedup)
+			}
+			ls = dedup
+		}
+
+		if m.sparse != nil && m.sparse.contains(ls) {
+			continue
+		}
+
+		key := ls.String()
+		if g, ok := byKey[key]; ok {
+			if record {
+				m.mergedSeries.add(metricLabels(it.Metric().Metric))
+			}
+			g.its = append(g.its, it)
+			continue
+		}
+		if m.seriesLimit > 0 && !m.admit(ls, record) {
+			continue
+		}
+		g := &seriesGroup{labels: ls, its: []local.SeriesIterator{it}}
+		byKey[key] = g
+		groups = append(groups, g)
+	}
+	for _, g := range groups {
+		if len(g.its) > 1 {
+			sort.SliceStable(g.its, func(i, j int) bool {
+				return g.its[i].Metric().Metric.Before(g.its[j].Metric().Metric)
+			})
+		}
+	}
+	return groups, nil
+}
+
+// metricLabels returns the labels of the v1 metric, sorted.
+func metricLabels(metric model.Metric) labels.Labels {
+	ls := make(labels.Labels, 0, len(metric))
+	for k, v := range metric {
+		ls = append(ls, labels.Label{Name: string(k), Value: string(v)})
+	}
+	sort.Sort(ls)
+	return ls
+}
+
+// admit reports whether the series with the labels ls is migrated under the
+// series limit, i.e. whether it has been migrated before or the limit has
+// not been reached yet. Only if add is set, a new series counts towards the
+// limit, so that read-only passes do not pick the series to migrate.
+func (m *migrator) admit(ls labels.Labels, add bool) bool {
+	m.admittedMtx.Lock()
+	defer m.admittedMtx.Unlock()
+
+	if m.admitted.contains(ls) {
+		return true
+	}
+	if !add {
+		return m.admitted.size() < m.seriesLimit
+	}
+	if m.admitted.size() >= m.seriesLimit {
+		m.limitReached.Do(func() {
+			level.Info(m.logger).Log("msg", "Reached maximum number of series, only migrating the remaining samples of the migrated series", "max_total_series", m.seriesLimit)
+		})
+		return false
+	}
+	m.admitted.add(ls)
+	return true
+}
+
+// readGroups reads the samples in [from, through] of the groups with up to
+// m.windowWorkers groups being read concurrently. The series are sent on the
+// returned channel in the order of groups, which is closed after the last
+// one. At most m.windowWorkers series are read ahead of the receiver.
+// Reading stops early if done is closed, and the channel is closed once no
+// group is read anymore.
+func (m *migrator) readGroups(done <-chan struct{}, groups []*seriesGroup, from, through model.Time) <-chan *series {
+	workers := m.windowWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		out     = make(chan *series)
+		pending = make(chan chan *series, workers)
+		sema    = make(chan struct{}, workers)
+	)
+	go func() {
+		var reads sync.WaitGroup
+		defer func() {
+			reads.Wait()
+			close(pending)
+		}()
+		for _, g := range groups {
+			select {
+			case sema <- struct{}{}:
+			case <-done:
+				return
+			}
+			res := make(chan *series, 1)
+			reads.Add(1)
+			go func(g *seriesGroup) {
+				defer reads.Done()
+				release := m.acquireQuery()
+				res <- readGroup(g, from, through)
+				release()
+				<-sema
+			}(g)
+			select {
+			case pending <- res:
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(out)
+		for res := range pending {
+			select {
+			case out <- <-res:
+			case <-done:
+				for range pending {
+				}
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// acquireQuery waits until m.querySema admits another read from the v1
+// storage, if it is not nil, and returns the function ending the read.
+func (m *migrator) acquireQuery() func() {
+	if m.querySema == nil {
+		return func() {}
+	}
+	m.querySema <- struct{}{}
+	return func() { <-m.querySema }
+}
+
+// readGroup reads the samples in [from, through] of all series of g and
+// merges them into one series. Of samples with the same timestamp, the one
+// of the earlier series is kept.
+func readGroup(g *seriesGroup, from, through model.Time) *series {
+	s := &series{labels: g.labels}
+	for _, it := range g.its {
+		samples := it.RangeValues(metric.Interval{
+			OldestInclusive: from,
+			NewestInclusive: through,
+		})
+		if s.samples == nil {
+			s.samples = samples
+			continue
+		}
+		s.samples = mergeSamples(s.samples, samples)
+	}
+	return s
+}
+
+// inSample reports whether the series with the labels ls is in the stable
+// pseudo-random sample containing the given fraction of all series.
+func inSample(ls labels.Labels, fraction float64) bool {
+	return float64(ls.Hash()) < fraction*math.MaxUint64
+}
+
+// unorderedSamples returns the number of samples whose timestamp is not
+// after that of the sample before them.
+func unorderedSamples(samples []model.SamplePair) int {
+	n := 0
+	for i := 1; i < len(samples); i++ {
+		if samples[i].Timestamp <= samples[i-1].Timestamp {
+			n++
+		}
+	}
+	return n
+}
+
+// sortSamples sorts samples by their timestamps. Of samples with the same
+// timestamp, the first one is kept.
+func sortSamples(samples []model.SamplePair) []model.SamplePair {
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp < samples[j].Timestamp
+	})
+	res := samples[:0]
+	for _, s := range samples {
+		if n := len(res); n > 0 && res[n-1].Timestamp == s.Timestamp {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// roundTimestamps rounds the timestamps of samples to the nearest multiple of
+// unit and returns the samples whose rounded timestamps are in [from,
+// through]. Of samples rounded to the same timestamp, the latest is kept.
+func roundTimestamps(samples []model.SamplePair, unit, from, through model.Time) []model.SamplePair {
+	res := make([]model.SamplePair, 0, len(samples))
+	for _, s := range samples {
+		t := (s.Timestamp + unit/2) / unit * unit
+		if t < from || t > through {
+			continue
+		}
+		if n := len(res); n > 0 && res[n-1].Timestamp == t {
+			res[n-1].Value = s.Value
+			continue
+		}
+		res = append(res, model.SamplePair{Timestamp: t, Value: s.Value})
+	}
+	return res
+}
+
+// dropInvalidTimes returns the samples with timestamps in [m.minValidTime,
+// m.maxValidTime] and the dropped samples.
+func (m *migrator) dropInvalidTimes(samples []model.SamplePair) ([]model.SamplePair, []model.SamplePair) {
+	var (
+		res     = make([]model.SamplePair, 0, len(samples))
+		dropped []model.SamplePair
+	)
+	for _, s := range samples {
+		if s.Timestamp >= m.minValidTime && s.Timestamp <= m.maxValidTime {
+			res = append(res, s)
+		} else {
+			dropped = append(dropped, s)
+		}
+	}
+	return res, dropped
+}
+
+// dropRepeatedValues removes the samples within runs of consecutive samples
+// with equal values, keeping the first and the last sample of every run as
+// well as the first and the last of all samples. Values are equal if they
+// differ from the first value of the run by at most tolerance relative to
+// the larger of both. NaN values, e.g. staleness markers, are never equal.
+func dropRepeatedValues(samples []model.SamplePair, tolerance float64) []model.SamplePair {
+	if len(samples) < 3 {
+		return samples
+	}
+	equal := func(a, b model.SampleValue) bool {
+		return a == b || math.Abs(float64(a-b)) <= tolerance*math.Max(math.Abs(float64(a)), math.Abs(float64(b)))
+	}
+
+	res := append(make([]model.SamplePair, 0, len(samples)), samples[0])
+	run := samples[0].Value
+	for i := 1; i < len(samples)-1; i++ {
+		v := samples[i].Value
+		if equal(v, run) && equal(samples[i+1].Value, run) {
+			continue
+		}
+		res = append(res, samples[i])
+		if !equal(v, run) {
+			run = v
+		}
+	}
+	return append(res, samples[len(samples)-1])
+}
+
+// staleNaN is the value of the staleness markers of Prometheus 2, a NaN with
+// a bit pattern of its own.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+// applyNaNPolicy drops the samples with NaN values if policy is "drop" or
+// replaces their values with staleness markers if it is "stale". It returns
+// the resulting samples and the samples with NaN values as they were. The v1
+// storage has no staleness markers, so every NaN is a plain one.
+func applyNaNPolicy(samples []model.SamplePair, policy string) ([]model.SamplePair, []model.SamplePair) {
+	var nans []model.SamplePair
+	for _, s := range samples {
+		if math.IsNaN(float64(s.Value)) {
+			nans = append(nans, s)
+		}
+	}
+	if len(nans) == 0 {
+		return samples, nil
+	}
+	// The samples may be shared with a read-ahead buffer, so they are
+	// copied instead of modified.
+	res := make([]model.SamplePair, 0, len(samples))
+	for _, s := range samples {
+		if math.IsNaN(float64(s.Value)) {
+			if policy == "drop" {
+				continue
+			}
+			s.Value = model.SampleValue(staleNaN)
+		}
+		res = append(res, s)
+	}
+	return res, nans
+}
+
+// series is a v1 series converted for appending to the v2 storage.
+type series struct {
+	labels  labels.Labels
+	samples []model.SamplePair
+}
+
+// mergeSamples merges two lists of samples sorted by timestamp. Of samples
+// with the same timestamp, the one from a is kept.
+func mergeSamples(a, b []model.SamplePair) []model.SamplePair {
+	res := make([]model.SamplePair, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].Timestamp < b[0].Timestamp:
+			res, a = append(res, a[0]), a[1:]
+		case a[0].Timestamp > b[0].Timestamp:
+			res, b = append(res, b[0]), b[1:]
+		default:
+			res, a, b = append(res, a[0]), a[1:], b[1:]
+		}
+	}
+	res = append(res, a...)
+	return append(res, b...)
+}
+
+// normalizeBucketLabels rewrites the values of histogram bucket and summary
+// quantile labels to the formatting used by the Prometheus client libraries,
+// e.g. "0.50" to "0.5". Unparseable values are left unchanged.
+func normalizeBucketLabels(ls labels.Labels) {
+	for i, l := range ls {
+		if l.Name != model.BucketLabel && l.Name != model.QuantileLabel {
+			continue
+		}
+		if f, err := strconv.ParseFloat(l.Value, 64); err == nil {
+			ls[i].Value = formatFloat(f)
+		}
+	}
+}
+
+// formatFloat formats f like the Prometheus text exposition format does.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// addExternalLabels returns the sorted labels ls with the external labels
+// added. If ls already has one of them, it is replaced if overwrite is set and
+// an error is returned otherwise.
+func addExternalLabels(ls, ext labels.Labels, overwrite bool) (labels.Labels, error) {
+	res := make(labels.Labels, 0, len(ls)+len(ext))
+	for _, l := range ls {
+		if v := ext.Get(l.Name); v != "" {
+			if !overwrite {
+				return nil, fmt.Errorf("external label %s=%q collides with label of series %s", l.Name, v, ls)
+			}
+			continue
+		}
+		res = append(res, l)
+	}
+	res = append(res, ext...)
+	sort.Sort(res)
+	return res, nil
+}
+
+// addDefaultLabels returns the sorted labels ls with the default labels
+// added whose names ls does not have.
+func addDefaultLabels(ls, defaults labels.Labels) labels.Labels {
+	var res labels.Labels
+	for _, d := range defaults {
+		if ls.Get(d.Name) != "" {
+			continue
+		}
+		if res == nil {
+			res = append(make(labels.Labels, 0, len(ls)+len(defaults)), ls...)
+		}
+		res = append(res, d)
+	}
+	if res == nil {
+		return ls
+	}
+	sort.Sort(res)
+	return res
+}
+
+// withoutNames returns ls without the labels with the given names.
+func withoutNames(ls labels.Labels, names []string) labels.Labels {
+	res := make(labels.Labels, 0, len(ls))
+	for _, l := range ls {
+		drop := false
+		for _, n := range names {
+			if l.Name == n {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// checkNames returns an error if the metric name or a label name of ls does
+// not follow the Prometheus naming rules, or a label value is not valid
+// UTF-8.
+func checkNames(ls labels.Labels) error {
+	for _, l := range ls {
+		if l.Name == model.MetricNameLabel {
+			if !model.IsValidMetricName(model.LabelValue(l.Value)) {
+				return fmt.Errorf("invalid metric name %q", l.Value)
+			}
+		} else if !model.LabelName(l.Name).IsValid() {
+			return fmt.Errorf("invalid label name %q", l.Name)
+		}
+		if !utf8.ValidString(l.Value) {
+			return fmt.Errorf("value of label %s is not valid UTF-8", l.Name)
+		}
+	}
+	return nil
+}
+
+// hasLongValues returns whether ls has a label value longer than max bytes.
+func hasLongValues(ls labels.Labels, max int) bool {
+	for _, l := range ls {
+		if len(l.Value) > max {
+			return true
+		}
+	}
+	return false
+}
+
+// truncationSuffixLen is the length of the hash that truncateValue appends,
+// and its separator.
+const truncationSuffixLen = 9
+
+// truncateValue shortens v if it is longer than max bytes, which must be
+// greater than truncationSuffixLen, to a prefix of v without split UTF-8
+// encoded characters followed by "~" and the hex FNV-1a hash of v, so that
+// values with the same prefix stay distinct.
+func truncateValue(v string, max int) string {
+	if len(v) <= max {
+		return v
+	}
+	n := max - truncationSuffixLen
+	for n > 0 && !utf8.RuneStart(v[n]) {
+		n--
+	}
+	h := fnv.New32a()
+	h.Write([]byte(v))
+	return fmt.Sprintf("%s~%08x", v[:n], h.Sum32())
+}
+
+// truncateValues shortens the label values of ls that are longer than max
+// bytes with truncateValue.
+func truncateValues(ls labels.Labels, max int) {
+	for i, l := range ls {
+		ls[i].Value = truncateValue(l.Value, max)
+	}
+}
+
+// labelTruncations records the full values of the truncated label values, to
+// detect distinct values that truncateValue shortens to the same value. It
+// holds one entry per distinct truncated value and is safe for concurrent
+// use.
+type labelTruncations struct {
+	mtx    sync.Mutex
+	values map[labels.Label]string
+}
+
+// truncate truncates the label values of ls like truncateValues. It returns
+// an error if another value of the same label name was truncated to the same
+// value before, which would merge distinct series.
+func (t *labelTruncations) truncate(ls labels.Labels, max int) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.values == nil {
+		t.values = map[labels.Label]string{}
+	}
+	for _, l := range ls {
+		if len(l.Value) <= max {
+			continue
+		}
+		short := labels.Label{Name: l.Name, Value: truncateValue(l.Value, max)}
+		if full, ok := t.values[short]; ok && full != l.Value {
+			return fmt.Errorf("values %q and %q of label %s are both truncated to %q", full, l.Value, l.Name, short.Value)
+		}
+		t.values[short] = l.Value
+	}
+	truncateValues(ls, max)
+	return nil
+}
+
+// dedupLabels returns the sorted labels ls with only the last of every run of
+// labels with the same name. It returns ls itself if all names are unique.
+func dedupLabels(ls labels.Labels) labels.Labels {
+	dup := false
+	for i := 1; i < len(ls); i++ {
+		if ls[i-1].Name == ls[i].Name {
+			dup = true
+			break
+		}
+	}
+	if !dup {
+		return ls
+	}
+	res := make(labels.Labels, 0, len(ls))
+	for i, l := range ls {
+		if i+1 < len(ls) && ls[i+1].Name == l.Name {
+			continue
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
+// checkLabels returns an error if ls is not sorted by name or contains a
+// label name more than once.
+func checkLabels(ls labels.Labels) error {
+	for i := 1; i < len(ls); i++ {
+		switch {
+		case ls[i-1].Name == ls[i].Name:
+			return fmt.Errorf("duplicate label name %q", ls[i].Name)
+		case ls[i-1].Name > ls[i].Name:
+			return fmt.Errorf("label %q sorted after %q", ls[i].Name, ls[i-1].Name)
+		}
+	}
+	return nil
+}
+
+// roundSignificant rounds v to the given number of significant decimal
+// digits. NaN values, including staleness markers, and infinities are
+// returned unchanged.
+func roundSignificant(v float64, digits int) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	r, err := strconv.ParseFloat(strconv.FormatFloat(v, 'g', digits, 64), 64)
+	if err != nil {
+		return v
+	}
+	return r
+}
@@ -0,0 +1,1436 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestCheckLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		ls      labels.Labels
+		wantErr bool
+	}{
+		{name: "sorted", ls: labels.Labels{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "a"}, {Name: "job", Value: "b"}}},
+		{name: "empty", ls: labels.Labels{}},
+		{name: "unsorted", ls: labels.Labels{{Name: "job", Value: "b"}, {Name: "instance", Value: "a"}}, wantErr: true},
+		{name: "duplicate", ls: labels.Labels{{Name: "instance", Value: "a"}, {Name: "instance", Value: "b"}}, wantErr: true},
+	} {
+		if err := checkLabels(tc.ls); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestRoundSignificant(t *testing.T) {
+	for _, tc := range []struct {
+		v      float64
+		digits int
+		want   float64
+	}{
+		{v: 123456, digits: 3, want: 123000},
+		{v: 0.00123456, digits: 2, want: 0.0012},
+		{v: -9.87654, digits: 4, want: -9.877},
+		{v: 1.5, digits: 1, want: 2},
+		{v: 0, digits: 3, want: 0},
+		{v: math.Inf(1), digits: 3, want: math.Inf(1)},
+		{v: math.Inf(-1), digits: 3, want: math.Inf(-1)},
+	} {
+		if got := roundSignificant(tc.v, tc.digits); got != tc.want {
+			t.Errorf("roundSignificant(%v, %d) = %v, want %v", tc.v, tc.digits, got, tc.want)
+		}
+	}
+	// Staleness markers are NaNs with a specific bit pattern that must be
+	// kept.
+	for _, bits := range []uint64{math.Float64bits(math.NaN()), 0x7ff0000000000002} {
+		if got := math.Float64bits(roundSignificant(math.Float64frombits(bits), 3)); got != bits {
+			t.Errorf("roundSignificant(%x) = %x, want the value unchanged", bits, got)
+		}
+	}
+}
+
+// repeatedValues returns the number of samples in samples with the same value
+// as the previous sample.
+func repeatedValues(samples []model.SamplePair) int {
+	n := 0
+	for i := 1; i < len(samples); i++ {
+		if samples[i].Value == samples[i-1].Value {
+			n++
+		}
+	}
+	return n
+}
+
+func TestValuePrecision(t *testing.T) {
+	var samples []*model.Sample
+	for i := 0; i < 240; i++ {
+		samples = append(samples, &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "test_metric", model.InstanceLabel: "host0:9090"},
+			Timestamp: testStart.Add(time.Duration(i) * 15 * time.Second),
+			// A value that jitters in its fifth significant digit.
+			Value: model.SampleValue(1000 + float64(i%7)*0.01),
+		})
+	}
+	v1, closeV1 := newTestV1Storage(t, samples)
+	defer closeV1()
+
+	var repeated []int
+	for _, precision := range []int{0, 4} {
+		s := &testStorage{}
+		m := newTestMigrator(v1, s)
+		m.valuePrecision = precision
+		if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Hour)-1); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.samples) != 1 {
+			t.Fatalf("precision %d: got %d series, want 1", precision, len(s.samples))
+		}
+		for _, got := range s.samples {
+			if len(got) != len(samples) {
+				t.Fatalf("precision %d: got %d samples, want %d", precision, len(got), len(samples))
+			}
+			for i, smpl := range got {
+				if want := model.SampleValue(roundSignificant(float64(samples[i].Value), precision)); precision > 0 && smpl.Value != want {
+					t.Fatalf("precision %d: got value %v, want %v", precision, smpl.Value, want)
+				}
+			}
+			repeated = append(repeated, repeatedValues(got))
+		}
+	}
+	if repeated[1] <= repeated[0] {
+		t.Errorf("got %d repeated values with rounding, %d without, want more", repeated[1], repeated[0])
+	}
+}
+
+func TestNormalizeBucketLabels(t *testing.T) {
+	for in, want := range map[string]string{
+		"0.5": "0.5", "0.50": "0.5", "1": "1", "1.0": "1", "+Inf": "+Inf", "+inf": "+Inf", "Inf": "+Inf",
+		"1e3": "1000", "0.000001": "1e-06", "NaN": "NaN", "not a number": "not a number",
+	} {
+		ls := labels.FromStrings("le", in, "quantile", in, "other", in)
+		normalizeBucketLabels(ls)
+		if got := ls.Get("le"); got != want {
+			t.Errorf("le %q: got %q, want %q", in, got, want)
+		}
+		if got := ls.Get("quantile"); got != want {
+			t.Errorf("quantile %q: got %q, want %q", in, got, want)
+		}
+		if got := ls.Get("other"); got != in {
+			t.Errorf("other label %q changed to %q", in, got)
+		}
+	}
+}
+
+func TestNormalizeBucketLabelsMergesSeries(t *testing.T) {
+	var samples []*model.Sample
+	for i := 0; i < 240; i++ {
+		// Alternate the formatting of the bucket between samples, as if the
+		// client library had changed in between.
+		le := model.LabelValue("0.5")
+		if i%2 == 1 {
+			le = "0.50"
+		}
+		samples = append(samples, &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "test_bucket", model.InstanceLabel: "host0:9090", model.BucketLabel: le},
+			Timestamp: testStart.Add(time.Duration(i) * 15 * time.Second),
+			Value:     model.SampleValue(i),
+		})
+	}
+	v1, closeV1 := newTestV1Storage(t, samples)
+	defer closeV1()
+
+	s := &testStorage{}
+	m := newTestMigrator(v1, s)
+	m.normalizeBucketLabels = true
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Hour)-1); err != nil {
+		t.Fatal(err)
+	}
+	want := labels.FromStrings(model.MetricNameLabel, "test_bucket", model.InstanceLabel, "host0:9090", model.BucketLabel, "0.5").String()
+	if len(s.samples) != 1 || len(s.samples[want]) != 240 {
+		t.Fatalf("got series %v, want 240 samples of %s", s.samples, want)
+	}
+	for i, smpl := range s.samples[want] {
+		if smpl.Value != model.SampleValue(i) {
+			t.Fatalf("got sample %v at index %d, want samples in order", smpl, i)
+		}
+	}
+}
+
+func TestNormalizeBucketLabelsMergesQuantiles(t *testing.T) {
+	var samples []*model.Sample
+	for i := 0; i < 240; i++ {
+		// The 0.9 quantile is formatted differently from sample to sample,
+		// the 0.99 quantile is not.
+		q := []model.LabelValue{"0.9", "0.90", "9e-01"}[i%3]
+		for _, quantile := range []model.LabelValue{q, "0.99"} {
+			samples = append(samples, &model.Sample{
+				Metric:    model.Metric{model.MetricNameLabel: "test_summary", model.InstanceLabel: "host0:9090", model.QuantileLabel: quantile},
+				Timestamp: testStart.Add(time.Duration(i) * 15 * time.Second),
+				Value:     model.SampleValue(i),
+			})
+		}
+	}
+	v1, closeV1 := newTestV1Storage(t, samples)
+	defer closeV1()
+
+	s := &testStorage{}
+	m := newTestMigrator(v1, s)
+	m.normalizeBucketLabels = true
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Hour)-1); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.samples) != 2 {
+		t.Fatalf("got %d series, want 2: %v", len(s.samples), s.samples)
+	}
+	for _, quantile := range []string{"0.9", "0.99"} {
+		ls := labels.FromStrings(model.MetricNameLabel, "test_summary", model.InstanceLabel, "host0:9090", model.QuantileLabel, quantile).String()
+		if len(s.samples[ls]) != 240 {
+			t.Errorf("got %d samples of %s, want 240", len(s.samples[ls]), ls)
+		}
+		for i, smpl := range s.samples[ls] {
+			if smpl.Value != model.SampleValue(i) {
+				t.Fatalf("got sample %v of %s at index %d, want samples in order", smpl, ls, i)
+			}
+		}
+	}
+}
+
+func TestDropLabels(t *testing.T) {
+	var samples []*model.Sample
+	for i := 0; i < 240; i++ {
+		ts := testStart.Add(time.Duration(i) * 15 * time.Second)
+		// The series of replica b has every sample, the one of replica a
+		// every other one, at the same timestamps.
+		samples = append(samples, &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "up", model.InstanceLabel: "host0:9090", "replica": "b", "job": "node"},
+			Timestamp: ts,
+			Value:     2,
+		})
+		if i%2 == 0 {
+			samples = append(samples, &model.Sample{
+				Metric:    model.Metric{model.MetricNameLabel: "up", model.InstanceLabel: "host0:9090", "replica": "a", "job": "node"},
+				Timestamp: ts,
+				Value:     1,
+			})
+		}
+	}
+	v1, closeV1 := newTestV1Storage(t, samples)
+	defer closeV1()
+
+	s := &testStorage{}
+	m := newTestMigrator(v1, s)
+	m.dropLabels = []string{"replica", "not_present"}
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Hour)-1); err != nil {
+		t.Fatal(err)
+	}
+	want := labels.FromStrings(model.MetricNameLabel, "up", model.InstanceLabel, "host0:9090", "job", "node").String()
+	if len(s.samples) != 1 || len(s.samples[want]) != 240 {
+		t.Fatalf("got series %v, want 240 samples of %s", s.samples, want)
+	}
+	for i, smpl := range s.samples[want] {
+		// The sample of replica a, whose labels sort first, is kept.
+		v := model.SampleValue(2)
+		if i%2 == 0 {
+			v = 1
+		}
+		if smpl.Timestamp != testStart.Add(time.Duration(i)*15*time.Second) || smpl.Value != v {
+			t.Fatalf("got sample %v at index %d, want value %v at %v", smpl, i, v, testStart.Add(time.Duration(i)*15*time.Second))
+		}
+	}
+}
+
+func TestNaNPolicy(t *testing.T) {
+	samples := testSamples(testInstances(1), 1, 10*time.Minute)
+	// Every tenth value is a plain NaN.
+	for i := 0; i < len(samples); i += 10 {
+		samples[i].Value = model.SampleValue(math.NaN())
+	}
+	v1, closeV1 := newTestV1Storage(t, samples)
+	defer closeV1()
+
+	for _, policy := range []string{"", "drop", "stale"} {
+		s := &testStorage{}
+		m := newTestMigrator(v1, s)
+		m.nanPolicy = policy
+		if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(10*time.Minute)-1); err != nil {
+			t.Fatal(err)
+		}
+		if m.nanValues != 4 && policy != "" {
+			t.Errorf("policy %q: counted %d NaN values, want 4", policy, m.nanValues)
+		}
+		var got []model.SamplePair
+		for _, ss := range s.samples {
+			got = ss
+		}
+		want := 40
+		if policy == "drop" {
+			want = 36
+		}
+		if len(got) != want {
+			t.Fatalf("policy %q: got %d samples, want %d", policy, len(got), want)
+		}
+		nans := 0
+		for _, smpl := range got {
+			if !math.IsNaN(float64(smpl.Value)) {
+				continue
+			}
+			nans++
+			if stale := math.Float64bits(float64(smpl.Value)) == math.Float64bits(staleNaN); stale != (policy == "stale") {
+				t.Errorf("policy %q: got NaN value %x at %v", policy, math.Float64bits(float64(smpl.Value)), smpl.Timestamp)
+			}
+		}
+		if wantNaNs := map[string]int{"": 4, "drop": 0, "stale": 4}[policy]; nans != wantNaNs {
+			t.Errorf("policy %q: got %d NaN values, want %d", policy, nans, wantNaNs)
+		}
+	}
+}
+
+// concurrencyStorage is a testStorage that records the highest number of
+// open appenders and of concurrent commits.
+type concurrencyStorage struct {
+	testStorage
+
+	mtx                    sync.Mutex
+	open, committing       int
+	maxOpen, maxCommitting int
+}
+
+func (s *concurrencyStorage) Appender() tsdb.Appender {
+	s.mtx.Lock()
+	s.open++
+	if s.open > s.maxOpen {
+		s.maxOpen = s.open
+	}
+	s.mtx.Unlock()
+	return &concurrencyAppender{Appender: s.testStorage.Appender(), s: s}
+}
+
+type concurrencyAppender struct {
+	tsdb.Appender
+	s *concurrencyStorage
+}
+
+func (a *concurrencyAppender) Commit() error {
+	a.s.mtx.Lock()
+	a.s.committing++
+	if a.s.committing > a.s.maxCommitting {
+		a.s.maxCommitting = a.s.committing
+	}
+	a.s.mtx.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	err := a.Appender.Commit()
+
+	a.s.mtx.Lock()
+	a.s.committing--
+	a.s.open--
+	a.s.mtx.Unlock()
+	return err
+}
+
+func TestMaxConcurrentCommits(t *testing.T) {
+	instances := testInstances(8)
+	v1, closeV1 := newTestV1Storage(t, testSamples(instances, 1, 10*time.Minute))
+	defer closeV1()
+
+	v2 := &concurrencyStorage{}
+	m := newTestMigrator(v1, v2)
+	m.commitSema = make(chan struct{}, 2)
+
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance string) {
+			defer wg.Done()
+			if err := migrateTestInstance(m, instance, testStart, testStart.Add(10*time.Minute)); err != nil {
+				t.Error(err)
+			}
+		}(instance)
+	}
+	wg.Wait()
+
+	if v2.maxCommitting > 2 {
+		t.Errorf("got %d concurrent commits, want at most 2", v2.maxCommitting)
+	}
+	if v2.maxOpen <= 2 {
+		t.Errorf("got %d instances migrating concurrently, want more than the 2 concurrent commits", v2.maxOpen)
+	}
+	if n := v2.numSamples(); n != 8*40 {
+		t.Errorf("got %d samples, want %d", n, 8*40)
+	}
+}
+
+func TestSourceQueryConcurrency(t *testing.T) {
+	instances := testInstances(8)
+	v1, closeV1 := newTestV1Storage(t, testSamples(instances, 4, 10*time.Minute))
+	defer closeV1()
+
+	v2 := &concurrencyStorage{}
+	m := newTestMigrator(v1, v2)
+	m.windowWorkers = 4
+	m.querySema = make(chan struct{}, 2)
+	// Hold both slots, so that no reads can start. The channel never
+	// admits more than its capacity.
+	m.querySema <- struct{}{}
+	m.querySema <- struct{}{}
+
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance string) {
+			defer wg.Done()
+			if err := migrateTestInstance(m, instance, testStart, testStart.Add(10*time.Minute)); err != nil {
+				t.Error(err)
+			}
+		}(instance)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := v2.numSamples(); n != 0 {
+		t.Fatalf("got %d samples while no reads were admitted, want 0", n)
+	}
+
+	// The reads are admitted two at a time.
+	<-m.querySema
+	<-m.querySema
+	wg.Wait()
+
+	if n := v2.numSamples(); n != 8*4*40 {
+		t.Errorf("got %d samples, want %d", n, 8*4*40)
+	}
+}
+
+func TestWindowWorkers(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 50, time.Hour))
+	defer closeV1()
+
+	var got []map[string][]model.SamplePair
+	for _, workers := range []int{1, 8} {
+		v2 := &testStorage{}
+		m := newTestMigrator(v1, v2)
+		m.windowWorkers = workers
+		if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, v2.samples)
+	}
+	if len(got[0]) != 50 {
+		t.Fatalf("got %d series, want 50", len(got[0]))
+	}
+	if !reflect.DeepEqual(got[0], got[1]) {
+		t.Error("reading series concurrently migrated different samples than reading them serially")
+	}
+}
+
+// BenchmarkWindowWorkers measures the migration of a step of 200 series with
+// 240 samples each with the -copy-window-workers that decode them.
+func BenchmarkWindowWorkers(b *testing.B) {
+	v1, closeV1 := newTestV1Storage(b, testSamples(testInstances(1), 200, time.Hour))
+	defer closeV1()
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("copy-window-workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m := newTestMigrator(v1, &testStorage{})
+				m.windowWorkers = workers
+				if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Hour)-1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSampleFraction(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(4), 100, 30*time.Minute))
+	defer removeV1()
+
+	var runs []map[string][]int64
+	for i := 0; i < 2; i++ {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		// Different steps must select the same series.
+		runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", fmt.Sprintf("%dm", 5*(i+1)), "-lookback", "30m",
+			"-end-timestamp", fmt.Sprint(testStart.Add(30*time.Minute).Unix()), "-sample-fraction", "0.2",
+		)
+		runs = append(runs, storedTimestamps(t, v2Dir))
+	}
+
+	if n := len(runs[0]); n < 60 || n > 100 {
+		t.Errorf("migrated %d of 400 series, want about 20%%", n)
+	}
+	if len(runs[0]) != len(runs[1]) {
+		t.Fatalf("migrated %d and %d series in two runs, want the same", len(runs[0]), len(runs[1]))
+	}
+	for ls, ts := range runs[0] {
+		if _, ok := runs[1][ls]; !ok {
+			t.Errorf("series %s was only selected in the first run", ls)
+		}
+		if len(ts) != 120 {
+			t.Errorf("series %s has %d samples, want all 120", ls, len(ts))
+		}
+	}
+}
+
+func TestExternalLabels(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 1, 30*time.Minute))
+	defer removeV1()
+	args := []string{
+		"-step", "10m", "-lookback", "30m", "-end-timestamp", fmt.Sprint(testStart.Add(30 * time.Minute).Unix()),
+		"-external-label", "source=migrated", "-external-label", "cluster=eu",
+	}
+	for _, tc := range []struct {
+		name      string
+		args      []string
+		wantCode  int
+		wantLabel string
+	}{
+		{name: "added", wantLabel: `idx="0"`},
+		{name: "collision", args: []string{"-external-label", "idx=all"}, wantCode: 1},
+		{name: "overwrite", args: []string{"-external-label", "idx=all", "-overwrite-labels"}, wantLabel: `idx="all"`},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		var code int
+		logs := captureStderr(t, func() {
+			code = runMain(append(append([]string{"-v1-dir", v1Dir, "-v2-dir", v2Dir}, args...), tc.args...)...)
+		})
+		if code != tc.wantCode {
+			t.Fatalf("%s: got exit code %d, want %d, logs:\n%s", tc.name, code, tc.wantCode, logs)
+		}
+		if code != 0 {
+			continue
+		}
+		got := storedTimestamps(t, v2Dir)
+		if len(got) == 0 {
+			t.Fatalf("%s: no series migrated", tc.name)
+		}
+		for ls := range got {
+			if !strings.Contains(ls, `cluster="eu"`) || !strings.Contains(ls, `source="migrated"`) || !strings.Contains(ls, tc.wantLabel) {
+				t.Errorf("%s: series %s does not have the external labels", tc.name, ls)
+			}
+		}
+	}
+}
+
+func TestDefaultLabels(t *testing.T) {
+	samples := testSamples(testInstances(2), 1, 30*time.Minute)
+	for _, s := range samples {
+		if s.Metric[model.InstanceLabel] == "host0:9090" {
+			s.Metric["job"], s.Metric["dc"] = "node", "us"
+		}
+	}
+	v1Dir, removeV1 := newTestV1Dir(t, samples)
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	if code := runMain(
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "30m",
+		"-end-timestamp", fmt.Sprint(testStart.Add(30*time.Minute).Unix()),
+		"-default-job", "migrated", "-default-label", "dc=eu",
+	); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	var series []string
+	for ls, ts := range storedTimestamps(t, v2Dir) {
+		series = append(series, ls)
+		if len(ts) != 120 {
+			t.Errorf("series %s has %d samples, want 120", ls, len(ts))
+		}
+	}
+	sort.Strings(series)
+	// Only the labels that a series does not have are added.
+	want := []string{
+		`{__name__="test_metric",dc="eu",idx="0",instance="host1:9090",job="migrated"}`,
+		`{__name__="test_metric",dc="us",idx="0",instance="host0:9090",job="node"}`,
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("got series %v, want %v", series, want)
+	}
+}
+
+func TestMergeIdenticalSeries(t *testing.T) {
+	var samples []*model.Sample
+	for i := 0; i < 240; i++ {
+		// Two series that only differ in the replica label, which is
+		// replaced below, alternate samples and both have every tenth one.
+		for _, replica := range []string{"a", "b"} {
+			if replica == "a" && i%2 == 1 || replica == "b" && i%2 == 0 && i%10 != 0 {
+				continue
+			}
+			samples = append(samples, &model.Sample{
+				Metric:    model.Metric{model.MetricNameLabel: "test_metric", model.InstanceLabel: "host0:9090", "replica": model.LabelValue(replica)},
+				Timestamp: testStart.Add(time.Duration(i) * 15 * time.Second),
+				Value:     model.SampleValue(i),
+			})
+		}
+	}
+	v1, closeV1 := newTestV1Storage(t, samples)
+	defer closeV1()
+
+	s := &testStorage{}
+	m := newTestMigrator(v1, s)
+	m.externalLabels, m.overwriteLabels = labels.FromStrings("replica", "merged"), true
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Hour)-1); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.mergedSeries.count(); n != 1 {
+		t.Errorf("merged %d series, want 1", n)
+	}
+	want := labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host0:9090", "replica", "merged").String()
+	if len(s.samples) != 1 || len(s.samples[want]) != 240 {
+		t.Fatalf("got series %v, want 240 samples of %s", s.samples, want)
+	}
+	for i, smpl := range s.samples[want] {
+		if smpl.Value != model.SampleValue(i) || smpl.Timestamp != testStart.Add(time.Duration(i)*15*time.Second) {
+			t.Fatalf("got sample %v at index %d, want samples in order without duplicates", smpl, i)
+		}
+	}
+}
+
+// testIterator is a v1 series iterator over fixed samples.
+type testIterator struct {
+	metric  model.Metric
+	samples []model.SamplePair
+	closed  bool
+}
+
+func (it *testIterator) ValueAtOrBeforeTime(model.Time) model.SamplePair { return model.ZeroSamplePair }
+
+func (it *testIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	var res []model.SamplePair
+	for _, s := range it.samples {
+		if !s.Timestamp.Before(in.OldestInclusive) && !s.Timestamp.After(in.NewestInclusive) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func (it *testIterator) Metric() metric.Metric { return metric.Metric{Metric: it.metric} }
+
+func (it *testIterator) Close() { it.closed = true }
+
+// testIterators returns an iterator for each metric, with samples at the
+// given timestamps in seconds and the timestamps as values.
+func testIterators(metrics []model.Metric, ts ...int64) []local.SeriesIterator {
+	var its []local.SeriesIterator
+	for _, m := range metrics {
+		it := &testIterator{metric: m}
+		for _, t := range ts {
+			it.samples = append(it.samples, model.SamplePair{Timestamp: model.TimeFromUnix(t), Value: model.SampleValue(t)})
+		}
+		its = append(its, it)
+	}
+	return its
+}
+
+func TestNonMonotonicTimestamps(t *testing.T) {
+	// The samples at 30s and 45s after testStart are swapped and the one at
+	// 60s is repeated.
+	ts := []int64{0, 15, 45, 30, 60, 60, 75}
+	for _, sorted := range []bool{false, true} {
+		its := testIterators([]model.Metric{{model.MetricNameLabel: "test_metric", model.InstanceLabel: "host0:9090"}})
+		it := its[0].(*testIterator)
+		for _, sec := range ts {
+			it.samples = append(it.samples, model.SamplePair{Timestamp: testStart.Add(time.Duration(sec) * time.Second), Value: model.SampleValue(sec)})
+		}
+		// The iterators are handed to the migrator as if read ahead.
+		done := make(chan struct{})
+		close(done)
+		s := &testStorage{}
+		m := newTestMigrator(nil, s)
+		m.checkOrder, m.sortSamples = true, sorted
+		m.prefetch = &prefetcher{reads: map[prefetchKey]*prefetchRead{
+			{instance: "host0:9090", from: testStart}: {running: true, done: done, its: its},
+		}}
+		if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(90*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if m.unordered != 2 {
+			t.Errorf("sorted %v: found %d unordered samples, want 2", sorted, m.unordered)
+		}
+		var got []int64
+		for _, ss := range s.samples {
+			for _, smpl := range ss {
+				got = append(got, int64(smpl.Timestamp.Sub(testStart)/time.Second))
+			}
+		}
+		want := ts
+		if sorted {
+			want = []int64{0, 15, 30, 45, 60, 75}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("sorted %v: got timestamps %v, want %v", sorted, got, want)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	metrics := []model.Metric{
+		{model.MetricNameLabel: "test_bucket", model.BucketLabel: "0.50"},
+		{model.MetricNameLabel: "test_other"},
+		{model.MetricNameLabel: "test_bucket", model.BucketLabel: "0.5"},
+		{model.MetricNameLabel: "test_skipped"},
+	}
+	its := testIterators(metrics)
+	m := newTestMigrator(nil, nil)
+	m.normalizeBucketLabels = true
+	m.seriesList = &seriesList{byHash: map[uint64][]labels.Labels{}}
+	for _, ls := range []labels.Labels{
+		labels.FromStrings(model.MetricNameLabel, "test_bucket", model.BucketLabel, "0.50"),
+		labels.FromStrings(model.MetricNameLabel, "test_bucket", model.BucketLabel, "0.5"),
+		labels.FromStrings(model.MetricNameLabel, "test_other"),
+	} {
+		m.seriesList.add(ls)
+	}
+
+	groups, err := m.transform(its)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The normalized buckets are grouped at the position of the first one,
+	// sorted by their v1 metric.
+	want := []*seriesGroup{
+		{labels: labels.FromStrings(model.MetricNameLabel, "test_bucket", model.BucketLabel, "0.5"), its: []local.SeriesIterator{its[2], its[0]}},
+		{labels: labels.FromStrings(model.MetricNameLabel, "test_other"), its: []local.SeriesIterator{its[1]}},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("got groups %v, want %v", groups, want)
+	}
+}
+
+func TestTransformSortsLabels(t *testing.T) {
+	its := testIterators([]model.Metric{
+		{model.MetricNameLabel: "up", "job": "node", "Zone": "a", "instance": "host0:9090"},
+	})
+	m := newTestMigrator(nil, nil)
+	// Both external labels sort before the metric name, one of them
+	// replaces a label of the series.
+	m.externalLabels = labels.FromStrings("Region", "eu", "Zone", "b")
+	m.overwriteLabels = true
+
+	groups, err := m.transform(its)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := labels.Labels{
+		{Name: "Region", Value: "eu"},
+		{Name: "Zone", Value: "b"},
+		{Name: model.MetricNameLabel, Value: "up"},
+		{Name: "instance", Value: "host0:9090"},
+		{Name: "job", Value: "node"},
+	}
+	if len(groups) != 1 || !reflect.DeepEqual(groups[0].labels, want) {
+		t.Errorf("got groups %v, want labels %v", groups, want)
+	}
+}
+
+func TestMigrateClosesIterators(t *testing.T) {
+	for _, storageErr := range []error{nil, errors.New("connection refused")} {
+		var metrics []model.Metric
+		for i := 0; i < 20; i++ {
+			metrics = append(metrics, model.Metric{model.MetricNameLabel: "test_metric", model.InstanceLabel: "host0:9090", "idx": model.LabelValue(fmt.Sprint(i))})
+		}
+		its := testIterators(metrics, 1, 2, 3, 4, 5)
+		done := make(chan struct{})
+		close(done)
+		m := newTestMigrator(nil, &testStorage{err: storageErr})
+		m.windowWorkers = 4
+		m.prefetch = &prefetcher{reads: map[prefetchKey]*prefetchRead{
+			{instance: "host0:9090", from: model.TimeFromUnix(1)}: {running: true, done: done, its: its},
+		}}
+		err := migrateTestInstance(m, "host0:9090", model.TimeFromUnix(1), model.TimeFromUnix(6))
+		if (err != nil) != (storageErr != nil) {
+			t.Fatalf("storage error %v: got error %v", storageErr, err)
+		}
+		for _, it := range its {
+			if !it.(*testIterator).closed {
+				t.Errorf("storage error %v: iterator of %s was not closed", storageErr, it.Metric().Metric)
+			}
+		}
+	}
+}
+
+func TestReadGroups(t *testing.T) {
+	var groups []*seriesGroup
+	for i := 0; i < 20; i++ {
+		groups = append(groups, &seriesGroup{
+			labels: labels.FromStrings("idx", fmt.Sprint(i)),
+			its: append(
+				testIterators([]model.Metric{{}}, 1, 3, 5, 7),
+				testIterators([]model.Metric{{}}, 2, 3, 4)...,
+			),
+		})
+	}
+	m := newTestMigrator(nil, nil)
+	m.windowWorkers = 4
+
+	done := make(chan struct{})
+	var got []*series
+	for s := range m.readGroups(done, groups, model.TimeFromUnix(2), model.TimeFromUnix(6)) {
+		got = append(got, s)
+	}
+	close(done)
+	if len(got) != len(groups) {
+		t.Fatalf("got %d series, want %d", len(got), len(groups))
+	}
+	for i, s := range got {
+		want := &series{labels: groups[i].labels}
+		for _, ts := range []int64{2, 3, 4, 5} {
+			want.samples = append(want.samples, model.SamplePair{Timestamp: model.TimeFromUnix(ts), Value: model.SampleValue(ts)})
+		}
+		if !reflect.DeepEqual(s, want) {
+			t.Errorf("got series %v at index %d, want %v", s, i, want)
+		}
+	}
+
+	// Reading stops once done is closed, without reading all groups.
+	done = make(chan struct{})
+	sers := m.readGroups(done, groups, model.TimeFromUnix(2), model.TimeFromUnix(6))
+	<-sers
+	close(done)
+	n := 1
+	for range sers {
+		n++
+	}
+	if n == len(groups) {
+		t.Error("all series were read after done was closed")
+	}
+}
+
+func TestMigrateStages(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 20, time.Hour))
+	defer closeV1()
+	from, through := testStart.Add(10*time.Minute), testStart.Add(40*time.Minute)
+
+	for _, workers := range []int{1, 4} {
+		s := &testStorage{}
+		m := newTestMigrator(v1, s)
+		m.windowWorkers = workers
+		if err := migrateTestInstance(m, "host0:9090", from, through); err != nil {
+			t.Fatal(err)
+		}
+
+		// Read the same series directly from the v1 storage.
+		matcher, err := metric.NewLabelMatcher(metric.Equal, model.InstanceLabel, "host0:9090")
+		if err != nil {
+			t.Fatal(err)
+		}
+		its, err := v1.QueryRange(context.Background(), from, through, matcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string][]model.SamplePair{}
+		for _, it := range its {
+			ls := labels.Labels{}
+			for n, v := range it.Metric().Metric {
+				ls = append(ls, labels.Label{Name: string(n), Value: string(v)})
+			}
+			sort.Sort(ls)
+			want[ls.String()] = it.RangeValues(metric.Interval{OldestInclusive: from, NewestInclusive: through})
+		}
+		closeIterators(its)
+
+		if !reflect.DeepEqual(s.samples, want) {
+			t.Errorf("%d workers: migrated samples differ from the v1 storage", workers)
+		}
+	}
+}
+
+func TestStrictNames(t *testing.T) {
+	metrics := []model.Metric{
+		{model.MetricNameLabel: "test_metric", model.InstanceLabel: "host0:9090"},
+		{model.MetricNameLabel: "test-metric", model.InstanceLabel: "host0:9090"},
+		{model.MetricNameLabel: "test_metric", "invalid-label": "a"},
+	}
+	for _, tc := range []struct {
+		mode       string
+		wantErr    bool
+		wantGroups int
+		wantSkips  uint64
+	}{
+		{mode: "", wantGroups: 3},
+		{mode: "skip", wantGroups: 1, wantSkips: 2},
+		{mode: "fail", wantErr: true},
+	} {
+		m := newTestMigrator(nil, nil)
+		m.strictNames = tc.mode
+		groups, err := m.transform(testIterators(metrics))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: got error %v, want error %v", tc.mode, err, tc.wantErr)
+		}
+		if tc.wantErr {
+			if err != nil && !strings.Contains(err.Error(), `invalid metric name "test-metric"`) {
+				t.Errorf("%q: got error %q, want it to name the invalid metric", tc.mode, err)
+			}
+			continue
+		}
+		if len(groups) != tc.wantGroups || m.nameViolations.count() != tc.wantSkips {
+			t.Errorf("%q: got %d series and %d skipped, want %d and %d", tc.mode, len(groups), m.nameViolations.count(), tc.wantGroups, tc.wantSkips)
+		}
+	}
+}
+
+func TestDropRepeatedValues(t *testing.T) {
+	nan := math.NaN()
+	for _, tc := range []struct {
+		name      string
+		in        []model.SamplePair
+		tolerance float64
+		want      []model.SamplePair
+	}{
+		{
+			name: "run collapsed to its endpoints",
+			in:   sampleValues(1, 2, 2, 2, 2, 3),
+			want: []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 10000, Value: 2}, {Timestamp: 40000, Value: 2}, {Timestamp: 50000, Value: 3}},
+		},
+		{
+			name: "first and last sample kept",
+			in:   sampleValues(4, 4, 4, 4),
+			want: []model.SamplePair{{Timestamp: 0, Value: 4}, {Timestamp: 30000, Value: 4}},
+		},
+		{
+			name: "staleness markers kept",
+			in:   sampleValues(4, 4, nan, nan, 4, 4),
+			want: sampleValues(4, 4, nan, nan, 4, 4),
+		},
+		{
+			name:      "values within tolerance",
+			in:        sampleValues(100, 100.5, 99.5, 100, 200),
+			tolerance: 0.01,
+			want:      []model.SamplePair{{Timestamp: 0, Value: 100}, {Timestamp: 30000, Value: 100}, {Timestamp: 40000, Value: 200}},
+		},
+	} {
+		got := dropRepeatedValues(tc.in, tc.tolerance)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Timestamp != tc.want[i].Timestamp || math.Float64bits(float64(got[i].Value)) != math.Float64bits(float64(tc.want[i].Value)) {
+				t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDropInvalidTimes(t *testing.T) {
+	samples := testSamples(testInstances(1), 1, 10*time.Minute)
+	farFuture := model.TimeFromUnix(time.Date(2250, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	samples = append(samples, &model.Sample{Metric: samples[0].Metric, Timestamp: farFuture, Value: 1})
+	v1, closeV1 := newTestV1Storage(t, samples)
+	defer closeV1()
+
+	v2 := &testStorage{}
+	m := newTestMigrator(v1, v2)
+	m.checkTimes = true
+	m.minValidTime, m.maxValidTime = model.Earliest, testStart.Add(time.Hour)
+	if err := migrateTestInstance(m, "host0:9090", testStart, farFuture); err != nil {
+		t.Fatal(err)
+	}
+	if m.invalidTimes != 1 {
+		t.Errorf("dropped %d samples with invalid timestamps, want 1", m.invalidTimes)
+	}
+	if len(v2.samples) != 1 {
+		t.Fatalf("got %d series, want 1", len(v2.samples))
+	}
+	for ls, got := range v2.samples {
+		if len(got) != 40 || got[len(got)-1].Timestamp >= m.maxValidTime {
+			t.Errorf("series %s has %d samples up to %s, want 40 without the far-future one", ls, len(got), got[len(got)-1].Timestamp)
+		}
+	}
+}
+
+func TestMaxTotalSeries(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(3), 4, time.Hour))
+	defer removeV1()
+
+	var selected []string
+	for run := 0; run < 2; run++ {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		var code int
+		logs := captureStderr(t, func() {
+			code = runMain(
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+				"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+				"-max-total-series", "5",
+			)
+		})
+		if code != 0 {
+			t.Fatalf("run %d: got exit code %d, want 0", run, code)
+		}
+		if l := logLine(logs, "Reached maximum number of series, only migrating the remaining samples of the migrated series"); logValue(l, "max_total_series") != "5" {
+			t.Errorf("run %d: got %q, want the series limit to be reported", run, l)
+		}
+
+		got := storedTimestamps(t, v2Dir)
+		var series []string
+		for ls, ts := range got {
+			series = append(series, ls)
+			// The samples of the admitted series in later steps
+			// are still migrated.
+			if len(ts) != 240 {
+				t.Errorf("run %d: series %s has %d samples, want 240", run, ls, len(ts))
+			}
+		}
+		sort.Strings(series)
+		if len(series) != 5 {
+			t.Errorf("run %d: got %d series, want 5", run, len(series))
+		}
+		if run == 1 && !reflect.DeepEqual(series, selected) {
+			t.Errorf("selected series %v, want the same as in the first run %v", series, selected)
+		}
+		selected = series
+	}
+}
+
+func TestPreviewDoesNotAdmitSeries(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(2), 2, 10*time.Minute))
+	defer closeV1()
+	v2 := &testStorage{}
+	m := newTestMigrator(v1, v2)
+	m.seriesLimit, m.admitted = 2, newSeriesList()
+
+	// A read-only pass over the series of host1 comes first.
+	matchers, err := shardMatchers(m.shardLabel, "host1:9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	its, err := m.queryV1(testStart, testStart.Add(10*time.Minute), matchers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := m.previewTransform(its)
+	closeIterators(its)
+	if err != nil || len(groups) != 2 {
+		t.Fatalf("previewed %d series with error %v, want 2", len(groups), err)
+	}
+	if n := m.admitted.size(); n != 0 {
+		t.Fatalf("preview admitted %d series, want none", n)
+	}
+
+	for _, instance := range []string{"host0:9090", "host1:9090"} {
+		if err := migrateTestInstance(m, instance, testStart, testStart.Add(10*time.Minute)-1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ls := range v2.samples {
+		if !strings.Contains(ls, "host0:9090") {
+			t.Errorf("migrated series %s, want only the first 2 series migrated, of host0", ls)
+		}
+	}
+}
+
+func TestRoundTimestamps(t *testing.T) {
+	in := []model.SamplePair{
+		{Timestamp: 9600, Value: 1},
+		{Timestamp: 20499, Value: 2},
+		// Collides with the next sample, which is kept.
+		{Timestamp: 29700, Value: 3},
+		{Timestamp: 30300, Value: 4},
+		{Timestamp: 40001, Value: 5},
+		// Rounded to after the window.
+		{Timestamp: 50600, Value: 6},
+	}
+	want := []model.SamplePair{
+		{Timestamp: 10000, Value: 1},
+		{Timestamp: 20000, Value: 2},
+		{Timestamp: 30000, Value: 4},
+		{Timestamp: 40000, Value: 5},
+	}
+	if got := roundTimestamps(in, 1000, 0, 50000); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTruncateValues(t *testing.T) {
+	for _, tc := range []struct {
+		name, value string
+		max         int
+		wantPrefix  string
+	}{
+		{name: "short", value: "host:9090", max: 20, wantPrefix: "host:9090"},
+		{name: "exact", value: "0123456789", max: 10, wantPrefix: "0123456789"},
+		{name: "long", value: "http://example.com/a/very/long/path", max: 20, wantPrefix: "http://exam~"},
+		{name: "multi-byte", value: "äöüäöüäöüäöü", max: 16, wantPrefix: "äöü~"},
+		{name: "no room for prefix", value: "äöüäöü", max: 10, wantPrefix: "~"},
+	} {
+		ls := labels.FromStrings("a", tc.value, "b", "short")
+		truncateValues(ls, tc.max)
+		got := ls.Get("a")
+		if len(got) > tc.max {
+			t.Errorf("%s: got %q, longer than %d bytes", tc.name, got, tc.max)
+		}
+		if len(tc.value) <= tc.max {
+			if got != tc.value {
+				t.Errorf("%s: got %q, want the value unchanged", tc.name, got)
+			}
+		} else if !strings.HasPrefix(got, tc.wantPrefix) || len(got) != len(tc.wantPrefix)+8 {
+			t.Errorf("%s: got %q, want %q followed by a hash", tc.name, got, tc.wantPrefix)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%s: got invalid UTF-8 %q", tc.name, got)
+		}
+		if ls.Get("b") != "short" {
+			t.Errorf("%s: short value changed to %q", tc.name, ls.Get("b"))
+		}
+	}
+}
+
+func TestLongLabelValues(t *testing.T) {
+	long := strings.Repeat("ä", 1000)
+	metrics := []model.Metric{
+		{model.MetricNameLabel: "test_metric", "path": model.LabelValue(long)},
+		{model.MetricNameLabel: "test_metric", "path": "/"},
+	}
+	for _, tc := range []struct {
+		skip      bool
+		wantPaths []string
+	}{
+		// Truncating to 11 bytes keeps one of the 2 byte characters
+		// before the hash.
+		{wantPaths: []string{"/", truncateValue(long, 11)}},
+		{skip: true, wantPaths: []string{"/"}},
+	} {
+		m := newTestMigrator(nil, nil)
+		m.maxLabelValueLength, m.skipLongLabelValues = 11, tc.skip
+		groups, err := m.transform(testIterators(metrics))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, g := range groups {
+			paths = append(paths, g.labels.Get("path"))
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, tc.wantPaths) || m.longLabelValues.count() != 1 {
+			t.Errorf("skip %v: got paths %q and %d affected series, want %q and 1", tc.skip, paths, m.longLabelValues.count(), tc.wantPaths)
+		}
+	}
+}
+
+// commitStorage is a testStorage that records the number of series in each
+// commit with samples.
+type commitStorage struct {
+	testStorage
+	commits []int
+}
+
+func (s *commitStorage) Appender() tsdb.Appender {
+	return &commitAppender{testAppender: &testAppender{s: &s.testStorage}, s: s}
+}
+
+type commitAppender struct {
+	*testAppender
+	s *commitStorage
+}
+
+func (a *commitAppender) Commit() error {
+	if n := len(a.added); n > 0 {
+		a.s.mtx.Lock()
+		a.s.commits = append(a.s.commits, n)
+		a.s.mtx.Unlock()
+	}
+	return a.testAppender.Commit()
+}
+
+func TestCommitThresholds(t *testing.T) {
+	// A wide and shallow step of 10 series with 4 samples each.
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 10, time.Minute))
+	defer closeV1()
+	for _, tc := range []struct {
+		samples, series int
+		wantCommits     []int
+	}{
+		{wantCommits: []int{10}},
+		{series: 3, wantCommits: []int{3, 3, 3, 1}},
+		// The series threshold is reached before the sample one.
+		{samples: 20, series: 4, wantCommits: []int{4, 4, 2}},
+		{samples: 20, wantCommits: []int{5, 5}},
+	} {
+		v2 := &commitStorage{}
+		m := newTestMigrator(v1, v2)
+		m.commitSamples, m.commitSeries = tc.samples, tc.series
+		if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Minute)-1); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v2.commits, tc.wantCommits) || v2.numSamples() != 40 {
+			t.Errorf("samples %d, series %d: got commits of %v series with %d samples, want %v with 40", tc.samples, tc.series, v2.commits, v2.numSamples(), tc.wantCommits)
+		}
+	}
+}
+
+// BenchmarkCommitSamples measures the migration of a step of 100 series with
+// 240 samples each into a v2 storage with the thresholds of -commit-samples.
+func BenchmarkCommitSamples(b *testing.B) {
+	v1, closeV1 := newTestV1Storage(b, testSamples(testInstances(1), 100, time.Hour))
+	defer closeV1()
+	for _, samples := range []int{1, 100, 10000, 0} {
+		b.Run(fmt.Sprintf("commit-samples=%d", samples), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db, closeV2 := newTestV2Storage(b)
+				m := newTestMigrator(v1, db)
+				m.commitSamples = samples
+				b.StartTimer()
+
+				if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Hour)-1); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				closeV2()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// partStorage is a testStorage that records the most samples of a series in
+// each commit.
+type partStorage struct {
+	testStorage
+	parts []int
+}
+
+func (s *partStorage) Appender() tsdb.Appender {
+	return &partAppender{testAppender: &testAppender{s: &s.testStorage}, s: s}
+}
+
+type partAppender struct {
+	*testAppender
+	s *partStorage
+}
+
+func (a *partAppender) Commit() error {
+	most := 0
+	for _, samples := range a.added {
+		if len(samples) > most {
+			most = len(samples)
+		}
+	}
+	a.s.mtx.Lock()
+	a.s.parts = append(a.s.parts, most)
+	a.s.mtx.Unlock()
+	return a.testAppender.Commit()
+}
+
+func TestSourceSampleLimit(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 3, 4*time.Hour))
+	defer closeV1()
+	v2 := &partStorage{}
+	m := newTestMigrator(v1, v2)
+	m.sampleLimit = 100
+
+	// The first step of the instance is read whole and sizes the parts of
+	// the much wider second one.
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Hour)-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateTestInstance(m, "host0:9090", testStart.Add(time.Hour), testStart.Add(4*time.Hour)-1); err != nil {
+		t.Fatal(err)
+	}
+	if len(v2.parts) < 8 || v2.parts[0] != 240 {
+		t.Fatalf("got parts with at most %v samples per series, want a first one of 240 and at least 7 more", v2.parts)
+	}
+	for _, n := range v2.parts[1:] {
+		if n > 101 {
+			t.Errorf("got a part with %d samples of a series, want at most about 100", n)
+		}
+	}
+	if len(v2.samples) != 3 {
+		t.Fatalf("got %d series, want 3", len(v2.samples))
+	}
+	for ls, samples := range v2.samples {
+		if len(samples) != 960 {
+			t.Errorf("series %s has %d samples, want 960", ls, len(samples))
+		}
+		for i := 1; i < len(samples); i++ {
+			if samples[i].Timestamp <= samples[i-1].Timestamp {
+				t.Fatalf("series %s has sample %v after %v, want samples in order without duplicates", ls, samples[i], samples[i-1])
+			}
+		}
+	}
+}
+
+func TestDedupLabels(t *testing.T) {
+	for _, tc := range []struct {
+		in, want labels.Labels
+	}{
+		{
+			in:   labels.Labels{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+			want: labels.Labels{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+		},
+		{
+			in:   labels.Labels{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "job", Value: "b"}, {Name: "job", Value: "c"}, {Name: "zone", Value: "x"}},
+			want: labels.Labels{{Name: "__name__", Value: "up"}, {Name: "job", Value: "c"}, {Name: "zone", Value: "x"}},
+		},
+		{
+			in:   labels.Labels{{Name: "a", Value: "1"}, {Name: "a", Value: "2"}, {Name: "b", Value: "1"}, {Name: "b", Value: "2"}},
+			want: labels.Labels{{Name: "a", Value: "2"}, {Name: "b", Value: "2"}},
+		},
+	} {
+		if got := dedupLabels(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("dedupLabels(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+// flakyStorage is an appendable whose appenders fail the first Add of a
+// sample of the series failing with a transient error.
+type flakyStorage struct {
+	appendable
+	failing labels.Labels
+
+	mtx    sync.Mutex
+	failed bool
+}
+
+func (s *flakyStorage) Appender() tsdb.Appender {
+	return &flakyAppender{Appender: s.appendable.Appender(), s: s}
+}
+
+type flakyAppender struct {
+	tsdb.Appender
+	s *flakyStorage
+}
+
+func (a *flakyAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	a.s.mtx.Lock()
+	fail := !a.s.failed && l.Equals(a.s.failing)
+	a.s.failed = a.s.failed || fail
+	a.s.mtx.Unlock()
+	if fail {
+		return 0, errors.New("transient error")
+	}
+	return a.Appender.Add(l, t, v)
+}
+
+func TestMigrateRetryAfterPartialCommit(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 3, time.Hour))
+	defer closeV1()
+
+	stored := &testStorage{}
+	v2 := &flakyStorage{
+		appendable: stored,
+		failing:    labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host0:9090", "idx", "2"),
+	}
+	m := newTestMigrator(v1, v2)
+	m.commitSeries, m.deterministic = 1, true
+
+	through := testStart.Add(time.Hour) - 1
+	if err := migrateTestInstance(m, "host0:9090", testStart, through); err == nil {
+		t.Fatal("migrating with a failing series succeeded")
+	}
+	if err := migrateTestInstance(m, "host0:9090", testStart, through); err != nil {
+		t.Fatalf("retrying the step after a partial commit failed: %s", err)
+	}
+	if len(stored.samples) != 3 {
+		t.Fatalf("got %d series, want 3", len(stored.samples))
+	}
+	for ls, samples := range stored.samples {
+		if len(samples) != 240 {
+			t.Errorf("series %s has %d samples, want 240", ls, len(samples))
+		}
+	}
+	if len(m.committed) != 0 {
+		t.Errorf("committed samples of %d instances kept after the step succeeded", len(m.committed))
+	}
+}
+
+func TestTransformCountsSeriesOnce(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 3, 3*time.Hour))
+	defer closeV1()
+
+	m := newTestMigrator(v1, &testStorage{})
+	m.maxLabelValueLength = 10
+	m.defaultLabels = labels.FromStrings("env", "prod")
+	for from := testStart; from.Before(testStart.Add(3 * time.Hour)); from = from.Add(time.Hour) {
+		if err := migrateTestInstance(m, "host0:9090", from, from.Add(time.Hour)-1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := m.longLabelValues.count(); n != 3 {
+		t.Errorf("got %d series with too long label values, want 3", n)
+	}
+	if n := m.defaultedSeries.count(); n != 3 {
+		t.Errorf("got %d series with default labels, want 3", n)
+	}
+}
+
+func TestPreviewTransformDoesNotCount(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 3, time.Hour))
+	defer closeV1()
+
+	m := newTestMigrator(v1, nil)
+	m.maxLabelValueLength = 10
+	m.defaultLabels = labels.FromStrings("env", "prod")
+	matchers, err := shardMatchers(m.shardLabel, "host0:9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	its, err := m.queryV1(testStart, testStart.Add(time.Hour), matchers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := m.previewTransform(its)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("got %d series, want 3", len(groups))
+	}
+	if n := m.longLabelValues.count() + m.defaultedSeries.count(); n != 0 {
+		t.Errorf("previewing the transformation counted %d series", n)
+	}
+}
+
+func TestLabelTruncationsKeepValuesDistinct(t *testing.T) {
+	var tr labelTruncations
+	a := labels.FromStrings("instance", "host0:19090")
+	b := labels.FromStrings("instance", "host1:19090")
+	for _, ls := range []labels.Labels{a, b, labels.FromStrings("instance", "host0:19090")} {
+		if err := tr.truncate(ls, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a[0].Value == b[0].Value {
+		t.Fatalf("distinct values both truncated to %q", a[0].Value)
+	}
+	for _, ls := range []labels.Labels{a, b} {
+		if len(ls[0].Value) > 10 {
+			t.Errorf("truncated value %q is longer than 10 bytes", ls[0].Value)
+		}
+	}
+}
+
+func TestLabelTruncationsCollision(t *testing.T) {
+	short := truncateValue("host0:19090", 10)
+	tr := labelTruncations{values: map[labels.Label]string{
+		{Name: "instance", Value: short}: "other:19090",
+	}}
+	if err := tr.truncate(labels.FromStrings("instance", "host0:19090"), 10); err == nil {
+		t.Fatal("truncating to the value of another truncated value succeeded")
+	}
+	if err := tr.truncate(labels.FromStrings("job", "host0:19090"), 10); err != nil {
+		t.Fatalf("truncating a value of another label failed: %s", err)
+	}
+}
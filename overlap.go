@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// overlapDetector tracks the timestamp of the latest sample committed for
+// every series during a run, to detect and skip samples that a later step
+// appends again at or before it, e.g. at a step boundary that belongs to two
+// steps. It holds one entry per migrated series.
+type overlapDetector struct {
+	mtx     sync.Mutex
+	latest  map[string]int64
+	skipped uint64
+}
+
+func newOverlapDetector() *overlapDetector {
+	return &overlapDetector{latest: map[string]int64{}}
+}
+
+// skip returns samples without those that are not newer than the latest
+// sample committed for the series ls and counts them.
+func (d *overlapDetector) skip(ls labels.Labels, samples []model.SamplePair) []model.SamplePair {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	latest, ok := d.latest[ls.String()]
+	if !ok {
+		return samples
+	}
+	i := sort.Search(len(samples), func(i int) bool {
+		return int64(samples[i].Timestamp) > latest
+	})
+	d.skipped += uint64(i)
+	return samples[i:]
+}
+
+// record stores the timestamps of the last samples of the committed series.
+func (d *overlapDetector) record(seen []appendedSeries) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for _, s := range seen {
+		key := s.labels.String()
+		if latest, ok := d.latest[key]; !ok || s.last > latest {
+			d.latest[key] = s.last
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOverlapDetector(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 2, 10*time.Minute))
+	defer closeV1()
+
+	for _, detect := range []bool{false, true} {
+		s := &testStorage{}
+		m := newTestMigrator(v1, s)
+		if detect {
+			m.overlaps = newOverlapDetector()
+		}
+		// Both steps include the sample at the boundary.
+		boundary := testStart.Add(5 * time.Minute)
+		if err := migrateTestInstance(m, "host0:9090", testStart, boundary); err != nil {
+			t.Fatal(err)
+		}
+		if err := migrateTestInstance(m, "host0:9090", boundary, testStart.Add(10*time.Minute)-1); err != nil {
+			t.Fatal(err)
+		}
+
+		want := 41
+		if detect {
+			want = 40
+			if m.overlaps.skipped != 2 {
+				t.Errorf("skipped %d samples, want the boundary sample of each of the 2 series", m.overlaps.skipped)
+			}
+		}
+		for ls, samples := range s.samples {
+			if len(samples) != want {
+				t.Errorf("detect %v: series %s has %d samples, want %d", detect, ls, len(samples), want)
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// prefetcher reads the samples of the next steps from the v1 storage while
+// the current step is written to the destinations. The samples are held in
+// memory until the step is migrated.
+type prefetcher struct {
+	m   *migrator
+	ctx context.Context
+
+	wg      sync.WaitGroup
+	mtx     sync.Mutex
+	started map[model.Time]bool
+	reads   map[prefetchKey]*prefetchRead
+}
+
+type prefetchKey struct {
+	instance model.LabelValue
+	from     model.Time
+}
+
+// prefetchRead is the result of reading the series of an instance in a
+// step. running is set once the read starts, and done is closed once its and
+// err are set.
+type prefetchRead struct {
+	running bool
+	done    chan struct{}
+	its     []local.SeriesIterator
+	err     error
+}
+
+func newPrefetcher(ctx context.Context, m *migrator) *prefetcher {
+	return &prefetcher{
+		m:       m,
+		ctx:     ctx,
+		started: map[model.Time]bool{},
+		reads:   map[prefetchKey]*prefetchRead{},
+	}
+}
+
+// start reads the series of the instances in the step [from, through] in the
+// background, one instance after another, unless the step has been started
+// before.
+func (p *prefetcher) start(from, through model.Time, instances model.LabelValues) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.started[from] {
+		return
+	}
+	p.started[from] = true
+
+	for _, instance := range instances {
+		p.reads[prefetchKey{instance: instance, from: from}] = &prefetchRead{done: make(chan struct{})}
+	}
+	// Samples just outside of the step may be rounded into it.
+	readFrom, readThrough := from-p.m.roundTimestamps, through+p.m.roundTimestamps
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for _, instance := range instances {
+			if p.ctx.Err() != nil {
+				return
+			}
+			// Reads that were taken before they started are done by
+			// the migration of the step itself.
+			p.mtx.Lock()
+			r, ok := p.reads[prefetchKey{instance: instance, from: from}]
+			if ok {
+				r.running = true
+			}
+			p.mtx.Unlock()
+			if !ok {
+				continue
+			}
+			r.its, r.err = p.m.readAhead(instance, readFrom, readThrough)
+			close(r.done)
+		}
+	}()
+}
+
+// take returns the series of the instance read for the step starting at from
+// and waits for the read to finish if it is running. It returns false if the
+// read has not started yet or failed, in which case the caller has to read
+// the series itself, or if the step was not read ahead for the instance.
+// Every read can be taken only once.
+func (p *prefetcher) take(instance model.LabelValue, from model.Time) ([]local.SeriesIterator, bool) {
+	key := prefetchKey{instance: instance, from: from}
+	p.mtx.Lock()
+	r, ok := p.reads[key]
+	delete(p.reads, key)
+	p.mtx.Unlock()
+
+	if !ok || !r.running {
+		return nil, false
+	}
+	<-r.done
+	return r.its, r.err == nil
+}
+
+// drop discards the reads of the step starting at from that have not been
+// taken, e.g. those of instances that were skipped.
+func (p *prefetcher) drop(from model.Time) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for key := range p.reads {
+		if key.from == from {
+			delete(p.reads, key)
+		}
+	}
+}
+
+// wait waits for all reads in the background to finish, which they do
+// quickly once the context of the prefetcher is canceled.
+func (p *prefetcher) wait() {
+	p.wg.Wait()
+}
+
+// readAhead returns iterators over the samples in [from, through] of all
+// series of the instance, which have been read from the v1 storage already.
+func (m *migrator) readAhead(instance model.LabelValue, from, through model.Time) ([]local.SeriesIterator, error) {
+	matchers, err := shardMatchers(m.shardLabel, instance)
+	if err != nil {
+		return nil, err
+	}
+	release := m.acquireQuery()
+	defer release()
+	its, err := m.queryV1(from, through, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]local.SeriesIterator, 0, len(its))
+	for _, it := range its {
+		res = append(res, &bufferedIterator{
+			m: it.Metric(),
+			samples: it.RangeValues(metric.Interval{
+				OldestInclusive: from,
+				NewestInclusive: through,
+			}),
+		})
+	}
+	// The samples are copies, so the chunks can be evicted again.
+	closeIterators(its)
+	return res, nil
+}
+
+// bufferedIterator is a series iterator over samples in memory.
+type bufferedIterator struct {
+	m       metric.Metric
+	samples []model.SamplePair
+}
+
+func (it *bufferedIterator) ValueAtOrBeforeTime(t model.Time) model.SamplePair {
+	i := sort.Search(len(it.samples), func(i int) bool { return it.samples[i].Timestamp > t })
+	if i == 0 {
+		return model.ZeroSamplePair
+	}
+	return it.samples[i-1]
+}
+
+func (it *bufferedIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	i := sort.Search(len(it.samples), func(i int) bool { return it.samples[i].Timestamp >= in.OldestInclusive })
+	j := sort.Search(len(it.samples), func(i int) bool { return it.samples[i].Timestamp > in.NewestInclusive })
+	if i >= j {
+		return nil
+	}
+	return it.samples[i:j]
+}
+
+func (it *bufferedIterator) Metric() metric.Metric { return it.m }
+func (it *bufferedIterator) Close()                {}
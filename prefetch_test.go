@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+// migrateSteps migrates the series of the instances in 10m steps over the
+// hour after testStart into a new testStorage, reading the next windows
+// steps ahead if windows is positive.
+func migrateSteps(v1 *local.MemorySeriesStorage, instances []string, windows int) (*testStorage, error) {
+	v2 := &testStorage{}
+	m := newTestMigrator(v1, v2)
+	values := make(model.LabelValues, len(instances))
+	for i, instance := range instances {
+		values[i] = model.LabelValue(instance)
+	}
+	if windows > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		m.prefetch = newPrefetcher(ctx, m)
+		defer m.prefetch.wait()
+	}
+
+	const step = 10 * time.Minute
+	end := testStart.Add(time.Hour)
+	for from := testStart; from.Before(end); from = from.Add(step) {
+		if m.prefetch != nil {
+			for n, i := from.Add(step), 0; i < windows && n.Before(end); n, i = n.Add(step), i+1 {
+				m.prefetch.start(n, n.Add(step)-1, values)
+			}
+		}
+		for _, instance := range values {
+			if _, err := m.migrate(from, from.Add(step)-1, instance); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v2, nil
+}
+
+func TestPrefetchIdenticalOutput(t *testing.T) {
+	instances := testInstances(3)
+	v1, closeV1 := newTestV1Storage(t, testSamples(instances, 4, time.Hour))
+	defer closeV1()
+
+	want, err := migrateSteps(v1, instances, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := want.numSamples(); n != 3*4*240 {
+		t.Fatalf("got %d samples without reading ahead, want %d", n, 3*4*240)
+	}
+	for _, windows := range []int{1, 2, 6} {
+		got, err := migrateSteps(v1, instances, windows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.samples, want.samples) {
+			t.Errorf("reading %d windows ahead migrated different samples", windows)
+		}
+	}
+}
+
+func BenchmarkPrefetch(b *testing.B) {
+	instances := testInstances(10)
+	v1, closeV1 := newTestV1Storage(b, testSamples(instances, 10, time.Hour))
+	defer closeV1()
+
+	for _, bench := range []struct {
+		name    string
+		windows int
+	}{
+		{name: "no-read-buffer", windows: 0},
+		{name: "read-buffer-windows=2", windows: 2},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := migrateSteps(v1, instances, bench.windows); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
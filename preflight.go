@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// metricIterator is a series iterator without samples. It lets transform
+// select series by their metric without loading any chunks.
+type metricIterator struct {
+	m metric.Metric
+}
+
+func (it metricIterator) ValueAtOrBeforeTime(model.Time) model.SamplePair {
+	return model.ZeroSamplePair
+}
+
+func (it metricIterator) RangeValues(metric.Interval) []model.SamplePair { return nil }
+func (it metricIterator) Metric() metric.Metric                          { return it.m }
+func (it metricIterator) Close()                                         {}
+
+// preflight returns the number of series of the instances that have samples
+// in [from, through] and are selected for migration by m.
+func preflight(m *migrator, instances model.LabelValues, from, through model.Time) (int, error) {
+	n := 0
+	for _, instance := range instances {
+		matchers, err := shardMatchers(m.shardLabel, instance)
+		if err != nil {
+			return 0, err
+		}
+		var its []local.SeriesIterator
+		for _, s := range m.v1Storages() {
+			metrics, err := s.MetricsForLabelMatchers(context.Background(), from, through, matchers)
+			if err != nil {
+				return 0, err
+			}
+			for _, met := range metrics {
+				its = append(its, metricIterator{m: met})
+			}
+		}
+		groups, err := m.previewTransform(its)
+		if err != nil {
+			return 0, err
+		}
+		n += len(groups)
+	}
+	return n, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPreflight(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, time.Hour))
+	defer removeV1()
+	listDir, removeList := tempDir(t)
+	defer removeList()
+	// The list selects a series that does not exist.
+	list := filepath.Join(listDir, "series.jsonl")
+	if err := ioutil.WriteFile(list, []byte(`{"__name__":"test_metric","instance":"host2:9090","idx":"0"}`+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		args       []string
+		wantCode   int
+		wantSeries string
+	}{
+		{wantSeries: "4"},
+		{args: []string{"-series-list", list}, wantCode: 1, wantSeries: "0"},
+		{args: []string{"-series-list", list, "-force"}, wantSeries: "0"},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		var code int
+		logs := captureStderr(t, func() {
+			code = runMain(append([]string{
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+				"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()), "-preflight",
+			}, tc.args...)...)
+		})
+		if code != tc.wantCode {
+			t.Errorf("%v: got exit code %d, want %d", tc.args, code, tc.wantCode)
+		}
+		if n := logValue(logLine(logs, "Preflight complete"), "series"); n != tc.wantSeries {
+			t.Errorf("%v: preflight found %q series, want %s", tc.args, n, tc.wantSeries)
+		}
+		// A refused migration does not start.
+		if tc.wantCode != 0 && logLine(logs, "Total steps") != "" {
+			t.Errorf("%v: migration started although it was refused", tc.args)
+		}
+	}
+}
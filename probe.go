@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/tsdb"
+)
+
+// probe checks that both storages can be read: it writes the number of
+// instances and a sample series of the v1 storage and the blocks of the v2
+// storages, which it opens and closes again, to w.
+func probe(v1Storage *local.MemorySeriesStorage, shardLabel model.LabelName, instances model.LabelValues, v2Dirs []string, v2Options *tsdb.Options, logger log.Logger, w io.Writer) error {
+	fmt.Fprintf(w, "v1 instances: %d\n", len(instances))
+	if len(instances) == 0 {
+		return fmt.Errorf("no series with label %q in v1 storage", shardLabel)
+	}
+	matchers, err := shardMatchers(shardLabel, instances[0])
+	if err != nil {
+		return err
+	}
+	metrics, err := v1Storage.MetricsForLabelMatchers(context.Background(), model.Earliest, model.Latest, matchers)
+	if err != nil {
+		return err
+	}
+	if len(metrics) == 0 {
+		return fmt.Errorf("no series found for instance %q in v1 storage", instances[0])
+	}
+	fmt.Fprintf(w, "v1 sample series: %s\n", metrics[0].Metric)
+
+	blocks := 0
+	for _, dir := range v2Dirs {
+		db, err := tsdb.Open(dir, logger, nil, v2Options)
+		if err != nil {
+			return fmt.Errorf("opening v2 storage %s: %s", dir, err)
+		}
+		blocks += len(db.Blocks())
+		if err := db.Close(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "v2 blocks: %d\n", blocks)
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(3), 1, 10*time.Minute))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	var code int
+	out := captureStdout(t, func() {
+		captureStderr(t, func() { code = runMain("-v1-dir", v1Dir, "-v2-dir", v2Dir, "-probe") })
+	})
+	if code != 0 {
+		t.Fatalf("probing valid storages exited with %d", code)
+	}
+	for _, want := range []string{"v1 instances: 3\n", `v1 sample series: test_metric{idx="0", instance="host`, "v2 blocks: 0\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("probe output %q does not contain %q", out, want)
+		}
+	}
+
+	missing := filepath.Join(v2Dir, "missing")
+	logs := captureStderr(t, func() {
+		captureStdout(t, func() { code = runMain("-v1-dir", missing, "-v2-dir", v2Dir, "-probe") })
+	})
+	if code != 1 {
+		t.Errorf("probing a missing v1 directory exited with %d, want 1", code)
+	}
+	if l := logLine(logs, "v1 storage directory not found"); logValue(l, "dir") != missing {
+		t.Errorf("got logs %q, want an error naming the missing v1 directory", logs)
+	}
+}
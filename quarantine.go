@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+const (
+	// quarantineFileSuffix is the suffix of the files in the quarantine
+	// directory.
+	quarantineFileSuffix = ".prom"
+	// quarantineDestinationsPrefix starts the comment that names the
+	// destinations that rejected the samples following it.
+	quarantineDestinationsPrefix = "# destinations: "
+)
+
+var (
+	// labelValueEscaper escapes label values for the text exposition
+	// format.
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+	// errInvalidTime and errNaNValue are the reasons of samples that the
+	// migrator drops itself.
+	errInvalidTime = errors.New("timestamp outside of -min-valid-time and -max-valid-time")
+	errNaNValue    = errors.New("NaN value dropped by -nan-policy drop")
+)
+
+// quarantine writes samples that the v2 storage rejected, e.g. because they
+// are out of order, or that the migrator dropped to a file in the text
+// exposition format, so that they can be inspected and replayed later.
+type quarantine struct {
+	dir string
+	// maxSize is the size in bytes after which a new file is started if
+	// it is greater than 0.
+	maxSize int64
+
+	mtx  sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	path string
+	// size is the size of the current file and files the number of files
+	// written.
+	size  int64
+	files int
+}
+
+// quarantinedSample is a sample to quarantine with the error that rejected
+// or dropped it.
+type quarantinedSample struct {
+	model.SamplePair
+	err error
+}
+
+// appendQuarantined adds the samples with the error err to qs.
+func appendQuarantined(qs []quarantinedSample, samples []model.SamplePair, err error) []quarantinedSample {
+	for _, s := range samples {
+		qs = append(qs, quarantinedSample{SamplePair: s, err: err})
+	}
+	return qs
+}
+
+// rejection is a run of samples of a series that the same destinations
+// rejected with the same error. If dests is empty, the samples were not
+// appended to any destination, e.g. because the migrator dropped them or
+// the storage is not a fanout.
+type rejection struct {
+	dests   []string
+	err     error
+	samples []model.SamplePair
+}
+
+// rejections sorts the samples qs by timestamp, so that they can be replayed
+// in order, and returns the runs of them with the same error.
+func rejections(qs []quarantinedSample) []rejection {
+	sort.SliceStable(qs, func(i, j int) bool { return qs[i].Timestamp < qs[j].Timestamp })
+	var rs []rejection
+	for _, s := range qs {
+		var dests []string
+		if e, ok := s.err.(*rejectedError); ok {
+			dests = e.destinations()
+		}
+		if n := len(rs); n > 0 && rs[n-1].err.Error() == s.err.Error() && reflect.DeepEqual(rs[n-1].dests, dests) {
+			rs[n-1].samples = append(rs[n-1].samples, s.SamplePair)
+			continue
+		}
+		rs = append(rs, rejection{dests: dests, err: s.err, samples: []model.SamplePair{s.SamplePair}})
+	}
+	return rs
+}
+
+// add writes the rejected samples of the series ls, each run preceded by the
+// error that rejected it and the destinations that did. The file is created
+// on the first call.
+func (q *quarantine) add(ls labels.Labels, rs []rejection) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.f == nil {
+		if err := os.MkdirAll(q.dir, 0777); err != nil {
+			return err
+		}
+		q.path = filepath.Join(q.dir, fmt.Sprintf("quarantine-%d%s", time.Now().UnixNano(), quarantineFileSuffix))
+		f, err := os.Create(q.path)
+		if err != nil {
+			return err
+		}
+		q.f, q.w = f, bufio.NewWriter(f)
+		q.size = 0
+		q.files++
+	}
+
+	name := formatSeries(ls)
+	for _, r := range rs {
+		// The text format ignores comments other than HELP and TYPE, the
+		// replay reads the destinations.
+		n, _ := fmt.Fprintf(q.w, "# %s: %s\n", ls, strings.Replace(r.err.Error(), "\n", " ", -1))
+		q.size += int64(n)
+		if len(r.dests) > 0 {
+			n, _ := fmt.Fprintf(q.w, "%s%s\n", quarantineDestinationsPrefix, strings.Join(r.dests, " "))
+			q.size += int64(n)
+		}
+		for _, s := range r.samples {
+			n, _ := fmt.Fprintf(q.w, "%s %s %d\n", name, formatFloat(float64(s.Value)), int64(s.Timestamp))
+			q.size += int64(n)
+		}
+	}
+	// Flush after every series so that a crash loses nothing.
+	if err := q.w.Flush(); err != nil {
+		return err
+	}
+	// A series is never split over two files.
+	if q.maxSize > 0 && q.size >= q.maxSize {
+		f := q.f
+		q.f = nil
+		return f.Close()
+	}
+	return nil
+}
+
+// close closes the quarantine file if one is open. A later add creates a
+// new file.
+func (q *quarantine) close() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.f == nil {
+		return nil
+	}
+	f := q.f
+	q.f = nil
+	if err := q.w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// formatSeries formats ls like a series in the text exposition format.
+func formatSeries(ls labels.Labels) string {
+	var b bytes.Buffer
+	b.WriteString(ls.Get(model.MetricNameLabel))
+	b.WriteByte('{')
+	first := true
+	for _, l := range ls {
+		if l.Name == model.MetricNameLabel {
+			continue
+		}
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		fmt.Fprintf(&b, `%s="%s"`, l.Name, labelValueEscaper.Replace(l.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// rejectedSample reports whether err is the v2 storage rejecting a single
+// sample, in which case the other samples can still be appended.
+func rejectedSample(err error) bool {
+	for err != nil {
+		switch err {
+		case tsdb.ErrOutOfBounds, tsdb.ErrOutOfOrderSample, tsdb.ErrAmendSample:
+			return true
+		}
+		c, ok := err.(interface {
+			Cause() error
+		})
+		if !ok || c.Cause() == err {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
+// quarantineReplay counts the outcome of replaying a quarantine.
+type quarantineReplay struct {
+	// series and samples were appended, failedSeries had samples rejected
+	// again, which are in failedSamples.
+	series, samples             int
+	failedSeries, failedSamples int
+}
+
+// replayQuarantine appends the samples of all files in the quarantine
+// directory dir to db, one file per commit, and removes every file that was
+// replayed. Samples that db rejects again are written to q, which should
+// write to dir as well, so that they can be replayed once more. Files that q
+// writes during the replay are not replayed.
+func replayQuarantine(dir string, db appendable, q *quarantine, logger log.Logger) (quarantineReplay, error) {
+	var total quarantineReplay
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return total, err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), quarantineFileSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		r, err := replayQuarantineFile(path, db, q)
+		if err != nil {
+			return total, fmt.Errorf("file %s: %s", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return total, err
+		}
+		level.Info(logger).Log("msg", "Replayed quarantine file", "file", path, "series", r.series, "samples", r.samples, "failed_series", r.failedSeries, "failed_samples", r.failedSamples)
+		total.series += r.series
+		total.samples += r.samples
+		total.failedSeries += r.failedSeries
+		total.failedSamples += r.failedSamples
+	}
+	return total, nil
+}
+
+// quarantinedSeries are the samples of a series in a quarantine file that
+// the destinations dests rejected, or all destinations if it is empty.
+type quarantinedSeries struct {
+	labels  labels.Labels
+	dests   []string
+	samples []model.SamplePair
+}
+
+// readQuarantineFile returns the series in the quarantine file at path in
+// the order they were written. A series is returned once for every comment
+// with an error that precedes samples of it.
+func readQuarantineFile(path string) ([]*quarantinedSeries, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		series  []*quarantinedSeries
+		dests   []string
+		section bytes.Buffer
+	)
+	parse := func() error {
+		var p expfmt.TextParser
+		mfs, err := p.TextToMetricFamilies(&section)
+		if err != nil {
+			return err
+		}
+		section.Reset()
+		byKey := map[string]*quarantinedSeries{}
+		for name, mf := range mfs {
+			for _, m := range mf.Metric {
+				if m.Untyped == nil || m.TimestampMs == nil {
+					return fmt.Errorf("sample of %s without value or timestamp", name)
+				}
+				ls := labels.Labels{{Name: model.MetricNameLabel, Value: name}}
+				for _, lp := range m.Label {
+					ls = append(ls, labels.Label{Name: lp.GetName(), Value: lp.GetValue()})
+				}
+				sort.Sort(ls)
+				key := ls.String()
+				s, ok := byKey[key]
+				if !ok {
+					s = &quarantinedSeries{labels: ls, dests: dests}
+					byKey[key] = s
+					series = append(series, s)
+				}
+				s.samples = append(s.samples, model.SamplePair{Timestamp: model.Time(m.GetTimestampMs()), Value: model.SampleValue(m.Untyped.GetValue())})
+			}
+		}
+		return nil
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(line, quarantineDestinationsPrefix):
+			dests = strings.Fields(strings.TrimPrefix(line, quarantineDestinationsPrefix))
+		case strings.HasPrefix(line, "# ") && !strings.HasPrefix(line, "# HELP ") && !strings.HasPrefix(line, "# TYPE "):
+			// The samples up to here were rejected by the destinations
+			// of the previous error.
+			if err := parse(); err != nil {
+				return nil, err
+			}
+			dests = nil
+			fallthrough
+		default:
+			section.WriteString(line)
+		}
+		if err == io.EOF {
+			return series, parse()
+		}
+	}
+}
+
+func replayQuarantineFile(path string, db appendable, q *quarantine) (quarantineReplay, error) {
+	var r quarantineReplay
+	series, err := readQuarantineFile(path)
+	if err != nil {
+		return r, err
+	}
+
+	// The rejected samples are only quarantined again once the others are
+	// committed, so that a failed replay of the file leaves no duplicates.
+	type requarantined struct {
+		s  *quarantinedSeries
+		qs []quarantinedSample
+	}
+	var (
+		app      = db.Appender()
+		fa, _    = app.(*fanoutAppender)
+		rejected []requarantined
+		// failed records the series that were replayed, and whether
+		// samples of them were rejected again.
+		failed = map[string]bool{}
+	)
+	for _, s := range series {
+		rq := requarantined{s: s}
+		for _, sp := range s.samples {
+			var err error
+			if fa != nil && len(s.dests) > 0 {
+				_, err = fa.addTo(s.dests, s.labels, int64(sp.Timestamp), float64(sp.Value))
+			} else {
+				_, err = app.Add(s.labels, int64(sp.Timestamp), float64(sp.Value))
+			}
+			if err != nil && rejectedSample(err) {
+				rq.qs = append(rq.qs, quarantinedSample{SamplePair: sp, err: err})
+				r.failedSamples++
+				continue
+			}
+			if err != nil {
+				app.Rollback()
+				return r, fmt.Errorf("series %s: %s", s.labels, err)
+			}
+			r.samples++
+		}
+		key := s.labels.String()
+		failed[key] = failed[key] || len(rq.qs) > 0
+		if len(rq.qs) > 0 {
+			rejected = append(rejected, rq)
+		}
+	}
+	for _, f := range failed {
+		if f {
+			r.failedSeries++
+		} else {
+			r.series++
+		}
+	}
+	if err := app.Commit(); err != nil {
+		return r, err
+	}
+	for _, rq := range rejected {
+		if err := q.add(rq.s.labels, rejections(rq.qs)); err != nil {
+			return r, fmt.Errorf("quarantining rejected samples: %s", err)
+		}
+	}
+	return r, nil
+}
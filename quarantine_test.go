@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// rejectingStorage is a testStorage that rejects the samples of the series
+// with the labels ls from time from on as out of order.
+type rejectingStorage struct {
+	testStorage
+	ls   labels.Labels
+	from int64
+}
+
+func (s *rejectingStorage) Appender() tsdb.Appender {
+	return &rejectingAppender{Appender: s.testStorage.Appender(), s: s}
+}
+
+type rejectingAppender struct {
+	tsdb.Appender
+	s *rejectingStorage
+}
+
+func (a *rejectingAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	if t >= a.s.from && l.Equals(a.s.ls) {
+		return 0, tsdb.ErrOutOfOrderSample
+	}
+	return a.Appender.Add(l, t, v)
+}
+
+func TestQuarantine(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 2, 10*time.Minute))
+	defer closeV1()
+	dir, remove := tempDir(t)
+	defer remove()
+
+	rejected := labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host0:9090", "idx", "1")
+	from := testStart.Add(5 * time.Minute)
+	v2 := &rejectingStorage{ls: rejected, from: int64(from)}
+	m := newTestMigrator(v1, v2)
+	m.quarantine = &quarantine{dir: dir}
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(10*time.Minute)-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.quarantine.close(); err != nil {
+		t.Fatal(err)
+	}
+	if m.quarantined != 20 || v2.numSamples() != 60 {
+		t.Fatalf("quarantined %d samples and migrated %d, want 20 and 60", m.quarantined, v2.numSamples())
+	}
+
+	b, err := ioutil.ReadFile(m.quarantine.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(m.quarantine.path) != dir || !strings.HasPrefix(string(b), "# "+rejected.String()+": out of order sample\n") {
+		t.Errorf("got quarantine file %s starting with %q, want it in %s with the series and error", m.quarantine.path, strings.SplitN(string(b), "\n", 2)[0], dir)
+	}
+
+	// The quarantined samples are replayed intact.
+	replayed := &testStorage{}
+	r, err := replayQuarantine(dir, replayed, &quarantine{dir: dir}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []model.SamplePair
+	for ts := from; ts.Before(testStart.Add(10 * time.Minute)); ts = ts.Add(15 * time.Second) {
+		want = append(want, model.SamplePair{Timestamp: ts, Value: 1})
+	}
+	if r.samples != 20 || len(replayed.samples) != 1 || !reflect.DeepEqual(replayed.samples[rejected.String()], want) {
+		t.Errorf("replayed %d samples %v, want %v of %s", r.samples, replayed.samples, want, rejected)
+	}
+	if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) != 0 {
+		t.Errorf("quarantine directory holds %d files after replaying, want none (err %v)", len(fis), err)
+	}
+}
+
+func TestQuarantinePerDestination(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 2, 10*time.Minute))
+	defer closeV1()
+	dir, remove := tempDir(t)
+	defer remove()
+
+	rejected := labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host0:9090", "idx", "1")
+	from := testStart.Add(5 * time.Minute)
+	v2, remote := &rejectingStorage{ls: rejected, from: int64(from)}, &testStorage{}
+	m := newTestMigrator(v1, &fanout{
+		dests:  []*destination{{name: "v2", storage: v2}, {name: "http://remote/write", storage: remote}},
+		logger: log.NewNopLogger(),
+	})
+	m.quarantine = &quarantine{dir: dir}
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(10*time.Minute)-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.quarantine.close(); err != nil {
+		t.Fatal(err)
+	}
+	// The remote write endpoint took the samples the v2 storage rejected.
+	if m.quarantined != 20 || m.appended != 80 || v2.numSamples() != 60 || remote.numSamples() != 80 {
+		t.Fatalf("quarantined %d samples and appended %d, %d to v2 and %d to remote, want 20, 80, 60 and 80", m.quarantined, m.appended, v2.numSamples(), remote.numSamples())
+	}
+	b, err := ioutil.ReadFile(m.quarantine.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# " + rejected.String() + ": destination v2: out of order sample\n# destinations: v2\n"; !strings.HasPrefix(string(b), want) {
+		t.Errorf("got quarantine file starting with %q, want %q", b[:len(want)], want)
+	}
+
+	// A replay without the v2 storage fails and keeps the file.
+	if _, err := replayQuarantine(dir, &fanout{
+		dests:  []*destination{{name: "http://remote/write", storage: &testStorage{}}},
+		logger: log.NewNopLogger(),
+	}, &quarantine{dir: dir}, log.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "destination v2 is not configured") {
+		t.Fatalf("got error %v replaying without the v2 storage, want it to be missing", err)
+	}
+
+	replayedV2, replayedRemote := &testStorage{}, &testStorage{}
+	r, err := replayQuarantine(dir, &fanout{
+		dests:  []*destination{{name: "v2", storage: replayedV2}, {name: "http://remote/write", storage: replayedRemote}},
+		logger: log.NewNopLogger(),
+	}, &quarantine{dir: dir}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.series != 1 || r.samples != 20 || len(replayedV2.samples[rejected.String()]) != 20 || replayedRemote.numSamples() != 0 {
+		t.Errorf("replayed %d samples of %d series, %d to v2 and %d to remote, want 20 of 1 to v2 only", r.samples, r.series, replayedV2.numSamples(), replayedRemote.numSamples())
+	}
+}
+
+// reasonStorage is a testStorage that rejects every sample of the series
+// in errs with their error.
+type reasonStorage struct {
+	testStorage
+	errs map[string]error
+}
+
+func (s *reasonStorage) Appender() tsdb.Appender {
+	return &reasonAppender{Appender: s.testStorage.Appender(), s: s}
+}
+
+type reasonAppender struct {
+	tsdb.Appender
+	s *reasonStorage
+}
+
+func (a *reasonAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	if err, ok := a.s.errs[l.String()]; ok {
+		return 0, err
+	}
+	return a.Appender.Add(l, t, v)
+}
+
+func TestQuarantineReasonsAndRotation(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 4, 10*time.Minute))
+	defer closeV1()
+	dir, remove := tempDir(t)
+	defer remove()
+
+	series := func(idx string) string {
+		return labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host0:9090", "idx", idx).String()
+	}
+	errs := map[string]error{
+		series("0"): tsdb.ErrOutOfOrderSample,
+		series("1"): tsdb.ErrOutOfBounds,
+		series("3"): tsdb.ErrAmendSample,
+	}
+	v2 := &reasonStorage{errs: errs}
+	m := newTestMigrator(v1, v2)
+	// Every series fills a file.
+	m.quarantine = &quarantine{dir: dir, maxSize: 1}
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(10*time.Minute)-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.quarantine.close(); err != nil {
+		t.Fatal(err)
+	}
+	if m.quarantined != 3*40 || v2.numSamples() != 40 {
+		t.Fatalf("quarantined %d samples and migrated %d, want %d and 40", m.quarantined, v2.numSamples(), 3*40)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+quarantineFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || m.quarantine.files != 3 {
+		t.Fatalf("got %d quarantine files, want one per rejected series", len(files))
+	}
+	got := map[string]string{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		if len(lines) != 41 {
+			t.Errorf("quarantine file %s has %d lines, want a comment and 40 samples", f, len(lines))
+		}
+		got[lines[0]] = f
+	}
+	for ls, err := range errs {
+		if header := "# " + ls + ": " + err.Error(); got[header] == "" {
+			t.Errorf("no quarantine file starts with %q, got %v", header, got)
+		}
+	}
+
+	replayed := &testStorage{}
+	if r, err := replayQuarantine(dir, replayed, &quarantine{dir: dir}, log.NewNopLogger()); err != nil || r.samples != 3*40 || len(replayed.samples) != 3 {
+		t.Errorf("replayed %d samples of %d series with error %v, want %d of 3", r.samples, len(replayed.samples), err, 3*40)
+	}
+}
+
+// timeStorage is a testStorage that rejects the samples at the times in
+// errs with their error.
+type timeStorage struct {
+	testStorage
+	errs map[int64]error
+}
+
+func (s *timeStorage) Appender() tsdb.Appender {
+	return &timeAppender{Appender: s.testStorage.Appender(), s: s}
+}
+
+type timeAppender struct {
+	tsdb.Appender
+	s *timeStorage
+}
+
+func (a *timeAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	if err, ok := a.s.errs[t]; ok {
+		return 0, err
+	}
+	return a.Appender.Add(l, t, v)
+}
+
+func TestQuarantineSampleReasons(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "test_metric", model.InstanceLabel: "host0:9090"}
+	var samples []*model.Sample
+	for i := 0; i < 40; i++ {
+		samples = append(samples, &model.Sample{Metric: metric, Timestamp: testStart.Add(time.Duration(i) * 15 * time.Second), Value: 1})
+	}
+	samples[5].Value = model.SampleValue(math.NaN())
+	v1, closeV1 := newTestV1Storage(t, samples)
+	defer closeV1()
+	dir, remove := tempDir(t)
+	defer remove()
+
+	at := func(i int) int64 { return int64(samples[i].Timestamp) }
+	v2 := &timeStorage{errs: map[int64]error{
+		at(8): tsdb.ErrOutOfOrderSample, at(9): tsdb.ErrOutOfOrderSample, at(10): tsdb.ErrOutOfOrderSample,
+		at(16): tsdb.ErrOutOfBounds,
+	}}
+	m := newTestMigrator(v1, v2)
+	m.quarantine = &quarantine{dir: dir}
+	m.nanPolicy = "drop"
+	// The last 4 samples are too late.
+	m.checkTimes, m.minValidTime, m.maxValidTime = true, model.Earliest, samples[35].Timestamp
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(10*time.Minute)-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.quarantine.close(); err != nil {
+		t.Fatal(err)
+	}
+	if m.quarantined != 4 || m.nanValues != 1 || m.invalidTimes != 4 || v2.numSamples() != 31 {
+		t.Fatalf("quarantined %d rejected samples, dropped %d NaN values and %d invalid timestamps and migrated %d, want 4, 1, 4 and 31", m.quarantined, m.nanValues, m.invalidTimes, v2.numSamples())
+	}
+
+	// Every sample follows the comment with its reason, in the order of
+	// their timestamps.
+	b, err := ioutil.ReadFile(m.quarantine.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			got = append(got, strings.SplitN(line, "}: ", 2)[1])
+			continue
+		}
+		got[len(got)-1] += " " + line[strings.LastIndex(line, " ")+1:]
+	}
+	want := []string{
+		fmt.Sprintf("%s %d", errNaNValue, at(5)),
+		fmt.Sprintf("%s %d %d %d", tsdb.ErrOutOfOrderSample, at(8), at(9), at(10)),
+		fmt.Sprintf("%s %d", tsdb.ErrOutOfBounds, at(16)),
+		fmt.Sprintf("%s %d %d %d %d", errInvalidTime, at(36), at(37), at(38), at(39)),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got quarantined reasons and timestamps %q, want %q", got, want)
+	}
+
+	replayed := &testStorage{}
+	if r, err := replayQuarantine(dir, replayed, &quarantine{dir: dir}, log.NewNopLogger()); err != nil || r.samples != 9 || r.series != 1 {
+		t.Errorf("replayed %d samples of %d series with error %v, want 9 of 1", r.samples, r.series, err)
+	}
+}
+
+func TestReplayQuarantineRequarantines(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(1), 3, 10*time.Minute))
+	defer closeV1()
+	dir, remove := tempDir(t)
+	defer remove()
+
+	series := func(idx string) labels.Labels {
+		return labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host0:9090", "idx", idx)
+	}
+	m := newTestMigrator(v1, &reasonStorage{errs: map[string]error{
+		series("0").String(): tsdb.ErrOutOfBounds,
+		series("1").String(): tsdb.ErrOutOfBounds,
+	}})
+	m.quarantine = &quarantine{dir: dir}
+	if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(10*time.Minute)-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.quarantine.close(); err != nil {
+		t.Fatal(err)
+	}
+	first := m.quarantine.path
+
+	// The destination still rejects one of the series, whose samples are
+	// quarantined again.
+	q := &quarantine{dir: dir}
+	still := &rejectingStorage{ls: series("1"), from: int64(testStart)}
+	r, err := replayQuarantine(dir, still, q, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := (quarantineReplay{series: 1, samples: 40, failedSeries: 1, failedSamples: 40}); r != want {
+		t.Errorf("got replay %+v, want %+v", r, want)
+	}
+	if _, ok := still.samples[series("0").String()]; !ok || len(still.samples) != 1 {
+		t.Errorf("got replayed series %v, want %s", still.samples, series("0"))
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+quarantineFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != q.path || q.path == first {
+		t.Fatalf("got quarantine files %v, want only the new file %s", files, q.path)
+	}
+
+	// A more permissive destination takes the rest.
+	q = &quarantine{dir: dir}
+	ok := &testStorage{}
+	if r, err = replayQuarantine(dir, ok, q, log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if want := (quarantineReplay{series: 1, samples: 40}); r != want || len(ok.samples[series("1").String()]) != 40 {
+		t.Errorf("got replay %+v of %v, want %+v of %s", r, ok.samples, want, series("1"))
+	}
+	if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) != 0 {
+		t.Errorf("quarantine directory holds %d files after replaying, want none (err %v)", len(fis), err)
+	}
+}
+
+func TestMaxAppendErrors(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 2, 5*time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	quarantineDir, removeQuarantine := tempDir(t)
+	defer removeQuarantine()
+
+	// Once the v2 storage has blocks of the later hours, it rejects all
+	// samples of the first hour as out of bounds.
+	if code := runMain(
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "4h", "-min-block-duration", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(5*time.Hour).Unix()),
+	); code != 0 {
+		t.Fatalf("first migration exited with %d", code)
+	}
+
+	for _, tc := range []struct {
+		args []string
+	}{
+		{args: []string{"-max-append-errors", "100"}},
+		{args: []string{"-max-append-error-ratio", "0.5"}},
+	} {
+		checkpointFile := filepath.Join(quarantineDir, "checkpoint")
+		var code int
+		logs := captureStderr(t, func() {
+			code = runMain(append([]string{
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h", "-min-block-duration", "1h",
+				"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+				"-quarantine-dir", quarantineDir, "-checkpoint-file", checkpointFile,
+			}, tc.args...)...)
+		})
+		if code != 1 {
+			t.Fatalf("%v: got exit code %d, want 1, logs:\n%s", tc.args, code, logs)
+		}
+		// With 40 samples per series and step, the limit of 100 is
+		// exceeded in the second step, the ratio in the first.
+		wantNext := testStart.Add(10 * time.Minute)
+		if tc.args[0] == "-max-append-errors" {
+			wantNext = testStart.Add(20 * time.Minute)
+		}
+		if l := logLine(logs, "too many samples rejected by the v2 storage, stopping"); logValue(l, "next") != wantNext.String() {
+			t.Errorf("%v: stopped with %q, want to stop before %v", tc.args, l, wantNext)
+		}
+		cp, err := readCheckpoint(checkpointFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp == nil || cp.Next != wantNext {
+			t.Errorf("%v: got checkpoint %+v, want the next step at %v", tc.args, cp, wantNext)
+		}
+		if err := os.Remove(checkpointFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
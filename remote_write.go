@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// remoteWriteBatchSize is the maximum number of samples sent in one
+// remote write request.
+const remoteWriteBatchSize = 10000
+
+// remoteWriteStorage sends migrated samples to a Prometheus remote write
+// endpoint.
+type remoteWriteStorage struct {
+	url    string
+	client *http.Client
+}
+
+func newRemoteWriteStorage(url string, timeout time.Duration) *remoteWriteStorage {
+	return &remoteWriteStorage{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *remoteWriteStorage) Appender() tsdb.Appender {
+	return &remoteWriteAppender{storage: s, refs: map[string]int{}}
+}
+
+type remoteWriteSeries struct {
+	labels  labels.Labels
+	samples []remoteWriteSample
+}
+
+type remoteWriteSample struct {
+	t int64
+	v float64
+}
+
+// remoteWriteAppender buffers samples until they are sent on Commit.
+type remoteWriteAppender struct {
+	storage *remoteWriteStorage
+	refs    map[string]int
+	series  []*remoteWriteSeries
+}
+
+func (a *remoteWriteAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	key := l.String()
+	ref, ok := a.refs[key]
+	if !ok {
+		ref = len(a.series)
+		a.refs[key] = ref
+		a.series = append(a.series, &remoteWriteSeries{labels: l})
+	}
+	return uint64(ref), a.AddFast(uint64(ref), t, v)
+}
+
+func (a *remoteWriteAppender) AddFast(ref uint64, t int64, v float64) error {
+	if ref >= uint64(len(a.series)) {
+		return tsdb.ErrNotFound
+	}
+	s := a.series[ref]
+	s.samples = append(s.samples, remoteWriteSample{t: t, v: v})
+	return nil
+}
+
+func (a *remoteWriteAppender) Commit() error {
+	var (
+		batch []*remoteWriteSeries
+		n     int
+	)
+	for _, s := range a.series {
+		for len(s.samples) > 0 {
+			k := len(s.samples)
+			if k > remoteWriteBatchSize-n {
+				k = remoteWriteBatchSize - n
+			}
+			batch = append(batch, &remoteWriteSeries{labels: s.labels, samples: s.samples[:k]})
+			s.samples = s.samples[k:]
+			n += k
+
+			if n == remoteWriteBatchSize {
+				if err := a.storage.send(batch); err != nil {
+					return err
+				}
+				batch, n = batch[:0], 0
+			}
+		}
+	}
+	a.refs, a.series = map[string]int{}, nil
+	if n == 0 {
+		return nil
+	}
+	return a.storage.send(batch)
+}
+
+func (a *remoteWriteAppender) Rollback() error {
+	a.refs, a.series = map[string]int{}, nil
+	return nil
+}
+
+// send posts the series as a snappy-compressed remote write request.
+func (s *remoteWriteStorage) send(series []*remoteWriteSeries) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(snappy.Encode(nil, encodeWriteRequest(series))))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		scanner := bufio.NewScanner(io.LimitReader(resp.Body, 256))
+		line := ""
+		if scanner.Scan() {
+			line = scanner.Text()
+		}
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, line)
+	}
+	return nil
+}
+
+// encodeWriteRequest encodes the series as a prometheus.WriteRequest
+// protobuf message.
+func encodeWriteRequest(series []*remoteWriteSeries) []byte {
+	var (
+		req = proto.NewBuffer(nil)
+		ts  = proto.NewBuffer(nil)
+		msg = proto.NewBuffer(nil)
+	)
+	for _, s := range series {
+		ts.Reset()
+		for _, l := range s.labels {
+			msg.Reset()
+			msg.EncodeVarint(1<<3 | proto.WireBytes)
+			msg.EncodeStringBytes(l.Name)
+			msg.EncodeVarint(2<<3 | proto.WireBytes)
+			msg.EncodeStringBytes(l.Value)
+
+			ts.EncodeVarint(1<<3 | proto.WireBytes)
+			ts.EncodeRawBytes(msg.Bytes())
+		}
+		for _, smpl := range s.samples {
+			msg.Reset()
+			msg.EncodeVarint(1<<3 | proto.WireFixed64)
+			msg.EncodeFixed64(math.Float64bits(smpl.v))
+			msg.EncodeVarint(2<<3 | proto.WireVarint)
+			msg.EncodeVarint(uint64(smpl.t))
+
+			ts.EncodeVarint(2<<3 | proto.WireBytes)
+			ts.EncodeRawBytes(msg.Bytes())
+		}
+		req.EncodeVarint(1<<3 | proto.WireBytes)
+		req.EncodeRawBytes(ts.Bytes())
+	}
+	return req.Bytes()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// v1Storages returns the v1 storage and its replicas in the order in which
+// their samples take precedence.
+func (m *migrator) v1Storages() []*local.MemorySeriesStorage {
+	res := append([]*local.MemorySeriesStorage{m.v1Storage}, m.v1Replicas...)
+	if m.lastReplicaWins {
+		for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+	}
+	return res
+}
+
+// queryV1 returns the series in [from, through] that match the matchers from
+// the v1 storage and its replicas. A series in several of them is returned
+// once per storage, in the order of v1Storages, so that transform groups
+// them into one series whose samples are merged with that precedence.
+func (m *migrator) queryV1(from, through model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	var res []local.SeriesIterator
+	for _, s := range m.v1Storages() {
+		its, err := s.QueryRange(context.Background(), from, through, matchers...)
+		if err != nil {
+			closeIterators(res)
+			return nil, err
+		}
+		res = append(res, its...)
+	}
+	return res, nil
+}
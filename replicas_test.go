@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+func TestReplicas(t *testing.T) {
+	// The first replica misses the samples from 20m to 30m.
+	var first []*model.Sample
+	for _, s := range testSamples(testInstances(1), 1, time.Hour) {
+		if s.Timestamp.Before(testStart.Add(20*time.Minute)) || !s.Timestamp.Before(testStart.Add(30*time.Minute)) {
+			s.Value = 1
+			first = append(first, s)
+		}
+	}
+	second := testSamples(testInstances(1), 1, time.Hour)
+	for _, s := range second {
+		s.Value = 2
+	}
+	v1, closeV1 := newTestV1Storage(t, first)
+	defer closeV1()
+	replica, closeReplica := newTestV1Storage(t, second)
+	defer closeReplica()
+
+	for _, lastWins := range []bool{false, true} {
+		s := &testStorage{}
+		m := newTestMigrator(v1, s)
+		m.v1Replicas = []*local.MemorySeriesStorage{replica}
+		m.lastReplicaWins = lastWins
+		if err := migrateTestInstance(m, "host0:9090", testStart, testStart.Add(time.Hour)-1); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.samples) != 1 {
+			t.Fatalf("last wins %v: got %d series, want the replicas merged into 1", lastWins, len(s.samples))
+		}
+		for ls, samples := range s.samples {
+			if len(samples) != 240 {
+				t.Fatalf("last wins %v: series %s has %d samples, want one for each of the 240 timestamps", lastWins, ls, len(samples))
+			}
+			for i, smpl := range samples {
+				if want := testStart.Add(time.Duration(i) * 15 * time.Second); smpl.Timestamp != want {
+					t.Fatalf("last wins %v: got sample at %v at index %d, want %v", lastWins, smpl.Timestamp, i, want)
+				}
+				want := model.SampleValue(1)
+				if lastWins || i >= 80 && i < 120 {
+					want = 2
+				}
+				if smpl.Value != want {
+					t.Errorf("last wins %v: got value %v at %v, want %v", lastWins, smpl.Value, smpl.Timestamp, want)
+				}
+			}
+		}
+	}
+}
+
+func TestReplicaDirs(t *testing.T) {
+	first, removeFirst := newTestV1Dir(t, testSamples(testInstances(1), 2, 30*time.Minute))
+	defer removeFirst()
+	// The replica has the same series, and another half hour.
+	second, removeSecond := newTestV1Dir(t, testSamples(testInstances(1), 2, time.Hour))
+	defer removeSecond()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	if code := runMain(
+		"-v1-dir", first, "-v1-replica-dir", second, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+	); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 2 {
+		t.Fatalf("got %d series, want 2", len(got))
+	}
+	for ls, ts := range got {
+		if len(ts) != 240 || len(distinct(ts)) != 240 {
+			t.Errorf("series %s has %d samples at %d timestamps, want one at each of 240", ls, len(ts), len(distinct(ts)))
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// migrationReport is the summary of a migration written to the report file.
+type migrationReport struct {
+	Start           model.Time       `json:"start"`
+	End             model.Time       `json:"end"`
+	Started         time.Time        `json:"started"`
+	Completed       time.Time        `json:"completed"`
+	Failed          bool             `json:"failed"`
+	Steps           int              `json:"steps"`
+	SamplesRead     int              `json:"samples_read"`
+	SamplesAppended uint64           `json:"samples_appended"`
+	Instances       []instanceReport `json:"instances"`
+	StepTimings     []stepReport     `json:"step_timings"`
+	// Skipped are the series and samples that were dropped or changed on
+	// the way, by reason.
+	Skipped []skipReport `json:"skipped"`
+	Errors  []string     `json:"errors"`
+}
+
+// instanceReport is the outcome of migrating an instance.
+type instanceReport struct {
+	Instance    model.LabelValue `json:"instance"`
+	SamplesRead int              `json:"samples_read"`
+	// FailedFrom is the step from which on the instance was skipped with
+	// -skip-failed-instances.
+	FailedFrom *model.Time `json:"failed_from,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+type stepReport struct {
+	Start   model.Time `json:"start"`
+	Seconds float64    `json:"seconds"`
+}
+
+type skipReport struct {
+	Reason string `json:"reason"`
+	Count  uint64 `json:"count"`
+	Unit   string `json:"unit"`
+}
+
+// newMigrationReport returns the report of the migration of instances from
+// start to end, whose progress s and timings have tracked.
+func newMigrationReport(start, end model.Time, s *migrationStatus, timings stepTimings, instances model.LabelValues, failed []*WindowMigrationError) migrationReport {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	r := migrationReport{
+		Start:       start,
+		End:         end,
+		Started:     s.started,
+		Completed:   time.Now(),
+		Steps:       len(timings),
+		SamplesRead: s.samples,
+		Instances:   make([]instanceReport, 0, len(instances)),
+		StepTimings: make([]stepReport, 0, len(timings)),
+		Skipped:     []skipReport{},
+		Errors:      []string{},
+	}
+	byInstance := map[model.LabelValue]*WindowMigrationError{}
+	for _, e := range failed {
+		byInstance[e.Instance] = e
+	}
+	for _, i := range instances {
+		ir := instanceReport{Instance: i, SamplesRead: s.instanceSamples[i]}
+		if e, ok := byInstance[i]; ok {
+			from := e.From
+			ir.FailedFrom, ir.Error = &from, e.Err.Error()
+		}
+		r.Instances = append(r.Instances, ir)
+	}
+	sort.Slice(r.Instances, func(i, j int) bool {
+		return r.Instances[i].Instance < r.Instances[j].Instance
+	})
+	for _, t := range timings {
+		r.StepTimings = append(r.StepTimings, stepReport{Start: t.start, Seconds: t.duration.Seconds()})
+	}
+	sort.Slice(r.StepTimings, func(i, j int) bool {
+		return r.StepTimings[i].Start < r.StepTimings[j].Start
+	})
+	return r
+}
+
+// skip records count series or samples, as given by unit, that were
+// skipped for reason, if there were any.
+func (r *migrationReport) skip(reason string, count uint64, unit string) {
+	if count > 0 {
+		r.Skipped = append(r.Skipped, skipReport{Reason: reason, Count: count, Unit: unit})
+	}
+}
+
+// reportSkipped records the series and samples that m skipped or changed
+// in r.
+func (m *migrator) reportSkipped(r *migrationReport) {
+	r.skip("already present in v2 storage", m.skippedExisting, "samples")
+	if m.sparse != nil {
+		r.skip("too few samples", uint64(m.sparse.size()), "series")
+	}
+	r.skip("merged with series with identical labels", m.mergedSeries.count(), "series")
+	r.skip("missing labels set to -default-label", m.defaultedSeries.count(), "series")
+	r.skip("invalid timestamps", m.invalidTimes, "samples")
+	r.skip("non-monotonic timestamps", m.unordered, "samples")
+	r.skip("repeated values", m.droppedRepeated, "samples")
+	if m.overlaps != nil {
+		r.skip("at or before the latest sample committed in an earlier step", m.overlaps.skipped, "samples")
+	}
+	r.skip("NaN values", m.nanValues, "samples")
+	r.skip("too long label values", m.longLabelValues.count(), "series")
+	r.skip("quarantined after being rejected by the v2 storage", m.quarantined, "samples")
+	r.skip("quarantined for a cardinality explosion", m.explodedSamples, "samples")
+	r.skip("invalid names", m.nameViolations.count(), "series")
+	r.skip("invalid labels", m.labelViolations.count(), "series")
+	r.skip("duplicate label names", m.duplicateLabels.count(), "series")
+}
+
+// reportBar is a bar of the step timing chart of the HTML report, in
+// percent of the chart size.
+type reportBar struct {
+	X, Y, Width, Height float64
+	Title               string
+}
+
+// Bars returns the step timing chart of the HTML report.
+func (r migrationReport) Bars() []reportBar {
+	var max float64
+	for _, t := range r.StepTimings {
+		if t.Seconds > max {
+			max = t.Seconds
+		}
+	}
+	bars := make([]reportBar, 0, len(r.StepTimings))
+	if max == 0 {
+		return bars
+	}
+	w := 100 / float64(len(r.StepTimings))
+	for i, t := range r.StepTimings {
+		h := 100 * t.Seconds / max
+		bars = append(bars, reportBar{
+			X:      float64(i) * w,
+			Y:      100 - h,
+			Width:  w,
+			Height: h,
+			Title:  fmt.Sprintf("%s: %.3fs", t.Start.Time().UTC().Format(time.RFC3339), t.Seconds),
+		})
+	}
+	return bars
+}
+
+// writeReport writes r to the file at path in the given format, "json" or
+// "html". The HTML report has no external assets, so that it can be
+// attached to a ticket as is.
+func writeReport(path, format string, r migrationReport) error {
+	if format == "json" {
+		return writeJSONFile(path, r)
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := reportTemplate.Execute(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time": func(t model.Time) string { return t.Time().UTC().Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Migration report {{time .Start}} to {{time .End}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+td.num { text-align: right; }
+.failed { color: #b00; }
+svg { width: 100%; height: 12em; background: #f6f6f6; }
+rect { fill: #4a7ebb; }
+</style>
+</head>
+<body>
+<h1>Migration report</h1>
+<table>
+<tr><th>Time range</th><td>{{time .Start}} to {{time .End}}</td></tr>
+<tr><th>Run</th><td>{{.Started.UTC.Format "2006-01-02T15:04:05Z07:00"}} to {{.Completed.UTC.Format "2006-01-02T15:04:05Z07:00"}}</td></tr>
+<tr><th>Result</th><td{{if .Failed}} class="failed">Complete with errors{{else}}>Complete{{end}}</td></tr>
+<tr><th>Steps</th><td class="num">{{.Steps}}</td></tr>
+<tr><th>Samples read</th><td class="num">{{.SamplesRead}}</td></tr>
+<tr><th>Samples appended</th><td class="num">{{.SamplesAppended}}</td></tr>
+</table>
+<h2>Instances</h2>
+<table>
+<tr><th>Instance</th><th>Samples read</th><th>Failed from</th><th>Error</th></tr>
+{{range .Instances}}<tr{{if .FailedFrom}} class="failed"{{end}}><td>{{.Instance}}</td><td class="num">{{.SamplesRead}}</td><td>{{with .FailedFrom}}{{time .}}{{end}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+<h2>Step timings</h2>
+<svg viewBox="0 0 100 100" preserveAspectRatio="none">
+{{range .Bars}}<rect x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}"><title>{{.Title}}</title></rect>
+{{end}}</svg>
+<table>
+<tr><th>Step</th><th>Seconds</th></tr>
+{{range .StepTimings}}<tr><td>{{time .Start}}</td><td class="num">{{printf "%.3f" .Seconds}}</td></tr>
+{{end}}</table>
+<h2>Skipped and changed</h2>
+{{if .Skipped}}<table>
+<tr><th>Reason</th><th>Count</th></tr>
+{{range .Skipped}}<tr><td>{{.Reason}}</td><td class="num">{{.Count}} {{.Unit}}</td></tr>
+{{end}}</table>
+{{else}}<p>Nothing.</p>
+{{end}}<h2>Errors</h2>
+{{if .Errors}}<ul>
+{{range .Errors}}<li class="failed">{{.}}</li>
+{{end}}</ul>
+{{else}}<p>None.</p>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/html"
+)
+
+// htmlText checks that the HTML document in the file at path is well formed,
+// with every element that is opened also closed, and returns its text.
+func htmlText(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var (
+		z     = html.NewTokenizer(f)
+		open  []string
+		text  []string
+		empty = map[string]bool{"meta": true, "br": true}
+	)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if len(open) > 0 {
+				t.Errorf("elements %v are not closed", open)
+			}
+			return strings.Join(text, " ")
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			if !empty[string(name)] {
+				open = append(open, string(name))
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if len(open) == 0 || open[len(open)-1] != string(name) {
+				t.Fatalf("end tag %s does not close the element opened last of %v", name, open)
+			}
+			open = open[:len(open)-1]
+		case html.TextToken:
+			if s := strings.TrimSpace(string(z.Text())); s != "" {
+				text = append(text, s)
+			}
+		}
+	}
+}
+
+func TestReportFile(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, time.Hour))
+	defer removeV1()
+
+	for _, format := range []string{"html", "json"} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		report := filepath.Join(v2Dir, "report."+format)
+		if code := runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+			"-expect-series", "5", "-report-file", report, "-report-format", format,
+		); code != 1 {
+			t.Fatalf("%s: got exit code %d, want 1", format, code)
+		}
+
+		if format == "html" {
+			text := htmlText(t, report)
+			for _, want := range []string{
+				"Complete with errors",
+				"Steps 6",
+				"Samples read 960",
+				"Samples appended 960",
+				"host0:9090 480",
+				"host1:9090 480",
+				"migrated 4 series instead of the expected 5",
+			} {
+				if !strings.Contains(text, want) {
+					t.Errorf("html: report does not contain %q:\n%s", want, text)
+				}
+			}
+			continue
+		}
+
+		var r migrationReport
+		if ok, err := readJSONFile(report, &r); err != nil || !ok {
+			t.Fatalf("json: reading report: %v, found %v", err, ok)
+		}
+		if !r.Failed || r.Steps != 6 || r.SamplesRead != 960 || r.SamplesAppended != 960 {
+			t.Errorf("json: got failed %v, %d steps, %d samples read and %d appended, want true, 6, 960 and 960", r.Failed, r.Steps, r.SamplesRead, r.SamplesAppended)
+		}
+		if len(r.Instances) != 2 || r.Instances[0].SamplesRead != 480 || r.Instances[1].SamplesRead != 480 {
+			t.Errorf("json: got instances %+v, want 2 with 480 samples read each", r.Instances)
+		}
+		if len(r.Errors) != 1 || !strings.Contains(r.Errors[0], "expected 5") {
+			t.Errorf("json: got errors %q, want the -expect-series mismatch", r.Errors)
+		}
+	}
+}
+
+func TestReportFileVerificationMismatch(t *testing.T) {
+	samples := testSamples(testInstances(1), 2, time.Hour)
+	v1Dir, removeV1 := newTestV1Dir(t, samples)
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	args := []string{
+		"-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+	}
+	if code := runMain(append(args, "-v1-dir", v1Dir)...); code != 0 {
+		t.Fatalf("first migration exited with %d", code)
+	}
+
+	// The v2 storage keeps the samples of the first migration and rejects
+	// the samples of the second one, whose values differ.
+	changed := make([]*model.Sample, 0, len(samples))
+	for _, s := range samples {
+		changed = append(changed, &model.Sample{Metric: s.Metric, Timestamp: s.Timestamp, Value: s.Value + 0.5})
+	}
+	changedDir, removeChanged := newTestV1Dir(t, changed)
+	defer removeChanged()
+	report := filepath.Join(v2Dir, "report.json")
+	if code := runMain(append(args,
+		"-v1-dir", changedDir, "-quarantine-dir", filepath.Join(v2Dir, "quarantine"),
+		"-verify-values", "-verify-values-fraction", "1", "-report-file", report, "-report-format", "json",
+	)...); code != 1 {
+		t.Fatalf("got exit code %d, want 1", code)
+	}
+
+	var r migrationReport
+	if ok, err := readJSONFile(report, &r); err != nil || !ok {
+		t.Fatalf("reading report: %v, found %v", err, ok)
+	}
+	if !r.Failed || len(r.Errors) != 1 || !strings.Contains(r.Errors[0], "samples of 2 of 2 checked series differ") {
+		t.Errorf("got failed %v and errors %q, want the mismatch of both series", r.Failed, r.Errors)
+	}
+	if _, err := os.Stat(filepath.Join(v2Dir, "migrator.checkpoint")); err != nil {
+		t.Errorf("checkpoint of the run that failed verification is gone: %v", err)
+	}
+}
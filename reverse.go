@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+)
+
+// reverseSteps returns the start times of the steps in [start, end), which
+// must be aligned to blockRange, grouped by block range with the newest
+// block range first and ordered by time within each block range.
+func reverseSteps(start, end model.Time, step time.Duration, blockRange int64) []model.Time {
+	var (
+		res []model.Time
+		r   = model.Time(blockRange)
+	)
+	for b := end - r; b >= start; b -= r {
+		for t := b; t < b+r; t = t.Add(step) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// blockWriter is an appendable that collects the samples of one block range
+// at a time in memory and writes them as a block to the v2 storage
+// directory. Unlike the v2 storage, which only accepts samples close to the
+// newest ones, it allows migrating block ranges in any order. The ranges are
+// multiples of blockRange, unless they are started with startRange.
+type blockWriter struct {
+	dir        string
+	blockRange int64
+	compactor  *tsdb.LeveledCompactor
+	logger     log.Logger
+
+	head       *tsdb.Head
+	mint, maxt int64
+}
+
+func newBlockWriter(dir string, blockRange int64, logger log.Logger) (*blockWriter, error) {
+	c, err := tsdb.NewLeveledCompactor(nil, logger, []int64{blockRange}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &blockWriter{dir: dir, blockRange: blockRange, compactor: c, logger: logger}, nil
+}
+
+func (w *blockWriter) Appender() tsdb.Appender {
+	return w.head.Appender()
+}
+
+// startBlock prepares appending the samples of the step starting at t. If t
+// is in another block range than the previous step, the block of the
+// previous block range is written first.
+func (w *blockWriter) startBlock(t model.Time) error {
+	mint := int64(t) - int64(t)%w.blockRange
+	return w.startRange(mint, mint+w.blockRange)
+}
+
+// startRange prepares appending samples in [mint, maxt). If the previous
+// range started at another time, its block is written first.
+func (w *blockWriter) startRange(mint, maxt int64) error {
+	if w.head != nil && mint == w.mint {
+		return nil
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	// The head rejects samples older than half its chunk range before
+	// its newest sample, which would make instances appending after
+	// another one fail.
+	h, err := tsdb.NewHead(nil, w.logger, nil, 2*(maxt-mint))
+	if err != nil {
+		return err
+	}
+	w.head, w.mint, w.maxt = h, mint, maxt
+	return nil
+}
+
+// flushComplete writes the block of the current range if t is not in it.
+// When migrating newest first, all steps of that range are done then.
+func (w *blockWriter) flushComplete(t model.Time) error {
+	if w.head == nil || int64(t) >= w.mint && int64(t) < w.maxt {
+		return nil
+	}
+	return w.flush()
+}
+
+// flush writes the samples of the current range as a block, unless there
+// are none.
+func (w *blockWriter) flush() error {
+	if w.head == nil {
+		return nil
+	}
+	h := w.head
+	w.head = nil
+	defer h.Close()
+
+	if h.MaxTime() == math.MinInt64 {
+		return nil
+	}
+	if err := w.compactor.Write(w.dir, h, w.mint, w.maxt); err != nil {
+		return err
+	}
+	level.Info(w.logger).Log("msg", "Wrote v2 block", "mint", model.Time(w.mint), "maxt", model.Time(w.maxt))
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestReverse(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, 3*time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	var code int
+	logs := captureStderr(t, func() {
+		code = runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "3h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(3*time.Hour).Unix()),
+			"-min-block-duration", "1h", "-reverse",
+		)
+	})
+	if code != 0 {
+		t.Fatalf("got exit code %d, want 0, logs:\n%s", code, logs)
+	}
+
+	var written []string
+	for _, l := range strings.Split(logs, "\n") {
+		if strings.Contains(l, `msg="Wrote v2 block"`) {
+			written = append(written, logValue(l, "mint"))
+		}
+	}
+	// The range is aligned to the 1h block range, which the test data
+	// is not.
+	start, end := alignRange(testStart, testStart.Add(3*time.Hour), time.Hour)
+	var want []string
+	for b := end.Add(-time.Hour); !b.Before(start); b = b.Add(-time.Hour) {
+		want = append(want, b.String())
+	}
+	if strings.Join(written, " ") != strings.Join(want, " ") {
+		t.Errorf("wrote blocks starting at %v, want %v", written, want)
+	}
+	if n := len(blockDirs(t, v2Dir)); n != len(want) {
+		t.Errorf("got %d blocks, want %d", n, len(want))
+	}
+	got := storedTimestamps(t, v2Dir)
+	if len(got) != 4 {
+		t.Fatalf("got %d series, want 4", len(got))
+	}
+	for ls, ts := range got {
+		if len(ts) != 720 || len(distinct(ts)) != 720 {
+			t.Errorf("series %s has %d samples at %d timestamps, want 720", ls, len(ts), len(distinct(ts)))
+		}
+	}
+}
+
+func TestRecentFirst(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 2, 4*time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	var code int
+	logs := captureStderr(t, func() {
+		code = runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "4h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(4*time.Hour).Unix()),
+			"-min-block-duration", "1h", "-recent-first", "90m",
+		)
+	})
+	if code != 0 {
+		t.Fatalf("got exit code %d, want 0, logs:\n%s", code, logs)
+	}
+
+	// 90m are rounded up to the two newest block ranges, which are
+	// written before the recent data is reported, and the older ones after.
+	_, end := alignRange(testStart, testStart.Add(4*time.Hour), time.Hour)
+	recentFrom := end.Add(-2 * time.Hour)
+	var before, after []string
+	reported := false
+	for _, l := range strings.Split(logs, "\n") {
+		switch {
+		case strings.Contains(l, `msg="Recent data migrated"`):
+			if got := logValue(l, "from"); got != recentFrom.String() {
+				t.Errorf("reported recent data from %s, want %s", got, recentFrom)
+			}
+			reported = true
+		case strings.Contains(l, `msg="Wrote v2 block"`) && reported:
+			after = append(after, logValue(l, "mint"))
+		case strings.Contains(l, `msg="Wrote v2 block"`):
+			before = append(before, logValue(l, "mint"))
+		}
+	}
+	wantBefore := []string{end.Add(-time.Hour).String(), recentFrom.String()}
+	if !reported || !reflect.DeepEqual(before, wantBefore) {
+		t.Fatalf("wrote blocks %v before reporting the recent data (reported %v), want %v", before, reported, wantBefore)
+	}
+	if len(after) == 0 {
+		t.Fatal("wrote no blocks after the recent data")
+	}
+	for _, mint := range after {
+		if mint >= recentFrom.String() {
+			t.Errorf("wrote block starting at %s after the recent data, want only older ones", mint)
+		}
+	}
+	for ls, ts := range storedTimestamps(t, v2Dir) {
+		if len(distinct(ts)) != 960 {
+			t.Errorf("series %s has samples at %d timestamps, want 960", ls, len(distinct(ts)))
+		}
+	}
+}
+
+func TestReverseMatchesForward(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, 3*time.Hour))
+	defer removeV1()
+
+	// blocks migrates into a new v2 storage and returns the time ranges
+	// and sizes of its blocks in order, and its samples.
+	blocks := func(args ...string) ([]string, map[string][]int64) {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		args = append([]string{"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-lookback", "3h", "-min-block-duration", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(3 * time.Hour).Unix())}, args...)
+		if code := runMain(args...); code != 0 {
+			t.Fatalf("%v: got exit code %d, want 0", args, code)
+		}
+		metas, err := readBlockMetas(v2Dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []string
+		for _, m := range metas {
+			res = append(res, fmt.Sprintf("[%d, %d) with %d series and %d samples", m.MinTime, m.MaxTime, m.Stats.NumSeries, m.Stats.NumSamples))
+		}
+		sort.Strings(res)
+		return res, storedTimestamps(t, v2Dir)
+	}
+
+	// Written one step at a time, every step of the forward migration is
+	// a block of the block range.
+	forward, forwardSamples := blocks("-step", "1h", "-align-blocks", "1h", "-exclusive-end", "-output-blocks-per-window")
+	reverse, reverseSamples := blocks("-step", "10m", "-reverse")
+	if len(forward) != 4 || !reflect.DeepEqual(reverse, forward) {
+		t.Errorf("got blocks %v in reverse, want the 4 blocks %v of the forward migration", reverse, forward)
+	}
+	if !reflect.DeepEqual(reverseSamples, forwardSamples) {
+		t.Errorf("the reverse migration stored different samples than the forward one")
+	}
+}
+
+func TestBlocksPerWindow(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	var code int
+	logs := captureStderr(t, func() {
+		code = runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+			"-exclusive-end", "-output-blocks-per-window",
+		)
+	})
+	if code != 0 {
+		t.Fatalf("got exit code %d, want 0, logs:\n%s", code, logs)
+	}
+
+	metas, err := readBlockMetas(v2Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 6 {
+		t.Fatalf("got %d blocks, want one for each of the 6 steps", len(metas))
+	}
+	steps := map[model.Time]bool{}
+	for _, m := range metas {
+		if m.MaxTime-m.MinTime != int64(10*time.Minute/time.Millisecond) {
+			t.Errorf("block %s spans [%d, %d), want a 10m step", m.ULID, m.MinTime, m.MaxTime)
+		}
+		steps[model.Time(m.MinTime)] = true
+	}
+	for s := testStart; s.Before(testStart.Add(time.Hour)); s = s.Add(10 * time.Minute) {
+		if !steps[s] {
+			t.Errorf("no block for the step starting at %s", s)
+		}
+	}
+	for ls, ts := range storedTimestamps(t, v2Dir) {
+		if len(ts) != 240 {
+			t.Errorf("series %s has %d samples, want 240", ls, len(ts))
+		}
+	}
+}
+
+func TestBlockWriterBlocksNotCompacted(t *testing.T) {
+	// Without compactions, the test waits as long as merging took with
+	// them.
+	wait := 10 * time.Second
+	for _, compact := range []bool{true, false} {
+		dir, remove := tempDir(t)
+		defer remove()
+
+		// Three blocks of one step each, as written with
+		// -output-blocks-per-window.
+		w, err := newBlockWriter(dir, int64(10*time.Minute/time.Millisecond), log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 3; i++ {
+			mint := i * int64(10*time.Minute/time.Millisecond)
+			if err := w.startRange(mint, mint+int64(10*time.Minute/time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+			app := w.Appender()
+			if _, err := app.Add(labels.FromStrings(model.MetricNameLabel, "up"), mint, 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := app.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		dbs, err := openV2Storages([]string{dir}, &tsdb.Options{
+			RetentionDuration: 999999 * 24 * 60 * 60 * 1000,
+			BlockRanges:       tsdb.ExponentialBlockRanges(int64(10*time.Minute/time.Millisecond), 10, 3),
+		}, nil, compact, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A commit of a head spanning more than 1.5 block ranges triggers
+		// a compaction, unless the storage is not ready to receive the
+		// trigger yet, so the commit is repeated with the last sample.
+		commit := func(from, through int64) {
+			app := dbs[0].Appender()
+			for ts := from; ts <= through; ts += int64(time.Minute / time.Millisecond) {
+				if _, err := app.Add(labels.FromStrings(model.MetricNameLabel, "other"), ts, 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := app.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		last := int64(80 * time.Minute / time.Millisecond)
+		commit(int64(time.Hour/time.Millisecond), last)
+		// Compacting merges the written blocks into one of a larger range.
+		merged := func() bool {
+			metas, err := readBlockMetas(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range metas {
+				if m.MinTime < int64(30*time.Minute/time.Millisecond) && m.MaxTime-m.MinTime > int64(10*time.Minute/time.Millisecond) {
+					return true
+				}
+			}
+			return false
+		}
+		start := time.Now()
+		for !merged() && time.Since(start) < wait {
+			commit(last, last)
+			time.Sleep(10 * time.Millisecond)
+		}
+		got := merged()
+		wait = time.Since(start)
+		dbs[0].Close()
+		if compact && !got {
+			t.Fatal("the v2 storage did not merge the blocks with compactions enabled, the test does not trigger compactions")
+		}
+		if !compact && got {
+			t.Error("the v2 storage merged the written blocks with compactions disabled")
+		}
+	}
+}
+
+func TestReverseStopped(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, 3*time.Hour))
+	defer removeV1()
+
+	// 6 steps stop right after the newest block range, 8 steps in the
+	// middle of the one before.
+	for _, maxWindows := range []string{"6", "8"} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		args := []string{
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "3h",
+			"-min-block-duration", "1h", "-reverse",
+		}
+		var code int
+		logs := captureStderr(t, func() {
+			code = runMain(append(args, "-max-windows", maxWindows, "-end-timestamp", fmt.Sprint(testStart.Add(3*time.Hour).Unix()))...)
+		})
+		if code != 0 {
+			t.Fatalf("max windows %s: got exit code %d, want 0, logs:\n%s", maxWindows, code, logs)
+		}
+		l := logLine(logs, "Migration stopped, re-run with -end-timestamp set to the start of the migrated data to migrate the rest")
+		var from model.Time
+		if err := from.UnmarshalJSON([]byte(logValue(l, "migrated_from"))); err != nil {
+			t.Fatalf("max windows %s: got log line %q: %s", maxWindows, l, err)
+		}
+		if code := runMain(append(args, "-end-timestamp", fmt.Sprint(from.Unix()))...); code != 0 {
+			t.Fatalf("max windows %s: resumed migration exited with %d", maxWindows, code)
+		}
+
+		got := storedTimestamps(t, v2Dir)
+		if len(got) != 4 {
+			t.Fatalf("max windows %s: got %d series, want 4", maxWindows, len(got))
+		}
+		for ls, ts := range got {
+			if len(ts) != 720 || len(distinct(ts)) != 720 {
+				t.Errorf("max windows %s: series %s has %d samples at %d timestamps, want 720", maxWindows, ls, len(ts), len(distinct(ts)))
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// seriesList is a set of exact label sets.
+type seriesList struct {
+	byHash map[uint64][]labels.Labels
+	n      int
+}
+
+func newSeriesList() *seriesList {
+	return &seriesList{byHash: map[uint64][]labels.Labels{}}
+}
+
+// readSeriesList reads a file with one JSON object of label names to values
+// per line, e.g. {"__name__":"up","instance":"a:9090","job":"a"}. Empty
+// lines are ignored.
+func readSeriesList(path string) (*seriesList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := newSeriesList()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for line := 1; s.Scan(); line++ {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		var m map[string]string
+		if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		l.add(labels.FromMap(m))
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *seriesList) add(ls labels.Labels) {
+	h := ls.Hash()
+	for _, o := range l.byHash[h] {
+		if o.Equals(ls) {
+			return
+		}
+	}
+	l.byHash[h] = append(l.byHash[h], ls)
+	l.n++
+}
+
+// contains reports whether the list contains exactly the labels ls, which
+// must be sorted.
+func (l *seriesList) contains(ls labels.Labels) bool {
+	for _, o := range l.byHash[ls.Hash()] {
+		if o.Equals(ls) {
+			return true
+		}
+	}
+	return false
+}
+
+// size returns the number of distinct label sets in the list.
+func (l *seriesList) size() int {
+	return l.n
+}
+
+// seriesCounter counts distinct series, e.g. those that transform skips or
+// changes for a reason, which it sees again in every step. It is safe for
+// concurrent use.
+type seriesCounter struct {
+	mtx  sync.Mutex
+	seen *seriesList
+}
+
+// add counts the series ls, which must be sorted, and reports whether it had
+// not been counted before.
+func (c *seriesCounter) add(ls labels.Labels) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.seen == nil {
+		c.seen = newSeriesList()
+	}
+	if c.seen.contains(ls) {
+		return false
+	}
+	// The caller may change ls afterwards.
+	c.seen.add(append(labels.Labels(nil), ls...))
+	return true
+}
+
+// count returns the number of distinct series counted.
+func (c *seriesCounter) count() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.seen == nil {
+		return 0
+	}
+	return uint64(c.seen.size())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSeriesList(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 3, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	// The list contains a series twice, a series that does not exist and a
+	// subset of the labels of an existing series.
+	list := filepath.Join(v2Dir, "series.jsonl")
+	if err := ioutil.WriteFile(list, []byte(`{"__name__":"test_metric","instance":"host0:9090","idx":"1"}
+
+{"instance":"host1:9090","idx":"2","__name__":"test_metric"}
+{"__name__":"test_metric","instance":"host1:9090","idx":"2"}
+{"__name__":"test_metric","instance":"host2:9090","idx":"0"}
+{"__name__":"test_metric","instance":"host0:9090"}
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	runMain(
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()), "-series-list", list,
+	)
+
+	var got []string
+	for ls, ts := range storedTimestamps(t, v2Dir) {
+		got = append(got, ls)
+		if len(ts) != 240 {
+			t.Errorf("series %s has %d samples, want 240", ls, len(ts))
+		}
+	}
+	sort.Strings(got)
+	want := []string{
+		`{__name__="test_metric",idx="1",instance="host0:9090"}`,
+		`{__name__="test_metric",idx="2",instance="host1:9090"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+}
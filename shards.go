@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// queryable is a storage whose samples can be queried.
+type queryable interface {
+	Querier(mint, maxt int64) (tsdb.Querier, error)
+}
+
+// shardDirs returns the directories of n v2 storages, formatted from
+// template with the shard numbers 0 to n-1.
+func shardDirs(template string, n int) ([]string, error) {
+	if strings.Count(template, "%d") != 1 || strings.Count(template, "%") != 1 {
+		return nil, fmt.Errorf("template %q must contain %%d exactly once and no other verbs", template)
+	}
+	dirs := make([]string, n)
+	for i := range dirs {
+		dirs[i] = fmt.Sprintf(template, i)
+	}
+	return dirs, nil
+}
+
+// openV2Storages opens the v2 storages in dirs with opts. Unless compact is
+// set, their background compactions are disabled, as they would merge the
+// blocks written next to them by a blockWriter.
+func openV2Storages(dirs []string, opts *tsdb.Options, r prometheus.Registerer, compact bool, logger log.Logger) ([]*tsdb.DB, error) {
+	var dbs []*tsdb.DB
+	for _, dir := range dirs {
+		db, err := tsdb.Open(dir, logger, r, opts)
+		if err != nil {
+			for _, db := range dbs {
+				db.Close()
+			}
+			return nil, fmt.Errorf("opening %s: %s", dir, err)
+		}
+		if !compact {
+			db.DisableCompactions()
+		}
+		dbs = append(dbs, db)
+		if err := initHead(db); err != nil {
+			for _, db := range dbs {
+				db.Close()
+			}
+			return nil, fmt.Errorf("reading head of %s: %s", dir, err)
+		}
+	}
+	return dbs, nil
+}
+
+// initHead starts the time range of the head of db at its earliest sample if
+// the head has not been initialized yet although it holds samples. This is
+// the case after the vendored TSDB library replayed the WAL of a storage
+// without blocks, e.g. that of a stopped migration. The head would otherwise
+// start in the block range of the first sample appended next, and drop the
+// earlier samples when it is compacted.
+func initHead(db *tsdb.DB) error {
+	h := db.Head()
+	if h.MinTime() != math.MinInt64 {
+		return nil
+	}
+	ir, err := h.Index()
+	if err != nil {
+		return err
+	}
+	defer ir.Close()
+	p, err := ir.Postings("", "")
+	if err != nil {
+		return err
+	}
+	var (
+		first = int64(math.MaxInt64)
+		ls    labels.Labels
+	)
+	for p.Next() {
+		var (
+			lset labels.Labels
+			chks []tsdb.ChunkMeta
+		)
+		if err := ir.Series(p.At(), &lset, &chks); err != nil {
+			return err
+		}
+		if len(chks) > 0 && chks[0].MinTime < first {
+			first, ls = chks[0].MinTime, lset
+		}
+	}
+	if err := p.Err(); err != nil {
+		return err
+	}
+	if ls == nil {
+		return nil
+	}
+	// The first sample appended initializes the head, even if it is
+	// rejected as out of order, and an existing series gains no samples
+	// when the append is rolled back.
+	app := db.Appender()
+	app.Add(ls, first, 0)
+	return app.Rollback()
+}
+
+// shardedStorage distributes series over several v2 storages by the hash of
+// their labels, so that every series always ends up in the same storage
+// regardless of the order in which series are migrated.
+type shardedStorage struct {
+	dbs []*tsdb.DB
+}
+
+// shard returns the index of the storage of the series ls.
+func (s *shardedStorage) shard(ls labels.Labels) int {
+	return int(ls.Hash() % uint64(len(s.dbs)))
+}
+
+func (s *shardedStorage) Appender() tsdb.Appender {
+	return &shardedAppender{storage: s, apps: make([]tsdb.Appender, len(s.dbs))}
+}
+
+// Querier returns a querier over all storages. As every series is in one
+// storage only, the series sets of the storages are returned one after
+// another.
+func (s *shardedStorage) Querier(mint, maxt int64) (tsdb.Querier, error) {
+	q := &shardedQuerier{}
+	for _, db := range s.dbs {
+		sq, err := db.Querier(mint, maxt)
+		if err != nil {
+			q.Close()
+			return nil, err
+		}
+		q.queriers = append(q.queriers, sq)
+	}
+	return q, nil
+}
+
+// shardedAppender appends every series to the appender of its storage,
+// which is created on the first sample appended to the storage.
+type shardedAppender struct {
+	storage *shardedStorage
+	apps    []tsdb.Appender
+}
+
+func (a *shardedAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	i := a.storage.shard(l)
+	if a.apps[i] == nil {
+		a.apps[i] = a.storage.dbs[i].Appender()
+	}
+	_, err := a.apps[i].Add(l, t, v)
+	return 0, err
+}
+
+func (a *shardedAppender) AddFast(ref uint64, t int64, v float64) error {
+	return tsdb.ErrNotFound
+}
+
+func (a *shardedAppender) Commit() error {
+	var errs tsdb.MultiError
+	for _, app := range a.apps {
+		if app != nil {
+			errs.Add(app.Commit())
+		}
+	}
+	return errs.Err()
+}
+
+func (a *shardedAppender) Rollback() error {
+	var errs tsdb.MultiError
+	for _, app := range a.apps {
+		if app != nil {
+			errs.Add(app.Rollback())
+		}
+	}
+	return errs.Err()
+}
+
+type shardedQuerier struct {
+	queriers []tsdb.Querier
+}
+
+func (q *shardedQuerier) Select(ms ...labels.Matcher) tsdb.SeriesSet {
+	sets := make([]tsdb.SeriesSet, 0, len(q.queriers))
+	for _, sq := range q.queriers {
+		sets = append(sets, sq.Select(ms...))
+	}
+	return &concatSeriesSet{sets: sets}
+}
+
+func (q *shardedQuerier) LabelValues(name string) ([]string, error) {
+	return q.labelValues(func(sq tsdb.Querier) ([]string, error) { return sq.LabelValues(name) })
+}
+
+func (q *shardedQuerier) LabelValuesFor(name string, l labels.Label) ([]string, error) {
+	return q.labelValues(func(sq tsdb.Querier) ([]string, error) { return sq.LabelValuesFor(name, l) })
+}
+
+// labelValues returns the sorted union of the label values that f returns
+// for every querier.
+func (q *shardedQuerier) labelValues(f func(tsdb.Querier) ([]string, error)) ([]string, error) {
+	set := map[string]bool{}
+	for _, sq := range q.queriers {
+		vs, err := f(sq)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vs {
+			set[v] = true
+		}
+	}
+	res := make([]string, 0, len(set))
+	for v := range set {
+		res = append(res, v)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (q *shardedQuerier) Close() error {
+	var errs tsdb.MultiError
+	for _, sq := range q.queriers {
+		errs.Add(sq.Close())
+	}
+	return errs.Err()
+}
+
+// concatSeriesSet returns the series of several series sets one after
+// another.
+type concatSeriesSet struct {
+	sets []tsdb.SeriesSet
+}
+
+func (s *concatSeriesSet) Next() bool {
+	for len(s.sets) > 0 {
+		if s.sets[0].Next() {
+			return true
+		}
+		if s.sets[0].Err() != nil {
+			return false
+		}
+		s.sets = s.sets[1:]
+	}
+	return false
+}
+
+func (s *concatSeriesSet) At() tsdb.Series {
+	return s.sets[0].At()
+}
+
+func (s *concatSeriesSet) Err() error {
+	if len(s.sets) == 0 {
+		return nil
+	}
+	return s.sets[0].Err()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestShardDirs(t *testing.T) {
+	for _, tc := range []struct {
+		template string
+		n        int
+		want     []string
+		wantErr  bool
+	}{
+		{template: "data/shard-%d", n: 3, want: []string{"data/shard-0", "data/shard-1", "data/shard-2"}},
+		{template: "%d", n: 1, want: []string{"0"}},
+		{template: "data/shard", n: 2, wantErr: true},
+		{template: "data/%d-%d", n: 2, wantErr: true},
+		{template: "data/%s-%d", n: 2, wantErr: true},
+		{template: "data/100%%-%d", n: 2, wantErr: true},
+	} {
+		got, err := shardDirs(tc.template, tc.n)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %v, want an error", tc.template, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.template, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.template, got, tc.want)
+		}
+	}
+}
+
+func TestShardedMigration(t *testing.T) {
+	instances := testInstances(3)
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(instances, 10, time.Hour))
+	defer removeV1()
+
+	// shardsOf migrates all series into 3 shards and returns the shard of
+	// every series.
+	shardsOf := func(args ...string) map[string]int {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		args = append([]string{"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h", "-v2-shards", "3",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix())}, args...)
+		if code := runMain(args...); code != 0 {
+			t.Fatalf("migration exited with %d", code)
+		}
+		res := map[string]int{}
+		for i := 0; i < 3; i++ {
+			for ls, ts := range storedTimestamps(t, filepath.Join(v2Dir, fmt.Sprintf("shard-%d", i))) {
+				if _, ok := res[ls]; ok {
+					t.Fatalf("series %s is in several shards", ls)
+				}
+				if len(distinct(ts)) != 240 {
+					t.Errorf("series %s has %d samples, want 240", ls, len(distinct(ts)))
+				}
+				res[ls] = i
+			}
+		}
+		return res
+	}
+
+	got := shardsOf()
+	if len(got) != 30 {
+		t.Fatalf("got %d series, want 30", len(got))
+	}
+	s := &shardedStorage{dbs: make([]*tsdb.DB, 3)}
+	perShard := make([]int, 3)
+	for _, instance := range instances {
+		for i := 0; i < 10; i++ {
+			ls := labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, instance, "idx", fmt.Sprint(i))
+			if got[ls.String()] != s.shard(ls) {
+				t.Errorf("series %s is in shard %d, want %d", ls, got[ls.String()], s.shard(ls))
+			}
+			perShard[s.shard(ls)]++
+		}
+	}
+	for i, n := range perShard {
+		if n < 5 {
+			t.Errorf("shard %d has %d of the 30 series, want at least 5", i, n)
+		}
+	}
+
+	// The assignment does not depend on the order of migration.
+	if again := shardsOf("-max-parallelism", "3"); !reflect.DeepEqual(again, got) {
+		t.Errorf("got shards %v when migrating in parallel, want %v", again, got)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// sparseSeries reads the series of the instances in the same steps from
+// start to end as the migration and returns the series selected by m with
+// fewer than min samples in all of them, and the number of series counted.
+// Samples are counted as read from the v1 storage, before any of them are
+// dropped.
+func sparseSeries(m *migrator, instances model.LabelValues, start, end model.Time, step time.Duration, exclusiveEnd bool, min int) (*seriesList, int, error) {
+	var (
+		counts = map[string]int{}
+		byKey  = map[string]labels.Labels{}
+	)
+	for _, instance := range instances {
+		matchers, err := shardMatchers(m.shardLabel, instance)
+		if err != nil {
+			return nil, 0, err
+		}
+		for t := start; t.Before(end); t = t.Add(step) {
+			through := stepEnd(t, end, step, exclusiveEnd)
+			its, err := m.queryV1(t, through, matchers...)
+			if err != nil {
+				return nil, 0, err
+			}
+			groups, err := m.previewTransform(its)
+			if err != nil {
+				closeIterators(its)
+				return nil, 0, err
+			}
+			for _, g := range groups {
+				s := readGroup(g, t, through)
+				if len(s.samples) == 0 {
+					continue
+				}
+				key := s.labels.String()
+				if _, ok := byKey[key]; !ok {
+					byKey[key] = s.labels
+				}
+				counts[key] += len(s.samples)
+			}
+			closeIterators(its)
+		}
+	}
+
+	sparse := newSeriesList()
+	for key, n := range counts {
+		if n < min {
+			sparse.add(byKey[key])
+		}
+	}
+	return sparse, len(counts), nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestMinSamplesPerSeries(t *testing.T) {
+	samples := testSamples(testInstances(1), 1, time.Hour)
+	// The sparse series has 5 samples, spread over several steps.
+	for i := 0; i < 5; i++ {
+		samples = append(samples, &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "sparse_metric", model.InstanceLabel: "host0:9090"},
+			Timestamp: testStart.Add(time.Duration(i) * 12 * time.Minute),
+			Value:     1,
+		})
+	}
+	v1Dir, removeV1 := newTestV1Dir(t, samples)
+	defer removeV1()
+
+	for _, tc := range []struct {
+		min        int
+		wantSparse bool
+	}{
+		{min: 4, wantSparse: true},
+		{min: 5, wantSparse: true},
+		{min: 6},
+	} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		logs := captureStderr(t, func() {
+			if code := runMain(
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+				"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+				"-min-samples-per-series", fmt.Sprint(tc.min),
+			); code != 0 {
+				t.Fatalf("min %d: got exit code %d, want 0", tc.min, code)
+			}
+		})
+
+		var sparse, other int
+		for ls, ts := range storedTimestamps(t, v2Dir) {
+			if strings.Contains(ls, "sparse_metric") {
+				sparse = len(ts)
+			} else {
+				other = len(ts)
+			}
+		}
+		if wantSparse := map[bool]int{true: 5}[tc.wantSparse]; sparse != wantSparse || other != 240 {
+			t.Errorf("min %d: got %d samples of the sparse series and %d of the other, want %d and 240", tc.min, sparse, other, wantSparse)
+		}
+		wantDropped := map[bool]string{true: "0", false: "1"}[tc.wantSparse]
+		if got := logValue(logLine(logs, "Dropping sparse series"), "series"); got != wantDropped {
+			t.Errorf("min %d: logged %q dropped series, want %s", tc.min, got, wantDropped)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// migrationStatus tracks the progress of the migration for the progress
+// file.
+type migrationStatus struct {
+	mtx       sync.Mutex
+	total     int64
+	done      int64
+	startDone int64
+	started   time.Time
+	current   model.Time
+	samples   int
+	errors    int
+	active    map[model.LabelValue]bool
+	// instanceSamples are the samples read per instance.
+	instanceSamples map[model.LabelValue]int
+	finished        bool
+
+	// etaModel is how the remaining time is estimated: 'linear' by the
+	// steps of this run, 'throughput' by the samples read per second
+	// recently and the samples per step so far, and 'density-weighted' by
+	// the estimated data of the steps done and left.
+	etaModel string
+	// marks are the samples read in this run by the time of each step
+	// completed in the last etaWindow, and the one before, for the
+	// throughput model.
+	marks []sampleMark
+	// density is the estimated data of each step of this run for the
+	// density-weighted model, of which densityDone has been migrated and
+	// densityLeft is still to go.
+	density                  map[model.Time]float64
+	densityDone, densityLeft float64
+}
+
+// etaWindow is how far back the throughput model measures the samples read
+// per second.
+const etaWindow = 5 * time.Minute
+
+type sampleMark struct {
+	at      time.Time
+	samples int
+}
+
+// statusReport is the content of the progress file.
+type statusReport struct {
+	Percent         float64            `json:"percent"`
+	StepsTotal      int64              `json:"steps_total"`
+	StepsDone       int64              `json:"steps_done"`
+	SamplesRead     int                `json:"samples_read"`
+	ETASeconds      float64            `json:"eta_seconds,omitempty"`
+	ETAModel        string             `json:"eta_model"`
+	CurrentStep     model.Time         `json:"current_step"`
+	ActiveInstances []model.LabelValue `json:"active_instances"`
+	Errors          int                `json:"errors"`
+	Finished        bool               `json:"finished"`
+	Updated         time.Time          `json:"updated"`
+}
+
+// newMigrationStatus returns the status of a migration of total steps, of
+// which done were completed by earlier runs, whose remaining time is
+// estimated with etaModel.
+func newMigrationStatus(total, done int64, etaModel string) *migrationStatus {
+	now := time.Now()
+	return &migrationStatus{
+		total:     total,
+		done:      done,
+		startDone: done,
+		started:   now,
+		active:    map[model.LabelValue]bool{},
+
+		instanceSamples: map[model.LabelValue]int{},
+		etaModel:        etaModel,
+		marks:           []sampleMark{{at: now}},
+	}
+}
+
+// setDensity sets the estimated data of each step of this run for the
+// density-weighted model.
+func (s *migrationStatus) setDensity(density map[model.Time]float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.density, s.densityLeft = density, 0
+	for _, d := range density {
+		s.densityLeft += d
+	}
+}
+
+func (s *migrationStatus) startStep(t model.Time) {
+	s.mtx.Lock()
+	s.current = t
+	s.mtx.Unlock()
+}
+
+func (s *migrationStatus) stepDone() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.done++
+	now := time.Now()
+	s.marks = append(s.marks, sampleMark{at: now, samples: s.samples})
+	for len(s.marks) > 2 && now.Sub(s.marks[1].at) > etaWindow {
+		s.marks = s.marks[1:]
+	}
+	d := s.density[s.current]
+	s.densityDone += d
+	s.densityLeft -= d
+}
+
+func (s *migrationStatus) startInstance(instance model.LabelValue) {
+	s.mtx.Lock()
+	s.active[instance] = true
+	s.mtx.Unlock()
+}
+
+// instanceDone records that migrating the current step of instance read n
+// samples and failed if err is not nil.
+func (s *migrationStatus) instanceDone(instance model.LabelValue, n int, err error) {
+	s.mtx.Lock()
+	delete(s.active, instance)
+	s.samples += n
+	s.instanceSamples[instance] += n
+	if err != nil {
+		s.errors++
+	}
+	s.mtx.Unlock()
+}
+
+func (s *migrationStatus) report() statusReport {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	r := statusReport{
+		StepsTotal:      s.total,
+		StepsDone:       s.done,
+		SamplesRead:     s.samples,
+		CurrentStep:     s.current,
+		ActiveInstances: make([]model.LabelValue, 0, len(s.active)),
+		Errors:          s.errors,
+		Finished:        s.finished,
+		Updated:         time.Now(),
+		ETAModel:        s.etaModel,
+	}
+	if s.total > 0 {
+		r.Percent = 100 * float64(s.done) / float64(s.total)
+	}
+	if !s.finished {
+		r.ETASeconds = s.eta()
+	}
+	for i := range s.active {
+		r.ActiveInstances = append(r.ActiveInstances, i)
+	}
+	sort.Slice(r.ActiveInstances, func(i, j int) bool {
+		return r.ActiveInstances[i] < r.ActiveInstances[j]
+	})
+	return r
+}
+
+// eta returns the estimated remaining seconds of the migration, or 0 if
+// there is no estimate yet. Like the progress bar, it only considers the
+// steps of this run. s.mtx must be held.
+func (s *migrationStatus) eta() float64 {
+	n := s.done - s.startDone
+	if n <= 0 {
+		return 0
+	}
+	left := float64(s.total - s.done)
+	switch s.etaModel {
+	case "throughput":
+		first, last := s.marks[0], s.marks[len(s.marks)-1]
+		if read, secs := last.samples-first.samples, last.at.Sub(first.at).Seconds(); read > 0 && secs > 0 {
+			perSecond := float64(read) / secs
+			return float64(s.samples) / float64(n) * left / perSecond
+		}
+	case "density-weighted":
+		// Steps without any data are migrated the fastest, but cannot
+		// be weighted.
+		if s.densityDone > 0 {
+			return time.Since(s.started).Seconds() * math.Max(s.densityLeft, 0) / s.densityDone
+		}
+	}
+	return time.Since(s.started).Seconds() / float64(n) * left
+}
+
+// writeEvery atomically rewrites the progress file at path every interval
+// in the background. The returned function stops that and writes the file a
+// last time.
+func (s *migrationStatus) writeEvery(path string, interval time.Duration, logger log.Logger) func() {
+	return s.every(interval, func() {
+		if err := writeJSONFile(path, s.report()); err != nil {
+			level.Warn(logger).Log("msg", "error writing progress file", "file", path, "err", err)
+		}
+	})
+}
+
+// remoteWriteEvery sends the progress as samples of the progressMetrics with
+// the labels ls to the remote write storage rw every interval in the
+// background. The returned function stops that and sends it a last time.
+func (s *migrationStatus) remoteWriteEvery(rw *remoteWriteStorage, ls labels.Labels, interval time.Duration, logger log.Logger) func() {
+	return s.every(interval, func() {
+		r := s.report()
+		t := int64(model.TimeFromUnixNano(r.Updated.UnixNano()))
+		app := rw.Appender()
+		for _, m := range progressMetrics {
+			series := append(labels.Labels{{Name: model.MetricNameLabel, Value: m.name}}, ls...)
+			sort.Sort(series)
+			if _, err := app.Add(series, t, m.value(r)); err != nil {
+				level.Warn(logger).Log("msg", "error sending progress", "url", rw.url, "err", err)
+				return
+			}
+		}
+		if err := app.Commit(); err != nil {
+			level.Warn(logger).Log("msg", "error sending progress", "url", rw.url, "err", err)
+		}
+	})
+}
+
+// progressMetrics are the metrics the progress is sent as by
+// remoteWriteEvery.
+var progressMetrics = []struct {
+	name  string
+	value func(statusReport) float64
+}{
+	{"prom_data_migrator_progress_percent", func(r statusReport) float64 { return r.Percent }},
+	{"prom_data_migrator_steps", func(r statusReport) float64 { return float64(r.StepsTotal) }},
+	{"prom_data_migrator_steps_done", func(r statusReport) float64 { return float64(r.StepsDone) }},
+	{"prom_data_migrator_samples_read", func(r statusReport) float64 { return float64(r.SamplesRead) }},
+	{"prom_data_migrator_eta_seconds", func(r statusReport) float64 { return r.ETASeconds }},
+	{"prom_data_migrator_current_step_timestamp_seconds", func(r statusReport) float64 { return float64(r.CurrentStep) / 1e3 }},
+	{"prom_data_migrator_active_instances", func(r statusReport) float64 { return float64(len(r.ActiveInstances)) }},
+	{"prom_data_migrator_errors", func(r statusReport) float64 { return float64(r.Errors) }},
+	{"prom_data_migrator_finished", func(r statusReport) float64 {
+		if r.Finished {
+			return 1
+		}
+		return 0
+	}},
+}
+
+// every calls f now and then every interval in the background. The returned
+// function stops that, marks the migration finished and calls f a last time.
+func (s *migrationStatus) every(interval time.Duration, f func()) func() {
+	f()
+
+	var (
+		stop    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				f()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		s.mtx.Lock()
+		s.finished = true
+		s.mtx.Unlock()
+		f()
+	}
+}
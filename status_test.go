@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+func TestProgressFile(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(3), 5, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	file := filepath.Join(v2Dir, "progress.json")
+
+	var (
+		code  int
+		polls int
+		last  statusReport
+	)
+	captureStderr(t, func() {
+		done := make(chan struct{})
+		go func() {
+			code = runMain(
+				"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "1m", "-lookback", "1h",
+				"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+				"-progress-file", file, "-progress-file-interval", "1ms",
+			)
+			close(done)
+		}()
+		for finished := false; !finished; {
+			select {
+			case <-done:
+				finished = true
+			default:
+			}
+			b, err := ioutil.ReadFile(file)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			polls++
+			if err := json.Unmarshal(b, &last); err != nil {
+				t.Fatalf("poll %d: invalid progress file %q: %s", polls, b, err)
+			}
+		}
+	})
+	if code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	if polls == 0 {
+		t.Fatal("progress file was never written")
+	}
+	if !last.Finished || last.StepsDone != 60 || last.Percent != 100 || last.SamplesRead != 3*5*240 || len(last.ActiveInstances) != 0 || last.Errors != 0 {
+		t.Errorf("got final progress %+v, want a finished run of 60 steps and %d samples", last, 3*5*240)
+	}
+}
+
+// decodeWriteRequest returns the samples of the series of a snappy-compressed
+// remote write request by the string form of their labels.
+func decodeWriteRequest(t *testing.T, body []byte) map[string][]model.SamplePair {
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fields calls f with the number and the bytes or value of every
+	// field of the message b, as encoded by encodeWriteRequest.
+	fields := func(b []byte, f func(field uint64, raw []byte, value uint64)) {
+		buf := proto.NewBuffer(b)
+		for {
+			key, err := buf.DecodeVarint()
+			if err == io.ErrUnexpectedEOF {
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				raw   []byte
+				value uint64
+			)
+			switch key & 7 {
+			case proto.WireBytes:
+				raw, err = buf.DecodeRawBytes(false)
+			case proto.WireFixed64:
+				value, err = buf.DecodeFixed64()
+			case proto.WireVarint:
+				value, err = buf.DecodeVarint()
+			default:
+				t.Fatalf("unexpected wire type %d", key&7)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			f(key>>3, raw, value)
+		}
+	}
+
+	res := map[string][]model.SamplePair{}
+	fields(b, func(_ uint64, ts []byte, _ uint64) {
+		var (
+			ls      labels.Labels
+			samples []model.SamplePair
+		)
+		fields(ts, func(field uint64, msg []byte, _ uint64) {
+			if field == 1 {
+				var l labels.Label
+				fields(msg, func(field uint64, s []byte, _ uint64) {
+					if field == 1 {
+						l.Name = string(s)
+					} else {
+						l.Value = string(s)
+					}
+				})
+				ls = append(ls, l)
+				return
+			}
+			var s model.SamplePair
+			fields(msg, func(field uint64, _ []byte, v uint64) {
+				if field == 1 {
+					s.Value = model.SampleValue(math.Float64frombits(v))
+				} else {
+					s.Timestamp = model.Time(v)
+				}
+			})
+			samples = append(samples, s)
+		})
+		res[ls.String()] = append(res[ls.String()], samples...)
+	})
+	return res
+}
+
+func TestProgressRemoteWrite(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 2, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	var (
+		mtx      sync.Mutex
+		received = map[string][]model.SamplePair{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		for ls, samples := range decodeWriteRequest(t, body) {
+			received[ls] = append(received[ls], samples...)
+		}
+	}))
+	defer srv.Close()
+
+	if code := runMain(
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+		"-progress-remote-write-url", srv.URL, "-progress-remote-write-interval", "1ms", "-progress-label", "migration=test",
+	); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(received) != len(progressMetrics) {
+		t.Errorf("received %d series, want the %d progress metrics: %v", len(received), len(progressMetrics), received)
+	}
+	// The last progress is sent once the migration has finished.
+	for name, want := range map[string]float64{
+		"prom_data_migrator_finished":         1,
+		"prom_data_migrator_progress_percent": 100,
+		"prom_data_migrator_steps":            6,
+		"prom_data_migrator_steps_done":       6,
+		"prom_data_migrator_samples_read":     2 * 240,
+		"prom_data_migrator_errors":           0,
+	} {
+		ls := labels.FromStrings(model.MetricNameLabel, name, "migration", "test").String()
+		samples := received[ls]
+		if len(samples) == 0 {
+			t.Errorf("received no samples of %s", ls)
+			continue
+		}
+		if got := float64(samples[len(samples)-1].Value); got != want {
+			t.Errorf("got last value %v of %s, want %v", got, ls, want)
+		}
+	}
+}
+
+func TestDensityWeightedETA(t *testing.T) {
+	v1Dir, removeV1 := tempDir(t)
+	defer removeV1()
+	// A series has samples every 15s in all 4 steps of 1h, 9 more only in
+	// the last one.
+	steps := []model.Time{testStart, testStart.Add(time.Hour), testStart.Add(2 * time.Hour), testStart.Add(3 * time.Hour)}
+	series := func(from model.Time, d time.Duration) []model.SamplePair {
+		var samples []model.SamplePair
+		for ts := from; ts.Before(from.Add(d)); ts = ts.Add(15 * time.Second) {
+			samples = append(samples, model.SamplePair{Timestamp: ts, Value: model.SampleValue(ts % 97)})
+		}
+		return samples
+	}
+	writeTestSeriesFile(t, v1Dir, model.Metric{model.MetricNameLabel: "test_metric", "idx": "0"}, series(testStart, 4*time.Hour))
+	for i := 1; i < 10; i++ {
+		writeTestSeriesFile(t, v1Dir, model.Metric{model.MetricNameLabel: "test_metric", "idx": model.LabelValue(fmt.Sprint(i))}, series(steps[3], time.Hour))
+	}
+	density, err := stepDensity(v1Dir, steps, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if density[steps[3]] < 5*density[steps[0]] {
+		t.Fatalf("got step densities %v, want the last step to be far denser", density)
+	}
+
+	// The steps take as long as they have samples: a second each for the
+	// first three, 10s for the last.
+	const actual = 10
+	eta := map[string]float64{}
+	for _, etaModel := range []string{"linear", "density-weighted"} {
+		s := newMigrationStatus(int64(len(steps)), 0, etaModel)
+		s.setDensity(density)
+		for _, st := range steps[:3] {
+			s.startStep(st)
+			s.stepDone()
+		}
+		s.started = time.Now().Add(-3 * time.Second)
+		r := s.report()
+		if r.ETAModel != etaModel {
+			t.Errorf("got ETA model %q, want %q", r.ETAModel, etaModel)
+		}
+		eta[etaModel] = r.ETASeconds
+	}
+	if math.Abs(eta["density-weighted"]-actual) >= math.Abs(eta["linear"]-actual) {
+		t.Errorf("got density-weighted ETA %.1fs and linear ETA %.1fs, want the density-weighted one closer to %ds", eta["density-weighted"], eta["linear"], actual)
+	}
+}
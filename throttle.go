@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/expfmt"
+)
+
+// loadThrottle reduces the number of instances migrated at the same time to
+// one while the load of the Prometheus server owning the v1 storage is high,
+// as reported by a metric it exposes.
+type loadThrottle struct {
+	url       string
+	metric    string
+	high, low float64
+	max       int
+	client    *http.Client
+	logger    log.Logger
+
+	mtx       sync.Mutex
+	throttled bool
+}
+
+// parallelism returns how many instances may be migrated at the same time.
+func (t *loadThrottle) parallelism() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.throttled {
+		return 1
+	}
+	return t.max
+}
+
+// run checks the load every interval until ctx is canceled. The migration
+// is throttled once the load exceeds the high threshold and until it falls
+// below the low threshold.
+func (t *loadThrottle) run(ctx context.Context, interval time.Duration) {
+	for {
+		t.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (t *loadThrottle) check() {
+	load, err := fetchMetric(t.client, t.url, t.metric)
+	if err != nil {
+		level.Warn(t.logger).Log("msg", "error checking source load, keeping current parallelism", "url", t.url, "err", err)
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	switch {
+	case !t.throttled && load > t.high:
+		t.throttled = true
+		level.Warn(t.logger).Log("msg", "Source load is high, migrating one instance at a time", "load", load)
+	case t.throttled && load < t.low:
+		t.throttled = false
+		level.Info(t.logger).Log("msg", "Source load is back to normal, migrating at full parallelism", "load", load, "parallelism", t.max)
+	}
+}
+
+// fetchMetric returns the sum of the values of all series of the gauge,
+// counter or untyped metric name exposed in text format at url.
+func fetchMetric(client *http.Client, url, name string) (float64, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var p expfmt.TextParser
+	mfs, err := p.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	mf, ok := mfs[name]
+	if !ok {
+		return 0, fmt.Errorf("metric %s not found", name)
+	}
+	var sum float64
+	for _, m := range mf.Metric {
+		switch {
+		case m.Gauge != nil:
+			sum += m.Gauge.GetValue()
+		case m.Counter != nil:
+			sum += m.Counter.GetValue()
+		case m.Untyped != nil:
+			sum += m.Untyped.GetValue()
+		default:
+			return 0, fmt.Errorf("metric %s is not a gauge, counter or untyped", name)
+		}
+	}
+	return sum, nil
+}
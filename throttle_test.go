@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestLoadThrottle(t *testing.T) {
+	var (
+		mtx  sync.Mutex
+		load float64
+		fail bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "# TYPE source_load gauge\nsource_load{shard=\"a\"} %v\nsource_load{shard=\"b\"} %v\n", load/2, load/2)
+	}))
+	defer srv.Close()
+
+	throttle := &loadThrottle{
+		url:    srv.URL,
+		metric: "source_load",
+		high:   0.7,
+		low:    0.5,
+		max:    8,
+		client: srv.Client(),
+		logger: log.NewNopLogger(),
+	}
+	for _, tc := range []struct {
+		load            float64
+		fail            bool
+		wantParallelism int
+	}{
+		{load: 0.2, wantParallelism: 8},
+		{load: 0.9, wantParallelism: 1},
+		// Between the thresholds, throttling continues.
+		{load: 0.6, wantParallelism: 1},
+		{fail: true, wantParallelism: 1},
+		{load: 0.4, wantParallelism: 8},
+		{load: 0.6, wantParallelism: 8},
+	} {
+		mtx.Lock()
+		load, fail = tc.load, tc.fail
+		mtx.Unlock()
+		throttle.check()
+		if got := throttle.parallelism(); got != tc.wantParallelism {
+			t.Errorf("load %v (failing %v): got parallelism %d, want %d", tc.load, tc.fail, got, tc.wantParallelism)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+)
+
+// outlierFactor is how many times slower than the median a step has to be to
+// be reported as an outlier.
+const outlierFactor = 3
+
+type stepTiming struct {
+	start    model.Time
+	duration time.Duration
+}
+
+// stepTimings records how long each step of the migration took.
+type stepTimings []stepTiming
+
+func (ts *stepTimings) add(start model.Time, d time.Duration) {
+	*ts = append(*ts, stepTiming{start: start, duration: d})
+}
+
+// report logs a summary of the step durations and all steps that took
+// considerably longer than the median.
+func (ts stepTimings) report(logger log.Logger) {
+	if len(ts) == 0 {
+		return
+	}
+	sorted := make([]time.Duration, len(ts))
+	for i, t := range ts {
+		sorted[i] = t.duration
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	quantile := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))]
+	}
+	median := quantile(0.5)
+
+	level.Info(logger).Log(
+		"msg", "Step timings",
+		"steps", len(ts),
+		"min", sorted[0],
+		"median", median,
+		"p90", quantile(0.9),
+		"p99", quantile(0.99),
+		"max", sorted[len(sorted)-1],
+	)
+	for _, t := range ts {
+		if t.duration > outlierFactor*median {
+			level.Info(logger).Log("msg", "Slow step", "start", t.start, "duration", t.duration, "median", median)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestTimingReport(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	logs := captureStderr(t, func() {
+		runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-timing-report", "-step", "10m", "-lookback", "1h",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+		)
+	})
+	l := logLine(logs, "Step timings")
+	if l == "" {
+		t.Fatalf("no step timings logged in %q", logs)
+	}
+	if steps := logValue(l, "steps"); steps != "6" {
+		t.Errorf("got %s steps, want 6", steps)
+	}
+	var prev time.Duration
+	for _, key := range []string{"min", "median", "p90", "p99", "max"} {
+		d, err := time.ParseDuration(logValue(l, key))
+		if err != nil {
+			t.Fatalf("%s: %s", key, err)
+		}
+		if d <= 0 || d > 10*time.Second || d < prev {
+			t.Errorf("implausible %s step duration %s in %q", key, d, l)
+		}
+		prev = d
+	}
+}
+
+func TestStepTimingsOutliers(t *testing.T) {
+	var ts stepTimings
+	for i := 0; i < 10; i++ {
+		d := 100 * time.Millisecond
+		if i == 7 {
+			d = time.Second
+		}
+		ts.add(testStart.Add(time.Duration(i)*time.Hour), d)
+	}
+	var buf bytes.Buffer
+	ts.report(log.NewLogfmtLogger(&buf))
+
+	if n := strings.Count(buf.String(), `msg="Slow step"`); n != 1 {
+		t.Fatalf("got %d slow steps, want 1 in %q", n, buf.String())
+	}
+	if l := logLine(buf.String(), "Slow step"); logValue(l, "start") != testStart.Add(7*time.Hour).String() {
+		t.Errorf("got slow step %q, want the one at %s", l, testStart.Add(7*time.Hour))
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/log/term"
+	"github.com/prometheus/common/model"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+// maxShownInstances bounds the active instances listed by the status view.
+const maxShownInstances = 10
+
+// progressView shows the progress of the migration on the terminal. It is
+// implemented by the progress bar and by statusView.
+type progressView interface {
+	Increment() int
+	FinishPrint(string)
+}
+
+// newProgressView returns the progress view selected by mode, "bar" or
+// "tui", that shows the progress s on standard output. The status view
+// falls back to the bar if standard output is not a terminal.
+func newProgressView(mode string, s *migrationStatus, logger log.Logger) progressView {
+	if mode == "tui" {
+		if term.IsTerminal(os.Stdout) {
+			return newStatusView(os.Stdout, s, time.Second)
+		}
+		level.Info(logger).Log("msg", "Standard output is not a terminal, showing a progress bar instead of -progress=tui")
+	}
+	// Set the steps completed by earlier runs before starting the bar, so
+	// that it shows the overall progress while the remaining time is
+	// estimated from the steps of this run only.
+	r := s.report()
+	bar := pb.New(int(r.StepsTotal)).Set(int(r.StepsDone))
+	// The bar estimates the remaining time linearly itself.
+	bar.ShowTimeLeft = s.etaModel == "linear"
+	return bar.Start()
+}
+
+// statusView is a multi-line progress view that redraws the overall
+// progress, throughput, remaining time and the instances being migrated in
+// place, using ANSI escape sequences. w must be a terminal.
+type statusView struct {
+	mtx sync.Mutex
+	w   io.Writer
+	s   *migrationStatus
+	// lines is the number of lines drawn last, which the next draw
+	// replaces.
+	lines int
+	stop  func()
+}
+
+// newStatusView draws the status s to w now and every interval until
+// FinishPrint is called.
+func newStatusView(w io.Writer, s *migrationStatus, interval time.Duration) *statusView {
+	v := &statusView{w: w, s: s}
+	v.stop = s.every(interval, v.draw)
+	return v
+}
+
+// Increment redraws the view after a step has started and returns the
+// number of steps done.
+func (v *statusView) Increment() int {
+	v.draw()
+	return int(v.s.report().StepsDone)
+}
+
+// FinishPrint draws the view a last time and prints msg below it.
+func (v *statusView) FinishPrint(msg string) {
+	v.stop()
+	fmt.Fprintln(v.w, msg)
+}
+
+func (v *statusView) draw() {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	r := v.s.report()
+	elapsed := time.Since(v.s.started)
+
+	var buf bytes.Buffer
+	if v.lines > 0 {
+		// Move to the start of the last draw and clear everything below.
+		fmt.Fprintf(&buf, "\x1b[%dA\x1b[J", v.lines)
+	}
+	lines := []string{
+		fmt.Sprintf("Migrated %d/%d steps (%.1f%%), %s elapsed%s", r.StepsDone, r.StepsTotal, r.Percent, elapsed.Truncate(time.Second), formatETA(r)),
+		fmt.Sprintf("Read %d samples (%.0f/s), %d errors", r.SamplesRead, float64(r.SamplesRead)/elapsed.Seconds(), r.Errors),
+	}
+	if !r.Finished && r.CurrentStep != 0 {
+		lines = append(lines, fmt.Sprintf("Current step from %s, %d active instances", formatStep(r.CurrentStep), len(r.ActiveInstances)))
+		for i, instance := range r.ActiveInstances {
+			if i == maxShownInstances {
+				lines = append(lines, fmt.Sprintf("  and %d more", len(r.ActiveInstances)-i))
+				break
+			}
+			lines = append(lines, "  "+string(instance))
+		}
+	}
+	for _, l := range lines {
+		fmt.Fprintln(&buf, l)
+	}
+	v.w.Write(buf.Bytes())
+	v.lines = len(lines)
+}
+
+func formatETA(r statusReport) string {
+	if r.ETASeconds == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", %s left", (time.Duration(r.ETASeconds) * time.Second).Truncate(time.Second))
+}
+
+func formatStep(t model.Time) string {
+	return t.Time().UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+// lastDraw returns the lines of the last draw of a status view to out.
+func lastDraw(out string) []string {
+	if i := strings.LastIndex(out, "\x1b[J"); i >= 0 {
+		out = out[i+len("\x1b[J"):]
+	}
+	return strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+}
+
+func TestStatusView(t *testing.T) {
+	var buf bytes.Buffer
+	s := newMigrationStatus(4, 1, "linear")
+	// The view is only redrawn by the steps of the test.
+	v := newStatusView(&buf, s, time.Hour)
+	if got := lastDraw(buf.String()); len(got) != 2 || !strings.HasPrefix(got[0], "Migrated 1/4 steps (25.0%)") {
+		t.Errorf("got initial view %q, want the steps done by earlier runs", got)
+	}
+
+	s.startStep(testStart)
+	for _, i := range testInstances(12) {
+		s.startInstance(model.LabelValue(i))
+	}
+	if n := v.Increment(); n != 1 {
+		t.Errorf("got %d steps done, want 1", n)
+	}
+	got := lastDraw(buf.String())
+	if len(got) != 14 || got[2] != "Current step from 2017-07-14T02:40:00Z, 12 active instances" || got[3] != "  host0:9090" || got[13] != "  and 2 more" {
+		t.Errorf("got view %q, want the current step and the first 10 of 12 active instances", got)
+	}
+	if c := strings.Count(buf.String(), "\x1b[2A\x1b[J"); c != 1 {
+		t.Errorf("the initial view of 2 lines was replaced %d times, want 1", c)
+	}
+
+	for _, i := range testInstances(12) {
+		s.instanceDone(model.LabelValue(i), 100, nil)
+	}
+	s.stepDone()
+	v.Increment()
+	got = lastDraw(buf.String())
+	if len(got) != 3 || !strings.HasPrefix(got[0], "Migrated 2/4 steps (50.0%)") || !strings.Contains(got[0], "left") || !strings.HasPrefix(got[1], "Read 1200 samples") || !strings.HasSuffix(got[1], ", 0 errors") || got[2] != "Current step from 2017-07-14T02:40:00Z, 0 active instances" {
+		t.Errorf("got view %q after the step, want 2 steps done with a remaining time and 1200 samples read", got)
+	}
+
+	v.FinishPrint("Migration Complete")
+	if !strings.HasSuffix(buf.String(), "Migration Complete\n") {
+		t.Errorf("got output %q, want it to end with the finish message", buf.String())
+	}
+	if got := lastDraw(strings.TrimSuffix(buf.String(), "Migration Complete\n")); len(got) != 2 {
+		t.Errorf("got final view %q, want no current step once finished", got)
+	}
+}
+
+func TestProgressViewFallback(t *testing.T) {
+	f, err := os.Create(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	defer func(stdout *os.File) { os.Stdout = stdout }(os.Stdout)
+	os.Stdout = f
+
+	v := newProgressView("tui", newMigrationStatus(4, 0, "linear"), log.NewNopLogger())
+	bar, ok := v.(*pb.ProgressBar)
+	if !ok {
+		t.Fatalf("got progress view %T, want a progress bar as standard output is not a terminal", v)
+	}
+	bar.Finish()
+}
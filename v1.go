@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// errSourceLocked is returned by startV1Storage if the v1 storage directory
+// is in use by another process.
+var errSourceLocked = errors.New("v1 storage appears locked or busy, stop the Prometheus server using it or migrate from a copy with -v1-readonly")
+
+// startV1Storage calls start, the Start method of a v1 storage, and waits for
+// it to load its series for at most timeout, or without limit if timeout is
+// 0. A v1 storage directory that another process holds the lock of fails
+// right away and is reported as errSourceLocked, as is a start that does not
+// finish in time, e.g. because its files are being written or are on a hung
+// file system. The start is not cancelled on a timeout, so the storage must
+// not be used afterwards.
+func startV1Storage(start func() error, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- start() }()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case err := <-errc:
+		if err == syscall.EWOULDBLOCK {
+			return errSourceLocked
+		}
+		return err
+	case <-expired:
+		return errSourceLocked
+	}
+}
+
+// trimToData returns the start of the first of the consecutive ranges of
+// length unit from start to end that the v1 storage has samples in, e.g.
+// because older samples were purged by its retention. It returns start if
+// the first range has samples or none has.
+func trimToData(v1Storage *local.MemorySeriesStorage, start, end model.Time, unit time.Duration) (model.Time, error) {
+	named, err := metric.NewLabelMatcher(metric.RegexMatch, model.MetricNameLabel, ".+")
+	if err != nil {
+		return 0, err
+	}
+	// hasData reports whether there are samples from start up to the end of
+	// the k-th range. Only the index is consulted, no chunks are loaded.
+	hasData := func(k int) (bool, error) {
+		through := start.Add(time.Duration(k+1)*unit) - 1
+		if through > end {
+			through = end
+		}
+		metrics, err := v1Storage.MetricsForLabelMatchers(context.Background(), start, through, metric.LabelMatchers{named})
+		return len(metrics) > 0, err
+	}
+
+	n := int((end.Sub(start) + unit - 1) / unit)
+	if n <= 1 {
+		return start, nil
+	}
+	if ok, err := hasData(0); err != nil || ok {
+		return start, err
+	}
+	if ok, err := hasData(n - 1); err != nil || !ok {
+		return start, err
+	}
+	// The first range has no samples and the last one has, so search the
+	// first one that has, which is in (lo, hi].
+	lo, hi := 0, n-1
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		ok, err := hasData(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return start.Add(time.Duration(hi) * unit), nil
+}
+
+// copyDir recursively copies the directory src to dst, which must not exist
+// yet.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm()|0700)
+		case fi.Mode().IsRegular():
+			return copyFile(path, target, fi.Mode().Perm())
+		}
+		// Skip sockets, symlinks and other special files.
+		return nil
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// fileStates returns the size and modification time of every file and
+// directory in dir, by path.
+func fileStates(t *testing.T, dir string) map[string]string {
+	res := map[string]string{}
+	if err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		res[path] = fmt.Sprintf("%s %s %d", fi.ModTime(), fi.Mode(), fi.Size())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestV1ReadOnly(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 2, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+	before := fileStates(t, v1Dir)
+	// Let modifications show in the modification times.
+	time.Sleep(10 * time.Millisecond)
+
+	runMain(
+		"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-v1-readonly", "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+	)
+	if after := fileStates(t, v1Dir); !reflect.DeepEqual(before, after) {
+		t.Errorf("v1 storage directory changed from %v to %v", before, after)
+	}
+	if got := storedTimestamps(t, v2Dir); len(got) != 4 {
+		t.Errorf("got %d series, want 4", len(got))
+	}
+}
+
+func TestTrimToData(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(1), 1, time.Hour))
+	defer removeV1()
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	// The requested range starts 2h and 5m before the earliest samples.
+	var code int
+	logs := captureStderr(t, func() {
+		code = runMain(
+			"-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "3h5m",
+			"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+		)
+	})
+	if code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	l := logLine(logs, "Trimmed time range to the earliest data in the v1 storage")
+	requested := testStart.Add(-125 * time.Minute)
+	if want := requested.Add(12 * 10 * time.Minute); logValue(l, "requested_start") != requested.String() || logValue(l, "start") != want.String() {
+		t.Errorf("got %q, want the start trimmed from %s to the step starting at %s", l, requested, want)
+	}
+	if steps := logValue(logLine(logs, "Total steps"), "steps"); steps != "7" {
+		t.Errorf("migrated %s steps, want 7", steps)
+	}
+	for ls, ts := range storedTimestamps(t, v2Dir) {
+		if len(ts) != 240 {
+			t.Errorf("series %s has %d samples, want 240", ls, len(ts))
+		}
+	}
+}
+
+func TestStartV1StorageLocked(t *testing.T) {
+	dir, remove := newTestV1Dir(t, testSamples(testInstances(1), 1, time.Hour))
+	defer remove()
+	running := local.NewMemorySeriesStorage(newTestV1Options(dir))
+	if err := running.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer running.Stop()
+
+	// The running storage holds the lock of dir.
+	s := local.NewMemorySeriesStorage(newTestV1Options(dir))
+	if err := startV1Storage(s.Start, time.Minute); err != errSourceLocked {
+		t.Errorf("got error %v, want %v", err, errSourceLocked)
+	}
+}
+
+func TestStartV1StorageTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	hanging := func() error {
+		<-release
+		return nil
+	}
+
+	begin := time.Now()
+	if err := startV1Storage(hanging, 50*time.Millisecond); err != errSourceLocked {
+		t.Errorf("got error %v, want %v", err, errSourceLocked)
+	}
+	if d := time.Since(begin); d > 5*time.Second {
+		t.Errorf("timeout fired after %s, want about 50ms", d)
+	}
+}
+
+func TestDeletedSeries(t *testing.T) {
+	dir, remove := newTestV1Dir(t, testSamples(testInstances(1), 3, time.Hour))
+	defer remove()
+	s := local.NewMemorySeriesStorage(newTestV1Options(dir))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	matcher, err := metric.NewLabelMatcher(metric.Equal, "idx", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.DropMetricsForLabelMatchers(context.Background(), matcher); err != nil || n != 1 {
+		t.Fatalf("dropped %d series with error %v, want 1", n, err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	v2Dir, removeV2 := tempDir(t)
+	defer removeV2()
+
+	if code := runMain(
+		"-v1-dir", dir, "-v2-dir", v2Dir, "-step", "10m", "-lookback", "1h",
+		"-end-timestamp", fmt.Sprint(testStart.Add(time.Hour).Unix()),
+	); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	var series []string
+	for ls := range storedTimestamps(t, v2Dir) {
+		series = append(series, ls)
+	}
+	sort.Strings(series)
+	want := []string{
+		`{__name__="test_metric",idx="0",instance="host0:9090"}`,
+		`{__name__="test_metric",idx="2",instance="host0:9090"}`,
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("got series %v, want %v without the deleted one", series, want)
+	}
+}
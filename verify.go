@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+const (
+	// valueTolerance is the relative difference up to which a v2 sample
+	// value is considered equal to the v1 value.
+	valueTolerance = 1e-9
+	// maxReportedMismatches bounds the mismatches logged per series.
+	maxReportedMismatches = 10
+)
+
+// verifyValues compares the samples in [from, through] of a stable sample of
+// the given fraction of the series of all instances in the v1 storage with
+// the v2 storage. If values is set, the sample values are compared, if resets
+// is set, the counter resets of counters. Mismatches are logged. It returns
+// the number of series checked and the number of series with mismatches.
+func verifyValues(m *migrator, instances model.LabelValues, from, through model.Time, fraction float64, values, resets bool, logger log.Logger) (checked, failed int, err error) {
+	q, err := m.v2DB.Querier(int64(from), int64(through))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer q.Close()
+
+	for _, instance := range instances {
+		matchers, err := shardMatchers(m.shardLabel, instance)
+		if err != nil {
+			return checked, failed, err
+		}
+		readFrom, readThrough := from-m.roundTimestamps, through+m.roundTimestamps
+		its, err := m.queryV1(readFrom, readThrough, matchers...)
+		if err != nil {
+			return checked, failed, err
+		}
+		groups, err := m.previewTransform(its)
+		if err != nil {
+			return checked, failed, err
+		}
+		for _, g := range groups {
+			if !inSample(g.labels, fraction) {
+				continue
+			}
+			want := readGroup(g, readFrom, readThrough)
+			if m.roundTimestamps > 0 {
+				want.samples = roundTimestamps(want.samples, m.roundTimestamps, from, through)
+			}
+			if m.checkTimes {
+				want.samples, _ = m.dropInvalidTimes(want.samples)
+			}
+			if m.nanPolicy != "" {
+				want.samples, _ = applyNaNPolicy(want.samples, m.nanPolicy)
+			}
+			got, err := seriesSamples(q, g.labels)
+			if err != nil {
+				return checked, failed, err
+			}
+			checked++
+			var mismatches []sampleMismatch
+			if values {
+				mismatches = compareSamples(want.samples, got, m.valuePrecision)
+			}
+			if resets && isCounter(g.labels) {
+				mismatches = append(mismatches, compareResets(want.samples, got)...)
+			}
+			if len(mismatches) > 0 {
+				failed++
+				for i, mm := range mismatches {
+					if i == maxReportedMismatches {
+						level.Error(logger).Log("msg", "more sample mismatches not shown", "series", g.labels, "mismatches", len(mismatches))
+						break
+					}
+					level.Error(logger).Log("msg", "sample mismatch between v1 and v2", "series", g.labels, "timestamp", mm.t, "err", mm.desc)
+				}
+			}
+		}
+		closeIterators(its)
+	}
+	return checked, failed, nil
+}
+
+// seriesSamples returns all samples of the v2 series with exactly the labels
+// ls in the range of q.
+func seriesSamples(q tsdb.Querier, ls labels.Labels) ([]model.SamplePair, error) {
+	ms := make([]labels.Matcher, 0, len(ls))
+	for _, l := range ls {
+		ms = append(ms, labels.NewEqualMatcher(l.Name, l.Value))
+	}
+
+	var res []model.SamplePair
+	set := q.Select(ms...)
+	for set.Next() {
+		if !set.At().Labels().Equals(ls) {
+			continue
+		}
+		it := set.At().Iterator()
+		for it.Next() {
+			t, v := it.At()
+			res = append(res, model.SamplePair{Timestamp: model.Time(t), Value: model.SampleValue(v)})
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return res, set.Err()
+}
+
+// verifySampleOrder checks that the timestamps of a stable sample of the
+// given fraction of the series in [from, through] are strictly increasing,
+// which iterating the series relies on. Every block in the v2 storage
+// directories and the head of every v2 storage in dbs is checked on its own,
+// clipped to its time range, so that the check covers blocks written
+// directly, e.g. by -reverse. Whether blocks overlap is up to
+// -verify-no-overlap.
+//
+// The vendored tsdb writes a chunk that crosses a block boundary into both
+// blocks, and compacting them keeps both, so that a series repeats the
+// samples after the boundary. Such exact duplicates of earlier samples are
+// counted but are no violation. Violations are logged with the block and the
+// offending timestamps. It returns the number of series checked, of series
+// with violations and of duplicate samples.
+func verifySampleOrder(dirs []string, dbs []*tsdb.DB, from, through model.Time, fraction float64, logger log.Logger) (checked, failed, duplicates int, err error) {
+	var (
+		series     = map[string]labels.Labels{}
+		violations = map[string]int{}
+	)
+	check := func(block string, b tsdb.BlockReader, mint, maxt int64) error {
+		if mint < int64(from) {
+			mint = int64(from)
+		}
+		if maxt > int64(through) {
+			maxt = int64(through)
+		}
+		if mint > maxt {
+			return nil
+		}
+		q, err := tsdb.NewBlockQuerier(b, mint, maxt)
+		if err != nil {
+			return err
+		}
+		defer q.Close()
+
+		named, err := labels.NewRegexpMatcher(model.MetricNameLabel, ".+")
+		if err != nil {
+			return err
+		}
+		set := q.Select(named)
+		for set.Next() {
+			ls := set.At().Labels()
+			if !inSample(ls, fraction) {
+				continue
+			}
+			key := ls.String()
+			series[key] = ls
+			// seen are the samples in order so far, to tell duplicates
+			// from violations.
+			var seen []model.SamplePair
+			it := set.At().Iterator()
+			for it.Next() {
+				t, v := it.At()
+				if n := len(seen); n == 0 || t > int64(seen[n-1].Timestamp) {
+					seen = append(seen, model.SamplePair{Timestamp: model.Time(t), Value: model.SampleValue(v)})
+					continue
+				}
+				i := sort.Search(len(seen), func(i int) bool { return int64(seen[i].Timestamp) >= t })
+				if int64(seen[i].Timestamp) == t && math.Float64bits(float64(seen[i].Value)) == math.Float64bits(v) {
+					duplicates++
+					continue
+				}
+				if violations[key] < maxReportedMismatches {
+					level.Warn(logger).Log("msg", "Sample not after the one before in v2 storage", "series", ls, "block", block, "timestamp", model.Time(t), "value", v, "previous", seen[len(seen)-1].Timestamp)
+				}
+				violations[key]++
+			}
+			if err := it.Err(); err != nil {
+				return err
+			}
+		}
+		return set.Err()
+	}
+
+	for _, dir := range dirs {
+		metas, err := readBlockMetas(dir)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, meta := range metas {
+			b, err := tsdb.OpenBlock(meta.dir, nil)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			// The maximum time of a block is exclusive.
+			err = check(meta.ULID.String(), b, meta.MinTime, meta.MaxTime-1)
+			b.Close()
+			if err != nil {
+				return 0, 0, 0, fmt.Errorf("block %s: %s", meta.ULID, err)
+			}
+		}
+	}
+	for _, db := range dbs {
+		// The head may still hold chunks that reach into the last block.
+		h := db.Head()
+		mint := h.MinTime()
+		for _, b := range db.Blocks() {
+			if b.Meta().MaxTime > mint {
+				mint = b.Meta().MaxTime
+			}
+		}
+		if err := check("head", h, mint, h.MaxTime()); err != nil {
+			return 0, 0, 0, fmt.Errorf("head of %s: %s", db.Dir(), err)
+		}
+	}
+
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if n := violations[key]; n > 0 {
+			level.Error(logger).Log("msg", "series has samples out of order in v2 storage", "series", series[key], "violations", n)
+			failed++
+		}
+	}
+	return len(series), failed, duplicates, nil
+}
+
+// verifyIndex compares the label index of the v2 storage in [from, through]
+// with the label pairs of the migrated series. Pairs of migrated series that
+// the index lacks are logged as errors, other values the index has for their
+// label names as warnings, as they may be of series migrated earlier. It
+// returns the number of pairs checked, missing and extra.
+func verifyIndex(db queryable, migrated *seriesList, from, through model.Time, logger log.Logger) (checked, missing, extra int, err error) {
+	want := map[string]map[string]bool{}
+	for _, lss := range migrated.byHash {
+		for _, ls := range lss {
+			for _, l := range ls {
+				if want[l.Name] == nil {
+					want[l.Name] = map[string]bool{}
+				}
+				want[l.Name][l.Value] = true
+			}
+		}
+	}
+
+	q, err := db.Querier(int64(from), int64(through))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer q.Close()
+
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vals, err := q.LabelValues(name)
+		if err != nil {
+			return checked, missing, extra, err
+		}
+		got := make(map[string]bool, len(vals))
+		for _, v := range vals {
+			got[v] = true
+			if !want[name][v] {
+				if extra < maxReportedMismatches {
+					level.Warn(logger).Log("msg", "Label pair in v2 index of no migrated series", "name", name, "value", v)
+				}
+				extra++
+			}
+		}
+		for v := range want[name] {
+			checked++
+			if !got[v] {
+				if missing < maxReportedMismatches {
+					level.Error(logger).Log("msg", "label pair of migrated series missing in v2 index", "name", name, "value", v)
+				}
+				missing++
+			}
+		}
+	}
+	return checked, missing, extra, nil
+}
+
+// sampleMismatch is a difference between the v1 and v2 samples of a series.
+type sampleMismatch struct {
+	t    model.Time
+	desc string
+}
+
+// compareSamples returns the differences between the v1 samples want, rounded
+// like the migrator does, and the v2 samples got. Both must be sorted by
+// timestamp.
+func compareSamples(want, got []model.SamplePair, precision int) []sampleMismatch {
+	var res []sampleMismatch
+	for len(want) > 0 || len(got) > 0 {
+		switch {
+		case len(got) == 0 || len(want) > 0 && want[0].Timestamp < got[0].Timestamp:
+			res = append(res, sampleMismatch{t: want[0].Timestamp, desc: fmt.Sprintf("missing in v2, v1 value %v", want[0].Value)})
+			want = want[1:]
+		case len(want) == 0 || got[0].Timestamp < want[0].Timestamp:
+			res = append(res, sampleMismatch{t: got[0].Timestamp, desc: fmt.Sprintf("missing in v1, v2 value %v", got[0].Value)})
+			got = got[1:]
+		default:
+			w := float64(want[0].Value)
+			if precision > 0 {
+				w = roundSignificant(w, precision)
+			}
+			if g := float64(got[0].Value); !valuesEqual(w, g) {
+				res = append(res, sampleMismatch{t: want[0].Timestamp, desc: fmt.Sprintf("v1 value %v, v2 value %v", w, g)})
+			}
+			want, got = want[1:], got[1:]
+		}
+	}
+	return res
+}
+
+// valuesEqual reports whether a and b are equal within valueTolerance. NaNs
+// are equal to each other, e.g. for staleness markers.
+func valuesEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= valueTolerance*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// isCounter reports whether the series is a counter by the naming
+// conventions, as the v1 storage does not know metric types.
+func isCounter(ls labels.Labels) bool {
+	name := ls.Get(model.MetricNameLabel)
+	return strings.HasSuffix(name, "_total") || strings.HasSuffix(name, "_count") || strings.HasSuffix(name, "_bucket")
+}
+
+// counterResets returns the timestamps of the samples that are lower than
+// the sample before them. Staleness markers are ignored.
+func counterResets(samples []model.SamplePair) []model.Time {
+	var (
+		res  []model.Time
+		prev = math.NaN()
+	)
+	for _, s := range samples {
+		v := float64(s.Value)
+		if math.IsNaN(v) {
+			continue
+		}
+		if v < prev {
+			res = append(res, s.Timestamp)
+		}
+		prev = v
+	}
+	return res
+}
+
+// compareResets returns the counter resets of the v1 samples want and the v2
+// samples got that happen in only one of them, e.g. because samples around a
+// reset were dropped or reordered.
+func compareResets(want, got []model.SamplePair) []sampleMismatch {
+	var (
+		res []sampleMismatch
+		w   = counterResets(want)
+		g   = counterResets(got)
+	)
+	for len(w) > 0 || len(g) > 0 {
+		switch {
+		case len(g) == 0 || len(w) > 0 && w[0] < g[0]:
+			res = append(res, sampleMismatch{t: w[0], desc: "counter reset missing in v2"})
+			w = w[1:]
+		case len(w) == 0 || g[0] < w[0]:
+			res = append(res, sampleMismatch{t: g[0], desc: "counter reset missing in v1"})
+			g = g[1:]
+		default:
+			w, g = w[1:], g[1:]
+		}
+	}
+	return res
+}
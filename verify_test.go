@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// corruptingStorage is an appendable that offsets the value of the sample at
+// time t of the series with the labels ls.
+type corruptingStorage struct {
+	appendable
+	ls labels.Labels
+	t  int64
+}
+
+func (s *corruptingStorage) Appender() tsdb.Appender {
+	return &corruptingAppender{Appender: s.appendable.Appender(), s: s}
+}
+
+type corruptingAppender struct {
+	tsdb.Appender
+	s *corruptingStorage
+}
+
+func (a *corruptingAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	if t == a.s.t && l.Equals(a.s.ls) {
+		v += 0.5
+	}
+	return a.Appender.Add(l, t, v)
+}
+
+func (a *corruptingAppender) AddFast(ref uint64, t int64, v float64) error {
+	return tsdb.ErrNotFound
+}
+
+func TestVerifyValues(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(2), 5, time.Hour))
+	defer closeV1()
+	v2, closeV2 := newTestV2Storage(t)
+	defer closeV2()
+
+	corrupted := labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host1:9090", "idx", "3")
+	ct := testStart.Add(20 * time.Minute)
+	m := newTestMigrator(v1, &corruptingStorage{appendable: v2, ls: corrupted, t: int64(ct)})
+	m.v2DB = v2
+	through := testStart.Add(time.Hour)
+	for _, instance := range []string{"host0:9090", "host1:9090"} {
+		if err := migrateTestInstance(m, instance, testStart, through); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	checked, failed, err := verifyValues(m, model.LabelValues{"host0:9090", "host1:9090"}, testStart, through, 1, true, false, log.NewLogfmtLogger(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 10 || failed != 1 {
+		t.Errorf("checked %d series with %d failures, want 10 with 1", checked, failed)
+	}
+	l := logLine(buf.String(), "sample mismatch between v1 and v2")
+	if logValue(l, "timestamp") != ct.String() || !strings.Contains(l, `idx=\"3\"`) || !strings.Contains(l, `instance=\"host1:9090\"`) {
+		t.Errorf("got mismatch %q, want the corrupted sample of %s at %s", l, corrupted, ct)
+	}
+	if !strings.Contains(l, "v1 value 3, v2 value 3.5") {
+		t.Errorf("got mismatch %q, want the v1 and v2 values", l)
+	}
+}
+
+// sampleValues returns samples with the values vs, 10s apart.
+func sampleValues(vs ...float64) []model.SamplePair {
+	res := make([]model.SamplePair, 0, len(vs))
+	for i, v := range vs {
+		res = append(res, model.SamplePair{Timestamp: model.Time(i * 10000), Value: model.SampleValue(v)})
+	}
+	return res
+}
+
+func TestCompareResets(t *testing.T) {
+	// The counter resets at 30s.
+	want := sampleValues(5, 8, 9, 1, 10)
+	if mm := compareResets(want, want); len(mm) != 0 {
+		t.Errorf("got mismatches %v for identical samples, want none", mm)
+	}
+	// Swapping the samples around the reset moves it to 20s.
+	reordered := sampleValues(5, 8, 1, 9, 10)
+	mm := compareResets(want, reordered)
+	wantMM := []sampleMismatch{
+		{t: 20000, desc: "counter reset missing in v1"},
+		{t: 30000, desc: "counter reset missing in v2"},
+	}
+	if !reflect.DeepEqual(mm, wantMM) {
+		t.Errorf("got mismatches %v, want %v", mm, wantMM)
+	}
+}
+
+func TestVerifyIndex(t *testing.T) {
+	v1, closeV1 := newTestV1Storage(t, testSamples(testInstances(2), 3, 10*time.Minute))
+	defer closeV1()
+	db, closeV2 := newTestV2Storage(t)
+	defer closeV2()
+
+	m := newTestMigrator(v1, db)
+	m.migrated = newSeriesList()
+	for _, instance := range testInstances(2) {
+		if err := migrateTestInstance(m, instance, testStart, testStart.Add(10*time.Minute)-1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	through := testStart.Add(10*time.Minute) - 1
+	// __name__, instance and idx with 1, 2 and 3 values.
+	checked, missing, extra, err := verifyIndex(db, m.migrated, testStart, through, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 6 || missing != 0 || extra != 0 {
+		t.Errorf("checked %d label pairs with %d missing and %d extra, want 6 with none missing or extra", checked, missing, extra)
+	}
+
+	// A series that was tracked but not appended, and one that was
+	// appended but not tracked.
+	m.migrated.add(labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host9:9090", "idx", "0"))
+	app := db.Appender()
+	if _, err := app.Add(labels.FromStrings(model.MetricNameLabel, "test_metric", model.InstanceLabel, "host0:9090", "idx", "7"), int64(testStart), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	checked, missing, extra, err = verifyIndex(db, m.migrated, testStart, through, log.NewLogfmtLogger(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 7 || missing != 1 || extra != 1 {
+		t.Errorf("checked %d label pairs with %d missing and %d extra, want 7 with 1 missing and 1 extra", checked, missing, extra)
+	}
+	for _, want := range []string{
+		`msg="label pair of migrated series missing in v2 index" name=instance value=host9:9090`,
+		`msg="Label pair in v2 index of no migrated series" name=idx value=7`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got logs %q, want them to contain %q", buf.String(), want)
+		}
+	}
+}
+
+func TestCIMode(t *testing.T) {
+	v1Dir, removeV1 := newTestV1Dir(t, testSamples(testInstances(2), 3, time.Hour))
+	defer removeV1()
+	end := testStart.Add(time.Hour)
+
+	for _, corrupt := range []bool{false, true} {
+		v2Dir, removeV2 := tempDir(t)
+		defer removeV2()
+		if corrupt {
+			// The v2 storage already has a sample of a migrated series
+			// that is not in the v1 storage, in the slice that is checked.
+			db := openTestV2(t, v2Dir)
+			app := db.Appender()
+			ls := labels.FromStrings(model.MetricNameLabel, "test_metric", "idx", "1", model.InstanceLabel, "host0:9090")
+			if _, err := app.Add(ls, int64(end.Add(-15*time.Minute-7*time.Second)), 42); err != nil {
+				t.Fatal(err)
+			}
+			if err := app.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var code int
+		out := captureStdout(t, func() {
+			code = runMain("ci", "-v1-dir", v1Dir, "-v2-dir", v2Dir, "-step", "10m", "-end-timestamp", fmt.Sprint(end.Unix()))
+		})
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		last := lines[len(lines)-1]
+		if !corrupt && (code != 0 || last != "CI check passed") {
+			t.Errorf("clean data: got exit code %d and last line %q, want 0 and a pass", code, last)
+		}
+		if corrupt && (code != 1 || !strings.HasPrefix(last, "CI check failed")) {
+			t.Errorf("corrupted data: got exit code %d and last line %q, want 1 and a failure", code, last)
+		}
+		if got := storedTimestamps(t, v2Dir); !corrupt && len(got) != 6 {
+			t.Errorf("clean data: got %d series, want 6", len(got))
+		}
+	}
+}
+
+func TestVerifySampleOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// ts and offset are the samples of the second block.
+		ts             []int64
+		offset         float64
+		wantFailed     int
+		wantDuplicates int
+	}{
+		{name: "duplicates", ts: []int64{5000, 6000, 7000, 8000, 9000}, offset: 0, wantFailed: 0, wantDuplicates: 5},
+		{name: "other values", ts: []int64{5000, 6000, 7000, 8000, 9000}, offset: 1, wantFailed: 1, wantDuplicates: 0},
+		{name: "earlier sample", ts: []int64{5500}, offset: 0, wantFailed: 1, wantDuplicates: 0},
+	} {
+		dir, remove := tempDir(t)
+		defer remove()
+
+		c, err := tsdb.NewLeveledCompactor(nil, log.NewNopLogger(), []int64{int64(2 * time.Hour / time.Millisecond)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Compacting two blocks with the same series concatenates their
+		// chunks, which writes the samples of the second block after the
+		// later ones of the first, bypassing the head's order check.
+		writeTestBlock(t, c, dir, []int64{1000, 2000, 3000, 4000, 5000, 6000, 7000, 8000, 9000, 10000}, 0)
+		writeTestBlock(t, c, dir, tc.ts, tc.offset)
+		sources, err := readBlockMetas(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sources) != 2 {
+			t.Fatalf("%s: got %d blocks, want 2", tc.name, len(sources))
+		}
+		if err := c.Compact(dir, sources[0].dir, sources[1].dir); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range sources {
+			if err := os.RemoveAll(s.dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		checked, failed, duplicates, err := verifySampleOrder([]string{dir}, nil, 0, 20000, 1, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checked != 1 || failed != tc.wantFailed || duplicates != tc.wantDuplicates {
+			t.Errorf("%s: got %d series checked, %d failed and %d duplicates, want 1, %d and %d", tc.name, checked, failed, duplicates, tc.wantFailed, tc.wantDuplicates)
+		}
+	}
+}
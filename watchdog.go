@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"runtime/pprof"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// watchIdle aborts the process with a dump of all goroutines once p has
+// not been updated for longer than timeout. It watches in the background
+// until the returned function is called.
+func watchIdle(p *progress, timeout time.Duration, logger log.Logger) func() {
+	interval := timeout / 4
+	switch {
+	case interval > time.Second:
+		interval = time.Second
+	case interval < time.Millisecond:
+		interval = time.Millisecond
+	}
+
+	var (
+		stop    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			}
+			last := p.lastProgress()
+			if time.Since(last) <= timeout {
+				continue
+			}
+			level.Error(logger).Log("msg", "No samples appended within idle timeout, aborting", "last_append", last, "max_idle_timeout", timeout)
+			pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+			os.Exit(1)
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
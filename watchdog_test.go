@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// hangingSource blocks forever like a hung read from the v1 storage.
+func hangingSource(started chan<- struct{}) {
+	close(started)
+	select {}
+}
+
+func TestWatchIdleFires(t *testing.T) {
+	if os.Getenv("TEST_WATCH_IDLE") == "1" {
+		var p progress
+		p.update()
+		started := make(chan struct{})
+		go hangingSource(started)
+		<-started
+		watchIdle(&p, 50*time.Millisecond, log.NewLogfmtLogger(os.Stderr))
+		time.Sleep(time.Minute)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWatchIdleFires$")
+	cmd.Env = append(os.Environ(), "TEST_WATCH_IDLE=1")
+	out, err := cmd.CombinedOutput()
+	if e, ok := err.(*exec.ExitError); !ok || e.Success() {
+		t.Fatalf("got error %v, want the watchdog to exit with an error", err)
+	}
+	if !strings.Contains(string(out), "No samples appended within idle timeout") {
+		t.Errorf("watchdog did not log the stall in %q", out)
+	}
+	if !strings.Contains(string(out), "goroutine") || !strings.Contains(string(out), "hangingSource") {
+		t.Errorf("watchdog did not dump the hanging goroutine in %q", out)
+	}
+}
+
+func TestWatchIdleStopped(t *testing.T) {
+	var p progress
+	p.update()
+	stop := watchIdle(&p, 50*time.Millisecond, log.NewNopLogger())
+	stop()
+	// A watchdog that was not stopped exits the test binary.
+	time.Sleep(200 * time.Millisecond)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// progress records when the migration last made progress.
+type progress struct {
+	// last is the Unix time in nanoseconds. Accessed atomically.
+	last int64
+}
+
+func (p *progress) update() {
+	atomic.StoreInt64(&p.last, time.Now().UnixNano())
+}
+
+func (p *progress) lastProgress() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.last))
+}
+
+// serveWeb serves metrics and a health check on addr in the background. The
+// health check fails once no step has completed within stallTimeout.
+func serveWeb(addr string, p *progress, stallTimeout time.Duration, logger log.Logger) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "migrator_last_progress_timestamp_seconds",
+		Help: "Unix time at which the migration last completed a step.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&p.last)) / 1e9
+	}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		last := p.lastProgress()
+		if time.Since(last) > stallTimeout {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Stalled, last progress at %s\n", last.UTC().Format(time.RFC3339))
+			return
+		}
+		fmt.Fprintf(w, "OK, last progress at %s\n", last.UTC().Format(time.RFC3339))
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			level.Error(logger).Log("msg", "error serving web endpoints", "addr", addr, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// freeAddress returns a local address that is free to listen on.
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// getStatus returns the HTTP status code of a GET request of url, retrying
+// until the server is up.
+func getStatus(t *testing.T, url string) int {
+	var err error
+	for i := 0; i < 50; i++ {
+		var resp *http.Response
+		if resp, err = http.Get(url); err == nil {
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return 0
+}
+
+func TestHealthzStall(t *testing.T) {
+	var p progress
+	p.update()
+	addr := freeAddress(t)
+	serveWeb(addr, &p, time.Minute, log.NewNopLogger())
+
+	if code := getStatus(t, "http://"+addr+"/healthz"); code != http.StatusOK {
+		t.Fatalf("got status %d while making progress, want %d", code, http.StatusOK)
+	}
+	atomic.StoreInt64(&p.last, time.Now().Add(-2*time.Minute).UnixNano())
+	if code := getStatus(t, "http://"+addr+"/healthz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d after stalling, want %d", code, http.StatusServiceUnavailable)
+	}
+	p.update()
+	if code := getStatus(t, "http://"+addr+"/healthz"); code != http.StatusOK {
+		t.Fatalf("got status %d after making progress again, want %d", code, http.StatusOK)
+	}
+	if code := getStatus(t, "http://"+addr+"/metrics"); code != http.StatusOK {
+		t.Fatalf("got status %d for metrics, want %d", code, http.StatusOK)
+	}
+}